@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/archive"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runArchive moves processed events past their retention to archive files, once or every interval
+func (a *app) runArchive(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	rulesPath := flags.String("rules", "", "JSON file with the retention per event type")
+	dir := flags.String("dir", "archive", "directory the archive files are written to")
+	format := flags.String("format", "jsonl.gz", "jsonl.gz or parquet")
+	batchSize := flags.Int("batch-size", 10_000, "number of events per archive file")
+	interval := flags.Duration("interval", time.Hour, "pause between archival runs")
+	once := flags.Bool("once", false, "archive expired events once and exit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rulesPath == "" {
+		return fmt.Errorf("archive requires -rules")
+	}
+
+	rules, err := db.LoadRetentionRules(*rulesPath)
+	if err != nil {
+		return err
+	}
+	archiveFormat, err := archive.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	archiver := archive.NewArchiver(a.newEventRepository(), rules, *dir, archiveFormat, *batchSize)
+	if *once {
+		result, err := archiver.Archive(ctx, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		a.log.Info("Archived events", "events", result.Events, "files", len(result.Files), "dir", *dir)
+		return nil
+	}
+
+	a.log.Info("Archiving expired events", "dir", *dir, "interval", *interval)
+	archiver.Start(ctx, *interval)
+	<-ctx.Done()
+	return nil
+}
+
+// runRestore inserts the events of archive files back into the events table
+func (a *app) runRestore(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 1000, "number of events inserted per query")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("restore requires archive files")
+	}
+
+	archiver := archive.NewArchiver(a.newEventRepository(), db.RetentionRules{}, "", "", *batchSize)
+	for _, path := range flags.Args() {
+		restored, err := archiver.Restore(ctx, path)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Restored events", "file", path, "events", restored)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runDryRun stitches events into the shadow profile table and reports how the result differs from the live profiles
+func (a *app) runDryRun(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("dry-run", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the event time range (RFC3339), defaults to the beginning of time")
+	to := flags.String("to", "", "end of the event time range (RFC3339), defaults to now")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	start, end, err := parseTimeRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	// Shadow profiles are stitched and committed in batches of a page
+	stitchingService := internal.NewStitchingService(a.newProfileRepository(), a.newEventRepository(), 0, 0, db.DefaultPageSize)
+	stitchingService.SetSegments(a.segments)
+	stitchingService.SetConsentRules(a.consentRules)
+	stitchingService.SetWorkspaces(a.workspaces)
+	stitchingService.SetErasures(db.NewPgDSARRepository(a.connPool))
+	report, err := stitchingService.DryRun(ctx, a.newShadowProfileRepository(), start, end)
+	if err != nil {
+		return err
+	}
+
+	a.log.Info("Dry run finished",
+		"events", report.Events,
+		"created", report.Actions[internal.ActionCreated],
+		"enriched", report.Actions[internal.ActionEnriched],
+		"merged", report.Actions[internal.ActionMerged])
+	a.log.Info("Shadow vs live profiles",
+		"live", report.LiveProfiles,
+		"shadow", report.ShadowProfiles,
+		"unchanged", report.Unchanged,
+		"changed", report.Changed,
+		"merges", report.Merges,
+		"splits", report.Splits,
+		"new", report.New,
+		"removed", report.Removed)
+	return nil
+}
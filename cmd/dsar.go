@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runDSAR handles data subject requests: access, erase or log
+func (a *app) runDSAR(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("dsar requires a subcommand: access, erase or log")
+	}
+	subcommand, args := args[0], args[1:]
+	dsarRepo := db.NewPgDSARRepository(a.connPool)
+
+	flags := flag.NewFlagSet("dsar "+subcommand, flag.ContinueOnError)
+	if subcommand == "log" {
+		limit := flags.Int("limit", 20, "number of latest requests to show")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		requests, err := dsarRepo.GetDSARRequests(db.AllWorkspaces(ctx), *limit)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			a.log.Info("DSAR request",
+				"id", r.Id,
+				"kind", r.Kind,
+				"identifier", r.IdentifierType,
+				"hash", r.IdentifierHash,
+				"mode", r.Mode,
+				"status", r.Status,
+				"profiles", r.ProfileIds,
+				"events", r.Events,
+				"error", r.Error,
+				"requested_by", r.RequestedBy,
+				"requested_at", r.RequestedAt,
+				"workspace", r.Workspace)
+		}
+		return nil
+	}
+
+	identifierType := flags.String("type", "", "identifier naming the person: cookie, message_id or phone")
+	value := flags.String("value", "", "value of the identifier")
+	profileId := flags.Int("profile", 0, "profile naming the person instead of an identifier")
+	requestedBy := flags.String("requested-by", "", "who filed the request, kept in the audit log")
+	out := flags.String("out", "", "file to write the access document to, optional for erase")
+	mode := flags.String("mode", string(db.ErasureDelete), "erase only: delete, anonymize or shred")
+	workspace := flags.String("workspace", db.DefaultWorkspace, "workspace the person is looked up in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = db.WithWorkspace(ctx, *workspace)
+	subject := internal.DataSubject{Identifier: db.Identifier{Type: *identifierType, Value: *value}, ProfileId: *profileId}
+
+	dsarService := internal.NewDSARService(a.newProfileRepository(), a.newEventRepository(), dsarRepo)
+	dsarService.SetOutbox(db.NewPgOutboxRepository(a.connPool))
+	dsarService.SetProfileKeys(db.NewPgProfileKeyRepository(a.connPool))
+
+	switch subcommand {
+	case "access":
+		if *out == "" {
+			return fmt.Errorf("dsar access requires -out")
+		}
+		request, err := writeDocument(*out, func(w io.Writer) (db.DSARRequest, error) {
+			return dsarService.Access(ctx, subject, *requestedBy, w)
+		})
+		if err != nil {
+			return err
+		}
+		a.log.Info("Access request completed", "id", request.Id, "file", *out, "profiles", request.ProfileIds,
+			"events", request.Events)
+
+	case "erase":
+		erasureMode, err := db.ParseErasureMode(*mode)
+		if err != nil {
+			return err
+		}
+		erase := func(w io.Writer) (db.DSARRequest, error) {
+			return dsarService.Erase(ctx, subject, erasureMode, *requestedBy, w)
+		}
+		var request db.DSARRequest
+		if *out != "" {
+			request, err = writeDocument(*out, erase)
+		} else {
+			request, err = erase(nil)
+		}
+		// The audit log names the person like the DSAR log, by the hash of the identifier
+		target := fmt.Sprintf("profile %d", *profileId)
+		if *profileId == 0 {
+			target = *identifierType + " " + db.HashIdentifier(subject.Identifier)
+		}
+		a.newAPIKeyService().Audit(ctx, "erase", target, err)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Erasure request completed", "id", request.Id, "mode", erasureMode, "profiles", request.ProfileIds,
+			"events", request.Events)
+
+	default:
+		return fmt.Errorf("unknown dsar subcommand %q", subcommand)
+	}
+	return nil
+}
+
+// writeDocument runs the request writing to a temporary file next to out, which replaces out once the request
+// completed, so a failed request leaves no partial document behind
+func writeDocument(out string, run func(w io.Writer) (db.DSARRequest, error)) (db.DSARRequest, error) {
+	file, err := os.CreateTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+	if err != nil {
+		return db.DSARRequest{}, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	request, err := run(file)
+	if err != nil {
+		return db.DSARRequest{}, err
+	}
+	if err := file.Sync(); err != nil {
+		return db.DSARRequest{}, err
+	}
+	if err := file.Close(); err != nil {
+		return db.DSARRequest{}, err
+	}
+	return request, os.Rename(file.Name(), out)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+)
+
+// runExport writes profiles to a file, every profile or only those changed since a time or the last export of a name
+func (a *app) runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "file to write, replaced only once the export is complete")
+	format := flags.String("format", "jsonl", "jsonl, csv or parquet")
+	since := flags.String("since", "", "export only profiles changed after this RFC 3339 time")
+	name := flags.String("name", "", "continue from the watermark of the last export of this name and store the new one")
+	overlap := flags.Duration("overlap", export.DefaultOverlap, "re-export profiles changed this long before the watermark")
+	pageSize := flags.Int("page-size", 1000, "number of profiles read per query")
+	workspace := flags.String("workspace", "", "export only the profiles of this workspace, every workspace when not given")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = db.AllWorkspaces(ctx)
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "workspace" {
+			ctx = db.WithWorkspace(ctx, *workspace)
+		}
+	})
+	if *out == "" {
+		return fmt.Errorf("export requires -out")
+	}
+
+	exportFormat, err := export.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+	opts := export.Options{Format: exportFormat, Name: *name, Overlap: *overlap}
+	if *since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+		opts.Since = opts.Since.UTC()
+	}
+
+	// Write to a temporary file next to the output, so a failed export leaves no partial file behind
+	file, err := os.CreateTemp(filepath.Dir(*out), filepath.Base(*out)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	exporter := export.NewExporter(a.newProfileRepository(), db.NewPgExportRepository(a.connPool), *pageSize)
+	exporter.SetConsentRules(a.consentRules)
+	result, err := exporter.Export(ctx, file, opts)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), *out); err != nil {
+		return err
+	}
+
+	if *name != "" {
+		if err := exporter.SaveWatermark(ctx, *name, result); err != nil {
+			return err
+		}
+	}
+
+	a.log.Info("Export finished", "file", *out, "profiles", result.Profiles, "since", result.Since,
+		"watermark", result.Watermark)
+	return nil
+}
@@ -7,9 +7,12 @@ import (
 	"github.com/tomashoffer/event-stitching/internal/db"
 )
 
-func GenerateEvents(ctx context.Context, numEvents int, ingestService *internal.EventIngestService) {
-	// Send events to queue
+func GenerateEvents(ctx context.Context, numEvents int, ingestService *internal.EventIngestService) error {
+	// Send events to queue, waiting for room
 	for range numEvents {
-		ingestService.Queue <- db.GenerateRandomEvent()
+		if err := ingestService.Enqueue(ctx, db.GenerateRandomEvent()); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/importer"
+)
+
+// runImport bulk loads historical events from an NDJSON or CSV file, resuming an interrupted import of the same file
+func (a *app) runImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	path := flags.String("file", "", "NDJSON or CSV file to import, optionally gzip compressed")
+	format := flags.String("format", "", "ndjson or csv, detected from the file extension by default")
+	mapping := flags.String("map", "", "comma separated field=column pairs, e.g. phone=mobile,traits.plan=tier")
+	source := flags.String("source", "", "source of events without one")
+	name := flags.String("name", "", "name the progress is stored under, defaults to the file path")
+	errorPath := flags.String("errors", "", "file receiving rejected rows, defaults to the file path with .rejected.ndjson appended")
+	batchSize := flags.Int("batch-size", 10_000, "number of rows loaded per transaction")
+	restart := flags.Bool("restart", false, "discard the progress of an earlier run and start over")
+	workspace := flags.String("workspace", db.DefaultWorkspace, "workspace the events are imported into")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx = db.WithWorkspace(ctx, *workspace)
+	if *path == "" {
+		return fmt.Errorf("import requires -file")
+	}
+
+	fieldMapping, err := importer.ParseMapping(*mapping)
+	if err != nil {
+		return err
+	}
+
+	imp := importer.NewImporter(a.newEventRepository(), db.NewPgImportRepository(a.connPool), *batchSize)
+	result, err := imp.Import(ctx, importer.Options{
+		Path:      *path,
+		Name:      *name,
+		Format:    importer.Format(*format),
+		Mapping:   fieldMapping,
+		Source:    *source,
+		ErrorPath: *errorPath,
+		Restart:   *restart,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.log.Info("Import finished", "lines", result.Lines, "loaded", result.Loaded, "rejected", result.Rejected,
+		"resumed_at", result.ResumedAt)
+	return nil
+}
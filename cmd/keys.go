@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runKeys manages API keys and shows the audit log: issue, revoke, list or audit
+func (a *app) runKeys(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("keys requires a subcommand: issue, revoke, list or audit")
+	}
+	subcommand, args := args[0], args[1:]
+	keys := a.newAPIKeyService()
+	apiKeyRepo := db.NewPgAPIKeyRepository(a.connPool)
+
+	flags := flag.NewFlagSet("keys "+subcommand, flag.ContinueOnError)
+	switch subcommand {
+	case "issue":
+		name := flags.String("name", "", "name of the key, logged as the actor of its admin actions")
+		workspace := flags.String("workspace", db.DefaultWorkspace, "workspace the key authenticates as")
+		scopes := flags.String("scopes", "", "comma separated scopes: ingest, profiles:read, admin, erase")
+		rateLimit := flags.Float64("rate-limit", 0, "requests allowed per second on average, unlimited when zero")
+		burst := flags.Int("burst", 0, "requests allowed at once, the rate limit rounded up when zero")
+		expires := flags.Duration("expires", 0, "lifetime of the key, e.g. 2160h, the key never expires when zero")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *name == "" {
+			return fmt.Errorf("keys issue requires -name")
+		}
+		parsed, err := db.ParseScopes(*scopes)
+		if err != nil {
+			return err
+		}
+
+		key := db.APIKey{Name: *name, Scopes: parsed, RateLimit: *rateLimit, Burst: *burst}
+		if *expires > 0 {
+			expiresAt := time.Now().UTC().Add(*expires)
+			key.ExpiresAt = &expiresAt
+		}
+		secret, key, err := keys.Issue(db.WithWorkspace(ctx, *workspace), key)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Issued API key", "id", key.Id, "name", key.Name, "workspace", key.Workspace, "scopes", key.Scopes)
+		// The key is only stored hashed, so this is the only time it is shown
+		fmt.Println(secret)
+
+	case "revoke":
+		id := flags.Int("id", 0, "key id")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		revoked, err := keys.Revoke(db.AllWorkspaces(ctx), *id)
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return fmt.Errorf("no active API key %d", *id)
+		}
+		a.log.Info("Revoked API key", "id", *id)
+
+	case "list":
+		apiKeys, err := apiKeyRepo.GetAPIKeys(db.AllWorkspaces(ctx))
+		if err != nil {
+			return err
+		}
+		for _, key := range apiKeys {
+			a.log.Info("API key",
+				"id", key.Id,
+				"name", key.Name,
+				"prefix", key.Prefix,
+				"workspace", key.Workspace,
+				"scopes", key.Scopes,
+				"rate_limit", key.RateLimit,
+				"burst", key.Burst,
+				"created_at", key.CreatedAt,
+				"expires_at", key.ExpiresAt,
+				"revoked_at", key.RevokedAt)
+		}
+
+	case "audit":
+		limit := flags.Int("limit", 20, "number of latest entries to show")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		entries, err := apiKeyRepo.GetAuditLog(db.AllWorkspaces(ctx), *limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			a.log.Info("Audit entry",
+				"id", e.Id,
+				"actor", e.Actor,
+				"key", e.APIKeyId,
+				"workspace", e.Workspace,
+				"action", e.Action,
+				"target", e.Target,
+				"outcome", e.Outcome,
+				"at", e.CreatedAt)
+		}
+
+	default:
+		return fmt.Errorf("unknown keys subcommand %q", subcommand)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runPartitions lists the monthly partitions of the events table, or maintains them once or every interval
+func (a *app) runPartitions(ctx context.Context, args []string) error {
+	eventRepo := a.newEventRepository()
+	if len(args) > 0 && args[0] == "list" {
+		partitions, err := eventRepo.GetPartitions(ctx)
+		if err != nil {
+			return err
+		}
+		for _, partition := range partitions {
+			a.log.Info("Event partition",
+				"name", partition.Name,
+				"from", partition.From.Format(time.DateOnly),
+				"to", partition.To.Format(time.DateOnly),
+				"estimated_rows", partition.Rows)
+		}
+		return nil
+	}
+
+	flags := flag.NewFlagSet("partitions", flag.ContinueOnError)
+	ahead := flags.Int("ahead", 3, "number of months after the current one to create partitions for")
+	from := flags.String("from", "", "first month to create partitions for (YYYY-MM), moving its events out of the default partition")
+	detachAfter := flags.String("detach-after", "", "age at which partitions are detached, e.g. 365d, never when empty")
+	drop := flags.Bool("drop", false, "drop partitions once detached")
+	interval := flags.Duration("interval", time.Hour, "pause between maintenance runs")
+	once := flags.Bool("once", false, "maintain the partitions once and exit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	policy := db.PartitionPolicy{Ahead: *ahead, DetachAfter: *detachAfter, Drop: *drop}
+	if *from != "" {
+		var err error
+		if policy.From, err = time.Parse("2006-01", *from); err != nil {
+			return fmt.Errorf("invalid -from month: %w", err)
+		}
+	}
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	maintainer := internal.NewPartitionMaintainer(eventRepo, policy)
+	if *once {
+		result, err := maintainer.Maintain(ctx, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		a.log.Info("Maintained event partitions",
+			"created", result.Created,
+			"moved", result.Moved,
+			"detached", result.Detached,
+			"kept", result.Kept)
+		return nil
+	}
+
+	a.log.Info("Maintaining event partitions", "ahead", *ahead, "detach_after", *detachAfter, "interval", *interval)
+	maintainer.Start(ctx, *interval)
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/pii"
+)
+
+// runPII manages the keys protecting identifiers: keygen, rotate, rewrap or rekey
+func (a *app) runPII(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("pii requires a subcommand: keygen, rotate, rewrap or rekey")
+	}
+	subcommand, args := args[0], args[1:]
+	keyRepo := db.NewPgDataKeyRepository(a.connPool)
+
+	flags := flag.NewFlagSet("pii "+subcommand, flag.ContinueOnError)
+	path := flags.String("keyfile", os.Getenv("PII_KEYFILE"), "keyfile holding the master keys")
+	switch subcommand {
+	case "keygen":
+		id := flags.String("id", "", "id of the new master key, e.g. 2024-06")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *path == "" || *id == "" {
+			return fmt.Errorf("pii keygen requires -keyfile and -id")
+		}
+
+		// A missing keyfile is created with the new key
+		keyfile, err := pii.LoadKeyfile(*path)
+		if errors.Is(err, os.ErrNotExist) {
+			keyfile, err = &pii.Keyfile{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := keyfile.AddKey(*id); err != nil {
+			return err
+		}
+		if err := keyfile.Save(*path); err != nil {
+			return err
+		}
+		a.log.Info("Master key added", "id", *id, "keyfile", *path)
+
+	case "rotate", "rewrap":
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		keyfile, err := pii.LoadKeyfile(*path)
+		if err != nil {
+			return err
+		}
+
+		if subcommand == "rotate" {
+			id, err := pii.RotateEncryptionKey(ctx, keyRepo, keyfile)
+			if err != nil {
+				return err
+			}
+			a.log.Info("Encryption key rotated, run pii rekey to encrypt stored identifiers with it", "key", id)
+			return nil
+		}
+		rewrapped, err := pii.RewrapDataKeys(ctx, keyRepo, keyfile)
+		if err != nil {
+			return err
+		}
+		profileKeys, err := pii.RewrapProfileKeys(ctx, db.NewPgProfileKeyRepository(a.connPool), keyfile)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Data keys rewrapped", "master_key", keyfile.CurrentKeyId(), "keys", rewrapped,
+			"profile_keys", profileKeys)
+
+	case "rekey":
+		pageSize := flags.Int("page-size", db.DefaultPageSize, "number of rows rewritten per transaction")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if err := a.loadProtector(ctx); err != nil {
+			return err
+		}
+
+		profiles, err := a.reprotect(ctx, a.newProfileRepository().ReprotectProfiles, *pageSize)
+		if err != nil {
+			return err
+		}
+		events, err := a.reprotect(ctx, a.newEventRepository().ReprotectEvents, *pageSize)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Stored identifiers reprotected", "profiles", profiles, "events", events)
+
+	default:
+		return fmt.Errorf("unknown pii subcommand %q", subcommand)
+	}
+	return nil
+}
+
+// reprotect runs the page function over the whole table, committing every page, and returns the rows rewritten
+func (a *app) reprotect(ctx context.Context, page func(ctx context.Context, afterId int, limit int) (int, int, error), pageSize int) (int, error) {
+	total, afterId := 0, 0
+	for {
+		var changed int
+		err := pgx.BeginFunc(ctx, a.connPool, func(tx pgx.Tx) error {
+			var err error
+			afterId, changed, err = page(context.WithValue(ctx, db.TransactionKey{}, tx), afterId, pageSize)
+			return err
+		})
+		if err != nil {
+			return total, err
+		}
+		total += changed
+		if afterId == 0 {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runRebuild recomputes all profiles from the events within the requested time range, which must cover every
+// stored event. The profiles of every workspace are replaced, which -all-workspaces confirms.
+func (a *app) runRebuild(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the event time range (RFC3339), defaults to the beginning of time")
+	to := flags.String("to", "", "end of the event time range (RFC3339), defaults to now")
+	allWorkspaces := flags.Bool("all-workspaces", false, "confirm the profiles of every workspace are replaced")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*allWorkspaces {
+		return fmt.Errorf("rebuild replaces the profiles of every workspace, run it with -all-workspaces")
+	}
+	ctx = db.AllWorkspaces(ctx)
+
+	start, end, err := parseTimeRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	rebuildService := internal.NewRebuildService(a.newProfileRepository(), a.newEventRepository())
+	rebuildService.SetConsentRules(a.consentRules)
+	rebuildService.SetWorkspaces(a.workspaces)
+	rebuildService.SetSegments(a.segments)
+	rebuildService.SetErasures(db.NewPgDSARRepository(a.connPool))
+	stats, err := rebuildService.Rebuild(ctx, start, end)
+	if err != nil {
+		return err
+	}
+
+	a.log.Info("Profiles rebuilt",
+		"events", stats.Events,
+		"profiles", stats.Profiles,
+		"processed", stats.ProcessedEvents,
+		"duration", stats.Duration)
+	return nil
+}
+
+// parseTimeRange parses optional RFC3339 bounds, an empty start means the zero time and an empty end means now
+func parseTimeRange(from, to string) (time.Time, time.Time, error) {
+	start, end := time.Time{}, time.Now().UTC()
+	var err error
+	if from != "" {
+		if start, err = time.Parse(time.RFC3339, from); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse(time.RFC3339, to); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	return start, end, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/sinks"
+)
+
+// runRelay delivers profile changes of a workspace from the outbox to a sink, resuming from the consumer's stored
+// cursor. Changes of profiles without consent to webhooks are skipped.
+func (a *app) runRelay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+	sinkName := flags.String("sink", "stdout", "sink to deliver to: stdout, file or webhook")
+	target := flags.String("target", "", "file path of the file sink or URL of the webhook sink")
+	consumer := flags.String("consumer", "", "name the cursor is stored under, defaults to the sink name")
+	batchSize := flags.Int("batch-size", 100, "maximum number of events per delivery")
+	interval := flags.Duration("interval", time.Second, "pause between polls once the outbox is drained")
+	once := flags.Bool("once", false, "deliver a single batch and exit")
+	workspace := flags.String("workspace", db.DefaultWorkspace, "workspace whose changes are delivered")
+	allWorkspaces := flags.Bool("all-workspaces", false, "deliver the changes of every workspace")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *consumer == "" {
+		*consumer = *sinkName
+	}
+
+	var sink internal.OutboxSink
+	switch *sinkName {
+	case "stdout":
+		sink = sinks.NewStdoutSink()
+	case "file":
+		fileSink, err := sinks.NewFileSink(*target)
+		if err != nil {
+			return err
+		}
+		defer fileSink.Close()
+		sink = fileSink
+	case "webhook":
+		if *target == "" {
+			return fmt.Errorf("webhook sink requires -target")
+		}
+		sink = sinks.NewWebhookSink(*target)
+	default:
+		return fmt.Errorf("unknown sink %q", *sinkName)
+	}
+
+	relay := internal.NewOutboxRelay(db.NewPgOutboxRepository(a.connPool), sink, *consumer, *interval, *batchSize)
+	if !*allWorkspaces {
+		relay.SetWorkspace(*workspace)
+	}
+	relay.SetConsents(a.newProfileRepository(), a.consentRules)
+	if *once {
+		delivered, err := relay.RelayOnce(ctx)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Relayed outbox events", "consumer", *consumer, "count", delivered)
+		return nil
+	}
+
+	a.log.Info("Relaying outbox events", "consumer", *consumer, "sink", *sinkName)
+	relay.Start(ctx)
+	<-ctx.Done()
+	return nil
+}
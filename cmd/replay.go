@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// runReplay hands historical events back to the stitching workers, or rebuilds profiles into the shadow table. Events
+// of a single workspace are replayed unless -all-workspaces is given, which shadow replays require.
+func (a *app) runReplay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the event time range (RFC3339), defaults to the beginning of time")
+	to := flags.String("to", "", "end of the event time range (RFC3339), defaults to now")
+	cookie := flags.String("cookie", "", "only replay events with this cookie")
+	messageId := flags.String("message-id", "", "only replay events with this message id")
+	phone := flags.String("phone", "", "only replay events with this phone")
+	shadow := flags.Bool("shadow", false, "rebuild profiles into the shadow table and swap it in atomically, the time range must cover every stored event")
+	workspace := flags.String("workspace", db.DefaultWorkspace, "workspace whose events are replayed")
+	allWorkspaces := flags.Bool("all-workspaces", false, "replay the events of every workspace, required by -shadow")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *shadow && !*allWorkspaces {
+		return fmt.Errorf("shadow replay replaces the profiles of every workspace, run it with -all-workspaces")
+	}
+	if *allWorkspaces {
+		ctx = db.AllWorkspaces(ctx)
+	} else {
+		ctx = db.WithWorkspace(ctx, *workspace)
+	}
+
+	start, end, err := parseTimeRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	replayService := internal.NewReplayService(a.newEventRepository(), a.newProfileRepository(), a.newShadowProfileRepository())
+	replayService.SetConsentRules(a.consentRules)
+	replayService.SetWorkspaces(a.workspaces)
+	replayService.SetSegments(a.segments)
+	replayService.SetErasures(db.NewPgDSARRepository(a.connPool))
+	result, err := replayService.Replay(ctx, internal.ReplayRequest{
+		Start: start,
+		End:   end,
+		Identifiers: db.EventIdentifier{
+			Cookie:    *cookie,
+			MessageId: *messageId,
+			Phone:     *phone,
+		},
+		Shadow: *shadow,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.log.Info("Replay finished", "events", result.ResetEvents, "profiles", result.Profiles, "shadow", result.Shadow)
+	return nil
+}
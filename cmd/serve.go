@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/api"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+	"github.com/tomashoffer/event-stitching/internal/rpc"
+)
+
+// runServe serves the profile lookup API, and the gRPC API when given an address, until interrupted
+func (a *app) runServe(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "address the HTTP API listens on")
+	grpcAddr := flags.String("grpc-addr", "", "address the gRPC API listens on, disabled when empty")
+	ingestWorkers := flags.Int("ingest-workers", 4, "number of workers inserting events received over gRPC")
+	stitchWorkers := flags.Int("stitch-workers", 5, "number of workers stitching stored events, none when zero so another process stitches them")
+	dropUnconsented := flags.Bool("drop-unconsented", false, "drop identifiers of events received over gRPC without consent to stitching")
+	ingestRate := flags.Float64("ingest-rate", 0, "events per second each source of a workspace may send over gRPC on average, unlimited when zero")
+	ingestBurst := flags.Int("ingest-burst", 0, "events each source of a workspace may send over gRPC at once, the rate rounded up when zero")
+	ingestShedAt := flags.Int("ingest-shed-at", 0, "ingest queue depth from which events received over gRPC are rejected, only once the queue is full when zero")
+	metricsAddr := flags.String("metrics-addr", "", "address serving metrics at /debug/vars, disabled when empty")
+	requireAPIKeys := flags.Bool("require-api-keys", true, "require requests to authenticate with API keys issued by the keys command, otherwise only admin and erase requests do")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	profileRepo := a.newProfileRepository()
+	eventRepo := a.newEventRepository()
+
+	// Stitches events of synchronous resolve requests, and with workers the events ingested or imported meanwhile
+	stitchingService := a.newStitchingService(profileRepo, eventRepo, *stitchWorkers)
+	if *stitchWorkers > 0 {
+		stitchingService.Start(ctx)
+	}
+
+	exporter := export.NewExporter(profileRepo, db.NewPgExportRepository(a.connPool), 1000)
+	exporter.SetConsentRules(a.consentRules)
+
+	dsarService := internal.NewDSARService(profileRepo, eventRepo, db.NewPgDSARRepository(a.connPool))
+	dsarService.SetOutbox(db.NewPgOutboxRepository(a.connPool))
+	dsarService.SetProfileKeys(db.NewPgProfileKeyRepository(a.connPool))
+
+	// Requests authenticate unless disabled, admin and erase requests always do
+	keys := a.newAPIKeyService()
+	keys.SetRequired(*requireAPIKeys)
+
+	apiServer := api.NewServer(internal.NewProfileLookupService(profileRepo), stitchingService, exporter)
+	apiServer.SetAPIKeys(keys)
+	apiServer.SetDSAR(dsarService)
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           apiServer,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		a.log.Info("Serving profile API", "addr", *addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	if *grpcAddr != "" {
+		listener, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			return err
+		}
+		ingestService := internal.NewEventIngestService(eventRepo, *ingestWorkers)
+		if *dropUnconsented {
+			ingestService.SetConsentRules(a.consentRules)
+		}
+		ingestService.SetRateLimit(*ingestRate, *ingestBurst)
+		ingestService.SetShedThreshold(*ingestShedAt)
+		expvar.Publish("ingest", expvar.Func(func() any { return ingestService.Stats() }))
+		ingestService.Start(ctx)
+		rpcServer := rpc.NewServer(ingestService, profileRepo)
+		rpcServer.SetAPIKeys(keys)
+		grpcServer := rpc.NewGRPCServer(rpcServer, rpc.DefaultTimeout)
+		defer grpcServer.GracefulStop()
+		go func() {
+			a.log.Info("Serving gRPC API", "addr", *grpcAddr)
+			errs <- grpcServer.Serve(listener)
+		}()
+	}
+
+	if *metricsAddr != "" {
+		// The expvar package registers /debug/vars on the default mux
+		metricsServer := &http.Server{Addr: *metricsAddr, Handler: http.DefaultServeMux, ReadHeaderTimeout: 5 * time.Second}
+		defer metricsServer.Close()
+		go func() {
+			a.log.Info("Serving metrics", "addr", *metricsAddr)
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				a.log.Error("Metrics server failed", "error", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/webhooks"
+)
+
+// runWebhooks manages webhook endpoints and runs their delivery: add, list, enable, disable, deliveries or run
+func (a *app) runWebhooks(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("webhooks requires a subcommand: add, list, enable, disable, deliveries or run")
+	}
+	subcommand, args := args[0], args[1:]
+	webhookRepo := db.NewPgWebhookRepository(a.connPool)
+
+	flags := flag.NewFlagSet("webhooks "+subcommand, flag.ContinueOnError)
+	switch subcommand {
+	case "add":
+		url := flags.String("url", "", "endpoint URL")
+		secret := flags.String("secret", "", "secret the requests are signed with")
+		kinds := flags.String("kinds", "", "comma separated event kinds to deliver, all kinds when empty")
+		workspace := flags.String("workspace", db.DefaultWorkspace, "workspace whose events are delivered")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if *url == "" || *secret == "" {
+			return fmt.Errorf("webhooks add requires -url and -secret")
+		}
+
+		endpoint := db.WebhookEndpoint{Url: *url, Secret: *secret, Workspace: *workspace}
+		if *kinds != "" {
+			endpoint.Kinds = strings.Split(*kinds, ",")
+		}
+		id, err := webhookRepo.CreateWebhookEndpoint(db.WithWorkspace(ctx, *workspace), endpoint)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Registered webhook endpoint", "id", id, "url", *url, "workspace", *workspace)
+
+	case "list":
+		endpoints, err := webhookRepo.GetWebhookEndpoints(ctx)
+		if err != nil {
+			return err
+		}
+		for _, endpoint := range endpoints {
+			a.log.Info("Webhook endpoint",
+				"id", endpoint.Id,
+				"url", endpoint.Url,
+				"kinds", endpoint.Kinds,
+				"workspace", endpoint.Workspace,
+				"active", endpoint.Active)
+		}
+
+	case "enable", "disable":
+		id := flags.Int("id", 0, "endpoint id")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if err := webhookRepo.SetWebhookEndpointActive(ctx, *id, subcommand == "enable"); err != nil {
+			return err
+		}
+		a.log.Info("Updated webhook endpoint", "id", *id, "active", subcommand == "enable")
+
+	case "deliveries":
+		id := flags.Int("id", 0, "endpoint id")
+		limit := flags.Int("limit", 20, "number of latest attempts to show")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		deliveries, err := webhookRepo.GetWebhookDeliveries(ctx, *id, *limit)
+		if err != nil {
+			return err
+		}
+		for _, d := range deliveries {
+			a.log.Info("Webhook delivery",
+				"event", d.OutboxId,
+				"kind", d.Kind,
+				"attempt", d.Attempt,
+				"status", d.StatusCode,
+				"success", d.Success,
+				"error", d.Error,
+				"duration_ms", d.DurationMs,
+				"at", d.CreatedAt)
+		}
+
+	case "run":
+		interval := flags.Duration("interval", time.Second, "pause between polls once the outbox is drained")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		service := webhooks.NewService(webhookRepo, db.NewPgOutboxRepository(a.connPool), webhooks.DefaultRetryPolicy(), *interval, 100)
+		service.SetConsents(a.newProfileRepository(), a.consentRules)
+		started, err := service.Start(ctx)
+		if err != nil {
+			return err
+		}
+		a.log.Info("Delivering webhooks", "endpoints", started)
+		<-ctx.Done()
+
+	default:
+		return fmt.Errorf("unknown webhooks subcommand %q", subcommand)
+	}
+	return nil
+}
+
+// runReplayDelivery sends a range of outbox events to a webhook endpoint again
+func (a *app) runReplayDelivery(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay-delivery", flag.ContinueOnError)
+	endpointId := flags.Int("endpoint", 0, "endpoint id")
+	from := flags.Int64("from", 0, "first outbox event id to deliver")
+	to := flags.Int64("to", 0, "last outbox event id to deliver, defaults to -from")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == 0 {
+		*to = *from
+	}
+
+	service := webhooks.NewService(db.NewPgWebhookRepository(a.connPool), db.NewPgOutboxRepository(a.connPool), webhooks.DefaultRetryPolicy(), 0, 0)
+	service.SetConsents(a.newProfileRepository(), a.consentRules)
+	replayed, err := service.Replay(ctx, *endpointId, *from, *to)
+	if err != nil {
+		return err
+	}
+	a.log.Info("Replayed webhook deliveries", "endpoint", *endpointId, "events", replayed)
+	return nil
+}
@@ -0,0 +1,536 @@
+// Package api serves stitched profiles over HTTP.
+//
+//	GET  /profiles/{id}                         profile by id, following merges unless ?follow=false
+//	GET  /profiles/by-identifier/{type}/{value} profile holding an identifier, e.g. /profiles/by-identifier/phone/+15550100
+//	POST /profiles/batch                        several lookups at once, see BatchRequest
+//	POST /identities/resolve                    ingest and stitch an event right away, see ResolveRequest
+//	GET  /export/profiles                       stream every profile, ?format=jsonl|csv|parquet and ?since=<RFC 3339>
+//	POST /profiles/merge                        merge profiles into one, see MergeRequest
+//	POST /dsar/erase                            erase a data subject, see EraseRequest
+//
+// Unknown profiles respond with 404. Profiles merged into another one respond with 410 and the
+// survivor's id when the merge is not followed.
+//
+// When API keys are required, every request must carry one in the X-API-Key header and only sees the profiles of
+// the key's workspace. Requests without a valid key respond with 401, requests over the key's rate limit with 429
+// and requests outside the key's scopes with 403: lookups need profiles:read, resolving needs ingest, exports and
+// merges need admin and erasures need erase. Exports, merges and erasures are recorded in the audit log. Without
+// API keys requests operate on the default workspace.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+)
+
+// MaxBatchSize limits the number of lookups in a single batch request
+const MaxBatchSize = 100
+
+// APIKeyHeader is the header carrying the API key which authenticates a request as a workspace
+const APIKeyHeader = "X-API-Key"
+
+type Server struct {
+	lookup           *internal.ProfileLookupService
+	stitchingService *internal.StitchingService
+	exporter         *export.Exporter
+	dsar             *internal.DSARService
+	keys             *internal.APIKeyService
+	mux              *http.ServeMux
+	log              *slog.Logger
+}
+
+func NewServer(lookup *internal.ProfileLookupService, stitchingService *internal.StitchingService, exporter *export.Exporter) *Server {
+	s := &Server{
+		lookup:           lookup,
+		stitchingService: stitchingService,
+		exporter:         exporter,
+		mux:              http.NewServeMux(),
+		log:              slog.Default(),
+	}
+	s.handle("GET /profiles/{id}", db.ScopeReadProfiles, s.getProfile)
+	s.handle("GET /profiles/by-identifier/{type}/{value}", db.ScopeReadProfiles, s.getProfileByIdentifier)
+	s.handle("POST /profiles/batch", db.ScopeReadProfiles, s.batchLookup)
+	s.handle("POST /identities/resolve", db.ScopeIngest, s.resolveIdentity)
+	s.handle("GET /export/profiles", db.ScopeAdmin, s.exportProfiles)
+	s.handle("POST /profiles/merge", db.ScopeAdmin, s.mergeProfiles)
+	s.handle("POST /dsar/erase", db.ScopeErase, s.eraseSubject)
+	return s
+}
+
+// SetAPIKeys authenticates requests with the API keys of the service, which every request needs once it requires
+// them and admin and erase requests always, and records admin actions in its audit log
+func (s *Server) SetAPIKeys(keys *internal.APIKeyService) {
+	s.keys = keys
+}
+
+// SetDSAR enables erasing data subjects, which responds with 501 otherwise
+func (s *Server) SetDSAR(dsar *internal.DSARService) {
+	s.dsar = dsar
+}
+
+// handle registers the handler for requests whose API key grants the scope
+func (s *Server) handle(pattern string, scope db.Scope, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		switch err := internal.Authorize(r.Context(), scope); {
+		case errors.Is(err, internal.ErrInvalidAPIKey):
+			s.writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+			return
+		case err != nil:
+			s.writeJSON(w, http.StatusForbidden, ErrorResponse{Error: err.Error()})
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Requests carrying a key authenticate with it even when keys are not required
+	secret := r.Header.Get(APIKeyHeader)
+	if s.keys == nil || (!s.keys.Required() && secret == "") {
+		s.mux.ServeHTTP(w, r.WithContext(db.WithWorkspace(r.Context(), db.DefaultWorkspace)))
+		return
+	}
+
+	key, err := s.keys.Authenticate(r.Context(), secret)
+	switch {
+	case errors.Is(err, internal.ErrInvalidAPIKey), errors.Is(err, internal.ErrAPIKeyExpired):
+		s.writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, internal.ErrRateLimited):
+		s.writeJSON(w, http.StatusTooManyRequests, ErrorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		s.log.Error("Failed to authenticate request", "error", err)
+		s.writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "internal error"})
+		return
+	}
+	ctx := internal.WithAPIKey(db.WithWorkspace(r.Context(), key.Workspace), key)
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// audit records the admin action taken by the request
+func (s *Server) audit(r *http.Request, action, target string, err error) {
+	if s.keys != nil {
+		s.keys.Audit(r.Context(), action, target, err)
+	}
+}
+
+// ProfileResponse is the JSON representation of a profile
+type ProfileResponse struct {
+	Id             int               `json:"id"`
+	RedirectedFrom int               `json:"redirected_from,omitempty"`
+	Identifiers    map[string]string `json:"identifiers"`
+	Traits         db.Traits         `json:"traits"`
+	Stats          StatsResponse     `json:"stats"`
+	Segments       []string          `json:"segments"`
+}
+
+// StatsResponse is the JSON representation of profile stats, times are omitted for profiles without events
+type StatsResponse struct {
+	FirstSeen     *time.Time `json:"first_seen,omitempty"`
+	LastSeen      *time.Time `json:"last_seen,omitempty"`
+	LastPurchase  *time.Time `json:"last_purchase,omitempty"`
+	TotalEvents   int        `json:"total_events"`
+	PurchaseCount int        `json:"purchase_count"`
+	Revenue       float64    `json:"revenue"`
+}
+
+// ErrorResponse is returned along with every non 2xx status
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// MergedInto is the profile which absorbed the requested one, set along with 410
+	MergedInto int `json:"merged_into,omitempty"`
+}
+
+// IdentifierQuery selects a profile by one of its identifiers
+type IdentifierQuery struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// BatchRequest lists profiles to look up by id and by identifier, merges are always followed
+type BatchRequest struct {
+	Ids         []int             `json:"ids"`
+	Identifiers []IdentifierQuery `json:"identifiers"`
+}
+
+// BatchResult is the outcome of a single lookup, in the order of the request with ids first
+type BatchResult struct {
+	Id         int              `json:"id,omitempty"`
+	Identifier *IdentifierQuery `json:"identifier,omitempty"`
+	Status     int              `json:"status"`
+	Profile    *ProfileResponse `json:"profile,omitempty"`
+	Error      *ErrorResponse   `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// ResolveRequest is an event stitched synchronously. Timestamp defaults to the time of the request
+// and traits without updated_at are observed at the event timestamp. Consents are recorded on the profile
+// as decided at the event timestamp.
+type ResolveRequest struct {
+	Cookie    string      `json:"cookie"`
+	MessageId string      `json:"message_id"`
+	Phone     string      `json:"phone"`
+	EventId   int         `json:"event_id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Source    string      `json:"source"`
+	Traits    db.Traits   `json:"traits"`
+	Revenue   float64     `json:"revenue"`
+	Consents  db.Consents `json:"consents"`
+}
+
+// MergeRequest lists profiles known to belong to the same person, they are merged into the one chosen by the
+// survivorship rules
+type MergeRequest struct {
+	ProfileIds []int `json:"profile_ids"`
+}
+
+// MergeResponse is the profile which absorbed the others
+type MergeResponse struct {
+	ProfileId int   `json:"profile_id"`
+	MergedIds []int `json:"merged_ids"`
+}
+
+// EraseRequest names the data subject to erase by an identifier or a profile id. Mode is "delete",
+// "anonymize" or "shred" and defaults to "delete".
+type EraseRequest struct {
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	ProfileId int    `json:"profile_id"`
+	Mode      string `json:"mode"`
+}
+
+// EraseResponse is the outcome of the erasure as recorded in the DSAR log
+type EraseResponse struct {
+	RequestId  int64  `json:"request_id"`
+	ProfileIds []int  `json:"profile_ids"`
+	Events     int    `json:"events"`
+	Status     string `json:"status"`
+}
+
+// ResolveResponse is the profile the event was stitched to, Action is "created", "enriched" or "merged".
+// Action is "skipped" with no profile when all identifiers of the event were erased.
+type ResolveResponse struct {
+	ProfileId int    `json:"profile_id"`
+	Action    string `json:"action"`
+	Merged    bool   `json:"merged"`
+	MergedIds []int  `json:"merged_ids,omitempty"`
+}
+
+func (s *Server) getProfile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid profile id"})
+		return
+	}
+	follow := r.URL.Query().Get("follow") != "false"
+
+	details, err := s.lookup.GetById(r.Context(), id, follow)
+	s.writeLookup(w, details, err)
+}
+
+func (s *Server) getProfileByIdentifier(w http.ResponseWriter, r *http.Request) {
+	details, err := s.lookup.GetByIdentifier(r.Context(), r.PathValue("type"), r.PathValue("value"))
+	s.writeLookup(w, details, err)
+}
+
+func (s *Server) batchLookup(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if len(req.Ids)+len(req.Identifiers) > MaxBatchSize {
+		s.writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: "too many lookups in batch"})
+		return
+	}
+
+	results := make([]BatchResult, 0, len(req.Ids)+len(req.Identifiers))
+	for _, id := range req.Ids {
+		details, err := s.lookup.GetById(r.Context(), id, true)
+		status, profile, errResp := s.lookupResult(details, err)
+		results = append(results, BatchResult{Id: id, Status: status, Profile: profile, Error: errResp})
+	}
+	for _, query := range req.Identifiers {
+		details, err := s.lookup.GetByIdentifier(r.Context(), query.Type, query.Value)
+		status, profile, errResp := s.lookupResult(details, err)
+		results = append(results, BatchResult{Identifier: &query, Status: status, Profile: profile, Error: errResp})
+	}
+	s.writeJSON(w, http.StatusOK, BatchResponse{Results: results})
+}
+
+func (s *Server) resolveIdentity(w http.ResponseWriter, r *http.Request) {
+	var req ResolveRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+
+	event := req.eventRecord(time.Now().UTC())
+	if event.EventIdentifier == (db.EventIdentifier{}) {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "at least one identifier is required"})
+		return
+	}
+	for _, consent := range event.Consents {
+		if err := consent.Validate(); err != nil {
+			s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	resolved, err := s.stitchingService.StitchNow(r.Context(), event)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.writeJSON(w, http.StatusGatewayTimeout, ErrorResponse{Error: "stitching timed out"})
+			return
+		}
+		s.log.Error("Failed to stitch event", "error", err)
+		s.writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "internal error"})
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, ResolveResponse{
+		ProfileId: resolved.ProfileId,
+		Action:    resolved.Action.String(),
+		Merged:    resolved.Merged(),
+		MergedIds: resolved.MergedIds,
+	})
+}
+
+// WatermarkTrailer is the trailer of export responses holding the since of the next incremental export
+const WatermarkTrailer = "X-Export-Watermark"
+
+// exportProfiles streams the export as it is read. Failures after the first bytes were sent abort the
+// response, so clients see a truncated body instead of a complete looking export.
+func (s *Server) exportProfiles(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = string(export.FormatJSONL)
+	}
+	format, err := export.ParseFormat(name)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	opts := export.Options{Format: format}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid since, expected an RFC 3339 time"})
+			return
+		}
+		opts.Since = opts.Since.UTC()
+	}
+
+	// Exports outlast the write timeout of the server
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Trailer", WatermarkTrailer)
+	result, err := s.exporter.Export(r.Context(), w, opts)
+	s.audit(r, "export", "profiles as "+string(format), err)
+	if err != nil {
+		s.log.Error("Failed to export profiles", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set(WatermarkTrailer, result.Watermark.Format(time.RFC3339Nano))
+}
+
+func (s *Server) mergeProfiles(w http.ResponseWriter, r *http.Request) {
+	var req MergeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if len(req.ProfileIds) > MaxBatchSize {
+		s.writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: "too many profiles to merge"})
+		return
+	}
+
+	merged, err := s.stitchingService.MergeNow(r.Context(), req.ProfileIds)
+	s.audit(r, "merge", fmt.Sprintf("profiles %v", req.ProfileIds), err)
+	switch {
+	case errors.Is(err, internal.ErrTooFewProfiles):
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: internal.ErrTooFewProfiles.Error()})
+		return
+	case errors.Is(err, internal.ErrProfileNotFound):
+		s.writeJSON(w, http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	case errors.Is(err, internal.ErrIdentifiersChanged):
+		s.writeJSON(w, http.StatusConflict, ErrorResponse{Error: internal.ErrIdentifiersChanged.Error()})
+		return
+	case err != nil:
+		s.log.Error("Failed to merge profiles", "error", err)
+		s.writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "internal error"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, MergeResponse{ProfileId: merged.ProfileId, MergedIds: merged.MergedIds})
+}
+
+func (s *Server) eraseSubject(w http.ResponseWriter, r *http.Request) {
+	if s.dsar == nil {
+		s.writeJSON(w, http.StatusNotImplemented, ErrorResponse{Error: "erasure is not enabled"})
+		return
+	}
+	var req EraseRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "invalid request body"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = string(db.ErasureDelete)
+	}
+	mode, err := db.ParseErasureMode(req.Mode)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// The log only names the subject by the hash of the identifier, like the DSAR log
+	subject := internal.DataSubject{Identifier: db.Identifier{Type: req.Type, Value: req.Value}, ProfileId: req.ProfileId}
+	target := fmt.Sprintf("profile %d", req.ProfileId)
+	if req.ProfileId == 0 {
+		if _, ok := db.IdentifierByName(req.Type, req.Value); !ok || req.Value == "" {
+			s.writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "an identifier or profile id is required"})
+			return
+		}
+		target = req.Type + " " + db.HashIdentifier(subject.Identifier)
+	}
+
+	requestedBy := "api"
+	if key, ok := internal.APIKeyFromContext(r.Context()); ok {
+		requestedBy = key.Name
+	}
+	request, err := s.dsar.Erase(r.Context(), subject, mode, requestedBy, nil)
+	s.audit(r, "erase", target, err)
+	if errors.Is(err, internal.ErrIdentifiersChanged) {
+		s.writeJSON(w, http.StatusConflict, ErrorResponse{Error: internal.ErrIdentifiersChanged.Error()})
+		return
+	}
+	if err != nil {
+		s.log.Error("Failed to erase data subject", "error", err)
+		s.writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "internal error"})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, EraseResponse{
+		RequestId:  request.Id,
+		ProfileIds: request.ProfileIds,
+		Events:     request.Events,
+		Status:     string(request.Status),
+	})
+}
+
+func (req ResolveRequest) eventRecord(received time.Time) db.EventRecord {
+	event := db.EventRecord{
+		EventIdentifier: db.EventIdentifier{Cookie: req.Cookie, MessageId: req.MessageId, Phone: req.Phone},
+		EventId:         req.EventId,
+		EventTimestamp:  req.Timestamp,
+		Source:          req.Source,
+		Traits:          req.Traits,
+		Revenue:         req.Revenue,
+		Consents:        req.Consents,
+	}
+	if event.EventTimestamp.IsZero() {
+		event.EventTimestamp = received
+	}
+	for name, trait := range event.Traits {
+		if trait.UpdatedAt.IsZero() {
+			trait.UpdatedAt = event.EventTimestamp
+			event.Traits[name] = trait
+		}
+	}
+	return event
+}
+
+func (s *Server) writeLookup(w http.ResponseWriter, details internal.ProfileDetails, err error) {
+	status, profile, errResp := s.lookupResult(details, err)
+	if errResp != nil {
+		s.writeJSON(w, status, errResp)
+		return
+	}
+	s.writeJSON(w, status, profile)
+}
+
+// lookupResult maps the outcome of a lookup to a status along with either a profile or an error
+func (s *Server) lookupResult(details internal.ProfileDetails, err error) (int, *ProfileResponse, *ErrorResponse) {
+	var merged *internal.ProfileMergedError
+	switch {
+	case err == nil:
+		profile := newProfileResponse(details)
+		return http.StatusOK, &profile, nil
+	case errors.As(err, &merged):
+		return http.StatusGone, nil, &ErrorResponse{Error: merged.Error(), MergedInto: merged.SurvivorId}
+	case errors.Is(err, internal.ErrProfileNotFound):
+		return http.StatusNotFound, nil, &ErrorResponse{Error: err.Error()}
+	case errors.Is(err, internal.ErrUnknownIdentifier):
+		return http.StatusBadRequest, nil, &ErrorResponse{Error: err.Error()}
+	}
+	s.log.Error("Failed to look up profile", "error", err)
+	return http.StatusInternalServerError, nil, &ErrorResponse{Error: "internal error"}
+}
+
+func newProfileResponse(details internal.ProfileDetails) ProfileResponse {
+	profile := details.Profile
+	profileIdentifiers := db.EventIdentifier{Cookie: profile.Cookie, MessageId: profile.MessageId, Phone: profile.Phone}
+	identifiers := make(map[string]string)
+	for _, name := range profileIdentifiers.GetIdentifierNames() {
+		if value, _ := profileIdentifiers.GetIdentifierValueByName(name); value != "" {
+			identifiers[name] = value
+		}
+	}
+
+	traits := profile.Traits
+	if traits == nil {
+		traits = db.Traits{}
+	}
+	segments := details.Segments
+	if segments == nil {
+		segments = []string{}
+	}
+
+	return ProfileResponse{
+		Id:             profile.Id,
+		RedirectedFrom: details.RedirectedFrom,
+		Identifiers:    identifiers,
+		Traits:         traits,
+		Stats:          newStatsResponse(details.Stats),
+		Segments:       segments,
+	}
+}
+
+func newStatsResponse(stats db.ProfileStats) StatsResponse {
+	optional := func(t time.Time) *time.Time {
+		if t.IsZero() {
+			return nil
+		}
+		return &t
+	}
+	return StatsResponse{
+		FirstSeen:     optional(stats.FirstSeen),
+		LastSeen:      optional(stats.LastSeen),
+		LastPurchase:  optional(stats.LastPurchase),
+		TotalEvents:   stats.TotalEvents,
+		PurchaseCount: stats.PurchaseCount,
+		Revenue:       stats.Revenue,
+	}
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.log.Error("Failed to write response", "error", err)
+	}
+}
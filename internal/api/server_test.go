@@ -0,0 +1,309 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/api"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		profileRepo *mocks.MockProfileRepository
+		eventRepo   *mocks.MockEventRepository
+		apiServer   *api.Server
+		server      *httptest.Server
+	)
+
+	get := func(path string, body any) int {
+		resp, err := http.Get(server.URL + path)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(json.NewDecoder(resp.Body).Decode(body)).To(Succeed())
+		return resp.StatusCode
+	}
+
+	BeforeEach(func() {
+		profileRepo = mocks.NewMockProfileRepository()
+		seen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		profileRepo.Profiles[1] = db.Profile{Id: 1, Cookie: "cookie-1", Phone: "+15550100",
+			Traits: db.Traits{"plan": db.StringTrait("pro", seen)}}
+		profileRepo.Profiles[2] = db.Profile{Id: 2, MessageId: "message-2"}
+		profileRepo.Stats[1] = db.ProfileStats{ProfileId: 1, FirstSeen: seen, LastSeen: seen, TotalEvents: 3}
+		profileRepo.Segments[1] = []string{"vip"}
+
+		// Profile 3 was merged into 1, and 4 into a profile that is gone since
+		profileRepo.Merges[3] = 1
+		profileRepo.Merges[4] = 5
+
+		eventRepo = mocks.NewMockEventRepository()
+		stitchingService := internal.NewStitchingService(profileRepo, eventRepo, time.Second, 1, 10)
+		apiServer = api.NewServer(internal.NewProfileLookupService(profileRepo), stitchingService,
+			export.NewExporter(profileRepo, mocks.NewMockExportRepository(), 2))
+		server = httptest.NewServer(apiServer)
+		DeferCleanup(server.Close)
+	})
+
+	It("should return a profile with its identifiers, traits, stats and segments", func() {
+		var profile api.ProfileResponse
+		Expect(get("/profiles/1", &profile)).To(Equal(http.StatusOK))
+		Expect(profile.Id).To(Equal(1))
+		Expect(profile.RedirectedFrom).To(BeZero())
+		Expect(profile.Identifiers).To(Equal(map[string]string{"cookie": "cookie-1", "phone": "+15550100"}))
+		Expect(profile.Traits["plan"].String).To(Equal("pro"))
+		Expect(profile.Stats.TotalEvents).To(Equal(3))
+		Expect(profile.Stats.LastPurchase).To(BeNil())
+		Expect(profile.Segments).To(Equal([]string{"vip"}))
+	})
+
+	It("should follow merges unless asked not to", func() {
+		var profile api.ProfileResponse
+		Expect(get("/profiles/3", &profile)).To(Equal(http.StatusOK))
+		Expect(profile.Id).To(Equal(1))
+		Expect(profile.RedirectedFrom).To(Equal(3))
+
+		var gone api.ErrorResponse
+		Expect(get("/profiles/3?follow=false", &gone)).To(Equal(http.StatusGone))
+		Expect(gone.MergedInto).To(Equal(1))
+	})
+
+	It("should distinguish unknown profiles from merged away ones", func() {
+		var errResp api.ErrorResponse
+		Expect(get("/profiles/99", &errResp)).To(Equal(http.StatusNotFound))
+		Expect(get("/profiles/4", &errResp)).To(Equal(http.StatusGone))
+		Expect(errResp.MergedInto).To(Equal(5))
+		Expect(get("/profiles/abc", &errResp)).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should look up profiles by any identifier", func() {
+		var profile api.ProfileResponse
+		Expect(get("/profiles/by-identifier/phone/+15550100", &profile)).To(Equal(http.StatusOK))
+		Expect(profile.Id).To(Equal(1))
+		Expect(get("/profiles/by-identifier/message_id/message-2", &profile)).To(Equal(http.StatusOK))
+		Expect(profile.Id).To(Equal(2))
+		Expect(profile.Segments).To(BeEmpty())
+
+		var errResp api.ErrorResponse
+		Expect(get("/profiles/by-identifier/phone/+15559999", &errResp)).To(Equal(http.StatusNotFound))
+		Expect(get("/profiles/by-identifier/email/a@example.com", &errResp)).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should look up several profiles in a batch", func() {
+		body, err := json.Marshal(api.BatchRequest{
+			Ids:         []int{1, 3, 4, 99},
+			Identifiers: []api.IdentifierQuery{{Type: "cookie", Value: "cookie-1"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := http.Post(server.URL+"/profiles/batch", "application/json", bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var batch api.BatchResponse
+		Expect(json.NewDecoder(resp.Body).Decode(&batch)).To(Succeed())
+		statuses := make([]int, len(batch.Results))
+		for i, result := range batch.Results {
+			statuses[i] = result.Status
+		}
+		Expect(statuses).To(Equal([]int{200, 200, 410, 404, 200}))
+		Expect(batch.Results[1].Profile.RedirectedFrom).To(Equal(3))
+		Expect(batch.Results[2].Error.MergedInto).To(Equal(5))
+		Expect(batch.Results[4].Identifier.Value).To(Equal("cookie-1"))
+	})
+
+	It("should reject oversized batches", func() {
+		body, err := json.Marshal(api.BatchRequest{Ids: make([]int, api.MaxBatchSize+1)})
+		Expect(err).NotTo(HaveOccurred())
+
+		resp, err := http.Post(server.URL+"/profiles/batch", "application/json", bytes.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should stitch events synchronously", func() {
+		post := func(req api.ResolveRequest) (int, api.ResolveResponse) {
+			body, err := json.Marshal(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.Post(server.URL+"/identities/resolve", "application/json", bytes.NewReader(body))
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			var resolved api.ResolveResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&resolved)).To(Succeed())
+			return resp.StatusCode, resolved
+		}
+
+		status, resolved := post(api.ResolveRequest{Cookie: "cookie-1"})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(resolved).To(Equal(api.ResolveResponse{ProfileId: 1, Action: "enriched"}))
+
+		// Profiles 1 and 2 share nothing until an event links them
+		status, resolved = post(api.ResolveRequest{Cookie: "cookie-1", MessageId: "message-2",
+			Traits: db.Traits{"tier": db.StringTrait("gold", time.Time{})}})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(resolved).To(Equal(api.ResolveResponse{ProfileId: 1, Action: "merged", Merged: true, MergedIds: []int{2}}))
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(2))
+		Expect(eventRepo.ProcessedEvents[1].Traits["tier"].UpdatedAt).To(Equal(eventRepo.ProcessedEvents[1].EventTimestamp))
+
+		status, _ = post(api.ResolveRequest{EventId: 1})
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should require an API key and stitch into the key's workspace", func() {
+		keys := internal.NewAPIKeyService(mocks.NewMockAPIKeyRepository())
+		keys.SetRequired(true)
+		apiServer.SetAPIKeys(keys)
+		keyA, _, err := keys.Issue(db.WithWorkspace(context.Background(), "brand-a"),
+			db.APIKey{Name: "brand-a", Scopes: []string{string(db.ScopeIngest)}})
+		Expect(err).NotTo(HaveOccurred())
+		resolve := func(key string) (int, api.ResolveResponse) {
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/identities/resolve", bytes.NewReader([]byte(`{"cookie": "cookie-1"}`)))
+			Expect(err).NotTo(HaveOccurred())
+			if key != "" {
+				req.Header.Set(api.APIKeyHeader, key)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+
+			var resolved api.ResolveResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&resolved)).To(Succeed())
+			return resp.StatusCode, resolved
+		}
+
+		status, _ := resolve("")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		status, _ = resolve("key-b")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+
+		// Profile 1 holding the cookie belongs to the default workspace, so brand-a gets a profile of its own
+		status, resolved := resolve(keyA)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(resolved.Action).To(Equal("created"))
+		Expect(profileRepo.Profiles[resolved.ProfileId].Workspace).To(Equal("brand-a"))
+		Expect(eventRepo.ProcessedEvents[0].Workspace).To(Equal("brand-a"))
+	})
+
+	It("should enforce the scopes, expiry and rate limits of issued keys and audit admin actions", func() {
+		apiKeyRepo := mocks.NewMockAPIKeyRepository()
+		keys := internal.NewAPIKeyService(apiKeyRepo)
+		keys.SetRequired(true)
+		apiServer.SetAPIKeys(keys)
+
+		ctx := context.Background()
+		reader, _, err := keys.Issue(ctx, db.APIKey{Name: "reader", Scopes: []string{string(db.ScopeReadProfiles)},
+			RateLimit: 1, Burst: 2})
+		Expect(err).NotTo(HaveOccurred())
+		admin, adminKey, err := keys.Issue(ctx, db.APIKey{Name: "ops", Scopes: []string{string(db.ScopeAdmin)}})
+		Expect(err).NotTo(HaveOccurred())
+		expiredAt := time.Now().UTC().Add(-time.Minute)
+		expired, _, err := keys.Issue(ctx, db.APIKey{Name: "old", Scopes: db.AllScopes(), ExpiresAt: &expiredAt})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apiKeyRepo.Keys[0].KeyHash).To(Equal(db.HashAPIKey(reader)))
+		Expect(apiKeyRepo.Keys[0].Prefix).To(Equal(reader[:12]))
+
+		do := func(method, path, key string, body any) int {
+			encoded, err := json.Marshal(body)
+			Expect(err).NotTo(HaveOccurred())
+			req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(encoded))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set(api.APIKeyHeader, key)
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		// The reader may look up profiles but not merge them, until its burst of two requests is used up
+		Expect(do(http.MethodGet, "/profiles/1", reader, nil)).To(Equal(http.StatusOK))
+		Expect(do(http.MethodPost, "/profiles/merge", reader, api.MergeRequest{ProfileIds: []int{1, 2}})).To(Equal(http.StatusForbidden))
+		Expect(do(http.MethodGet, "/profiles/1", reader, nil)).To(Equal(http.StatusTooManyRequests))
+		Expect(do(http.MethodGet, "/profiles/1", expired, nil)).To(Equal(http.StatusUnauthorized))
+
+		Expect(do(http.MethodPost, "/profiles/merge", admin, api.MergeRequest{ProfileIds: []int{2, 1}})).To(Equal(http.StatusOK))
+		Expect(profileRepo.MergeCalls).To(Equal([][]int{{1, 2}}))
+		Expect(do(http.MethodPost, "/profiles/merge", admin, api.MergeRequest{ProfileIds: []int{1, 9}})).To(Equal(http.StatusNotFound))
+		Expect(do(http.MethodPost, "/profiles/merge", admin, api.MergeRequest{ProfileIds: []int{1}})).To(Equal(http.StatusBadRequest))
+
+		revoked, err := keys.Revoke(ctx, adminKey.Id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(revoked).To(BeTrue())
+		Expect(do(http.MethodPost, "/profiles/merge", admin, api.MergeRequest{ProfileIds: []int{1, 2}})).To(Equal(http.StatusUnauthorized))
+
+		var merges []db.AuditEntry
+		for _, entry := range apiKeyRepo.Audit {
+			if entry.Action == "merge" {
+				merges = append(merges, entry)
+			}
+		}
+		Expect(merges).To(HaveLen(3))
+		Expect(merges[0].Actor).To(Equal("ops"))
+		Expect(merges[0].APIKeyId).To(Equal(adminKey.Id))
+		Expect(merges[0].Target).To(Equal("profiles [2 1]"))
+		Expect(merges[0].Outcome).To(Equal("ok"))
+		Expect(merges[1].Outcome).To(ContainSubstring(internal.ErrProfileNotFound.Error()))
+		Expect(apiKeyRepo.Audit[len(apiKeyRepo.Audit)-1].Action).To(Equal("revoke_key"))
+		Expect(apiKeyRepo.Audit[len(apiKeyRepo.Audit)-1].Actor).To(Equal("cli"))
+	})
+
+	It("should refuse admin and erase requests without an API key when keys are not required", func() {
+		apiServer.SetAPIKeys(internal.NewAPIKeyService(mocks.NewMockAPIKeyRepository()))
+
+		var profile api.ProfileResponse
+		Expect(get("/profiles/1", &profile)).To(Equal(http.StatusOK))
+		var errResp api.ErrorResponse
+		Expect(get("/export/profiles", &errResp)).To(Equal(http.StatusUnauthorized))
+		for _, path := range []string{"/profiles/merge", "/dsar/erase"} {
+			resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader([]byte(`{}`)))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		}
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+	})
+
+	It("should stream exports with the watermark as a trailer", func() {
+		profileRepo.UpdatedAt[1] = time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+		profileRepo.UpdatedAt[2] = time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)
+		keys := internal.NewAPIKeyService(mocks.NewMockAPIKeyRepository())
+		apiServer.SetAPIKeys(keys)
+		admin, _, err := keys.Issue(context.Background(), db.APIKey{Name: "ops", Scopes: []string{string(db.ScopeAdmin)}})
+		Expect(err).NotTo(HaveOccurred())
+		exportProfiles := func(query string) *http.Response {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/export/profiles"+query, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set(api.APIKeyHeader, admin)
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			return resp
+		}
+
+		resp := exportProfiles("?since=2024-05-02T12:00:00Z")
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+		var record export.Record
+		decoder := json.NewDecoder(resp.Body)
+		Expect(decoder.Decode(&record)).To(Succeed())
+		Expect(record.Id).To(BeEquivalentTo(2))
+		Expect(decoder.More()).To(BeFalse())
+		Expect(resp.Trailer.Get(api.WatermarkTrailer)).To(Equal("2024-05-03T00:00:00Z"))
+
+		resp = exportProfiles("?format=xml")
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+})
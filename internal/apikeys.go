@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var (
+	// ErrInvalidAPIKey is returned for missing, unknown and revoked API keys
+	ErrInvalidAPIKey = errors.New("missing or invalid API key")
+	// ErrAPIKeyExpired is returned for API keys past their expiry
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrRateLimited is returned once an API key exceeds its rate limit
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrMissingScope is returned when an API key does not grant the scope of an action
+	ErrMissingScope = errors.New("API key lacks the required scope")
+)
+
+// cliActor is the actor of audit entries for actions taken by commands instead of API keys
+const cliActor = "cli"
+
+// apiKeyContextKey holds the API key a request authenticated with
+type apiKeyContextKey struct{}
+
+// WithAPIKey returns the context of a request authenticated with the key
+func WithAPIKey(ctx context.Context, key db.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFromContext returns the key the request of the context authenticated with
+func APIKeyFromContext(ctx context.Context) (db.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(db.APIKey)
+	return key, ok
+}
+
+// Authorize checks that the request of the context may take actions of the scope. Requests which did not
+// authenticate, as authentication is not required, may ingest and read profiles but never take admin or erase
+// actions.
+func Authorize(ctx context.Context, scope db.Scope) error {
+	key, ok := APIKeyFromContext(ctx)
+	if !ok {
+		if scope == db.ScopeAdmin || scope == db.ScopeErase {
+			return fmt.Errorf("%w, required for %q", ErrInvalidAPIKey, scope)
+		}
+		return nil
+	}
+	if !key.HasScope(scope) {
+		return fmt.Errorf("%w %q", ErrMissingScope, scope)
+	}
+	return nil
+}
+
+// APIKeyService issues and authenticates API keys stored hashed in the database, enforcing their expiry and
+// rate limits, and keeps the audit log of admin actions
+type APIKeyService struct {
+	apiKeyRepo db.APIKeyRepository
+	required   bool
+	mu         sync.Mutex
+	buckets    map[int]*tokenBucket
+	now        func() time.Time
+	log        *slog.Logger
+}
+
+func NewAPIKeyService(apiKeyRepo db.APIKeyRepository) *APIKeyService {
+	return &APIKeyService{
+		apiKeyRepo: apiKeyRepo,
+		buckets:    make(map[int]*tokenBucket),
+		now:        func() time.Time { return time.Now().UTC() },
+		log:        slog.Default(),
+	}
+}
+
+// SetRequired requires every request to authenticate, otherwise only admin and erase actions need a key
+func (s *APIKeyService) SetRequired(required bool) {
+	s.required = required
+}
+
+// Required reports whether requests must authenticate
+func (s *APIKeyService) Required() bool {
+	return s.required
+}
+
+// Issue generates a key with the settings of key, stores its hash and returns the key itself, which cannot be
+// recovered later. The key is issued in the workspace of the context when scoped.
+func (s *APIKeyService) Issue(ctx context.Context, key db.APIKey) (string, db.APIKey, error) {
+	// Create a helper function for preparing failure results
+	fail := func(err error) (string, db.APIKey, error) {
+		return "", db.APIKey{}, fmt.Errorf("issue API key: %w", err)
+	}
+
+	if key.Name == "" {
+		return fail(errors.New("name is required"))
+	}
+	if len(key.Scopes) == 0 {
+		return fail(errors.New("at least one scope is required"))
+	}
+	if key.RateLimit < 0 || key.Burst < 0 {
+		return fail(errors.New("rate limit and burst must not be negative"))
+	}
+
+	secret, err := db.GenerateAPIKey()
+	if err != nil {
+		return fail(err)
+	}
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		key.Workspace = workspace
+	}
+	key.KeyHash = db.HashAPIKey(secret)
+	key.Prefix = secret[:12]
+
+	key.Id, err = s.apiKeyRepo.CreateAPIKey(ctx, key)
+	s.Audit(db.WithWorkspace(ctx, key.Workspace), "issue_key", fmt.Sprintf("key %d %s", key.Id, key.Name), err)
+	if err != nil {
+		return fail(err)
+	}
+	return secret, key, nil
+}
+
+// Revoke stops the key from authenticating, false when the workspace of the context has no such active key
+func (s *APIKeyService) Revoke(ctx context.Context, id int) (bool, error) {
+	revoked, err := s.apiKeyRepo.RevokeAPIKey(ctx, id)
+	outcome := err
+	if err == nil && !revoked {
+		outcome = errors.New("no such active key")
+	}
+	s.Audit(ctx, "revoke_key", fmt.Sprintf("key %d", id), outcome)
+	if err != nil {
+		return false, fmt.Errorf("revoke API key: %w", err)
+	}
+	return revoked, nil
+}
+
+// Authenticate returns the key which the secret is, taking a request from its rate limit
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string) (db.APIKey, error) {
+	if secret == "" {
+		return db.APIKey{}, ErrInvalidAPIKey
+	}
+	if s.apiKeyRepo == nil {
+		return db.APIKey{}, ErrInvalidAPIKey
+	}
+
+	key, found, err := s.apiKeyRepo.GetAPIKeyByHash(ctx, db.HashAPIKey(secret))
+	if err != nil {
+		return db.APIKey{}, fmt.Errorf("authenticate: %w", err)
+	}
+	if !found || key.RevokedAt != nil {
+		return db.APIKey{}, ErrInvalidAPIKey
+	}
+
+	now := s.now()
+	if key.Expired(now) {
+		return db.APIKey{}, ErrAPIKeyExpired
+	}
+	if !s.allow(key, now) {
+		return db.APIKey{}, ErrRateLimited
+	}
+	return key, nil
+}
+
+// allow takes a request from the rate limit of the key
+func (s *APIKeyService) allow(key db.APIKey, now time.Time) bool {
+	if key.RateLimit <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[key.Id]
+	if !ok {
+		bucket = newTokenBucket(key.RateLimit, key.Burst, now)
+		s.buckets[key.Id] = bucket
+	}
+	return bucket.allow(now)
+}
+
+// Audit records an admin action taken by the API key of the context, or by a command when there is none, along
+// with its outcome. Failing to record the entry is logged, as the action was taken already.
+func (s *APIKeyService) Audit(ctx context.Context, action, target string, actionErr error) {
+	entry := db.AuditEntry{Actor: cliActor, Action: action, Target: target, Outcome: "ok"}
+	if key, ok := APIKeyFromContext(ctx); ok {
+		entry.APIKeyId, entry.Actor, entry.Workspace = key.Id, key.Name, key.Workspace
+	}
+	if actionErr != nil {
+		entry.Outcome = actionErr.Error()
+	}
+	s.log.Info("Audit", "actor", entry.Actor, "action", action, "target", target, "outcome", entry.Outcome)
+
+	if s.apiKeyRepo == nil {
+		return
+	}
+	// The entry is recorded even when the request taking the action was cancelled
+	if err := s.apiKeyRepo.RecordAudit(context.WithoutCancel(ctx), entry); err != nil {
+		s.log.Error("Failed to record audit entry", "action", action, "error", err)
+	}
+}
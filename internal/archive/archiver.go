@@ -0,0 +1,145 @@
+package archive
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Result describes an archival run
+type Result struct {
+	Files  []string
+	Events int
+}
+
+// Archiver moves processed events past the retention of their type to files in a directory, one file per batch.
+// A batch is locked, written, synced and only then deleted in the same transaction, so an event is either still
+// stored or archived. Events are archived as stored, protected identifiers and sealed events stay so.
+type Archiver struct {
+	archiveRepo db.ArchiveRepository
+	rules       db.RetentionRules
+	dir         string
+	format      Format
+	batchSize   int
+	log         *slog.Logger
+}
+
+func NewArchiver(archiveRepo db.ArchiveRepository, rules db.RetentionRules, dir string, format Format, batchSize int) *Archiver {
+	return &Archiver{
+		archiveRepo: archiveRepo,
+		rules:       rules,
+		dir:         dir,
+		format:      format,
+		batchSize:   batchSize,
+		log:         slog.Default(),
+	}
+}
+
+// Start archives expired events every interval until the context is cancelled
+func (a *Archiver) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		for {
+			result, err := a.Archive(ctx, time.Now().UTC())
+			if err != nil {
+				a.log.Error("Failed to archive events", "error", err)
+			} else if result.Events > 0 {
+				a.log.Info("Archived events", "events", result.Events, "files", len(result.Files))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Archive archives every event expired at the given time in batches, and returns the files written
+func (a *Archiver) Archive(ctx context.Context, now time.Time) (Result, error) {
+	var result Result
+	fail := func(err error) (Result, error) {
+		return result, fmt.Errorf("archive: %w", err)
+	}
+
+	cutoffs, err := a.rules.Cutoffs(now)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.MkdirAll(a.dir, 0o750); err != nil {
+		return fail(fmt.Errorf("failed to create archive directory: %w", err))
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		path, archived, err := a.archiveBatch(ctx, cutoffs)
+		if err != nil {
+			return fail(err)
+		}
+		if archived == 0 {
+			return result, nil
+		}
+		result.Files = append(result.Files, path)
+		result.Events += archived
+	}
+}
+
+// archiveBatch archives and deletes the next batch of expired events, returning the file written
+func (a *Archiver) archiveBatch(ctx context.Context, cutoffs db.RetentionCutoffs) (string, int, error) {
+	tx, err := a.archiveRepo.BeginTx(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	// Defer a rollback in case anything fails
+	defer tx.Rollback(ctx)
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	// Events of every workspace expire by the same rules
+	events, err := a.archiveRepo.GetExpiredEvents(db.AllWorkspaces(txCtx), cutoffs, a.batchSize)
+	if err != nil || len(events) == 0 {
+		return "", 0, err
+	}
+
+	// Events are ordered by id, a batch archived again after a failed commit gets the same name
+	name := fmt.Sprintf("events-%d-%d%s", events[0].Id, events[len(events)-1].Id, a.format.Extension())
+	path := filepath.Join(a.dir, name)
+	if err := writeFile(path, a.format, events); err != nil {
+		return "", 0, err
+	}
+
+	if _, err := a.archiveRepo.DeleteArchivedEvents(txCtx, events); err != nil {
+		return "", 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return path, len(events), nil
+}
+
+// Restore inserts the events of an archive file back as processed events and returns the number restored. Events
+// still stored are skipped, so restoring a file twice is harmless. Replay the time range of the restored events to
+// stitch them again.
+func (a *Archiver) Restore(ctx context.Context, path string) (int, error) {
+	events, err := ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("restore: %w", err)
+	}
+
+	restored := 0
+	for start := 0; start < len(events); start += a.batchSize {
+		n, err := a.archiveRepo.RestoreEvents(ctx, events[start:min(start+a.batchSize, len(events))])
+		if err != nil {
+			return restored, fmt.Errorf("restore: %w", err)
+		}
+		restored += n
+	}
+	return restored, nil
+}
@@ -0,0 +1,107 @@
+package archive_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/archive"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Archiver", func() {
+	var (
+		archiveRepo *mocks.MockArchiveRepository
+		rules       db.RetentionRules
+		dir         string
+		now         time.Time
+	)
+
+	event := func(id, eventId int, age time.Duration) db.ArchivedEvent {
+		return db.ArchivedEvent{
+			Id:             id,
+			EventId:        eventId,
+			EventTimestamp: now.Add(-age),
+			Identifiers:    json.RawMessage(`{"cookie":"cookie-1","message_id":"","phone":""}`),
+			Source:         "web",
+		}
+	}
+
+	BeforeEach(func() {
+		archiveRepo = mocks.NewMockArchiveRepository()
+		rules = db.RetentionRules{Default: "30d", EventTypes: map[int]string{db.EventIdPurchase: db.RetainForever, 7: "1h"}}
+		dir = GinkgoT().TempDir()
+		now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+		key := "5f0c7d2e-8a4b-4c1e-9d3f-2b6a7e8c9d01"
+		purchase := event(5, db.EventIdPurchase, 400*24*time.Hour)
+		purchase.Revenue = 9.5
+		sealed := event(6, 7, 2*time.Hour)
+		sealed.ProfileKey = &key
+		sealed.Traits = json.RawMessage(`{"pii:sealed":{"type":"string","value":"pii:k5f0c7d2e-8a4b-4c1e-9d3f-2b6a7e8c9d01:abc"}}`)
+		sealed.Consents = json.RawMessage(`[{"purpose":"export","status":"denied"}]`)
+		archiveRepo.Events = []db.ArchivedEvent{
+			event(1, 0, 31*24*time.Hour),
+			event(2, 0, 29*24*time.Hour),
+			event(3, 0, 40*24*time.Hour),
+			event(4, 0, 50*24*time.Hour),
+			purchase,
+			sealed,
+		}
+		archiveRepo.Unprocessed[4] = true
+	})
+
+	DescribeTable("should archive expired processed events in batches and restore them",
+		func(format archive.Format) {
+			archiver := archive.NewArchiver(archiveRepo, rules, dir, format, 2)
+			stored := slices.Clone(archiveRepo.Events)
+
+			result, err := archiver.Archive(GinkgoT().Context(), now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Events).To(Equal(3))
+			Expect(result.Files).To(Equal([]string{
+				filepath.Join(dir, "events-1-3"+format.Extension()),
+				filepath.Join(dir, "events-6-6"+format.Extension()),
+			}))
+			Expect(archiveRepo.Events).To(Equal([]db.ArchivedEvent{stored[1], stored[3], stored[4]}))
+
+			archived, err := archive.ReadFile(result.Files[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(archived).To(HaveLen(1))
+			Expect(archived[0].Id).To(Equal(6))
+			Expect(*archived[0].ProfileKey).To(Equal("5f0c7d2e-8a4b-4c1e-9d3f-2b6a7e8c9d01"))
+			Expect(archived[0].Traits).To(MatchJSON(stored[5].Traits))
+			Expect(archived[0].Consents).To(MatchJSON(stored[5].Consents))
+
+			// Nothing is left to archive
+			result, err = archiver.Archive(GinkgoT().Context(), now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Events).To(BeZero())
+
+			restored, err := archiver.Restore(GinkgoT().Context(), filepath.Join(dir, "events-1-3"+format.Extension()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal(2))
+			restored, err = archiver.Restore(GinkgoT().Context(), filepath.Join(dir, "events-1-3"+format.Extension()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(BeZero())
+
+			Expect(archiveRepo.Events).To(HaveLen(5))
+			Expect(archiveRepo.Events[0].Id).To(Equal(1))
+			Expect(archiveRepo.Events[0].EventTimestamp).To(Equal(stored[0].EventTimestamp))
+			Expect(archiveRepo.Events[0].Identifiers).To(MatchJSON(stored[0].Identifiers))
+			Expect(archiveRepo.Events[0].Traits).To(BeNil())
+		},
+		Entry("as JSONL.gz", archive.FormatJSONL),
+		Entry("as Parquet", archive.FormatParquet),
+	)
+
+	It("should reject malformed retention rules", func() {
+		Expect(db.RetentionRules{Default: "soon"}.Validate()).NotTo(Succeed())
+		Expect(db.RetentionRules{EventTypes: map[int]string{1: "0d"}}.Validate()).NotTo(Succeed())
+		Expect(db.RetentionRules{Default: "12h", EventTypes: map[int]string{1: db.RetainForever}}.Validate()).To(Succeed())
+	})
+})
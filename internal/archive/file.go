@@ -0,0 +1,229 @@
+// Package archive moves processed events past their retention from the events table to compressed files on local
+// disk, and restores those files for replays.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Format is the encoding of archive files
+type Format string
+
+const (
+	// FormatJSONL writes gzip compressed JSON lines, one event per line
+	FormatJSONL Format = "jsonl.gz"
+	// FormatParquet writes a Parquet file with JSON columns kept as strings
+	FormatParquet Format = "parquet"
+)
+
+// ParseFormat accepts the format names along with "jsonl" for JSONL.gz
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jsonl.gz", "jsonl":
+		return FormatJSONL, nil
+	case "parquet":
+		return FormatParquet, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q, use jsonl.gz or parquet", name)
+}
+
+// Extension is the file name extension of the format, archives are read according to it
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+// formatOf returns the format of an archive file by its extension
+func formatOf(path string) (Format, error) {
+	for _, format := range []Format{FormatJSONL, FormatParquet} {
+		if strings.HasSuffix(path, format.Extension()) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("unknown archive file %s, expected a .jsonl.gz or .parquet file", path)
+}
+
+// parquetEvent is an archived event as a Parquet row, empty JSON columns were NULL
+type parquetEvent struct {
+	Id             int64     `parquet:"id"`
+	EventId        int32     `parquet:"event_id"`
+	EventTimestamp time.Time `parquet:"event_timestamp"`
+	Identifiers    string    `parquet:"identifiers"`
+	Source         string    `parquet:"source"`
+	Traits         string    `parquet:"traits"`
+	Revenue        float64   `parquet:"revenue"`
+	ProfileKey     *string   `parquet:"profile_key,optional"`
+	Consents       string    `parquet:"consents"`
+	Workspace      string    `parquet:"workspace"`
+}
+
+func newParquetEvent(e db.ArchivedEvent) parquetEvent {
+	return parquetEvent{
+		Id:             int64(e.Id),
+		EventId:        int32(e.EventId),
+		EventTimestamp: e.EventTimestamp.UTC(),
+		Identifiers:    string(e.Identifiers),
+		Source:         e.Source,
+		Traits:         string(e.Traits),
+		Revenue:        e.Revenue,
+		ProfileKey:     e.ProfileKey,
+		Consents:       string(e.Consents),
+		Workspace:      e.Workspace,
+	}
+}
+
+func (p parquetEvent) archivedEvent() db.ArchivedEvent {
+	return db.ArchivedEvent{
+		Id:             int(p.Id),
+		EventId:        int(p.EventId),
+		EventTimestamp: p.EventTimestamp.UTC(),
+		Identifiers:    rawJSON(p.Identifiers),
+		Source:         p.Source,
+		Traits:         rawJSON(p.Traits),
+		Revenue:        p.Revenue,
+		ProfileKey:     p.ProfileKey,
+		Consents:       rawJSON(p.Consents),
+		Workspace:      p.Workspace,
+	}
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+// writeFile writes the events to path. The file is written under a temporary name, synced and renamed, so a
+// file with the final name is always complete.
+func writeFile(path string, format Format, events []db.ArchivedEvent) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err := encode(tmp, format, events); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close archive file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename archive file: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func encode(w io.Writer, format Format, events []db.ArchivedEvent) error {
+	switch format {
+	case FormatJSONL:
+		gz := gzip.NewWriter(w)
+		encoder := json.NewEncoder(gz)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return fmt.Errorf("failed to write event %d: %w", event.Id, err)
+			}
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+		return nil
+
+	case FormatParquet:
+		rows := make([]parquetEvent, len(events))
+		for i, event := range events {
+			rows[i] = newParquetEvent(event)
+		}
+		pw := parquet.NewGenericWriter[parquetEvent](w, parquet.Compression(&parquet.Zstd))
+		if _, err := pw.Write(rows); err != nil {
+			return fmt.Errorf("failed to write parquet rows: %w", err)
+		}
+		if err := pw.Close(); err != nil {
+			return fmt.Errorf("failed to write parquet footer: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown archive format %q", format)
+}
+
+// syncDir makes a rename within the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open archive directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive directory: %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads the events of an archive file, the format is told by the file extension
+func ReadFile(path string) ([]db.ArchivedEvent, error) {
+	format, err := formatOf(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	if format == FormatParquet {
+		reader := parquet.NewGenericReader[parquetEvent](f)
+		defer reader.Close()
+		rows := make([]parquetEvent, reader.NumRows())
+		n, err := reader.Read(rows)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to read parquet rows: %w", err)
+		}
+		events := make([]db.ArchivedEvent, n)
+		for i, row := range rows[:n] {
+			events[i] = row.archivedEvent()
+		}
+		return events, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+
+	var events []db.ArchivedEvent
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event db.ArchivedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("failed to decode archived event: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,274 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeIngest allows sending events
+	ScopeIngest Scope = "ingest"
+	// ScopeReadProfiles allows looking up profiles
+	ScopeReadProfiles Scope = "profiles:read"
+	// ScopeAdmin allows exporting and merging profiles
+	ScopeAdmin Scope = "admin"
+	// ScopeErase allows erasing data subjects
+	ScopeErase Scope = "erase"
+)
+
+// AllScopes lists every scope, which API keys configured for a workspace are granted
+func AllScopes() []string {
+	return []string{string(ScopeIngest), string(ScopeReadProfiles), string(ScopeAdmin), string(ScopeErase)}
+}
+
+// ParseScopes validates a comma separated list of scopes
+func ParseScopes(spec string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(spec, ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+		if !slices.Contains(AllScopes(), scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// apiKeyPrefix starts every generated API key, so leaked keys are easy to recognize
+const apiKeyPrefix = "esk_"
+
+// GenerateAPIKey returns a new random API key
+func GenerateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashAPIKey returns the hex SHA-256 of the key, which is all the database stores of it. Keys are random,
+// so a plain hash is enough to make a leaked table useless.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKey authenticates requests as a workspace, allowing the actions of its scopes
+type APIKey struct {
+	Id        int    `db:"id"`
+	Name      string `db:"name"`
+	Workspace string `db:"workspace"`
+	KeyHash   string `db:"key_hash"`
+	// Prefix is the start of the key, shown to tell keys apart
+	Prefix string   `db:"prefix"`
+	Scopes []string `db:"scopes"`
+	// RateLimit is the number of requests allowed per second on average, unlimited when zero
+	RateLimit float64 `db:"rate_limit"`
+	// Burst is the number of requests allowed at once, the rate limit rounded up when zero
+	Burst     int        `db:"burst"`
+	CreatedAt time.Time  `db:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// HasScope reports whether the key grants the scope
+func (k APIKey) HasScope(scope Scope) bool {
+	return slices.Contains(k.Scopes, string(scope))
+}
+
+// Expired reports whether the key expired at the given time
+func (k APIKey) Expired(at time.Time) bool {
+	return k.ExpiresAt != nil && !at.Before(*k.ExpiresAt)
+}
+
+// AuditEntry records an admin action, the actor is the name of the API key or the command it was taken with
+type AuditEntry struct {
+	Id        int64     `db:"id"`
+	APIKeyId  int       `db:"api_key_id"`
+	Actor     string    `db:"actor"`
+	Workspace string    `db:"workspace"`
+	Action    string    `db:"action"`
+	Target    string    `db:"target"`
+	Outcome   string    `db:"outcome"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// APIKeyRepository stores hashed API keys and the audit log of admin actions taken with them
+type APIKeyRepository interface {
+	CreateAPIKey(ctx context.Context, key APIKey) (int, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, bool, error)
+	GetAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int) (bool, error)
+	RecordAudit(ctx context.Context, entry AuditEntry) error
+	GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error)
+}
+
+type PgAPIKeyRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgAPIKeyRepository(pool *pgxpool.Pool) *PgAPIKeyRepository {
+	return &PgAPIKeyRepository{pool: pool}
+}
+
+// CreateAPIKey stores the key, which must be hashed already, in the workspace of the context when scoped
+func (r *PgAPIKeyRepository) CreateAPIKey(ctx context.Context, key APIKey) (int, error) {
+	workspace, err := writeWorkspace(ctx, key.Workspace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create API key: %w", err)
+	}
+
+	query := `
+		INSERT INTO api_keys (name, workspace, key_hash, prefix, scopes, rate_limit, burst, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, now() AT TIME ZONE 'utc', $8)
+		RETURNING id`
+	args := []interface{}{key.Name, workspace, key.KeyHash, key.Prefix, key.Scopes,
+		key.RateLimit, key.Burst, key.ExpiresAt}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var id int
+	if tx != nil {
+		err = tx.QueryRow(ctx, query, args...).Scan(&id)
+	} else {
+		err = r.pool.QueryRow(ctx, query, args...).Scan(&id)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to create API key: %w", err)
+	}
+	return id, nil
+}
+
+// GetAPIKeyByHash returns the key with the hash, including revoked and expired keys
+func (r *PgAPIKeyRepository) GetAPIKeyByHash(ctx context.Context, keyHash string) (APIKey, bool, error) {
+	keys, err := r.queryAPIKeys(ctx, "WHERE key_hash = $1", keyHash)
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	if len(keys) == 0 {
+		return APIKey{}, false, nil
+	}
+	return keys[0], true, nil
+}
+
+// GetAPIKeys returns the keys of the workspace, including revoked and expired keys
+func (r *PgAPIKeyRepository) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return r.queryAPIKeys(ctx, "WHERE "+workspaceFilter("workspace", 1), workspaceArg(ctx))
+}
+
+func (r *PgAPIKeyRepository) queryAPIKeys(ctx context.Context, where string, args ...any) ([]APIKey, error) {
+	query := `
+		SELECT id, name, workspace, key_hash, prefix, scopes, rate_limit, burst, created_at, expires_at, revoked_at
+		FROM api_keys
+		` + where + `
+		ORDER BY id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys, err := pgx.CollectRows(rows, pgx.RowToStructByName[APIKey])
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to collect API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey stops the key from authenticating, false when the workspace has no such key or it was revoked already
+func (r *PgAPIKeyRepository) RevokeAPIKey(ctx context.Context, id int) (bool, error) {
+	query := `
+		UPDATE api_keys
+		SET revoked_at = now() AT TIME ZONE 'utc'
+		WHERE id = $1 AND revoked_at IS NULL AND ` + workspaceFilter("workspace", 2)
+	args := []interface{}{id, workspaceArg(ctx)}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, args...)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke API key: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// RecordAudit appends the entry to the audit log. It is meant to run outside of the transaction taking the action,
+// so failed actions are logged as well.
+func (r *PgAPIKeyRepository) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	workspace, err := writeWorkspace(ctx, entry.Workspace)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+
+	query := `
+		INSERT INTO audit_log (api_key_id, actor, workspace, action, target, outcome, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now() AT TIME ZONE 'utc')`
+	args := []interface{}{entry.APIKeyId, entry.Actor, workspace, entry.Action,
+		entry.Target, entry.Outcome}
+
+	if _, err := r.pool.Exec(ctx, query, args...); err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the most recent entries of the workspace first
+func (r *PgAPIKeyRepository) GetAuditLog(ctx context.Context, limit int) ([]AuditEntry, error) {
+	query := `
+		SELECT id, api_key_id, actor, workspace, action, target, outcome, created_at
+		FROM audit_log
+		WHERE ` + workspaceFilter("workspace", 2) + `
+		ORDER BY id DESC
+		LIMIT $1`
+
+	rows, err := r.pool.Query(ctx, query, limit, workspaceArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[AuditEntry])
+}
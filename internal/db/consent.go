@@ -0,0 +1,197 @@
+package db
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// ConsentStatus is the decision of a consent record
+type ConsentStatus string
+
+const (
+	ConsentGranted ConsentStatus = "granted"
+	ConsentDenied  ConsentStatus = "denied"
+)
+
+// Purposes checked by the features using profiles, consent records may name other purposes as well
+const (
+	// PurposeStitching covers linking identifiers of events into profiles
+	PurposeStitching = "stitching"
+	// PurposeExport covers exporting profiles
+	PurposeExport = "export"
+	// PurposeWebhooks covers sending profile changes to webhook endpoints and relay sinks
+	PurposeWebhooks = "webhooks"
+	// PurposeSegments covers segment memberships
+	PurposeSegments = "segments"
+)
+
+// Consent is a consent decision for a purpose, given for the whole profile or a single identifier.
+// Events carry the decision, profiles keep the latest decision per purpose and identifier along with the event
+// which set it.
+type Consent struct {
+	Purpose string `json:"purpose"`
+	// IdentifierType limits the consent to one identifier, e.g. "phone", empty for the whole profile
+	IdentifierType string        `json:"identifier_type,omitempty"`
+	Status         ConsentStatus `json:"status"`
+	// SourceEventId and UpdatedAt are the event id and timestamp of the event which set the consent
+	SourceEventId int       `json:"source_event_id,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at,omitempty"`
+}
+
+// Validate checks that the consent names a purpose, a known identifier and a known status
+func (c Consent) Validate() error {
+	if c.Purpose == "" {
+		return fmt.Errorf("consent without purpose")
+	}
+	if c.IdentifierType != "" {
+		if _, ok := IdentifierByName(c.IdentifierType, ""); !ok {
+			return fmt.Errorf("unknown identifier %q in %s consent", c.IdentifierType, c.Purpose)
+		}
+	}
+	switch c.Status {
+	case ConsentGranted, ConsentDenied:
+		return nil
+	}
+	return fmt.Errorf("unknown consent status %q", c.Status)
+}
+
+// consentKey is what a consent decides on, a later decision on the same key replaces an earlier one
+type consentKey struct {
+	Purpose        string
+	IdentifierType string
+}
+
+func (c Consent) key() consentKey {
+	return consentKey{Purpose: c.Purpose, IdentifierType: c.IdentifierType}
+}
+
+// Consents are the consent records of a profile or an event, at most one per purpose and identifier
+type Consents []Consent
+
+// Apply returns the consents with the updates applied, a decision replaces the one on the same purpose and
+// identifier unless that one is more recent
+func (c Consents) Apply(updates Consents) Consents {
+	if len(updates) == 0 {
+		return c
+	}
+	result := slices.Clone(c)
+	for _, update := range updates {
+		i := slices.IndexFunc(result, func(existing Consent) bool { return existing.key() == update.key() })
+		switch {
+		case i < 0:
+			result = append(result, update)
+		case !result[i].UpdatedAt.After(update.UpdatedAt):
+			result[i] = update
+		}
+	}
+	result.sort()
+	return result
+}
+
+// MergeConsents combines the consents of merged profiles conservatively: a denial on a purpose and identifier
+// wins over any grant, otherwise the most recent grant is kept
+func MergeConsents(sets ...Consents) Consents {
+	var result Consents
+	for _, set := range sets {
+		for _, consent := range set {
+			i := slices.IndexFunc(result, func(existing Consent) bool { return existing.key() == consent.key() })
+			switch {
+			case i < 0:
+				result = append(result, consent)
+			case result[i].Status == consent.Status && result[i].UpdatedAt.Before(consent.UpdatedAt):
+				result[i] = consent
+			case consent.Status == ConsentDenied && result[i].Status != ConsentDenied:
+				result[i] = consent
+			}
+		}
+	}
+	result.sort()
+	return result
+}
+
+// find returns the consent on the purpose and identifier
+func (c Consents) find(purpose, identifierType string) (Consent, bool) {
+	i := slices.IndexFunc(c, func(consent Consent) bool {
+		return consent.Purpose == purpose && consent.IdentifierType == identifierType
+	})
+	if i < 0 {
+		return Consent{}, false
+	}
+	return c[i], true
+}
+
+func (c Consents) sort() {
+	slices.SortFunc(c, func(a, b Consent) int {
+		return cmp.Or(cmp.Compare(a.Purpose, b.Purpose), cmp.Compare(a.IdentifierType, b.IdentifierType))
+	})
+}
+
+// consentsArg returns the value stored for the consents of an event, NULL when there are none
+func consentsArg(c Consents) any {
+	if len(c) == 0 {
+		return nil
+	}
+	return c
+}
+
+// EventConsents returns the consents carried by the event, stamped with the event id and timestamp
+func EventConsents(event EventRecord) Consents {
+	consents := make(Consents, 0, len(event.Consents))
+	for _, consent := range event.Consents {
+		consent.SourceEventId, consent.UpdatedAt = event.EventId, event.EventTimestamp
+		consents = append(consents, consent)
+	}
+	return consents
+}
+
+// ConsentRules decide what profiles without a consent record on a purpose are allowed to. Purposes listed in
+// OptIn require a grant, others are allowed unless denied.
+type ConsentRules struct {
+	OptIn []string `json:"opt_in"`
+}
+
+// LoadConsentRules reads the rules from a JSON file, e.g. {"opt_in": ["export", "webhooks"]}
+func LoadConsentRules(path string) (ConsentRules, error) {
+	var rules ConsentRules
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("failed to read consent rules: %w", err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("failed to parse consent rules: %w", err)
+	}
+	return rules, nil
+}
+
+// Allows reports whether the consents allow the purpose, for the whole profile when identifierType is empty or
+// for one of its identifiers. A denial of the profile covers all of its identifiers.
+func (r ConsentRules) Allows(consents Consents, purpose, identifierType string) bool {
+	profile, hasProfile := consents.find(purpose, "")
+	if hasProfile && profile.Status == ConsentDenied {
+		return false
+	}
+	if identifierType != "" {
+		if identifier, ok := consents.find(purpose, identifierType); ok {
+			return identifier.Status == ConsentGranted
+		}
+	}
+	if hasProfile {
+		return profile.Status == ConsentGranted
+	}
+	return !slices.Contains(r.OptIn, purpose)
+}
+
+// AllowedIdentifiers returns the identifiers with the ones the consents do not allow for the purpose cleared
+func (r ConsentRules) AllowedIdentifiers(consents Consents, purpose string, identifiers EventIdentifier) EventIdentifier {
+	allowed, _ := MapIdentifiers(identifiers, func(identifierType, value string) (string, error) {
+		if !r.Allows(consents, purpose, identifierType) {
+			return "", nil
+		}
+		return value, nil
+	})
+	return allowed
+}
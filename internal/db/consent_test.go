@@ -0,0 +1,77 @@
+package db_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var _ = Describe("Consents", func() {
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	granted := func(purpose, identifierType string, at time.Time) db.Consent {
+		return db.Consent{Purpose: purpose, IdentifierType: identifierType, Status: db.ConsentGranted, UpdatedAt: at}
+	}
+	denied := func(purpose, identifierType string, at time.Time) db.Consent {
+		return db.Consent{Purpose: purpose, IdentifierType: identifierType, Status: db.ConsentDenied, UpdatedAt: at}
+	}
+
+	It("should stamp the consents of an event with the event", func() {
+		event := db.EventRecord{EventId: 7, EventTimestamp: baseTime, Consents: db.Consents{{Purpose: "export", Status: db.ConsentDenied}}}
+		Expect(db.EventConsents(event)).To(Equal(db.Consents{
+			{Purpose: "export", Status: db.ConsentDenied, SourceEventId: 7, UpdatedAt: baseTime},
+		}))
+	})
+
+	It("should only replace decisions with later ones", func() {
+		current := db.Consents{denied("export", "", baseTime.Add(time.Hour)), granted("segments", "", baseTime)}
+
+		applied := current.Apply(db.Consents{
+			granted("export", "", baseTime),
+			denied("segments", "", baseTime.Add(time.Hour)),
+			granted("segments", "phone", baseTime),
+		})
+
+		Expect(applied).To(Equal(db.Consents{
+			denied("export", "", baseTime.Add(time.Hour)),
+			denied("segments", "", baseTime.Add(time.Hour)),
+			granted("segments", "phone", baseTime),
+		}))
+		Expect(current[1].Status).To(Equal(db.ConsentGranted))
+	})
+
+	It("should keep denials when merging", func() {
+		merged := db.MergeConsents(
+			db.Consents{granted("export", "", baseTime.Add(time.Hour)), granted("webhooks", "", baseTime)},
+			db.Consents{denied("export", "", baseTime), granted("webhooks", "", baseTime.Add(time.Hour))},
+		)
+		Expect(merged).To(Equal(db.Consents{
+			denied("export", "", baseTime),
+			granted("webhooks", "", baseTime.Add(time.Hour)),
+		}))
+	})
+
+	It("should decide by identifier, profile and rules", func() {
+		consents := db.Consents{granted("export", "phone", baseTime), denied("stitching", "cookie", baseTime),
+			denied("webhooks", "", baseTime), granted("webhooks", "phone", baseTime)}
+		optIn := db.ConsentRules{OptIn: []string{"export"}}
+
+		Expect(optIn.Allows(consents, "export", "phone")).To(BeTrue())
+		Expect(optIn.Allows(consents, "export", "cookie")).To(BeFalse())
+		Expect(optIn.Allows(consents, "export", "")).To(BeFalse())
+		Expect(optIn.Allows(consents, "segments", "")).To(BeTrue())
+		// A denial of the profile covers all of its identifiers
+		Expect(optIn.Allows(consents, "webhooks", "phone")).To(BeFalse())
+
+		identifiers := db.EventIdentifier{Cookie: "cookie-1", Phone: "111"}
+		Expect(db.ConsentRules{}.AllowedIdentifiers(consents, "stitching", identifiers)).To(Equal(db.EventIdentifier{Phone: "111"}))
+	})
+
+	It("should reject malformed consents", func() {
+		Expect(granted("export", "", baseTime).Validate()).To(Succeed())
+		Expect(granted("", "", baseTime).Validate()).NotTo(Succeed())
+		Expect(granted("export", "email", baseTime).Validate()).NotTo(Succeed())
+		Expect(db.Consent{Purpose: "export", Status: "maybe"}.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// HashIdentifier returns the hex SHA-256 of the identifier, which tombstones and the DSAR audit log store
+// instead of the value itself
+func HashIdentifier(identifier Identifier) string {
+	sum := sha256.Sum256([]byte(identifier.Type + ":" + identifier.Value))
+	return hex.EncodeToString(sum[:])
+}
+
+// identifierValuesByType groups the values of the identifiers by type, with an entry for every identifier name
+func identifierValuesByType(identifiers []Identifier) map[string][]string {
+	values := make(map[string][]string, 3)
+	for _, name := range (EventIdentifier{}).GetIdentifierNames() {
+		values[name] = []string{}
+	}
+	for _, identifier := range identifiers {
+		if _, ok := values[identifier.Type]; ok {
+			values[identifier.Type] = append(values[identifier.Type], identifier.Value)
+		}
+	}
+	return values
+}
+
+// DSARKind is the type of a data subject request
+type DSARKind string
+
+const (
+	// DSARAccess exports everything known about a person
+	DSARAccess DSARKind = "access"
+	// DSARErasure removes everything known about a person
+	DSARErasure DSARKind = "erasure"
+)
+
+// ErasureMode selects how the data of an erased person is removed
+type ErasureMode string
+
+const (
+	// ErasureDelete deletes the events and profile rows of the person
+	ErasureDelete ErasureMode = "delete"
+	// ErasureAnonymize keeps events, stats and segments for aggregates, but removes identifiers and traits
+	ErasureAnonymize ErasureMode = "anonymize"
+	// ErasureShred destroys the keys sealing the events of the person and deletes their profile rows, events
+	// which are not sealed are anonymized
+	ErasureShred ErasureMode = "shred"
+)
+
+// ParseErasureMode validates an erasure mode given by name
+func ParseErasureMode(name string) (ErasureMode, error) {
+	switch mode := ErasureMode(name); mode {
+	case ErasureDelete, ErasureAnonymize, ErasureShred:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown erasure mode %q", name)
+}
+
+// DSARStatus is the progress of a data subject request
+type DSARStatus string
+
+const (
+	DSARPending   DSARStatus = "pending"
+	DSARCompleted DSARStatus = "completed"
+	DSARFailed    DSARStatus = "failed"
+)
+
+// DSARRequest is the audit record of a data subject request. The identifier naming the person is only
+// stored hashed, so the log does not keep what an erasure removed.
+type DSARRequest struct {
+	Id             int64       `db:"id"`
+	Kind           DSARKind    `db:"kind"`
+	IdentifierType string      `db:"identifier_type"`
+	IdentifierHash string      `db:"identifier_hash"`
+	Mode           ErasureMode `db:"mode"`
+	Status         DSARStatus  `db:"status"`
+	// ProfileIds are the profiles of the person, including those merged away
+	ProfileIds []int `db:"profile_ids"`
+	// Events is the number of events exported or erased
+	Events      int        `db:"events"`
+	Error       string     `db:"error"`
+	RequestedBy string     `db:"requested_by"`
+	RequestedAt time.Time  `db:"requested_at"`
+	CompletedAt *time.Time `db:"completed_at"`
+	// Workspace is the workspace the person was looked up in
+	Workspace string `db:"workspace"`
+}
+
+// DSARRepository keeps the audit log of data subject requests and the tombstones of erased identifiers
+type DSARRepository interface {
+	CreateDSARRequest(ctx context.Context, request DSARRequest) (int64, error)
+	CompleteDSARRequest(ctx context.Context, request DSARRequest) error
+	GetDSARRequests(ctx context.Context, limit int) ([]DSARRequest, error)
+	InsertTombstones(ctx context.Context, requestId int64, identifiers []Identifier) error
+	RemoveErasedIdentifiers(ctx context.Context, identifiers EventIdentifier) (EventIdentifier, error)
+}
+
+type PgDSARRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgDSARRepository(pool *pgxpool.Pool) *PgDSARRepository {
+	return &PgDSARRepository{pool: pool}
+}
+
+// CreateDSARRequest logs a new request as pending. It is meant to run outside of the transaction handling the
+// request, so the request stays logged when handling it fails.
+func (r *PgDSARRepository) CreateDSARRequest(ctx context.Context, request DSARRequest) (int64, error) {
+	workspace, err := writeWorkspace(ctx, request.Workspace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create DSAR request: %w", err)
+	}
+
+	query := `
+		INSERT INTO dsar_requests (kind, identifier_type, identifier_hash, mode, status, requested_by, requested_at, workspace)
+		VALUES ($1, $2, $3, $4, $5, $6, now() AT TIME ZONE 'utc', $7)
+		RETURNING id`
+	args := []interface{}{request.Kind, request.IdentifierType, request.IdentifierHash, request.Mode, DSARPending,
+		request.RequestedBy, workspace}
+
+	var id int64
+	if err := r.pool.QueryRow(ctx, query, args...).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to create DSAR request: %w", err)
+	}
+	return id, nil
+}
+
+// CompleteDSARRequest records the outcome of the request
+func (r *PgDSARRepository) CompleteDSARRequest(ctx context.Context, request DSARRequest) error {
+	query := `
+		UPDATE dsar_requests
+		SET status = $2, profile_ids = $3, events = $4, error = $5, completed_at = now() AT TIME ZONE 'utc'
+		WHERE id = $1`
+	profileIds := request.ProfileIds
+	if profileIds == nil {
+		profileIds = []int{}
+	}
+	args := []interface{}{request.Id, request.Status, profileIds, request.Events, request.Error}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to complete DSAR request: %w", err)
+	}
+	return nil
+}
+
+// GetDSARRequests returns the most recent requests of the workspace first
+func (r *PgDSARRepository) GetDSARRequests(ctx context.Context, limit int) ([]DSARRequest, error) {
+	query := `
+		SELECT id, kind, identifier_type, identifier_hash, mode, status, profile_ids, events, error,
+			requested_by, requested_at, completed_at, workspace
+		FROM dsar_requests
+		WHERE ` + workspaceFilter("workspace", 2) + `
+		ORDER BY id DESC
+		LIMIT $1`
+
+	rows, err := r.pool.Query(ctx, query, limit, workspaceArg(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DSAR requests: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DSARRequest])
+}
+
+// InsertTombstones marks the identifiers as erased by the request within the workspace, stitching ignores them
+// from then on
+func (r *PgDSARRepository) InsertTombstones(ctx context.Context, requestId int64, identifiers []Identifier) error {
+	if len(identifiers) == 0 {
+		return nil
+	}
+
+	workspace, err := writeWorkspace(ctx, DefaultWorkspace)
+	if err != nil {
+		return fmt.Errorf("failed to insert erasure tombstones: %w", err)
+	}
+
+	types := make([]string, len(identifiers))
+	hashes := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		types[i], hashes[i] = identifier.Type, HashIdentifier(identifier)
+	}
+
+	query := `
+		INSERT INTO erasure_tombstones (workspace, identifier_type, value_hash, request_id, erased_at)
+		SELECT $4, identifier_type, value_hash, $3, now() AT TIME ZONE 'utc'
+		FROM unnest($1::text[], $2::text[]) AS t(identifier_type, value_hash)
+		ON CONFLICT (workspace, identifier_type, value_hash) DO NOTHING`
+	args := []interface{}{types, hashes, requestId, workspace}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to insert erasure tombstones: %w", err)
+	}
+	return nil
+}
+
+// RemoveErasedIdentifiers returns the identifiers with the ones erased in the workspace cleared
+func (r *PgDSARRepository) RemoveErasedIdentifiers(ctx context.Context, identifiers EventIdentifier) (EventIdentifier, error) {
+	present := identifiers.Identifiers()
+	if len(present) == 0 {
+		return identifiers, nil
+	}
+
+	types := make([]string, len(present))
+	hashes := make([]string, len(present))
+	for i, identifier := range present {
+		types[i], hashes[i] = identifier.Type, HashIdentifier(identifier)
+	}
+
+	query := `
+		SELECT t.identifier_type
+		FROM erasure_tombstones t
+		JOIN unnest($1::text[], $2::text[]) AS i(identifier_type, value_hash)
+			ON t.identifier_type = i.identifier_type AND t.value_hash = i.value_hash
+		WHERE ` + workspaceFilter("t.workspace", 3)
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, types, hashes, workspaceArg(ctx))
+	} else {
+		rows, err = r.pool.Query(ctx, query, types, hashes, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return EventIdentifier{}, fmt.Errorf("failed to query erasure tombstones: %w", err)
+	}
+	defer rows.Close()
+
+	erased, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return EventIdentifier{}, fmt.Errorf("failed to read erasure tombstones: %w", err)
+	}
+	return identifiers.Without(erased...), nil
+}
@@ -0,0 +1,139 @@
+package db_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var _ = Describe("DSAR Repository", func() {
+	var (
+		tc        *profileTestContext
+		eventRepo *db.PgEventRepository
+		dsarRepo  *db.PgDSARRepository
+	)
+
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		tc = setupProfileTest(ctx)
+		eventRepo = db.NewPgEventRepository(tc.connPool)
+		dsarRepo = db.NewPgDSARRepository(tc.connPool)
+		_, err := tc.connPool.Exec(ctx, "TRUNCATE TABLE events, dsar_requests, erasure_tombstones")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		tc.cleanup()
+	})
+
+	It("should remove tombstoned identifiers without storing their values", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		phone := db.Identifier{Type: "phone", Value: "+15550100"}
+		Expect(dsarRepo.InsertTombstones(ctx, 1, []db.Identifier{phone})).To(Succeed())
+		// Tombstoning twice keeps the first request
+		Expect(dsarRepo.InsertTombstones(ctx, 2, []db.Identifier{phone})).To(Succeed())
+
+		identifiers, err := dsarRepo.RemoveErasedIdentifiers(ctx, db.EventIdentifier{Cookie: "c", Phone: phone.Value})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(identifiers).To(Equal(db.EventIdentifier{Cookie: "c"}))
+
+		var stored int
+		Expect(tc.connPool.QueryRow(ctx, "SELECT count(*) FROM erasure_tombstones WHERE value_hash = $1 AND request_id = 1",
+			db.HashIdentifier(phone)).Scan(&stored)).To(Succeed())
+		Expect(stored).To(Equal(1))
+	})
+
+	It("should log requests and their outcome", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		id, err := dsarRepo.CreateDSARRequest(ctx, db.DSARRequest{Kind: db.DSARErasure, IdentifierType: "phone",
+			IdentifierHash: db.HashIdentifier(db.Identifier{Type: "phone", Value: "1"}), Mode: db.ErasureDelete, RequestedBy: "legal"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(dsarRepo.CompleteDSARRequest(ctx, db.DSARRequest{Id: id, Status: db.DSARCompleted, ProfileIds: []int{4, 7},
+			Events: 12})).To(Succeed())
+
+		requests, err := dsarRepo.GetDSARRequests(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Status).To(Equal(db.DSARCompleted))
+		Expect(requests[0].ProfileIds).To(Equal([]int{4, 7}))
+		Expect(requests[0].Events).To(Equal(12))
+		Expect(requests[0].RequestedBy).To(Equal("legal"))
+		Expect(requests[0].CompletedAt).NotTo(BeNil())
+	})
+
+	It("should find and erase the profiles and events of a person", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		at := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		first := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}, EventTimestamp: at}
+		second := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-b", Phone: "111"}, EventTimestamp: at}
+		other := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-z"}, EventTimestamp: at}
+		for _, event := range []db.EventRecord{first, second, other} {
+			Expect(eventRepo.InsertEvent(ctx, event)).To(Succeed())
+		}
+
+		id, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a", Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tc.repo.RecordObservations(ctx, id, first)).To(Succeed())
+		Expect(tc.repo.RecordObservations(ctx, id, second)).To(Succeed())
+		otherId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-z"})
+		Expect(err).NotTo(HaveOccurred())
+
+		// cookie-b is only observed, not held by the profile
+		ids, err := tc.repo.GetProfileIdsByIdentifier(ctx, db.Identifier{Type: "cookie", Value: "cookie-b"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]int{id}))
+
+		identifiers := []db.Identifier{{Type: "cookie", Value: "cookie-a"}, {Type: "cookie", Value: "cookie-b"}, {Type: "phone", Value: "111"}}
+		var events []db.EventRecord
+		for event, err := range eventRepo.IterEventsByIdentifiers(ctx, identifiers, nil, 1) {
+			Expect(err).NotTo(HaveOccurred())
+			events = append(events, event)
+		}
+		Expect(events).To(HaveLen(2))
+
+		tx, err := tc.connPool.Begin(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		defer tx.Rollback(ctx)
+		txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+		erased, err := eventRepo.EraseEventsByIdentifiers(txCtx, identifiers, nil, db.ErasureDelete)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(erased).To(Equal(2))
+		Expect(tc.repo.EraseProfiles(txCtx, []int{id}, db.ErasureDelete)).To(Succeed())
+		Expect(tx.Commit(ctx)).To(Succeed())
+
+		_, found, err := tc.repo.GetProfileById(ctx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+		_, found, err = tc.repo.GetProfileById(ctx, otherId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		count, err := eventRepo.GetEventsCount(ctx, at, at)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(1))
+	})
+
+	It("should anonymize profiles keeping their rows", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		id, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a", Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tc.repo.EraseProfiles(ctx, []int{id}, db.ErasureAnonymize)).To(MatchError(db.ErrNoTransaction))
+
+		tx, err := tc.connPool.Begin(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		defer tx.Rollback(ctx)
+		Expect(tc.repo.EraseProfiles(context.WithValue(ctx, db.TransactionKey{}, tx), []int{id}, db.ErasureAnonymize)).To(Succeed())
+		Expect(tx.Commit(ctx)).To(Succeed())
+
+		profile, found, err := tc.repo.GetProfileById(ctx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(profile.Cookie).To(BeEmpty())
+		Expect(profile.Phone).To(BeEmpty())
+	})
+})
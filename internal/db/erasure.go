@@ -0,0 +1,212 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// personEventsFilter matches events holding any of the identifier values passed as the arrays $n, $n+1 and $n+2,
+// holding the cookies, message ids and phones
+func personEventsFilter(n int) string {
+	return fmt.Sprintf("(identifiers->>'cookie' = ANY($%d) OR identifiers->>'message_id' = ANY($%d) OR identifiers->>'phone' = ANY($%d))",
+		n, n+1, n+2)
+}
+
+// IterEventsByIdentifiers yields every event holding any of the identifiers or sealed with the key of any of the
+// profiles in insertion order, reading pageSize events per query
+func (r *PgEventRepository) IterEventsByIdentifiers(ctx context.Context, identifiers []Identifier, profileIds []int, pageSize int) iter.Seq2[EventRecord, error] {
+	query := `
+		SELECT
+			id,
+			event_id,
+			event_timestamp,
+			identifiers->>'cookie' as cookie,
+			identifiers->>'message_id' as message_id,
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
+		FROM events
+		WHERE id > $1 AND (` + personEventsFilter(2) + ` OR profile_key IN ` + profileKeysOf(5) + `) AND ` + workspaceFilter("workspace", 7) + `
+		ORDER BY id
+		LIMIT $6`
+	values, err := identifierCandidates(r.protector, identifiers)
+	if err != nil {
+		return func(yield func(EventRecord, error) bool) { yield(EventRecord{}, err) }
+	}
+
+	fetch := func(afterId int, limit int) ([]EventRecord, error) {
+		return r.queryEventPage(ctx, query, afterId, values["cookie"], values["message_id"], values["phone"], profileIds, limit, workspaceArg(ctx))
+	}
+	return paginate(ctx, 0, pageSize, fetch, func(e EventRecord) int { return e.Id })
+}
+
+// EraseEventsByIdentifiers deletes the events holding any of the identifiers or sealed with the key of any of the
+// profiles, or clears their identifiers and traits when anonymizing. Anonymized events are marked as processed,
+// as there is nothing left to stitch. Shredding only anonymizes events which are not sealed, sealed events are
+// erased by destroying the keys of their profiles.
+func (r *PgEventRepository) EraseEventsByIdentifiers(ctx context.Context, identifiers []Identifier, profileIds []int, mode ErasureMode) (int, error) {
+	var query string
+	switch mode {
+	case ErasureDelete:
+		query = "DELETE FROM events WHERE " + workspaceFilter("workspace", 1) + " AND (" + personEventsFilter(2) + " OR profile_key IN " + profileKeysOf(5) + ")"
+	case ErasureAnonymize:
+		query = `
+			UPDATE events SET identifiers = '{}'::jsonb, traits = NULL, processed = true
+			WHERE ` + workspaceFilter("workspace", 1) + ` AND (` + personEventsFilter(2) + ` OR profile_key IN ` + profileKeysOf(5) + `)`
+	case ErasureShred:
+		query = `
+			UPDATE events SET identifiers = '{}'::jsonb, traits = NULL, processed = true
+			WHERE ` + workspaceFilter("workspace", 1) + ` AND profile_key IS NULL AND ` + personEventsFilter(2)
+	default:
+		return 0, fmt.Errorf("unknown erasure mode %q", mode)
+	}
+	values, err := identifierCandidates(r.protector, identifiers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to erase events: %w", err)
+	}
+	args := []interface{}{workspaceArg(ctx), values["cookie"], values["message_id"], values["phone"]}
+	if mode != ErasureShred {
+		args = append(args, profileIds)
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, args...)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to erase events: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DeleteSegmentTransitions deletes the segment history of the profiles
+func (r *PgEventRepository) DeleteSegmentTransitions(ctx context.Context, profileIds []int) error {
+	query := "DELETE FROM segment_transitions WHERE profile_id = ANY($1)"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, profileIds)
+	} else {
+		_, err = r.pool.Exec(ctx, query, profileIds)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete segment transitions: %w", err)
+	}
+	return nil
+}
+
+// GetProfileIdsByIdentifier returns the ids of the profiles holding the identifier, either as their value or
+// as one of their observed values
+func (r *PgProfileRepository) GetProfileIdsByIdentifier(ctx context.Context, identifier Identifier) ([]int, error) {
+	if _, ok := IdentifierByName(identifier.Type, identifier.Value); !ok {
+		return nil, fmt.Errorf("unknown identifier %q", identifier.Type)
+	}
+
+	query := `
+		SELECT id FROM ` + r.qualify("profiles") + ` WHERE ` + identifier.Type + ` = ANY($2) AND ` + workspaceFilter("workspace", 3) + `
+		UNION
+		SELECT pi.profile_id FROM ` + r.qualify("profile_identifiers") + ` pi
+		JOIN ` + r.qualify("profiles") + ` p ON p.id = pi.profile_id
+		WHERE pi.identifier_type = $1 AND pi.value = ANY($2) AND ` + workspaceFilter("p.workspace", 3) + `
+		ORDER BY 1`
+	candidates, err := r.protector.Candidates(identifier.Type, identifier.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to protect %s: %w", identifier.Type, err)
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, identifier.Type, candidates, workspaceArg(ctx))
+	} else {
+		rows, err = r.pool.Query(ctx, query, identifier.Type, candidates, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profiles by %s: %w", identifier.Type, err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+// GetMergedIds returns the ids of the profiles merged into any of the survivors
+func (r *PgProfileRepository) GetMergedIds(ctx context.Context, survivorIds []int) ([]int, error) {
+	query := "SELECT merged_id FROM " + r.qualify("profile_merges") + " WHERE survivor_id = ANY($1) ORDER BY merged_id"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, survivorIds)
+	} else {
+		rows, err = r.pool.Query(ctx, query, survivorIds)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query merged profiles: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+// EraseProfiles removes the profiles, given along with the ids merged into them. Deleting removes every row
+// of the profiles, as does shredding, anonymizing keeps their rows, stats and segments but clears identifiers and traits.
+func (r *PgProfileRepository) EraseProfiles(ctx context.Context, profileIds []int, mode ErasureMode) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to erase profiles: %w", ErrNoTransaction)
+	}
+
+	var queries []string
+	switch mode {
+	case ErasureDelete, ErasureShred:
+		queries = []string{
+			"DELETE FROM " + r.qualify("profiles") + " WHERE id = ANY($1)",
+			"DELETE FROM " + r.qualify("profile_identifiers") + " WHERE profile_id = ANY($1)",
+			"DELETE FROM " + r.qualify("profile_stats") + " WHERE profile_id = ANY($1)",
+			"DELETE FROM " + r.qualify("profile_segments") + " WHERE profile_id = ANY($1)",
+			"DELETE FROM " + r.qualify("profile_consents") + " WHERE profile_id = ANY($1)",
+			"DELETE FROM " + r.qualify("profile_merges") + " WHERE merged_id = ANY($1) OR survivor_id = ANY($1)",
+		}
+	case ErasureAnonymize:
+		queries = []string{
+			`UPDATE ` + r.qualify("profiles") + `
+			SET cookie = '', message_id = '', phone = '', traits = NULL, updated_at = now() AT TIME ZONE 'utc'
+			WHERE id = ANY($1)`,
+			"DELETE FROM " + r.qualify("profile_identifiers") + " WHERE profile_id = ANY($1)",
+		}
+	default:
+		return fmt.Errorf("unknown erasure mode %q", mode)
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(ctx, query, profileIds); err != nil {
+			return fmt.Errorf("failed to erase profiles: %w", err)
+		}
+	}
+	return nil
+}
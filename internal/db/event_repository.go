@@ -3,9 +3,11 @@ package db
 import (
 	"context"
 	"fmt"
+	"iter"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -16,56 +18,184 @@ type EventRepository interface {
 	GetUnProcessedEvents(ctx context.Context, batchSize int) ([]EventRecord, error)
 	MarkEventAsProcessed(ctx context.Context, event EventRecord) error
 	GetEvents(ctx context.Context) ([]EventRecord, error)
-	GetEventsCount(ctx context.Context) (int, error)
+	IterEvents(ctx context.Context, pageSize int) iter.Seq2[EventRecord, error]
+	GetEventsCount(ctx context.Context, start, end time.Time) (int, error)
 	InsertEvent(ctx context.Context, event EventRecord) error
+	InsertProcessedEvent(ctx context.Context, event EventRecord) (int, error)
+	CopyEvents(ctx context.Context, events []EventRecord) (int, error)
+	GetEventsByTimeRange(ctx context.Context, start, end time.Time) ([]EventRecord, error)
+	IterEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[EventRecord, error]
+	MarkEventsAsProcessed(ctx context.Context, events []EventRecord) (int, error)
+	HasEventsOutsideTimeRange(ctx context.Context, start, end time.Time) (bool, error)
+	HasArchivedEvents(ctx context.Context) (bool, error)
+	HasDetachedPartitions(ctx context.Context) (bool, error)
+	IterProcessedEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[EventRecord, error]
+	ResetProcessedEvents(ctx context.Context, events []EventRecord) (int, error)
+	IterEventsByIdentifiers(ctx context.Context, identifiers []Identifier, profileIds []int, pageSize int) iter.Seq2[EventRecord, error]
+	EraseEventsByIdentifiers(ctx context.Context, identifiers []Identifier, profileIds []int, mode ErasureMode) (int, error)
+	SealEvent(ctx context.Context, event EventRecord, identifiers EventIdentifier, profileId int) error
+	InsertSegmentTransitions(ctx context.Context, transitions []SegmentTransition) error
+	GetSegmentTransitions(ctx context.Context, profileId int) ([]SegmentTransition, error)
+	DeleteSegmentTransitions(ctx context.Context, profileIds []int) error
 	BeginTx(ctx context.Context) (pgx.Tx, error)
 }
 
 type PgEventRepository struct {
-	pool *pgxpool.Pool
+	pool      *pgxpool.Pool
+	protector IdentifierProtector
+	sealer    EventSealer
 }
 
 func NewPgEventRepository(pool *pgxpool.Pool) *PgEventRepository {
-	return &PgEventRepository{pool: pool}
+	return &PgEventRepository{pool: pool, protector: PlainIdentifiers{}}
+}
+
+// SetProtector changes how identifiers are stored, events already stored are read regardless of how they were protected
+func (r *PgEventRepository) SetProtector(protector IdentifierProtector) {
+	r.protector = protector
+}
+
+// SetSealer enables sealing stitched events with the key of their profile, events are opened when read
+// regardless of the sealer being set, unless sealed ones were written
+func (r *PgEventRepository) SetSealer(sealer EventSealer) {
+	r.sealer = sealer
+}
+
+// revealEvents opens sealed events and reveals the identifiers of the events in place
+func (r *PgEventRepository) revealEvents(ctx context.Context, events []EventRecord) ([]EventRecord, error) {
+	if r.sealer != nil {
+		if err := r.sealer.Open(ctx, events); err != nil {
+			return nil, fmt.Errorf("failed to open sealed events: %w", err)
+		}
+	}
+	for i := range events {
+		identifiers, err := revealIdentifiers(r.protector, events[i].EventIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reveal identifiers of event %d: %w", events[i].EventId, err)
+		}
+		events[i].EventIdentifier = identifiers
+	}
+	return events, nil
 }
 
 func (r *PgEventRepository) InsertEvent(ctx context.Context, event EventRecord) error {
-	query := "INSERT INTO events (event_id, event_timestamp, identifiers) VALUES ($1, $2, $3)"
+	_, err := r.insertEvent(ctx, event, false)
+	return err
+}
+
+// InsertProcessedEvent inserts an event that is stitched by the caller, so the stitching workers never pick it up.
+// It returns the id of the event.
+func (r *PgEventRepository) InsertProcessedEvent(ctx context.Context, event EventRecord) (int, error) {
+	return r.insertEvent(ctx, event, true)
+}
+
+// CopyEvents bulk loads unprocessed events using COPY
+func (r *PgEventRepository) CopyEvents(ctx context.Context, events []EventRecord) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	columns := []string{"event_id", "event_timestamp", "identifiers", "source", "traits", "revenue", "consents", "workspace"}
+	rows := pgx.CopyFromSlice(len(events), func(i int) ([]any, error) {
+		e := events[i]
+		protected, err := protectIdentifiers(r.protector, e.EventIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("failed to protect identifiers of event %d: %w", e.EventId, err)
+		}
+		identifiers := map[string]interface{}{
+			"cookie":     protected.Cookie,
+			"message_id": protected.MessageId,
+			"phone":      protected.Phone,
+		}
+		workspace, err := writeWorkspace(ctx, e.Workspace)
+		if err != nil {
+			return nil, err
+		}
+		return []any{e.EventId, e.EventTimestamp, identifiers, e.Source, traitsArg(e.Traits), e.Revenue, consentsArg(e.Consents),
+			workspace}, nil
+	})
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var copied int64
+	var err error
+	if tx != nil {
+		copied, err = tx.CopyFrom(ctx, pgx.Identifier{"events"}, columns, rows)
+	} else {
+		copied, err = r.pool.CopyFrom(ctx, pgx.Identifier{"events"}, columns, rows)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy events: %w", err)
+	}
+	return int(copied), nil
+}
+
+func (r *PgEventRepository) insertEvent(ctx context.Context, event EventRecord, processed bool) (int, error) {
+	identifiers, err := protectIdentifiers(r.protector, event.EventIdentifier)
+	if err != nil {
+		return 0, fmt.Errorf("failed to protect event identifiers: %w", err)
+	}
+	workspace, err := writeWorkspace(ctx, event.Workspace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert event: %w", err)
+	}
+
+	query := `
+		INSERT INTO events (event_id, event_timestamp, identifiers, source, traits, revenue, processed, consents, workspace)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`
 	args := []interface{}{
 		event.EventId,
 		event.EventTimestamp,
 		map[string]interface{}{
-			"cookie":     event.Cookie,
-			"message_id": event.MessageId,
-			"phone":      event.Phone,
+			"cookie":     identifiers.Cookie,
+			"message_id": identifiers.MessageId,
+			"phone":      identifiers.Phone,
 		},
+		event.Source,
+		traitsArg(event.Traits),
+		event.Revenue,
+		processed,
+		consentsArg(event.Consents),
+		workspace,
 	}
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
-	var err error
+	var id int
 	if tx != nil {
-		_, err = tx.Exec(ctx, query, args...)
+		err = tx.QueryRow(ctx, query, args...).Scan(&id)
 	} else {
-		_, err = r.pool.Exec(ctx, query, args...)
+		err = r.pool.QueryRow(ctx, query, args...).Scan(&id)
 	}
 
 	if err != nil {
-		return fmt.Errorf("failed to insert event: %w", err)
+		return 0, fmt.Errorf("failed to insert event: %w", err)
 	}
-	return nil
+	return id, nil
 }
 
+// GetEvents loads every event at once, use IterEvents for tables of unbounded size
 func (r *PgEventRepository) GetEvents(ctx context.Context) ([]EventRecord, error) {
 	query := `
 		SELECT 
+			id,
 			event_id,
 			event_timestamp,
 			identifiers->>'cookie' as cookie,
 			identifiers->>'message_id' as message_id,
-			identifiers->>'phone' as phone
-		FROM events`
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
+		FROM events
+		WHERE ` + workspaceFilter("workspace", 1)
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
@@ -73,9 +203,9 @@ func (r *PgEventRepository) GetEvents(ctx context.Context) ([]EventRecord, error
 	var rows pgx.Rows
 	var err error
 	if tx != nil {
-		rows, err = tx.Query(ctx, query)
+		rows, err = tx.Query(ctx, query, workspaceArg(ctx))
 	} else {
-		rows, err = r.pool.Query(ctx, query)
+		rows, err = r.pool.Query(ctx, query, workspaceArg(ctx))
 	}
 
 	if err != nil {
@@ -83,20 +213,140 @@ func (r *PgEventRepository) GetEvents(ctx context.Context) ([]EventRecord, error
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	if err != nil {
+		return nil, err
+	}
+	return r.revealEvents(ctx, events)
+}
+
+// eventCursor is the position of an event in the order of the time range iteration
+type eventCursor struct {
+	Timestamp time.Time
+	Id        int
+}
+
+// IterEvents yields every event in insertion order, reading pageSize events per query
+func (r *PgEventRepository) IterEvents(ctx context.Context, pageSize int) iter.Seq2[EventRecord, error] {
+	query := `
+		SELECT
+			id,
+			event_id,
+			event_timestamp,
+			identifiers->>'cookie' as cookie,
+			identifiers->>'message_id' as message_id,
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
+		FROM events
+		WHERE id > $1 AND ` + workspaceFilter("workspace", 3) + `
+		ORDER BY id
+		LIMIT $2`
+
+	fetch := func(afterId int, limit int) ([]EventRecord, error) {
+		return r.queryEventPage(ctx, query, afterId, limit, workspaceArg(ctx))
+	}
+	return paginate(ctx, 0, pageSize, fetch, func(e EventRecord) int { return e.Id })
+}
+
+// IterEventsByTimeRange yields the events within the time range ordered by timestamp, like GetEventsByTimeRange,
+// reading pageSize events per query
+func (r *PgEventRepository) IterEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[EventRecord, error] {
+	query := `
+		SELECT
+			id,
+			event_id,
+			event_timestamp,
+			identifiers->>'cookie' as cookie,
+			identifiers->>'message_id' as message_id,
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
+		FROM events
+		WHERE event_timestamp BETWEEN $1 AND $2 AND (event_timestamp, id) > ($3, $4) AND ` + workspaceFilter("workspace", 6) + `
+		ORDER BY event_timestamp, id
+		LIMIT $5`
+
+	fetch := func(after eventCursor, limit int) ([]EventRecord, error) {
+		return r.queryEventPage(ctx, query, start, end, after.Timestamp, after.Id, limit, workspaceArg(ctx))
+	}
+	cursor := func(e EventRecord) eventCursor { return eventCursor{Timestamp: e.EventTimestamp, Id: e.Id} }
+	return paginate(ctx, eventCursor{Timestamp: start}, pageSize, fetch, cursor)
+}
+
+// IterProcessedEventsByTimeRange yields the processed events within the time range ordered by timestamp, like
+// IterEventsByTimeRange
+func (r *PgEventRepository) IterProcessedEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[EventRecord, error] {
+	query := `
+		SELECT
+			id,
+			event_id,
+			event_timestamp,
+			identifiers->>'cookie' as cookie,
+			identifiers->>'message_id' as message_id,
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
+		FROM events
+		WHERE processed = true AND event_timestamp BETWEEN $1 AND $2 AND (event_timestamp, id) > ($3, $4) AND ` + workspaceFilter("workspace", 6) + `
+		ORDER BY event_timestamp, id
+		LIMIT $5`
+
+	fetch := func(after eventCursor, limit int) ([]EventRecord, error) {
+		return r.queryEventPage(ctx, query, start, end, after.Timestamp, after.Id, limit, workspaceArg(ctx))
+	}
+	cursor := func(e EventRecord) eventCursor { return eventCursor{Timestamp: e.EventTimestamp, Id: e.Id} }
+	return paginate(ctx, eventCursor{Timestamp: start}, pageSize, fetch, cursor)
+}
+
+func (r *PgEventRepository) queryEventPage(ctx context.Context, query string, args ...any) ([]EventRecord, error) {
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events page: %w", err)
+	}
+	defer rows.Close()
+
+	page, err := pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect events page: %w", err)
+	}
+	return r.revealEvents(ctx, page)
 }
 
-func (r *PgEventRepository) GetEventsCount(ctx context.Context) (int, error) {
-	query := "SELECT COUNT(*) FROM events"
+// GetEventsCount counts the events of the time range, reading only the partitions of the range
+func (r *PgEventRepository) GetEventsCount(ctx context.Context, start, end time.Time) (int, error) {
+	query := "SELECT COUNT(*) FROM events WHERE event_timestamp BETWEEN $1 AND $2 AND " + workspaceFilter("workspace", 3)
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
 	var row pgx.Row
 	if tx != nil {
-		row = tx.QueryRow(ctx, query)
+		row = tx.QueryRow(ctx, query, start, end, workspaceArg(ctx))
 	} else {
-		row = r.pool.QueryRow(ctx, query)
+		row = r.pool.QueryRow(ctx, query, start, end, workspaceArg(ctx))
 	}
 
 	var count int
@@ -110,13 +360,20 @@ func (r *PgEventRepository) GetEventsCount(ctx context.Context) (int, error) {
 func (r *PgEventRepository) GetUnProcessedEvents(ctx context.Context, batchSize int) ([]EventRecord, error) {
 	query := `
 		SELECT 
+			id,
 			event_id,
 			event_timestamp,
 			identifiers->>'cookie' as cookie,
 			identifiers->>'message_id' as message_id,
-			identifiers->>'phone' as phone
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
 		FROM events 
-		WHERE processed = false 
+		WHERE processed = false AND ` + workspaceFilter("workspace", 2) + `
 		ORDER BY event_timestamp ASC 
 		LIMIT $1 
 		FOR UPDATE SKIP LOCKED`
@@ -127,9 +384,9 @@ func (r *PgEventRepository) GetUnProcessedEvents(ctx context.Context, batchSize
 	var rows pgx.Rows
 	var err error
 	if tx != nil {
-		rows, err = tx.Query(ctx, query, batchSize)
+		rows, err = tx.Query(ctx, query, batchSize, workspaceArg(ctx))
 	} else {
-		rows, err = r.pool.Query(ctx, query, batchSize)
+		rows, err = r.pool.Query(ctx, query, batchSize, workspaceArg(ctx))
 	}
 
 	if err != nil {
@@ -137,45 +394,214 @@ func (r *PgEventRepository) GetUnProcessedEvents(ctx context.Context, batchSize
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	if err != nil {
+		return nil, err
+	}
+	return r.revealEvents(ctx, events)
 }
 
+// MarkEventAsProcessed flags the stored event as processed, matching it by its primary key as events of a type
+// often share their timestamp. It fails when the event is not stored.
 func (r *PgEventRepository) MarkEventAsProcessed(ctx context.Context, event EventRecord) error {
-	query := "UPDATE events SET processed = true WHERE event_id = $1 AND event_timestamp = $2"
+	query := "UPDATE events SET processed = true WHERE id = $1 AND event_timestamp = $2 AND " + workspaceFilter("workspace", 3)
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
+	var tag pgconn.CommandTag
 	var err error
 	if tx != nil {
-		_, err = tx.Exec(ctx, query, event.EventId, event.EventTimestamp)
+		tag, err = tx.Exec(ctx, query, event.Id, event.EventTimestamp, workspaceArg(ctx))
 	} else {
-		_, err = r.pool.Exec(ctx, query, event.EventId, event.EventTimestamp)
+		tag, err = r.pool.Exec(ctx, query, event.Id, event.EventTimestamp, workspaceArg(ctx))
 	}
 
 	if err != nil {
 		return fmt.Errorf("failed to mark event as processed: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to mark event as processed: no event with id %d at %s", event.Id, event.EventTimestamp)
+	}
 	return nil
 }
 
+// GetEventsByTimeRange loads the events within the time range at once, use IterEventsByTimeRange for large ranges
 func (r *PgEventRepository) GetEventsByTimeRange(ctx context.Context, start, end time.Time) ([]EventRecord, error) {
-	rows, err := r.pool.Query(ctx, `
+	query := `
 		SELECT 
+			id,
 			event_id,
 			event_timestamp,
 			identifiers->>'cookie' as cookie,
 			identifiers->>'message_id' as message_id,
-			identifiers->>'phone' as phone
+			identifiers->>'phone' as phone,
+			COALESCE(source, '') as source,
+			traits,
+			COALESCE(revenue, 0)::float8 as revenue,
+			consents,
+			COALESCE(profile_key::text, '') as profile_key,
+			workspace
 		FROM events 
-		WHERE event_timestamp BETWEEN $1 AND $2
-		ORDER BY event_timestamp ASC`, start, end)
+		WHERE event_timestamp BETWEEN $1 AND $2 AND ` + workspaceFilter("workspace", 3) + `
+		ORDER BY event_timestamp ASC`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, start, end, workspaceArg(ctx))
+	} else {
+		rows, err = r.pool.Query(ctx, query, start, end, workspaceArg(ctx))
+	}
+
 	if err != nil {
 		return nil, fmt.Errorf("failed to query events by time range: %w", err)
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[EventRecord])
+	if err != nil {
+		return nil, err
+	}
+	return r.revealEvents(ctx, events)
+}
+
+// MarkEventsAsProcessed flags the stored events as processed by their primary key, leaving alone events stored
+// since they were read
+func (r *PgEventRepository) MarkEventsAsProcessed(ctx context.Context, events []EventRecord) (int, error) {
+	query := `
+		UPDATE events e SET processed = true
+		FROM unnest($1::int[], $2::timestamp[]) AS t(id, event_timestamp)
+		WHERE e.id = t.id AND e.event_timestamp = t.event_timestamp AND e.processed = false AND ` + workspaceFilter("e.workspace", 3)
+	ids := make([]int, len(events))
+	timestamps := make([]time.Time, len(events))
+	for i, event := range events {
+		ids[i] = event.Id
+		timestamps[i] = event.EventTimestamp
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, ids, timestamps, workspaceArg(ctx))
+	} else {
+		tag, err = r.pool.Exec(ctx, query, ids, timestamps, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark events as processed: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// HasEventsOutsideTimeRange reports whether any event is stored before the start or after the end of the time range
+func (r *PgEventRepository) HasEventsOutsideTimeRange(ctx context.Context, start, end time.Time) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM events WHERE (event_timestamp < $1 OR event_timestamp > $2) AND " + workspaceFilter("workspace", 3) + ")"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, start, end, workspaceArg(ctx))
+	} else {
+		row = r.pool.QueryRow(ctx, query, start, end, workspaceArg(ctx))
+	}
+
+	var outside bool
+	if err := row.Scan(&outside); err != nil {
+		return false, fmt.Errorf("failed to check events outside time range: %w", err)
+	}
+	return outside, nil
+}
+
+// ResetProcessedEvents flags the stored events as unprocessed, so they get stitched again
+func (r *PgEventRepository) ResetProcessedEvents(ctx context.Context, events []EventRecord) (int, error) {
+	query := `
+		UPDATE events e SET processed = false
+		FROM unnest($1::int[], $2::timestamp[]) AS t(id, event_timestamp)
+		WHERE e.id = t.id AND e.event_timestamp = t.event_timestamp AND e.processed = true AND ` + workspaceFilter("e.workspace", 3)
+	ids := make([]int, len(events))
+	timestamps := make([]time.Time, len(events))
+	for i, event := range events {
+		ids[i] = event.Id
+		timestamps[i] = event.EventTimestamp
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, ids, timestamps, workspaceArg(ctx))
+	} else {
+		tag, err = r.pool.Exec(ctx, query, ids, timestamps, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to reset processed events: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// SealEvent seals the identifiers and traits of a stitched event with the key of its profile, given the
+// identifiers it was stitched with. Events sealed before are kept sealed with the key of the profile they were
+// first stitched to. It is a no-op without a sealer, and fails when the event is not stored.
+func (r *PgEventRepository) SealEvent(ctx context.Context, event EventRecord, identifiers EventIdentifier, profileId int) error {
+	if r.sealer == nil {
+		return nil
+	}
+
+	event.EventIdentifier = identifiers
+	sealed, err := r.sealer.Seal(ctx, profileId, event)
+	if err != nil {
+		return fmt.Errorf("failed to seal event %d: %w", event.EventId, err)
+	}
+
+	// Events are matched by their primary key, an event sealed before matches without being changed
+	query := `
+		UPDATE events SET
+			identifiers = CASE WHEN profile_key IS NULL THEN $3 ELSE identifiers END,
+			traits = CASE WHEN profile_key IS NULL THEN $4 ELSE traits END,
+			profile_key = COALESCE(profile_key, $5::text::uuid)
+		WHERE id = $1 AND event_timestamp = $2 AND ` + workspaceFilter("workspace", 6)
+	args := []interface{}{
+		event.Id,
+		event.EventTimestamp,
+		map[string]interface{}{
+			"cookie":     sealed.Cookie,
+			"message_id": sealed.MessageId,
+			"phone":      sealed.Phone,
+		},
+		traitsArg(sealed.Traits),
+		sealed.ProfileKeyId,
+		workspaceArg(ctx),
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, args...)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to seal event: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("failed to seal event %d: no event with id %d at %s", event.EventId, event.Id, event.EventTimestamp)
+	}
+	return nil
 }
 
 func (r *PgEventRepository) BeginTx(ctx context.Context) (pgx.Tx, error) {
@@ -2,6 +2,7 @@ package db_test
 
 import (
 	"context"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	. "github.com/onsi/ginkgo/v2"
@@ -18,7 +19,7 @@ type eventTestContext struct {
 	cancelIngest  context.CancelFunc
 }
 
-func setupEventTest(ctx SpecContext, numWorkers int) *eventTestContext {
+func setupEventTest(ctx context.Context, numWorkers int) *eventTestContext {
 	var err error
 	tc := &eventTestContext{}
 
@@ -48,14 +49,14 @@ func (tc *eventTestContext) cleanup() {
 	}
 }
 
-func (tc *eventTestContext) testSingleEvent(ctx SpecContext) {
+func (tc *eventTestContext) testSingleEvent(ctx context.Context) {
 	generatedEvent := db.GenerateRandomEvent()
 
-	tc.ingestService.Queue <- generatedEvent
+	Expect(tc.ingestService.Enqueue(ctx, generatedEvent)).To(Succeed())
 
 	// Wait for the record count to be 1
 	Eventually(func() (int, error) {
-		return tc.repo.GetEventsCount(ctx)
+		return tc.repo.GetEventsCount(ctx, time.Now().UTC().Add(-time.Hour), time.Now().UTC().Add(time.Hour))
 	}).WithContext(ctx).Should(Equal(1), "Expected exactly one event to be inserted")
 
 	// Wait for and verify the record contents
@@ -67,32 +68,39 @@ func (tc *eventTestContext) testSingleEvent(ctx SpecContext) {
 		if len(events) != 1 {
 			return db.EventRecord{}, nil
 		}
+		// Ids are assigned by the database
+		events[0].Id = 0
 		return events[0], nil
 	}).WithContext(ctx).Should(Equal(generatedEvent), "Expected event details to match")
 }
 
-func (tc *eventTestContext) testMultipleEvents(ctx SpecContext) {
+func (tc *eventTestContext) testMultipleEvents(ctx context.Context) {
 	numOfEvents := 10
 	insertedEvents := make([]db.EventRecord, numOfEvents)
 
 	for i := 0; i < numOfEvents; i++ {
 		insertedEvents[i] = db.GenerateRandomEvent()
-		tc.ingestService.Queue <- insertedEvents[i]
+		Expect(tc.ingestService.Enqueue(ctx, insertedEvents[i])).To(Succeed())
 	}
 
 	Eventually(func() (int, error) {
-		return tc.repo.GetEventsCount(ctx)
+		return tc.repo.GetEventsCount(ctx, time.Now().UTC().Add(-time.Hour), time.Now().UTC().Add(time.Hour))
 	}).WithContext(ctx).Should(Equal(numOfEvents), "Expected all events to be inserted")
 
 	Eventually(func() ([]db.EventRecord, error) {
-		return tc.repo.GetEvents(ctx)
+		events, err := tc.repo.GetEvents(ctx)
+		for i := range events {
+			events[i].Id = 0
+		}
+		return events, err
 	}).WithContext(ctx).Should(ConsistOf(insertedEvents), "Expected all events to match")
 }
 
 var _ = Describe("Event Record Insertion - 2 workers", func() {
 	var tc *eventTestContext
 
-	BeforeEach(func(ctx SpecContext) {
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc = setupEventTest(ctx, 2)
 	})
 
@@ -100,11 +108,13 @@ var _ = Describe("Event Record Insertion - 2 workers", func() {
 		tc.cleanup()
 	})
 
-	It("should successfully insert single event record", func(ctx SpecContext) {
+	It("should successfully insert single event record", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc.testSingleEvent(ctx)
 	})
 
-	It("should successfully insert 10 event records", func(ctx SpecContext) {
+	It("should successfully insert 10 event records", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc.testMultipleEvents(ctx)
 	})
 })
@@ -112,7 +122,8 @@ var _ = Describe("Event Record Insertion - 2 workers", func() {
 var _ = Describe("Event Record Insertion - 1 worker", func() {
 	var tc *eventTestContext
 
-	BeforeEach(func(ctx SpecContext) {
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc = setupEventTest(ctx, 1)
 	})
 
@@ -120,11 +131,50 @@ var _ = Describe("Event Record Insertion - 1 worker", func() {
 		tc.cleanup()
 	})
 
-	It("should successfully insert single event record", func(ctx SpecContext) {
+	It("should successfully insert single event record", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc.testSingleEvent(ctx)
 	})
 
-	It("should successfully insert 10 event records", func(ctx SpecContext) {
+	It("should successfully insert 10 event records", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc.testMultipleEvents(ctx)
 	})
 })
+
+var _ = Describe("Event Processing State", func() {
+	var tc *eventTestContext
+
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		tc = setupEventTest(ctx, 1)
+	})
+
+	AfterEach(func() {
+		tc.cleanup()
+	})
+
+	It("should mark only the event with the primary key as processed", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		timestamp := time.Now().UTC().Truncate(time.Microsecond)
+		for _, cookie := range []string{"cookie-1", "cookie-2"} {
+			Expect(tc.repo.InsertEvent(ctx, db.EventRecord{
+				EventIdentifier: db.EventIdentifier{Cookie: cookie},
+				EventId:         db.EventIdPurchase,
+				EventTimestamp:  timestamp,
+			})).To(Succeed())
+		}
+		events, err := tc.repo.GetUnProcessedEvents(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+
+		Expect(tc.repo.MarkEventAsProcessed(ctx, events[0])).To(Succeed())
+		unprocessed, err := tc.repo.GetUnProcessedEvents(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unprocessed).To(ConsistOf(HaveField("Id", events[1].Id)))
+
+		missing := events[0]
+		missing.Id = events[1].Id + 1
+		Expect(tc.repo.MarkEventAsProcessed(ctx, missing)).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ImportCheckpoint is the progress of a bulk import, Line is the last input line whose outcome was committed
+type ImportCheckpoint struct {
+	Name      string    `db:"name"`
+	Line      int64     `db:"line"`
+	Loaded    int64     `db:"loaded"`
+	Rejected  int64     `db:"rejected"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type ImportRepository interface {
+	GetImportCheckpoint(ctx context.Context, name string) (ImportCheckpoint, bool, error)
+	SaveImportCheckpoint(ctx context.Context, checkpoint ImportCheckpoint) error
+	DeleteImportCheckpoint(ctx context.Context, name string) error
+}
+
+type PgImportRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgImportRepository(pool *pgxpool.Pool) *PgImportRepository {
+	return &PgImportRepository{pool: pool}
+}
+
+func (r *PgImportRepository) GetImportCheckpoint(ctx context.Context, name string) (ImportCheckpoint, bool, error) {
+	query := "SELECT name, line, loaded, rejected, updated_at FROM import_checkpoints WHERE name = $1"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, name)
+	} else {
+		rows, err = r.pool.Query(ctx, query, name)
+	}
+
+	if err != nil {
+		return ImportCheckpoint{}, false, fmt.Errorf("failed to query import checkpoint: %w", err)
+	}
+	defer rows.Close()
+
+	checkpoint, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[ImportCheckpoint])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ImportCheckpoint{}, false, nil
+	}
+	if err != nil {
+		return ImportCheckpoint{}, false, fmt.Errorf("failed to collect import checkpoint: %w", err)
+	}
+	return checkpoint, true, nil
+}
+
+// SaveImportCheckpoint stores the progress of an import, it is meant to run in the transaction loading the events
+func (r *PgImportRepository) SaveImportCheckpoint(ctx context.Context, checkpoint ImportCheckpoint) error {
+	query := `
+		INSERT INTO import_checkpoints (name, line, loaded, rejected, updated_at)
+		VALUES ($1, $2, $3, $4, now() AT TIME ZONE 'utc')
+		ON CONFLICT (name) DO UPDATE SET
+			line = EXCLUDED.line,
+			loaded = EXCLUDED.loaded,
+			rejected = EXCLUDED.rejected,
+			updated_at = EXCLUDED.updated_at`
+	args := []interface{}{checkpoint.Name, checkpoint.Line, checkpoint.Loaded, checkpoint.Rejected}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to save import checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (r *PgImportRepository) DeleteImportCheckpoint(ctx context.Context, name string) error {
+	query := "DELETE FROM import_checkpoints WHERE name = $1"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, name)
+	} else {
+		_, err = r.pool.Exec(ctx, query, name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete import checkpoint: %w", err)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"slices"
 	"time"
 
 	"github.com/google/uuid"
@@ -44,12 +45,78 @@ func (e EventIdentifier) GetIdentifierValueByName(name string) (value string, fo
 	return "", false
 }
 
+// IdentifierByName returns identifiers holding only the named one, e.g. "phone"
+func IdentifierByName(name string, value string) (EventIdentifier, bool) {
+	var e EventIdentifier
+	t := reflect.TypeOf(e)
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("db") == name {
+			reflect.ValueOf(&e).Elem().Field(i).SetString(value)
+			return e, true
+		}
+	}
+	return EventIdentifier{}, false
+}
+
+// Identifier is a single identifier value, e.g. the phone +15550100
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Identifiers lists the non-empty identifiers
+func (e EventIdentifier) Identifiers() []Identifier {
+	identifiers := make([]Identifier, 0, 3)
+	for _, name := range e.GetIdentifierNames() {
+		if value, _ := e.GetIdentifierValueByName(name); value != "" {
+			identifiers = append(identifiers, Identifier{Type: name, Value: value})
+		}
+	}
+	return identifiers
+}
+
+// Without returns the identifiers with the named ones cleared
+func (e EventIdentifier) Without(names ...string) EventIdentifier {
+	v := reflect.ValueOf(&e).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if slices.Contains(names, t.Field(i).Tag.Get("db")) {
+			v.Field(i).SetString("")
+		}
+	}
+	return e
+}
+
 type EventRecord struct {
 	EventIdentifier
+	// Id is assigned when the event is stored, along with the timestamp it is the primary key of the event
+	Id             int       `db:"id"`
 	EventId        int       `db:"event_id"`
 	EventTimestamp time.Time `db:"event_timestamp"`
+	// Source names the system which produced the event, e.g. "web" or "crm"
+	Source string `db:"source"`
+	// Traits are profile attributes carried by the event, typically an identify event
+	Traits Traits `db:"traits"`
+	// Revenue is the value of a purchase event
+	Revenue float64 `db:"revenue"`
+	// Consents are consent decisions carried by the event, which stitching records on its profile
+	Consents Consents `db:"consents"`
+	// Workspace isolates the event, it is only stitched with profiles of the same workspace
+	Workspace string `db:"workspace"`
+	// ProfileKeyId is the profile key the stored event is sealed with, empty when it is not sealed
+	ProfileKeyId string `db:"profile_key"`
 }
 
+// Generated events use ids below 100, so well-known ids start there
+const (
+	// EventIdIdentify marks events whose purpose is to set profile traits
+	EventIdIdentify = 100
+	// EventIdPurchase marks purchases, which are counted in profile stats along with their revenue
+	EventIdPurchase = 101
+)
+
+var eventSources = []string{"web", "app", "crm"}
+
 func GenerateRandomEvent() EventRecord {
 	return EventRecord{
 		EventIdentifier: EventIdentifier{
@@ -59,12 +126,92 @@ func GenerateRandomEvent() EventRecord {
 		},
 		EventId:        rand.Intn(100),
 		EventTimestamp: time.Now().UTC().Add(time.Duration(rand.Intn(1000)) * time.Millisecond),
+		Source:         eventSources[rand.Intn(len(eventSources))],
 	}
 }
 
 type Profile struct {
-	Id        int    `db:"id"`
-	Cookie    string `db:"cookie"`
-	MessageId string `db:"message_id"`
-	Phone     string `db:"phone"`
+	Id        int    `db:"id" json:"id"`
+	Cookie    string `db:"cookie" json:"cookie,omitempty"`
+	MessageId string `db:"message_id" json:"message_id,omitempty"`
+	Phone     string `db:"phone" json:"phone,omitempty"`
+	Traits    Traits `db:"traits" json:"traits,omitempty"`
+	Workspace string `db:"workspace" json:"workspace,omitempty"`
+}
+
+// ProfileStats are aggregates over all events stitched to a profile
+type ProfileStats struct {
+	ProfileId     int       `db:"profile_id"`
+	FirstSeen     time.Time `db:"first_seen"`
+	LastSeen      time.Time `db:"last_seen"`
+	TotalEvents   int       `db:"total_events"`
+	PurchaseCount int       `db:"purchase_count"`
+	Revenue       float64   `db:"revenue"`
+	LastPurchase  time.Time `db:"last_purchase"`
+}
+
+// Add accounts for one more event in the stats
+func (s ProfileStats) Add(event EventRecord) ProfileStats {
+	added := ProfileStats{
+		FirstSeen:     event.EventTimestamp,
+		LastSeen:      event.EventTimestamp,
+		TotalEvents:   1,
+		PurchaseCount: event.purchases(),
+		Revenue:       event.revenue(),
+	}
+	if added.PurchaseCount > 0 {
+		added.LastPurchase = event.EventTimestamp
+	}
+	return s.Combine(added)
+}
+
+// Combine returns stats covering the events of both, keeping the profile id of s
+func (s ProfileStats) Combine(other ProfileStats) ProfileStats {
+	if s.TotalEvents == 0 {
+		other.ProfileId = s.ProfileId
+		return other
+	}
+	if other.TotalEvents == 0 {
+		return s
+	}
+	if other.FirstSeen.Before(s.FirstSeen) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(s.LastSeen) {
+		s.LastSeen = other.LastSeen
+	}
+	if other.LastPurchase.After(s.LastPurchase) {
+		s.LastPurchase = other.LastPurchase
+	}
+	s.TotalEvents += other.TotalEvents
+	s.PurchaseCount += other.PurchaseCount
+	s.Revenue += other.Revenue
+	return s
+}
+
+func (e EventRecord) purchases() int {
+	if e.EventId == EventIdPurchase {
+		return 1
+	}
+	return 0
+}
+
+func (e EventRecord) revenue() float64 {
+	if e.EventId == EventIdPurchase {
+		return e.Revenue
+	}
+	return 0
+}
+
+// ProfileSnapshot is a profile along with its stats, as loaded in bulk by ReplaceAllProfiles
+type ProfileSnapshot struct {
+	Profile  Profile
+	Stats    ProfileStats
+	Consents Consents
+	// Observations are the sightings of the identifier values of the profile, ordered by identifier type and value
+	Observations []IdentifierObservation
+	// Segments are the segments the profile is a member of
+	Segments []string
+	// KeyIds are the profile keys sealing events of the profile, which are handed over to it
+	KeyIds []string
 }
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// OutboxKind is the type of change described by an outbox event
+type OutboxKind string
+
+const (
+	KindProfileCreated OutboxKind = "profile.created"
+	KindProfileUpdated OutboxKind = "profile.updated"
+	KindProfileMerged  OutboxKind = "profile.merged"
+	KindProfileDeleted OutboxKind = "profile.deleted"
+	KindProfileErased  OutboxKind = "profile.erased"
+	KindSegmentEntered OutboxKind = "segment.entered"
+	KindSegmentExited  OutboxKind = "segment.exited"
+)
+
+// OutboxEvent is a profile change recorded in the same transaction as the change itself.
+// TxId is the id of the writing transaction, events are consumed in (TxId, Id) order.
+type OutboxEvent struct {
+	Id        int64           `db:"id" json:"id"`
+	TxId      int64           `db:"tx_id" json:"-"`
+	Kind      OutboxKind      `db:"kind" json:"kind"`
+	ProfileId int             `db:"profile_id" json:"profile_id"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	CreatedAt time.Time       `db:"created_at" json:"created_at"`
+	// Workspace is the workspace of the profile, events are only delivered to consumers of the workspace
+	Workspace string `db:"workspace" json:"workspace,omitempty"`
+}
+
+// OutboxCursor is the position of a consumer in the outbox, the zero value starts from the beginning
+type OutboxCursor struct {
+	TxId int64 `db:"last_tx_id"`
+	Id   int64 `db:"last_id"`
+}
+
+// Cursor returns the position right after the event
+func (e OutboxEvent) Cursor() OutboxCursor {
+	return OutboxCursor{TxId: e.TxId, Id: e.Id}
+}
+
+type OutboxRepository interface {
+	AppendOutbox(ctx context.Context, events []OutboxEvent) error
+	GetOutboxAfter(ctx context.Context, cursor OutboxCursor, limit int) ([]OutboxEvent, error)
+	GetOutboxRange(ctx context.Context, fromId, toId int64) ([]OutboxEvent, error)
+	GetOutboxCursor(ctx context.Context, consumer string) (OutboxCursor, error)
+	SaveOutboxCursor(ctx context.Context, consumer string, cursor OutboxCursor) error
+	DeleteOutboxByProfiles(ctx context.Context, profileIds []int, identifiers []Identifier) (int, error)
+}
+
+type PgOutboxRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgOutboxRepository(pool *pgxpool.Pool) *PgOutboxRepository {
+	return &PgOutboxRepository{pool: pool}
+}
+
+// AppendOutbox records the events, it is meant to run in the transaction making the described changes
+func (r *PgOutboxRepository) AppendOutbox(ctx context.Context, events []OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	kinds := make([]string, len(events))
+	profileIds := make([]int, len(events))
+	payloads := make([]string, len(events))
+	workspaces := make([]string, len(events))
+	for i, e := range events {
+		workspace, err := writeWorkspace(ctx, e.Workspace)
+		if err != nil {
+			return fmt.Errorf("failed to append outbox events: %w", err)
+		}
+		kinds[i], profileIds[i], payloads[i], workspaces[i] = string(e.Kind), e.ProfileId, string(e.Payload), workspace
+	}
+
+	query := `
+		INSERT INTO outbox (kind, profile_id, payload, workspace)
+		SELECT kind, profile_id, payload::jsonb, workspace
+		FROM unnest($1::text[], $2::int[], $3::text[], $4::text[]) AS e(kind, profile_id, payload, workspace)`
+	args := []interface{}{kinds, profileIds, payloads, workspaces}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to append outbox events: %w", err)
+	}
+	return nil
+}
+
+// GetOutboxAfter returns up to limit events following the cursor. Only events of transactions older than every
+// running transaction are returned, so events committed later can never sort before the returned ones.
+func (r *PgOutboxRepository) GetOutboxAfter(ctx context.Context, cursor OutboxCursor, limit int) ([]OutboxEvent, error) {
+	query := `
+		SELECT id, tx_id::text::bigint AS tx_id, kind, profile_id, payload, created_at, workspace
+		FROM outbox
+		WHERE (tx_id, id) > ($1::text::xid8, $2)
+			AND tx_id < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY tx_id, id
+		LIMIT $3`
+	args := []interface{}{fmt.Sprint(cursor.TxId), cursor.Id, limit}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[OutboxEvent])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect outbox events: %w", err)
+	}
+	return events, nil
+}
+
+// GetOutboxRange returns the committed events with ids between fromId and toId inclusive, ordered by id
+func (r *PgOutboxRepository) GetOutboxRange(ctx context.Context, fromId, toId int64) ([]OutboxEvent, error) {
+	query := `
+		SELECT id, tx_id::text::bigint AS tx_id, kind, profile_id, payload, created_at, workspace
+		FROM outbox
+		WHERE id BETWEEN $1 AND $2
+		ORDER BY id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, fromId, toId)
+	} else {
+		rows, err = r.pool.Query(ctx, query, fromId, toId)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[OutboxEvent])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect outbox events: %w", err)
+	}
+	return events, nil
+}
+
+func (r *PgOutboxRepository) GetOutboxCursor(ctx context.Context, consumer string) (OutboxCursor, error) {
+	query := "SELECT last_tx_id, last_id FROM outbox_cursors WHERE consumer = $1"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, consumer)
+	} else {
+		row = r.pool.QueryRow(ctx, query, consumer)
+	}
+
+	var cursor OutboxCursor
+	if err := row.Scan(&cursor.TxId, &cursor.Id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return OutboxCursor{}, nil
+		}
+		return OutboxCursor{}, fmt.Errorf("failed to query outbox cursor: %w", err)
+	}
+	return cursor, nil
+}
+
+func (r *PgOutboxRepository) SaveOutboxCursor(ctx context.Context, consumer string, cursor OutboxCursor) error {
+	query := `
+		INSERT INTO outbox_cursors (consumer, last_tx_id, last_id, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (consumer) DO UPDATE SET
+			last_tx_id = EXCLUDED.last_tx_id,
+			last_id = EXCLUDED.last_id,
+			updated_at = EXCLUDED.updated_at`
+	args := []interface{}{consumer, cursor.TxId, cursor.Id}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to save outbox cursor: %w", err)
+	}
+	return nil
+}
+
+// DeleteOutboxByProfiles deletes the events of the profiles, whose payloads may hold data of an erased person,
+// along with the events of the workspace whose profile payload carries any of the identifiers, as profile ids are
+// reassigned by rebuilds. Consumers which did not read them yet never see them.
+func (r *PgOutboxRepository) DeleteOutboxByProfiles(ctx context.Context, profileIds []int, identifiers []Identifier) (int, error) {
+	query := `
+		DELETE FROM outbox
+		WHERE profile_id = ANY($1)
+			OR (` + workspaceFilter("workspace", 4) + ` AND EXISTS (
+				SELECT 1 FROM unnest($2::text[], $3::text[]) AS i(type, value)
+				WHERE payload->'profile'->>i.type = i.value
+			))`
+	types := make([]string, len(identifiers))
+	values := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		types[i], values[i] = identifier.Type, identifier.Value
+	}
+	args := []interface{}{profileIds, types, values, workspaceArg(ctx)}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, args...)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete outbox events: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"iter"
+)
+
+// DefaultPageSize is the number of rows read per query when iterating over a table
+const DefaultPageSize = 1000
+
+// paginate yields the rows of consecutive keyset pages, fetching each page after the key of the last row of the
+// previous one. Pages are read completely before their rows are yielded, so callers may run other queries on the
+// transaction in ctx while iterating. The iteration ends with ctx's error when it is cancelled between rows.
+func paginate[T, K any](ctx context.Context, after K, pageSize int, fetch func(after K, limit int) ([]T, error), key func(T) K) iter.Seq2[T, error] {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return func(yield func(T, error) bool) {
+		var zero T
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(zero, err)
+				return
+			}
+
+			page, err := fetch(after, pageSize)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			for _, row := range page {
+				if err := ctx.Err(); err != nil {
+					yield(zero, err)
+					return
+				}
+				if !yield(row, nil) {
+					return
+				}
+			}
+			if len(page) < pageSize {
+				return
+			}
+			after = key(page[len(page)-1])
+		}
+	}
+}
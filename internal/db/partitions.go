@@ -0,0 +1,266 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// EventsDefaultPartition holds the events outside every monthly partition
+const EventsDefaultPartition = "events_default"
+
+// partitionNameLayout names monthly partitions of the events table, e.g. events_2024_06
+const partitionNameLayout = "events_2006_01"
+
+// Partition is a monthly partition of the events table, holding the events from From up to To
+type Partition struct {
+	Name string
+	From time.Time
+	To   time.Time
+	// Rows is the planner's estimate of the rows, -1 until the partition was first analyzed
+	Rows int64
+}
+
+// PartitionName returns the name of the partition holding the month of the given time
+func PartitionName(month time.Time) string {
+	return MonthStart(month).Format(partitionNameLayout)
+}
+
+// MonthStart returns the start of the month of the given time, the lower bound of its partition
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// PartitionPolicy decides which monthly partitions of the events table exist
+type PartitionPolicy struct {
+	// Ahead is the number of months after the current one created in advance
+	Ahead int
+	// From creates partitions back to its month when set, moving the events of these months out of the default
+	// partition
+	From time.Time
+	// DetachAfter is the age at which partitions are detached, as a duration or whole days, e.g. "365d". Partitions
+	// stay attached when it is empty.
+	DetachAfter string
+	// Drop drops partitions once detached instead of keeping them as standalone tables. Only partitions whose events
+	// were all archived are dropped.
+	Drop bool
+}
+
+// Validate checks the number of months ahead and the detach age
+func (p PartitionPolicy) Validate() error {
+	if p.Ahead < 0 {
+		return fmt.Errorf("invalid number of months ahead %d", p.Ahead)
+	}
+	if _, err := parseRetention(p.DetachAfter); err != nil {
+		return fmt.Errorf("invalid partition detach age: %w", err)
+	}
+	return nil
+}
+
+// DetachBefore returns the time before which partitions are detached at the given time, nil when never
+func (p PartitionPolicy) DetachBefore(now time.Time) (*time.Time, error) {
+	d, err := parseRetention(p.DetachAfter)
+	if err != nil || d == 0 {
+		return nil, err
+	}
+	before := now.Add(-d)
+	return &before, nil
+}
+
+// PartitionRepository manages the monthly partitions of the events table
+type PartitionRepository interface {
+	GetPartitions(ctx context.Context) ([]Partition, error)
+	CreatePartition(ctx context.Context, month time.Time) (int, error)
+	DetachPartition(ctx context.Context, partition Partition, drop bool) (bool, error)
+}
+
+// GetPartitions returns the monthly partitions of the events table ordered by time, the default partition excluded
+func (r *PgEventRepository) GetPartitions(ctx context.Context) ([]Partition, error) {
+	query := `
+		SELECT c.relname, c.reltuples::bigint
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'events'::regclass
+		ORDER BY c.relname`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query)
+	} else {
+		rows, err = r.pool.Query(ctx, query)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query partitions: %w", err)
+	}
+	defer rows.Close()
+
+	var partitions []Partition
+	for rows.Next() {
+		var name string
+		var estimate int64
+		if err := rows.Scan(&name, &estimate); err != nil {
+			return nil, fmt.Errorf("failed to scan partition: %w", err)
+		}
+		from, err := time.Parse(partitionNameLayout, name)
+		if err != nil {
+			// Not a monthly partition
+			continue
+		}
+		partitions = append(partitions, Partition{Name: name, From: from, To: from.AddDate(0, 1, 0), Rows: estimate})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read partitions: %w", err)
+	}
+	return partitions, nil
+}
+
+// HasDetachedPartitions reports whether monthly partitions were detached from the events table and kept as
+// standalone tables, their events are missing from the events table
+func (r *PgEventRepository) HasDetachedPartitions(ctx context.Context) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = current_schema() AND c.relkind = 'r' AND NOT c.relispartition
+				AND c.relname ~ '^events_\d{4}_\d{2}$'
+		)`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query)
+	} else {
+		row = r.pool.QueryRow(ctx, query)
+	}
+
+	var detached bool
+	if err := row.Scan(&detached); err != nil {
+		return false, fmt.Errorf("failed to check detached partitions: %w", err)
+	}
+	return detached, nil
+}
+
+// CreatePartition creates the partition of the month of the given time and returns the number of events moved into
+// it from the default partition. Events inserted into the default partition for the month while it is created fail
+// the attachment, the partition is then left to a next attempt.
+func (r *PgEventRepository) CreatePartition(ctx context.Context, month time.Time) (int, error) {
+	from := MonthStart(month)
+	to := from.AddDate(0, 1, 0)
+	name := pgx.Identifier{PartitionName(from)}.Sanitize()
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	// The partition is created detached, so events of its month already in the default partition can be moved
+	// before attaching it
+	if _, err := tx.Exec(ctx, "CREATE TABLE "+name+" (LIKE events INCLUDING DEFAULTS INCLUDING CONSTRAINTS)"); err != nil {
+		return 0, fmt.Errorf("failed to create partition %s: %w", name, err)
+	}
+
+	tag, err := tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM `+EventsDefaultPartition+`
+			WHERE event_timestamp >= $1 AND event_timestamp < $2
+			RETURNING *
+		)
+		INSERT INTO `+name+` SELECT * FROM moved`, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move events to partition %s: %w", name, err)
+	}
+
+	bounds := fmt.Sprintf("FROM ('%s') TO ('%s')", from.Format(time.DateTime), to.Format(time.DateTime))
+	if _, err := tx.Exec(ctx, "ALTER TABLE events ATTACH PARTITION "+name+" FOR VALUES "+bounds); err != nil {
+		return 0, fmt.Errorf("failed to attach partition %s: %w", name, err)
+	}
+
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DetachPartition detaches a partition from the events table, dropping it when asked. Partitions holding unprocessed
+// events are kept attached, in which case it returns false, as are partitions to drop holding any event: their events
+// are archived first, so they can be restored.
+func (r *PgEventRepository) DetachPartition(ctx context.Context, partition Partition, drop bool) (bool, error) {
+	name := pgx.Identifier{partition.Name}.Sanitize()
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	// Detaching first locks the partition, so no event can be reset to unprocessed after the check. The detachment
+	// is undone through a savepoint when the check fails, also within the caller's transaction.
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer savepoint.Rollback(ctx)
+
+	if _, err := savepoint.Exec(ctx, "ALTER TABLE events DETACH PARTITION "+name); err != nil {
+		return false, fmt.Errorf("failed to detach partition %s: %w", name, err)
+	}
+
+	check := "SELECT EXISTS (SELECT 1 FROM " + name + " WHERE processed = false)"
+	if drop {
+		check = "SELECT EXISTS (SELECT 1 FROM " + name + ")"
+	}
+	var kept bool
+	if err := savepoint.QueryRow(ctx, check).Scan(&kept); err != nil {
+		return false, fmt.Errorf("failed to check events of partition %s: %w", name, err)
+	}
+	if kept {
+		return false, nil
+	}
+
+	if drop {
+		if _, err := savepoint.Exec(ctx, "DROP TABLE "+name); err != nil {
+			return false, fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+	}
+	if err := savepoint.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return false, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+	return true, nil
+}
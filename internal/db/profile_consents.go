@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SetConsents records the consent decisions on the profile, a decision replaces the one on the same purpose and
+// identifier unless that one is more recent
+func (r *PgProfileRepository) SetConsents(ctx context.Context, profileId int, consents Consents) error {
+	if len(consents) == 0 {
+		return nil
+	}
+	for _, consent := range consents {
+		if err := consent.Validate(); err != nil {
+			return fmt.Errorf("failed to set consents of profile %d: %w", profileId, err)
+		}
+	}
+
+	purposes := make([]string, len(consents))
+	types := make([]string, len(consents))
+	statuses := make([]string, len(consents))
+	sourceIds := make([]int, len(consents))
+	updatedAts := make([]time.Time, len(consents))
+	for i, c := range consents {
+		purposes[i], types[i], statuses[i] = c.Purpose, c.IdentifierType, string(c.Status)
+		sourceIds[i], updatedAts[i] = c.SourceEventId, c.UpdatedAt
+	}
+
+	// The last decision on a purpose and identifier wins, as an upsert cannot touch a row twice
+	query := `
+		INSERT INTO ` + r.qualify("profile_consents") + ` AS pc
+			(profile_id, purpose, identifier_type, status, source_event_id, updated_at)
+		SELECT DISTINCT ON (t.purpose, t.identifier_type) $1, t.purpose, t.identifier_type, t.status, t.source_event_id, t.updated_at
+		FROM unnest($2::text[], $3::text[], $4::text[], $5::int[], $6::timestamp[])
+			WITH ORDINALITY AS t(purpose, identifier_type, status, source_event_id, updated_at, n)
+		ORDER BY t.purpose, t.identifier_type, t.n DESC
+		ON CONFLICT (profile_id, purpose, identifier_type) DO UPDATE SET
+			status = EXCLUDED.status,
+			source_event_id = EXCLUDED.source_event_id,
+			updated_at = EXCLUDED.updated_at
+		WHERE pc.updated_at <= EXCLUDED.updated_at`
+	args := []interface{}{profileId, purposes, types, statuses, sourceIds, updatedAts}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to set consents of profile %d: %w", profileId, err)
+	}
+	return nil
+}
+
+// GetConsents returns the consent records of the profiles by profile id, profiles without any are left out
+func (r *PgProfileRepository) GetConsents(ctx context.Context, profileIds []int) (map[int]Consents, error) {
+	query := `
+		SELECT profile_id, purpose, identifier_type, status, source_event_id, updated_at
+		FROM ` + r.qualify("profile_consents") + `
+		WHERE profile_id = ANY($1)
+		ORDER BY profile_id, purpose, identifier_type`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, profileIds)
+	} else {
+		rows, err = r.pool.Query(ctx, query, profileIds)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile consents: %w", err)
+	}
+	defer rows.Close()
+
+	consents := make(map[int]Consents)
+	for rows.Next() {
+		var profileId int
+		var c Consent
+		if err := rows.Scan(&profileId, &c.Purpose, &c.IdentifierType, &c.Status, &c.SourceEventId, &c.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan profile consent: %w", err)
+		}
+		consents[profileId] = append(consents[profileId], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile consents: %w", err)
+	}
+	return consents, nil
+}
+
+// mergeConsents moves the consents of all merged profiles to the survivor, combining them like MergeConsents:
+// a denial wins over any grant, otherwise the most recent grant is kept
+func (r *PgProfileRepository) mergeConsents(ctx context.Context, profileIds []int, survivorId int) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to merge profile consents: %w", ErrNoTransaction)
+	}
+
+	combineQuery := `
+		INSERT INTO ` + r.qualify("profile_consents") + ` AS pc
+			(profile_id, purpose, identifier_type, status, source_event_id, updated_at)
+		SELECT DISTINCT ON (purpose, identifier_type) $2, purpose, identifier_type, status, source_event_id, updated_at
+		FROM ` + r.qualify("profile_consents") + `
+		WHERE profile_id = ANY($1)
+		ORDER BY purpose, identifier_type, status = 'denied' DESC, updated_at DESC
+		ON CONFLICT (profile_id, purpose, identifier_type) DO UPDATE SET
+			status = EXCLUDED.status,
+			source_event_id = EXCLUDED.source_event_id,
+			updated_at = EXCLUDED.updated_at`
+
+	if _, err := tx.Exec(ctx, combineQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to merge profile consents: %w", err)
+	}
+
+	deleteQuery := "DELETE FROM " + r.qualify("profile_consents") + " WHERE profile_id = ANY($1) AND profile_id != $2"
+	if _, err := tx.Exec(ctx, deleteQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to delete merged profile consents: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ProfileExport is a profile with its identifier graph, stats, segments and the ids of the profiles merged into it
+type ProfileExport struct {
+	Profile      Profile
+	Observations []IdentifierObservation
+	Stats        ProfileStats
+	Segments     []string
+	MergedIds    []int
+	Consents     Consents
+	// UpdatedAt is the last change of the profile or its stats
+	UpdatedAt time.Time
+}
+
+// IterProfileExports yields the profiles changed after since ordered by id, every profile when since is zero,
+// reading pageSize profiles per query
+func (r *PgProfileRepository) IterProfileExports(ctx context.Context, since time.Time, pageSize int) iter.Seq2[ProfileExport, error] {
+	fetch := func(afterId int, limit int) ([]ProfileExport, error) {
+		return r.getProfileExportPage(ctx, afterId, since, limit)
+	}
+	return paginate(ctx, 0, pageSize, fetch, func(e ProfileExport) int { return e.Profile.Id })
+}
+
+// getProfileExportPage returns up to limit profiles changed after since with an id above afterId
+func (r *PgProfileRepository) getProfileExportPage(ctx context.Context, afterId int, since time.Time, limit int) ([]ProfileExport, error) {
+	return r.queryProfileExports(ctx, "p.id > $1 AND (p.updated_at > $2 OR s.updated_at > $2) ORDER BY p.id LIMIT $3",
+		afterId, since, limit)
+}
+
+// GetProfileExports returns the given profiles ordered by id, profiles which do not exist are left out
+func (r *PgProfileRepository) GetProfileExports(ctx context.Context, profileIds []int) ([]ProfileExport, error) {
+	return r.queryProfileExports(ctx, "p.id = ANY($1) ORDER BY p.id", profileIds)
+}
+
+// queryProfileExports returns the profiles of the workspace matching the condition, which must order them by id
+func (r *PgProfileRepository) queryProfileExports(ctx context.Context, condition string, args ...any) ([]ProfileExport, error) {
+	args = append(args, workspaceArg(ctx))
+	query := `
+		SELECT p.id, p.cookie, p.message_id, p.phone, p.traits, p.workspace,
+			GREATEST(p.updated_at, s.updated_at) AS updated_at,
+			COALESCE(s.first_seen, '0001-01-01'), COALESCE(s.last_seen, '0001-01-01'),
+			COALESCE(s.total_events, 0), COALESCE(s.purchase_count, 0), COALESCE(s.revenue, 0)::float8,
+			COALESCE(s.last_purchase, '0001-01-01'),
+			COALESCE((SELECT array_agg(ps.segment ORDER BY ps.segment) FROM ` + r.qualify("profile_segments") + ` ps
+				WHERE ps.profile_id = p.id), '{}'),
+			COALESCE((SELECT array_agg(pm.merged_id ORDER BY pm.merged_id) FROM ` + r.qualify("profile_merges") + ` pm
+				WHERE pm.survivor_id = p.id), '{}')
+		FROM ` + r.qualify("profiles") + ` p
+		LEFT JOIN ` + r.qualify("profile_stats") + ` s ON s.profile_id = p.id
+		WHERE ` + workspaceFilter("p.workspace", len(args)) + ` AND ` + condition
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile exports: %w", err)
+	}
+	defer rows.Close()
+
+	var exports []ProfileExport
+	var ids []int
+	for rows.Next() {
+		var e ProfileExport
+		err := rows.Scan(&e.Profile.Id, &e.Profile.Cookie, &e.Profile.MessageId, &e.Profile.Phone, &e.Profile.Traits,
+			&e.Profile.Workspace, &e.UpdatedAt, &e.Stats.FirstSeen, &e.Stats.LastSeen, &e.Stats.TotalEvents, &e.Stats.PurchaseCount, &e.Stats.Revenue,
+			&e.Stats.LastPurchase, &e.Segments, &e.MergedIds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan profile export: %w", err)
+		}
+		e.Stats.ProfileId = e.Profile.Id
+		exports = append(exports, e)
+		ids = append(ids, e.Profile.Id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read profile exports: %w", err)
+	}
+	if len(exports) == 0 {
+		return nil, nil
+	}
+	for i := range exports {
+		profiles := []Profile{exports[i].Profile}
+		if err := revealProfiles(r.protector, profiles); err != nil {
+			return nil, err
+		}
+		exports[i].Profile = profiles[0]
+	}
+
+	observations, err := r.getObservations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	// Both are ordered by profile id
+	i := 0
+	for _, o := range observations {
+		for exports[i].Profile.Id != o.ProfileId {
+			i++
+		}
+		exports[i].Observations = append(exports[i].Observations, o)
+	}
+
+	consents, err := r.GetConsents(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range exports {
+		exports[i].Consents = consents[exports[i].Profile.Id]
+	}
+	return exports, nil
+}
+
+// ExportRepository stores the watermarks of incremental exports
+type ExportRepository interface {
+	GetExportWatermark(ctx context.Context, name string) (time.Time, bool, error)
+	SaveExportWatermark(ctx context.Context, name string, watermark time.Time) error
+}
+
+type PgExportRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgExportRepository(pool *pgxpool.Pool) *PgExportRepository {
+	return &PgExportRepository{pool: pool}
+}
+
+func (r *PgExportRepository) GetExportWatermark(ctx context.Context, name string) (time.Time, bool, error) {
+	var watermark time.Time
+	err := r.pool.QueryRow(ctx, "SELECT watermark FROM export_watermarks WHERE name = $1", name).Scan(&watermark)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to query export watermark: %w", err)
+	}
+	return watermark, true, nil
+}
+
+func (r *PgExportRepository) SaveExportWatermark(ctx context.Context, name string, watermark time.Time) error {
+	query := `
+		INSERT INTO export_watermarks (name, watermark, updated_at)
+		VALUES ($1, $2, now() AT TIME ZONE 'utc')
+		ON CONFLICT (name) DO UPDATE SET
+			watermark = EXCLUDED.watermark,
+			updated_at = EXCLUDED.updated_at`
+
+	if _, err := r.pool.Exec(ctx, query, name, watermark); err != nil {
+		return fmt.Errorf("failed to save export watermark: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package db_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+func collectExports(ctx context.Context, repo db.ProfileRepository, since time.Time, pageSize int) []db.ProfileExport {
+	var exports []db.ProfileExport
+	for export, err := range repo.IterProfileExports(ctx, since, pageSize) {
+		Expect(err).NotTo(HaveOccurred())
+		exports = append(exports, export)
+	}
+	return exports
+}
+
+var _ = Describe("Profile Export", func() {
+	var (
+		tc         *profileTestContext
+		exportRepo *db.PgExportRepository
+	)
+
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		tc = setupProfileTest(ctx)
+		exportRepo = db.NewPgExportRepository(tc.connPool)
+		_, err := tc.connPool.Exec(ctx, "TRUNCATE TABLE export_watermarks")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		tc.cleanup()
+	})
+
+	dbNow := func(ctx context.Context, pool *pgxpool.Pool) time.Time {
+		var now time.Time
+		Expect(pool.QueryRow(ctx, "SELECT now() AT TIME ZONE 'utc'").Scan(&now)).To(Succeed())
+		return now
+	}
+
+	It("should page through profiles with their stats, segments, observations and lineage", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		events := []db.EventRecord{db.GenerateRandomEvent(), db.GenerateRandomEvent(), db.GenerateRandomEvent()}
+		ids := make([]int, len(events))
+		for i, event := range events {
+			id, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: event.Cookie, MessageId: event.MessageId, Phone: event.Phone})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tc.repo.RecordObservations(ctx, id, event)).To(Succeed())
+			Expect(tc.repo.RecordEventStats(ctx, id, event)).To(Succeed())
+			ids[i] = id
+		}
+		survivorId, err := tc.repo.MergeProfiles(ctx, ids[1:])
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tc.repo.UpdateSegments(ctx, survivorId, []string{"vip"}, time.Now().UTC())
+		Expect(err).NotTo(HaveOccurred())
+
+		// A page size of one reads every profile with its own query
+		exports := collectExports(ctx, tc.repo, time.Time{}, 1)
+		Expect(exports).To(HaveLen(2))
+		Expect(exports[0].Profile.Id).To(Equal(ids[0]))
+		Expect(exports[0].Stats.TotalEvents).To(Equal(1))
+		Expect(exports[0].Observations).NotTo(BeEmpty())
+		Expect(exports[0].MergedIds).To(BeEmpty())
+
+		survivor := exports[1]
+		Expect(survivor.Profile.Id).To(Equal(survivorId))
+		Expect(survivor.Stats.TotalEvents).To(Equal(2))
+		Expect(survivor.Segments).To(Equal([]string{"vip"}))
+		Expect(survivor.MergedIds).To(HaveLen(1))
+		Expect(ids[1:]).To(ContainElement(survivor.MergedIds[0]))
+		Expect(survivor.UpdatedAt).NotTo(BeZero())
+	})
+
+	It("should only return profiles changed since a time", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		first, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-1"})
+		Expect(err).NotTo(HaveOccurred())
+		second, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-2"})
+		Expect(err).NotTo(HaveOccurred())
+
+		since := dbNow(ctx, tc.connPool)
+		Expect(tc.repo.SetTraits(ctx, second, db.Traits{"plan": db.StringTrait("pro", time.Now().UTC())})).To(Succeed())
+
+		changed := collectExports(ctx, tc.repo, since, 10)
+		Expect(changed).To(HaveLen(1))
+		Expect(changed[0].Profile.Id).To(Equal(second))
+		Expect(changed[0].UpdatedAt).To(BeTemporally(">", since))
+
+		// Stats changes count as changes of the profile
+		Expect(tc.repo.RecordEventStats(ctx, first, db.GenerateRandomEvent())).To(Succeed())
+		Expect(collectExports(ctx, tc.repo, since, 10)).To(HaveLen(2))
+	})
+
+	It("should store export watermarks", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		_, found, err := exportRepo.GetExportWatermark(ctx, "warehouse")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		watermark := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		Expect(exportRepo.SaveExportWatermark(ctx, "warehouse", watermark)).To(Succeed())
+		Expect(exportRepo.SaveExportWatermark(ctx, "warehouse", watermark.Add(time.Hour))).To(Succeed())
+
+		stored, found, err := exportRepo.GetExportWatermark(ctx, "warehouse")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(stored).To(Equal(watermark.Add(time.Hour)))
+	})
+})
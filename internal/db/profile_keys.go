@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// EventSealer encrypts the identifiers and traits of stitched events with a key of their profile, see package pii.
+// Destroying the key of a profile erases its sealed events without rewriting them.
+type EventSealer interface {
+	// Seal returns the event with its identifiers and traits encrypted with a key of the profile, and ProfileKeyId
+	// set to the key
+	Seal(ctx context.Context, profileId int, event EventRecord) (EventRecord, error)
+	// Open decrypts sealed events in place and leaves other events as they are. Events sealed with a destroyed
+	// key are left without identifiers and traits.
+	Open(ctx context.Context, events []EventRecord) error
+}
+
+// ProfileKey is a key sealing the events of a profile, stored wrapped by a master key. Keys are identified by a
+// random id which is never reused, unlike profile ids, and move along with the events they sealed when profiles
+// are merged or rebuilt. Shredded keys have no wrapped key and no profile left.
+type ProfileKey struct {
+	KeyId       string     `db:"key_id"`
+	ProfileId   *int       `db:"profile_id"`
+	MasterKeyId string     `db:"master_key_id"`
+	WrappedKey  []byte     `db:"wrapped_key"`
+	CreatedAt   time.Time  `db:"created_at"`
+	ShreddedAt  *time.Time `db:"shredded_at"`
+}
+
+// Shredded reports whether the key was destroyed
+func (k ProfileKey) Shredded() bool {
+	return k.ShreddedAt != nil
+}
+
+// ProfileKeyRepository stores the wrapped keys of profiles
+type ProfileKeyRepository interface {
+	GetProfileKeys(ctx context.Context, keyIds []string) ([]ProfileKey, error)
+	GetLiveProfileKey(ctx context.Context, profileId int) (ProfileKey, bool, error)
+	InsertProfileKey(ctx context.Context, key ProfileKey) (ProfileKey, error)
+	ShredProfileKeys(ctx context.Context, profileIds []int) (int, error)
+	GetProfileKeysToRewrap(ctx context.Context, masterKeyId string, limit int) ([]ProfileKey, error)
+	UpdateProfileKey(ctx context.Context, key ProfileKey) error
+}
+
+type PgProfileKeyRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgProfileKeyRepository(pool *pgxpool.Pool) *PgProfileKeyRepository {
+	return &PgProfileKeyRepository{pool: pool}
+}
+
+// profileKeyColumns are the columns of a ProfileKey
+const profileKeyColumns = "key_id::text AS key_id, profile_id, master_key_id, wrapped_key, created_at, shredded_at"
+
+// GetProfileKeys returns the keys by their ids, shredded ones included, ordered by key id
+func (r *PgProfileKeyRepository) GetProfileKeys(ctx context.Context, keyIds []string) ([]ProfileKey, error) {
+	query := `
+		SELECT ` + profileKeyColumns + `
+		FROM profile_keys
+		WHERE key_id = ANY($1::text[]::uuid[])
+		ORDER BY key_id`
+	return r.queryProfileKeys(ctx, query, keyIds)
+}
+
+// GetLiveProfileKey returns the oldest key of the profile which is not shredded, false when it has none. A profile
+// holds several keys after absorbing other profiles.
+func (r *PgProfileKeyRepository) GetLiveProfileKey(ctx context.Context, profileId int) (ProfileKey, bool, error) {
+	query := `
+		SELECT ` + profileKeyColumns + `
+		FROM profile_keys
+		WHERE profile_id = $1 AND shredded_at IS NULL
+		ORDER BY created_at, key_id
+		LIMIT 1`
+	keys, err := r.queryProfileKeys(ctx, query, profileId)
+	if err != nil || len(keys) == 0 {
+		return ProfileKey{}, false, err
+	}
+	return keys[0], true, nil
+}
+
+// InsertProfileKey stores a new key of the profile under a random key id and returns it
+func (r *PgProfileKeyRepository) InsertProfileKey(ctx context.Context, key ProfileKey) (ProfileKey, error) {
+	query := `
+		INSERT INTO profile_keys (key_id, profile_id, master_key_id, wrapped_key, created_at)
+		VALUES ($1::text::uuid, $2, $3, $4, now() AT TIME ZONE 'utc')
+		RETURNING ` + profileKeyColumns
+	key.KeyId = uuid.NewString()
+	args := []interface{}{key.KeyId, key.ProfileId, key.MasterKeyId, key.WrappedKey}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return ProfileKey{}, fmt.Errorf("failed to insert profile key: %w", err)
+	}
+	inserted, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[ProfileKey])
+	if err != nil {
+		return ProfileKey{}, fmt.Errorf("failed to insert profile key: %w", err)
+	}
+	return inserted, nil
+}
+
+// ShredProfileKeys destroys the keys of the profiles and returns the number of keys destroyed. The rows are
+// kept without a profile, so a sealed event of the profiles is never opened again and nothing sealed later by a
+// profile with the same id uses them.
+func (r *PgProfileKeyRepository) ShredProfileKeys(ctx context.Context, profileIds []int) (int, error) {
+	query := `
+		UPDATE profile_keys SET profile_id = NULL, wrapped_key = NULL, shredded_at = now() AT TIME ZONE 'utc'
+		WHERE profile_id = ANY($1) AND shredded_at IS NULL`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, profileIds)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, profileIds)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to shred profile keys: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// GetProfileKeysToRewrap returns up to limit live keys wrapped with another master key than the given one
+func (r *PgProfileKeyRepository) GetProfileKeysToRewrap(ctx context.Context, masterKeyId string, limit int) ([]ProfileKey, error) {
+	query := `
+		SELECT ` + profileKeyColumns + `
+		FROM profile_keys
+		WHERE shredded_at IS NULL AND master_key_id != $1
+		ORDER BY key_id
+		LIMIT $2`
+	return r.queryProfileKeys(ctx, query, masterKeyId, limit)
+}
+
+// UpdateProfileKey replaces the wrapped form of a live key, after it was rewrapped with another master key
+func (r *PgProfileKeyRepository) UpdateProfileKey(ctx context.Context, key ProfileKey) error {
+	query := `
+		UPDATE profile_keys SET master_key_id = $2, wrapped_key = $3
+		WHERE key_id = $1::text::uuid AND shredded_at IS NULL`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, key.KeyId, key.MasterKeyId, key.WrappedKey)
+	} else {
+		_, err = r.pool.Exec(ctx, query, key.KeyId, key.MasterKeyId, key.WrappedKey)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update profile key %s: %w", key.KeyId, err)
+	}
+	return nil
+}
+
+func (r *PgProfileKeyRepository) queryProfileKeys(ctx context.Context, query string, args ...any) ([]ProfileKey, error) {
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile keys: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[ProfileKey])
+}
+
+// profileKeysOf matches the ids of the keys held by the profiles passed as the array $n
+func profileKeysOf(n int) string {
+	return fmt.Sprintf("(SELECT key_id FROM profile_keys WHERE profile_id = ANY($%d))", n)
+}
+
+// moveProfileKeys hands the keys of the merged profiles over to the survivor. Keys are kept outside the profile
+// tables, so they only follow merges of the live profiles.
+func (r *PgProfileRepository) moveProfileKeys(ctx context.Context, profileIds []int, survivorId int) error {
+	if r.schema != "" {
+		return nil
+	}
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to move profile keys: %w", ErrNoTransaction)
+	}
+
+	query := "UPDATE profile_keys SET profile_id = $2 WHERE profile_id = ANY($1) AND profile_id != $2"
+	if _, err := tx.Exec(ctx, query, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to move profile keys: %w", err)
+	}
+	return nil
+}
+
+// assignProfileKeys hands the keys of the snapshots over to the profiles with the given ids, keys held by no
+// snapshot are detached as their profiles are gone. Shadow profiles record the holders of the keys instead,
+// which PromoteShadow hands them over to.
+func (r *PgProfileRepository) assignProfileKeys(ctx context.Context, tx pgx.Tx, ids []int, snapshots []ProfileSnapshot) error {
+	var keyIds []string
+	var profileIds []int
+	for i, snapshot := range snapshots {
+		for _, keyId := range snapshot.KeyIds {
+			keyIds = append(keyIds, keyId)
+			profileIds = append(profileIds, ids[i])
+		}
+	}
+
+	query := `
+		UPDATE profile_keys k SET profile_id = h.profile_id
+		FROM unnest($1::text[], $2::int[]) AS h(key_id, profile_id)
+		WHERE k.key_id = h.key_id::uuid AND k.shredded_at IS NULL`
+	if r.schema != "" {
+		query = `
+			INSERT INTO ` + r.qualify("profile_key_holders") + ` (key_id, profile_id)
+			SELECT key_id::uuid, profile_id FROM unnest($1::text[], $2::int[]) AS h(key_id, profile_id)
+			ON CONFLICT (key_id) DO NOTHING`
+	} else if _, err := tx.Exec(ctx, "UPDATE profile_keys SET profile_id = NULL WHERE profile_id IS NOT NULL"); err != nil {
+		return fmt.Errorf("failed to detach profile keys: %w", err)
+	}
+	if _, err := tx.Exec(ctx, query, keyIds, profileIds); err != nil {
+		return fmt.Errorf("failed to assign profile keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// recordMerge redirects the merged profiles to the survivor. Redirects pointing to a merged profile are moved
+// to the survivor as well, so every redirect leads to a live profile in a single step.
+func (r *PgProfileRepository) recordMerge(ctx context.Context, profileIds []int, survivorId int) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to record merge: %w", ErrNoTransaction)
+	}
+
+	redirectQuery := `
+		UPDATE ` + r.qualify("profile_merges") + `
+		SET survivor_id = $2
+		WHERE survivor_id = ANY($1)`
+
+	if _, err := tx.Exec(ctx, redirectQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to redirect merged profiles: %w", err)
+	}
+
+	insertQuery := `
+		INSERT INTO ` + r.qualify("profile_merges") + ` (merged_id, survivor_id, merged_at)
+		SELECT merged_id, $2, now() AT TIME ZONE 'utc'
+		FROM unnest($1::int[]) AS merged_id
+		WHERE merged_id != $2
+		ON CONFLICT (merged_id) DO UPDATE SET survivor_id = EXCLUDED.survivor_id`
+
+	if _, err := tx.Exec(ctx, insertQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to record merge: %w", err)
+	}
+	return nil
+}
+
+// GetMergeSurvivor returns the profile which absorbed the given one, if it was merged away
+func (r *PgProfileRepository) GetMergeSurvivor(ctx context.Context, profileId int) (int, bool, error) {
+	query := "SELECT survivor_id FROM " + r.qualify("profile_merges") + " WHERE merged_id = $1"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, profileId)
+	} else {
+		row = r.pool.QueryRow(ctx, query, profileId)
+	}
+
+	var survivorId int
+	if err := row.Scan(&survivorId); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to query merge survivor: %w", err)
+	}
+	return survivorId, true, nil
+}
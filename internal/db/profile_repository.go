@@ -2,8 +2,14 @@ package db
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
+	"slices"
+	"sort"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -14,37 +20,139 @@ type ProfileRepository interface {
 	UpdateProfileById(ctx context.Context, id int, profile Profile) error
 	InsertProfile(ctx context.Context, profile Profile) (int, error)
 	GetAllProfiles(ctx context.Context) ([]Profile, error)
+	IterProfiles(ctx context.Context, pageSize int) iter.Seq2[Profile, error]
 	EnrichProfileByIdentifiers(ctx context.Context, id int, identifiers EventIdentifier) error
-	MergeProfiles(ctx context.Context, profileIds []int) error
+	MergeProfiles(ctx context.Context, profileIds []int) (int, error)
+	SurvivorshipRules(workspace string) SurvivorshipRules
+	LockIdentifiers(ctx context.Context, identifiers ...EventIdentifier) error
+	ReplaceAllProfiles(ctx context.Context, snapshots []ProfileSnapshot) (int, error)
+	RecordObservations(ctx context.Context, profileId int, event EventRecord) error
+	GetProfileById(ctx context.Context, id int) (Profile, bool, error)
+	SetTraits(ctx context.Context, id int, traits Traits) error
+	SetConsents(ctx context.Context, profileId int, consents Consents) error
+	GetConsents(ctx context.Context, profileIds []int) (map[int]Consents, error)
+	GetProfilesByTrait(ctx context.Context, name string, value TraitValue) ([]Profile, error)
+	RecordEventStats(ctx context.Context, profileId int, event EventRecord) error
+	ForgetEvent(ctx context.Context, profileId int, event EventRecord) error
+	GetProfileStats(ctx context.Context, profileId int) (ProfileStats, bool, error)
+	UpdateSegments(ctx context.Context, profileId int, segments []string, at time.Time) ([]SegmentTransition, error)
+	GetProfileSegments(ctx context.Context, profileId int) ([]string, error)
+	GetMergeSurvivor(ctx context.Context, profileId int) (int, bool, error)
+	IterProfileExports(ctx context.Context, since time.Time, pageSize int) iter.Seq2[ProfileExport, error]
+	GetProfileExports(ctx context.Context, profileIds []int) ([]ProfileExport, error)
+	GetProfileIdsByIdentifier(ctx context.Context, identifier Identifier) ([]int, error)
+	GetMergedIds(ctx context.Context, survivorIds []int) ([]int, error)
+	EraseProfiles(ctx context.Context, profileIds []int, mode ErasureMode) error
+}
+
+// ErrNoTransaction is returned by operations that are only meaningful inside a transaction
+var ErrNoTransaction = errors.New("operation requires a transaction in context")
+
+// ShadowProfileRepository is a ProfileRepository backed by shadow copies of the profile tables,
+// which can be rebuilt without affecting readers and then promoted to replace the live tables.
+type ShadowProfileRepository interface {
+	ProfileRepository
+	ResetShadow(ctx context.Context) error
+	PromoteShadow(ctx context.Context) error
 }
 
 type PgProfileRepository struct {
-	pool *pgxpool.Pool
-	log  *slog.Logger
+	pool  *pgxpool.Pool
+	log   *slog.Logger
+	rules SurvivorshipRules
+	// workspaces replaces the survivorship rules for merges within the workspaces configured with their own
+	workspaces Workspaces
+	// protector converts identifiers between the form callers use and the one they are stored in
+	protector IdentifierProtector
+	// schema is empty for the live tables and shadowSchema for the shadow namespace
+	schema string
 }
 
 func NewPgProfileRepository(pool *pgxpool.Pool) *PgProfileRepository {
 	return &PgProfileRepository{
-		pool: pool,
-		log:  slog.Default(),
+		pool:      pool,
+		log:       slog.Default(),
+		rules:     DefaultSurvivorshipRules(),
+		protector: PlainIdentifiers{},
 	}
 }
 
+// NewPgShadowProfileRepository returns a repository operating on the profile tables in the shadow namespace
+func NewPgShadowProfileRepository(pool *pgxpool.Pool) *PgProfileRepository {
+	return &PgProfileRepository{
+		pool:      pool,
+		log:       slog.Default(),
+		rules:     DefaultSurvivorshipRules(),
+		protector: PlainIdentifiers{},
+		schema:    shadowSchema,
+	}
+}
+
+// SetSurvivorshipRules changes how MergeProfiles combines profiles
+func (r *PgProfileRepository) SetSurvivorshipRules(rules SurvivorshipRules) {
+	r.rules = rules
+}
+
+// SetWorkspaces sets the per-workspace survivorship rules MergeProfiles uses instead of the repository's rules
+func (r *PgProfileRepository) SetWorkspaces(workspaces Workspaces) {
+	r.workspaces = workspaces
+}
+
+// SurvivorshipRules returns the rules MergeProfiles combines profiles of the workspace with
+func (r *PgProfileRepository) SurvivorshipRules(workspace string) SurvivorshipRules {
+	return r.workspaces.SurvivorshipRules(workspace, r.rules)
+}
+
+// SetProtector changes how identifiers are stored, profiles already stored are read regardless of how they were protected
+func (r *PgProfileRepository) SetProtector(protector IdentifierProtector) {
+	r.protector = protector
+}
+
+// collectProfiles reads the profile rows revealing their identifiers
+func (r *PgProfileRepository) collectProfiles(rows pgx.Rows) ([]Profile, error) {
+	profiles, err := pgx.CollectRows(rows, pgx.RowToStructByName[Profile])
+	if err != nil {
+		return nil, err
+	}
+	if err := revealProfiles(r.protector, profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// qualify returns the table name within the namespace the repository operates on
+func (r *PgProfileRepository) qualify(table string) string {
+	if r.schema == "" {
+		return table
+	}
+	return r.schema + "." + table
+}
+
+func (r *PgProfileRepository) tableIdentifier(table string) pgx.Identifier {
+	if r.schema == "" {
+		return pgx.Identifier{table}
+	}
+	return pgx.Identifier{r.schema, table}
+}
+
 func (r *PgProfileRepository) getProfileByIdentifier(ctx context.Context, identifier string, value string) ([]Profile, error) {
 	query := `
-		SELECT id, cookie, message_id, phone
-		FROM profiles
-		WHERE ` + identifier + ` = $1`
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE ` + identifier + ` = ANY($1) AND ` + workspaceFilter("workspace", 2)
+	candidates, err := r.protector.Candidates(identifier, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to protect %s: %w", identifier, err)
+	}
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
 	var rows pgx.Rows
-	var err error
 	if tx != nil {
-		rows, err = tx.Query(ctx, query, value)
+		rows, err = tx.Query(ctx, query, candidates, workspaceArg(ctx))
 	} else {
-		rows, err = r.pool.Query(ctx, query, value)
+		rows, err = r.pool.Query(ctx, query, candidates, workspaceArg(ctx))
 	}
 
 	if err != nil {
@@ -52,7 +160,7 @@ func (r *PgProfileRepository) getProfileByIdentifier(ctx context.Context, identi
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[Profile])
+	return r.collectProfiles(rows)
 }
 
 func (r *PgProfileRepository) TryGetProfilesByIdentifiers(ctx context.Context, identifiers EventIdentifier) ([]Profile, bool, error) {
@@ -94,19 +202,24 @@ func (r *PgProfileRepository) TryGetProfilesByIdentifiers(ctx context.Context, i
 }
 
 func (r *PgProfileRepository) UpdateProfileById(ctx context.Context, id int, profile Profile) error {
+	profile, err := protectProfile(r.protector, profile)
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+
 	query := `
-		UPDATE profiles 
-		SET cookie = $1, message_id = $2, phone = $3
-		WHERE id = $4`
+		UPDATE ` + r.qualify("profiles") + ` 
+		SET cookie = $1, message_id = $2, phone = $3, traits = $4, updated_at = now() AT TIME ZONE 'utc'
+		WHERE id = $5 AND ` + workspaceFilter("workspace", 6)
+	args := []interface{}{profile.Cookie, profile.MessageId, profile.Phone, traitsArg(profile.Traits), id, workspaceArg(ctx)}
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
-	var err error
 	if tx != nil {
-		_, err = tx.Exec(ctx, query, profile.Cookie, profile.MessageId, profile.Phone, id)
+		_, err = tx.Exec(ctx, query, args...)
 	} else {
-		_, err = r.pool.Exec(ctx, query, profile.Cookie, profile.MessageId, profile.Phone, id)
+		_, err = r.pool.Exec(ctx, query, args...)
 	}
 
 	if err != nil {
@@ -116,33 +229,45 @@ func (r *PgProfileRepository) UpdateProfileById(ctx context.Context, id int, pro
 }
 
 func (r *PgProfileRepository) InsertProfile(ctx context.Context, profile Profile) (int, error) {
+	profile, err := protectProfile(r.protector, profile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert profile: %w", err)
+	}
+	workspace, err := writeWorkspace(ctx, profile.Workspace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert profile: %w", err)
+	}
+
 	query := `
-		INSERT INTO profiles (cookie, message_id, phone)
-		VALUES ($1, $2, $3)
+		INSERT INTO ` + r.qualify("profiles") + ` (cookie, message_id, phone, traits, workspace)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id`
+	args := []interface{}{profile.Cookie, profile.MessageId, profile.Phone, traitsArg(profile.Traits),
+		workspace}
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
 	var row pgx.Row
 	if tx != nil {
-		row = tx.QueryRow(ctx, query, profile.Cookie, profile.MessageId, profile.Phone)
+		row = tx.QueryRow(ctx, query, args...)
 	} else {
-		row = r.pool.QueryRow(ctx, query, profile.Cookie, profile.MessageId, profile.Phone)
+		row = r.pool.QueryRow(ctx, query, args...)
 	}
 
 	var id int
-	err := row.Scan(&id)
-	if err != nil {
+	if err := row.Scan(&id); err != nil {
 		return 0, fmt.Errorf("failed to insert profile: %w", err)
 	}
 	return id, nil
 }
 
+// GetAllProfiles loads every profile at once, use IterProfiles for tables of unbounded size
 func (r *PgProfileRepository) GetAllProfiles(ctx context.Context) ([]Profile, error) {
 	query := `
-		SELECT id, cookie, message_id, phone
-		FROM profiles`
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE ` + workspaceFilter("workspace", 1)
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
@@ -150,9 +275,9 @@ func (r *PgProfileRepository) GetAllProfiles(ctx context.Context) ([]Profile, er
 	var rows pgx.Rows
 	var err error
 	if tx != nil {
-		rows, err = tx.Query(ctx, query)
+		rows, err = tx.Query(ctx, query, workspaceArg(ctx))
 	} else {
-		rows, err = r.pool.Query(ctx, query)
+		rows, err = r.pool.Query(ctx, query, workspaceArg(ctx))
 	}
 
 	if err != nil {
@@ -160,26 +285,67 @@ func (r *PgProfileRepository) GetAllProfiles(ctx context.Context) ([]Profile, er
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[Profile])
+	return r.collectProfiles(rows)
+}
+
+// IterProfiles yields every profile ordered by id, reading pageSize profiles per query
+func (r *PgProfileRepository) IterProfiles(ctx context.Context, pageSize int) iter.Seq2[Profile, error] {
+	query := `
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE id > $1 AND ` + workspaceFilter("workspace", 3) + `
+		ORDER BY id
+		LIMIT $2`
+
+	fetch := func(afterId int, limit int) ([]Profile, error) {
+		// Get transaction from context if available
+		tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+		var rows pgx.Rows
+		var err error
+		if tx != nil {
+			rows, err = tx.Query(ctx, query, afterId, limit, workspaceArg(ctx))
+		} else {
+			rows, err = r.pool.Query(ctx, query, afterId, limit, workspaceArg(ctx))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to query profiles page: %w", err)
+		}
+		defer rows.Close()
+
+		page, err := r.collectProfiles(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect profiles page: %w", err)
+		}
+		return page, nil
+	}
+	return paginate(ctx, 0, pageSize, fetch, func(p Profile) int { return p.Id })
 }
 
 func (r *PgProfileRepository) EnrichProfileByIdentifiers(ctx context.Context, id int, identifiers EventIdentifier) error {
+	identifiers, err := protectIdentifiers(r.protector, identifiers)
+	if err != nil {
+		return fmt.Errorf("failed to enrich profile: %w", err)
+	}
+
 	query := `
-		UPDATE profiles 
+		UPDATE ` + r.qualify("profiles") + ` 
 		SET 
 			cookie = COALESCE(NULLIF($1, ''), cookie),
 			message_id = COALESCE(NULLIF($2, ''), message_id),
-			phone = COALESCE(NULLIF($3, ''), phone)
-		WHERE id = $4`
+			phone = COALESCE(NULLIF($3, ''), phone),
+			updated_at = now() AT TIME ZONE 'utc'
+		WHERE id = $4 AND ` + workspaceFilter("workspace", 5)
+	args := []interface{}{identifiers.Cookie, identifiers.MessageId, identifiers.Phone, id, workspaceArg(ctx)}
 
 	// Get transaction from context if available
 	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
 
-	var err error
 	if tx != nil {
-		_, err = tx.Exec(ctx, query, identifiers.Cookie, identifiers.MessageId, identifiers.Phone, id)
+		_, err = tx.Exec(ctx, query, args...)
 	} else {
-		_, err = r.pool.Exec(ctx, query, identifiers.Cookie, identifiers.MessageId, identifiers.Phone, id)
+		_, err = r.pool.Exec(ctx, query, args...)
 	}
 
 	if err != nil {
@@ -188,9 +354,15 @@ func (r *PgProfileRepository) EnrichProfileByIdentifiers(ctx context.Context, id
 	return nil
 }
 
-func (r *PgProfileRepository) MergeProfiles(ctx context.Context, profileIds []int) error {
-	if len(profileIds) < 2 {
-		return nil
+// MergeProfiles combines the profiles into the one chosen by the survivorship rules, deletes the others
+// and returns the id of the surviving profile. Identifier observations and profile keys of merged profiles are
+// folded into the survivor.
+func (r *PgProfileRepository) MergeProfiles(ctx context.Context, profileIds []int) (int, error) {
+	if len(profileIds) == 0 {
+		return 0, nil
+	}
+	if len(profileIds) == 1 {
+		return profileIds[0], nil
 	}
 
 	// Get transaction from context if available
@@ -202,7 +374,7 @@ func (r *PgProfileRepository) MergeProfiles(ctx context.Context, profileIds []in
 	if tx == nil {
 		tx, err = r.pool.Begin(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to begin transaction: %w", err)
+			return 0, fmt.Errorf("failed to begin transaction: %w", err)
 		}
 		startedTx = true
 		defer tx.Rollback(ctx)
@@ -213,60 +385,481 @@ func (r *PgProfileRepository) MergeProfiles(ctx context.Context, profileIds []in
 
 	// Get all profiles to merge with row locks
 	query := `
-		SELECT id, cookie, message_id, phone
-		FROM profiles
-		WHERE id = ANY($1)
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE id = ANY($1) AND ` + workspaceFilter("workspace", 2) + `
 		ORDER BY id ASC
 		FOR UPDATE`
 
-	rows, err := tx.Query(ctx, query, profileIds)
+	rows, err := tx.Query(ctx, query, profileIds, workspaceArg(ctx))
 	if err != nil {
-		return fmt.Errorf("failed to query profiles to merge: %w", err)
+		return 0, fmt.Errorf("failed to query profiles to merge: %w", err)
 	}
 	defer rows.Close()
 
-	profiles, err := pgx.CollectRows(rows, pgx.RowToStructByName[Profile])
+	profiles, err := r.collectProfiles(rows)
 	if err != nil {
-		return fmt.Errorf("failed to collect profiles to merge: %w", err)
+		return 0, fmt.Errorf("failed to collect profiles to merge: %w", err)
 	}
 
-	if len(profiles) < 2 {
-		return nil
+	if len(profiles) == 0 {
+		return 0, nil
+	}
+	if len(profiles) == 1 {
+		return profiles[0].Id, nil
+	}
+	profileIds = make([]int, len(profiles))
+	for i, p := range profiles {
+		profileIds[i] = p.Id
 	}
 
-	// Find the lowest non-empty values for each field
-	var lowestCookie, lowestMessageId, lowestPhone string
-	for _, p := range profiles {
-		if p.Cookie != "" && (lowestCookie == "" || p.Cookie < lowestCookie) {
-			lowestCookie = p.Cookie
-		}
-		if p.MessageId != "" && (lowestMessageId == "" || p.MessageId < lowestMessageId) {
-			lowestMessageId = p.MessageId
-		}
-		if p.Phone != "" && (lowestPhone == "" || p.Phone < lowestPhone) {
-			lowestPhone = p.Phone
-		}
+	candidates, err := r.getMergeCandidates(txCtx, profiles)
+	if err != nil {
+		return 0, err
 	}
 
-	// Create merged profile with the lowest values
-	merged := profiles[0]
-	merged.Cookie = lowestCookie
-	merged.MessageId = lowestMessageId
-	merged.Phone = lowestPhone
+	// Combine the profiles according to the survivorship rules of their workspace, profiles of other workspaces
+	// were left out by the query
+	merged := r.SurvivorshipRules(profiles[0].Workspace).Merge(candidates)
 
-	// Update the first profile with merged data using the transaction context
+	// Update the surviving profile with merged data using the transaction context
 	if err := r.UpdateProfileById(txCtx, merged.Id, merged); err != nil {
-		return err
+		return 0, err
+	}
+
+	// Fold observations of all merged profiles into the survivor
+	observationsQuery := `
+		INSERT INTO ` + r.qualify("profile_identifiers") + ` AS pi
+			(profile_id, identifier_type, value, source, first_seen, last_seen, seen_count)
+		SELECT $2, identifier_type, value,
+			(array_agg(source ORDER BY last_seen DESC))[1],
+			MIN(first_seen), MAX(last_seen), SUM(seen_count)
+		FROM ` + r.qualify("profile_identifiers") + `
+		WHERE profile_id = ANY($1)
+		GROUP BY identifier_type, value
+		ON CONFLICT (profile_id, identifier_type, value) DO UPDATE SET
+			source = EXCLUDED.source,
+			first_seen = EXCLUDED.first_seen,
+			last_seen = EXCLUDED.last_seen,
+			seen_count = EXCLUDED.seen_count`
+
+	if _, err := tx.Exec(ctx, observationsQuery, profileIds, merged.Id); err != nil {
+		return 0, fmt.Errorf("failed to merge identifier observations: %w", err)
+	}
+
+	deleteObservationsQuery := `
+		DELETE FROM ` + r.qualify("profile_identifiers") + `
+		WHERE profile_id = ANY($1) AND profile_id != $2`
+
+	if _, err := tx.Exec(ctx, deleteObservationsQuery, profileIds, merged.Id); err != nil {
+		return 0, fmt.Errorf("failed to delete merged identifier observations: %w", err)
+	}
+
+	if err := r.mergeStats(txCtx, profileIds, merged.Id); err != nil {
+		return 0, err
+	}
+
+	if err := r.mergeSegments(txCtx, profileIds, merged.Id); err != nil {
+		return 0, err
+	}
+
+	if err := r.mergeConsents(txCtx, profileIds, merged.Id); err != nil {
+		return 0, err
+	}
+
+	if err := r.recordMerge(txCtx, profileIds, merged.Id); err != nil {
+		return 0, err
+	}
+
+	if err := r.moveProfileKeys(txCtx, profileIds, merged.Id); err != nil {
+		return 0, err
 	}
 
 	// Delete all other profiles
 	deleteQuery := `
-		DELETE FROM profiles
+		DELETE FROM ` + r.qualify("profiles") + `
 		WHERE id = ANY($1) AND id != $2`
 
 	_, err = tx.Exec(ctx, deleteQuery, profileIds, merged.Id)
 	if err != nil {
-		return fmt.Errorf("failed to delete merged profiles: %w", err)
+		return 0, fmt.Errorf("failed to delete merged profiles: %w", err)
+	}
+
+	// Commit if we started the transaction
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	return merged.Id, nil
+}
+
+// getMergeCandidates loads the identifier observations and stats of the profiles taking part in a merge
+func (r *PgProfileRepository) getMergeCandidates(ctx context.Context, profiles []Profile) ([]MergeCandidate, error) {
+	ids := make([]int, len(profiles))
+	for i, p := range profiles {
+		ids[i] = p.Id
+	}
+
+	observations, err := r.getObservations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := r.getStats(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]MergeCandidate, len(profiles))
+	for i, p := range profiles {
+		candidates[i] = MergeCandidate{Profile: p}
+		for _, o := range observations {
+			if o.ProfileId == p.Id {
+				candidates[i].Observations = append(candidates[i].Observations, o)
+			}
+		}
+		for _, st := range stats {
+			if st.ProfileId == p.Id {
+				candidates[i].Events = st.TotalEvents
+			}
+		}
+	}
+	return candidates, nil
+}
+
+func (r *PgProfileRepository) getObservations(ctx context.Context, profileIds []int) ([]IdentifierObservation, error) {
+	query := `
+		SELECT profile_id, identifier_type, value, source, first_seen, last_seen, seen_count
+		FROM ` + r.qualify("profile_identifiers") + `
+		WHERE profile_id = ANY($1)
+		ORDER BY profile_id, identifier_type, value`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, profileIds)
+	} else {
+		rows, err = r.pool.Query(ctx, query, profileIds)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query identifier observations: %w", err)
+	}
+	defer rows.Close()
+
+	observations, err := pgx.CollectRows(rows, pgx.RowToStructByName[IdentifierObservation])
+	if err != nil {
+		return nil, err
+	}
+	if err := revealObservations(r.protector, observations); err != nil {
+		return nil, err
+	}
+	return observations, nil
+}
+
+// RecordObservations records a sighting of every non-empty identifier of the event on the profile,
+// which the survivorship rules use to judge recency, frequency and source of identifier values.
+func (r *PgProfileRepository) RecordObservations(ctx context.Context, profileId int, event EventRecord) error {
+	types := make([]string, 0, 3)
+	values := make([]string, 0, 3)
+	for _, name := range event.GetIdentifierNames() {
+		value, _ := event.GetIdentifierValueByName(name)
+		if value == "" {
+			continue
+		}
+		protected, err := r.protector.Protect(name, value)
+		if err != nil {
+			return fmt.Errorf("failed to protect %s: %w", name, err)
+		}
+		types = append(types, name)
+		values = append(values, protected)
+	}
+	if len(types) == 0 {
+		return nil
+	}
+
+	query := `
+		INSERT INTO ` + r.qualify("profile_identifiers") + ` AS pi
+			(profile_id, identifier_type, value, source, first_seen, last_seen, seen_count)
+		SELECT $1, t.identifier_type, t.value, $4, $5, $5, 1
+		FROM unnest($2::text[], $3::text[]) AS t(identifier_type, value)
+		ON CONFLICT (profile_id, identifier_type, value) DO UPDATE SET
+			source = CASE WHEN EXCLUDED.last_seen >= pi.last_seen THEN EXCLUDED.source ELSE pi.source END,
+			first_seen = LEAST(pi.first_seen, EXCLUDED.first_seen),
+			last_seen = GREATEST(pi.last_seen, EXCLUDED.last_seen),
+			seen_count = pi.seen_count + 1`
+	args := []interface{}{profileId, types, values, event.Source, event.EventTimestamp}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to record identifier observations: %w", err)
+	}
+	return nil
+}
+
+// LockIdentifiers takes a transaction-scoped advisory lock for every non-empty identifier value of all the given
+// identifiers. Concurrent transactions stitching events which share an identifier are serialized, so only one
+// of them can observe "no profile found" and insert a new profile. The locks of all identifiers are acquired in
+// a single sorted order, so a transaction locking every identifier it will touch in one call cannot deadlock with
+// another doing the same. Locks are re-entrant and are released automatically on commit or rollback. The
+// identifiers are locked within the workspace the context is scoped to.
+func (r *PgProfileRepository) LockIdentifiers(ctx context.Context, identifiers ...EventIdentifier) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to lock identifiers: %w", ErrNoTransaction)
+	}
+
+	// Identifiers of different workspaces belong to different people, so they are locked independently
+	workspace, ok := WorkspaceFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("failed to lock identifiers: %w", ErrNoWorkspace)
+	}
+	prefix := ""
+	if workspace != DefaultWorkspace {
+		prefix = workspace + "/"
+	}
+	keys := make([]string, 0, 3*len(identifiers))
+	for _, identifier := range identifiers {
+		for _, name := range identifier.GetIdentifierNames() {
+			value, _ := identifier.GetIdentifierValueByName(name)
+			if value == "" {
+				continue
+			}
+			keys = append(keys, prefix+name+":"+value)
+		}
+	}
+	sort.Strings(keys)
+	keys = slices.Compact(keys)
+
+	// Shadow profiles are locked in a namespace of their own, so stitching into the shadow never waits for or blocks
+	// stitching of the live profiles
+	seed := 0
+	if r.schema != "" {
+		seed = 1
+	}
+	for _, key := range keys {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, $2))", key, seed); err != nil {
+			return fmt.Errorf("failed to lock identifier %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// ReplaceAllProfiles atomically discards every stored profile along with its identifier observations, stats,
+// segment memberships, consents and merge redirects, and bulk loads the given ones using COPY. The profile keys of
+// the snapshots are handed over to the loaded profiles. Profiles get new ids from the running id sequence, so ids
+// of discarded profiles are never reused, any id set on the input is ignored.
+func (r *PgProfileRepository) ReplaceAllProfiles(ctx context.Context, snapshots []ProfileSnapshot) (int, error) {
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	truncateQuery := "TRUNCATE TABLE " + r.qualify("profiles") + ", " + r.qualify("profile_identifiers") + ", " +
+		r.qualify("profile_stats") + ", " + r.qualify("profile_segments") + ", " + r.qualify("profile_merges") + ", " +
+		r.qualify("profile_consents")
+	if _, err := tx.Exec(ctx, truncateQuery); err != nil {
+		return 0, fmt.Errorf("failed to truncate profiles: %w", err)
+	}
+
+	// Allocate ids upfront, so the stats can reference the profiles they belong to
+	rows, err := tx.Query(ctx, "SELECT nextval('public.profiles_id_seq')::int FROM generate_series(1, $1)", len(snapshots))
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate profile ids: %w", err)
+	}
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate profile ids: %w", err)
+	}
+
+	copied, err := tx.CopyFrom(ctx,
+		r.tableIdentifier("profiles"),
+		[]string{"id", "cookie", "message_id", "phone", "traits", "workspace"},
+		pgx.CopyFromSlice(len(snapshots), func(i int) ([]any, error) {
+			p, err := protectProfile(r.protector, snapshots[i].Profile)
+			if err != nil {
+				return nil, err
+			}
+			return []any{ids[i], p.Cookie, p.MessageId, p.Phone, traitsArg(p.Traits), p.Workspace}, nil
+		}),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy profiles: %w", err)
+	}
+
+	if err := r.assignProfileKeys(ctx, tx, ids, snapshots); err != nil {
+		return 0, err
+	}
+
+	statsRows := make([][]any, 0, len(snapshots))
+	for i, snapshot := range snapshots {
+		stats := snapshot.Stats
+		if stats.TotalEvents == 0 {
+			continue
+		}
+		statsRows = append(statsRows, []any{ids[i], stats.FirstSeen, stats.LastSeen, stats.TotalEvents, stats.PurchaseCount,
+			stats.Revenue, nullTime(stats.LastPurchase)})
+	}
+	_, err = tx.CopyFrom(ctx,
+		r.tableIdentifier("profile_stats"),
+		[]string{"profile_id", "first_seen", "last_seen", "total_events", "purchase_count", "revenue", "last_purchase"},
+		pgx.CopyFromRows(statsRows),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy profile stats: %w", err)
+	}
+
+	var observationRows [][]any
+	for i, snapshot := range snapshots {
+		for _, o := range snapshot.Observations {
+			value, err := r.protector.Protect(o.IdentifierType, o.Value)
+			if err != nil {
+				return 0, fmt.Errorf("failed to protect %s: %w", o.IdentifierType, err)
+			}
+			observationRows = append(observationRows, []any{ids[i], o.IdentifierType, value, o.Source, o.FirstSeen, o.LastSeen, o.SeenCount})
+		}
+	}
+	_, err = tx.CopyFrom(ctx,
+		r.tableIdentifier("profile_identifiers"),
+		[]string{"profile_id", "identifier_type", "value", "source", "first_seen", "last_seen", "seen_count"},
+		pgx.CopyFromRows(observationRows),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy identifier observations: %w", err)
+	}
+
+	var segmentRows [][]any
+	enteredAt := time.Now().UTC()
+	for i, snapshot := range snapshots {
+		for _, segment := range snapshot.Segments {
+			segmentRows = append(segmentRows, []any{ids[i], segment, enteredAt})
+		}
+	}
+	_, err = tx.CopyFrom(ctx,
+		r.tableIdentifier("profile_segments"),
+		[]string{"profile_id", "segment", "entered_at"},
+		pgx.CopyFromRows(segmentRows),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy profile segments: %w", err)
+	}
+
+	var consentRows [][]any
+	for i, snapshot := range snapshots {
+		for _, c := range snapshot.Consents {
+			consentRows = append(consentRows, []any{ids[i], c.Purpose, c.IdentifierType, string(c.Status), c.SourceEventId, c.UpdatedAt})
+		}
+	}
+	_, err = tx.CopyFrom(ctx,
+		r.tableIdentifier("profile_consents"),
+		[]string{"profile_id", "purpose", "identifier_type", "status", "source_event_id", "updated_at"},
+		pgx.CopyFromRows(consentRows),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy profile consents: %w", err)
+	}
+
+	// Commit if we started the transaction
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	return int(copied), nil
+}
+
+func (r *PgProfileRepository) GetProfileById(ctx context.Context, id int) (Profile, bool, error) {
+	query := `
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE id = $1 AND ` + workspaceFilter("workspace", 2)
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, id, workspaceArg(ctx))
+	} else {
+		rows, err = r.pool.Query(ctx, query, id, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return Profile{}, false, fmt.Errorf("failed to query profile by id: %w", err)
+	}
+	defer rows.Close()
+
+	profile, err := pgx.CollectOneRow(rows, pgx.RowToStructByName[Profile])
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Profile{}, false, nil
+	}
+	if err != nil {
+		return Profile{}, false, fmt.Errorf("failed to collect profile by id: %w", err)
+	}
+	profiles := []Profile{profile}
+	if err := revealProfiles(r.protector, profiles); err != nil {
+		return Profile{}, false, err
+	}
+	return profiles[0], true, nil
+}
+
+// SetTraits applies the traits to the profile, keeping stored values which were observed later than the new ones
+func (r *PgProfileRepository) SetTraits(ctx context.Context, id int, traits Traits) error {
+	if len(traits) == 0 {
+		return nil
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	// Lock the profile row, so concurrent updates of its traits are applied one after another
+	var current Traits
+	selectQuery := "SELECT traits FROM " + r.qualify("profiles") + " WHERE id = $1 AND " + workspaceFilter("workspace", 2) + " FOR UPDATE"
+	if err := tx.QueryRow(ctx, selectQuery, id, workspaceArg(ctx)).Scan(&current); err != nil {
+		return fmt.Errorf("failed to query profile traits: %w", err)
+	}
+
+	updateQuery := "UPDATE " + r.qualify("profiles") + " SET traits = $1, updated_at = now() AT TIME ZONE 'utc' WHERE id = $2"
+	if _, err := tx.Exec(ctx, updateQuery, traitsArg(current.Apply(traits)), id); err != nil {
+		return fmt.Errorf("failed to set profile traits: %w", err)
 	}
 
 	// Commit if we started the transaction
@@ -278,3 +871,40 @@ func (r *PgProfileRepository) MergeProfiles(ctx context.Context, profileIds []in
 
 	return nil
 }
+
+// GetProfilesByTrait returns the profiles whose trait has the given type and value
+func (r *PgProfileRepository) GetProfilesByTrait(ctx context.Context, name string, value TraitValue) ([]Profile, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode trait value: %w", err)
+	}
+	// Drop updated_at, so the containment query matches regardless of when the trait was set
+	var match map[string]any
+	if err := json.Unmarshal(encoded, &match); err != nil {
+		return nil, fmt.Errorf("failed to encode trait value: %w", err)
+	}
+	delete(match, "updated_at")
+
+	query := `
+		SELECT id, cookie, message_id, phone, traits, workspace
+		FROM ` + r.qualify("profiles") + `
+		WHERE traits @> jsonb_build_object($1::text, $2::jsonb) AND ` + workspaceFilter("workspace", 3) + `
+		ORDER BY id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, name, match, workspaceArg(ctx))
+	} else {
+		rows, err = r.pool.Query(ctx, query, name, match, workspaceArg(ctx))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profiles by trait: %w", err)
+	}
+	defer rows.Close()
+
+	return r.collectProfiles(rows)
+}
@@ -1,8 +1,12 @@
 package db_test
 
 import (
+	"context"
+	"fmt"
 	"slices"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -15,7 +19,7 @@ type profileTestContext struct {
 	repo     db.ProfileRepository
 }
 
-func setupProfileTest(ctx SpecContext) *profileTestContext {
+func setupProfileTest(ctx context.Context) *profileTestContext {
 	var err error
 	tc := &profileTestContext{}
 
@@ -25,7 +29,7 @@ func setupProfileTest(ctx SpecContext) *profileTestContext {
 	tc.repo = db.NewPgProfileRepository(tc.connPool)
 
 	// Clean up the database before each test
-	_, err = tc.connPool.Exec(ctx, "TRUNCATE TABLE profiles")
+	_, err = tc.connPool.Exec(ctx, "TRUNCATE TABLE profiles, profile_identifiers, profile_stats, profile_segments, profile_merges, profile_consents, segment_transitions")
 	Expect(err).NotTo(HaveOccurred())
 
 	return tc
@@ -40,7 +44,8 @@ func (tc *profileTestContext) cleanup() {
 var _ = Describe("Profile Repository", func() {
 	var tc *profileTestContext
 
-	BeforeEach(func(ctx SpecContext) {
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		tc = setupProfileTest(ctx)
 	})
 
@@ -48,7 +53,8 @@ var _ = Describe("Profile Repository", func() {
 		tc.cleanup()
 	})
 
-	It("should insert and retrieve a profile by each identifier", func(ctx SpecContext) {
+	It("should insert and retrieve a profile by each identifier", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		profile := db.Profile{
 			Cookie:    "test-cookie",
 			MessageId: "test-message",
@@ -94,7 +100,8 @@ var _ = Describe("Profile Repository", func() {
 	})
 
 	DescribeTable("should enrich profile data",
-		func(ctx SpecContext, originalProfile db.Profile, identifiers db.EventIdentifier, expectedProfile db.Profile) {
+		func(spec SpecContext, originalProfile db.Profile, identifiers db.EventIdentifier, expectedProfile db.Profile) {
+			ctx := db.AllWorkspaces(spec)
 			profileId, err := tc.repo.InsertProfile(ctx, originalProfile)
 			Expect(err).NotTo(HaveOccurred())
 
@@ -195,7 +202,8 @@ var _ = Describe("Profile Repository", func() {
 		),
 	)
 
-	It("should return not found for non-existent identifiers", func(ctx SpecContext) {
+	It("should return not found for non-existent identifiers", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		_, found, err := tc.repo.TryGetProfilesByIdentifiers(ctx, db.EventIdentifier{
 			Cookie: "non-existent",
 		})
@@ -203,7 +211,27 @@ var _ = Describe("Profile Repository", func() {
 		Expect(found).To(BeFalse())
 	})
 
-	It("should handle all combinations of identifiers", func(ctx SpecContext) {
+	It("should only find profiles of the workspace and refuse queries without one", func(spec SpecContext) {
+		brandA := db.WithWorkspace(spec, "brand-a")
+		_, err := tc.repo.InsertProfile(brandA, db.Profile{Cookie: "shared-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, found, err := tc.repo.TryGetProfilesByIdentifiers(db.WithWorkspace(spec, "brand-b"), db.EventIdentifier{Cookie: "shared-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+		profiles, found, err := tc.repo.TryGetProfilesByIdentifiers(brandA, db.EventIdentifier{Cookie: "shared-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(profiles[0].Workspace).To(Equal("brand-a"))
+
+		_, err = tc.repo.GetAllProfiles(spec)
+		Expect(err).To(MatchError(db.ErrNoWorkspace))
+		_, err = tc.repo.InsertProfile(spec, db.Profile{Cookie: "other-cookie"})
+		Expect(err).To(MatchError(db.ErrNoWorkspace))
+	})
+
+	It("should handle all combinations of identifiers", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		profile := db.Profile{
 			Cookie:    "test-cookie",
 			MessageId: "test-message",
@@ -237,7 +265,8 @@ var _ = Describe("Profile Repository", func() {
 		}
 	})
 
-	It("should handle empty identifiers", func(ctx SpecContext) {
+	It("should handle empty identifiers", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		// Test with all empty identifiers
 		_, found, err := tc.repo.TryGetProfilesByIdentifiers(ctx, db.EventIdentifier{})
 		Expect(err).NotTo(HaveOccurred())
@@ -253,7 +282,8 @@ var _ = Describe("Profile Repository", func() {
 		Expect(found).To(BeFalse())
 	})
 
-	It("should skip empty identifiers when searching", func(ctx SpecContext) {
+	It("should skip empty identifiers when searching", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		profile := db.Profile{
 			Cookie:    "test-cookie",
 			MessageId: "", // Empty message_id
@@ -280,7 +310,8 @@ var _ = Describe("Profile Repository", func() {
 		Expect(found).To(BeFalse())
 	})
 
-	It("should handle case sensitivity in identifiers", func(ctx SpecContext) {
+	It("should handle case sensitivity in identifiers", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
 		profile := db.Profile{
 			Cookie:    "Test-Cookie",
 			MessageId: "Test-Message",
@@ -305,8 +336,251 @@ var _ = Describe("Profile Repository", func() {
 		}
 	})
 
+	It("should set, merge and query traits", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		profileId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tc.repo.SetTraits(ctx, profileId, db.Traits{
+			"country": db.StringTrait("SK", baseTime.Add(time.Hour)),
+			"tier":    db.StringTrait("gold", baseTime),
+		})).To(Succeed())
+		Expect(tc.repo.SetTraits(ctx, profileId, db.Traits{
+			"country": db.StringTrait("CZ", baseTime),
+			"opt_in":  db.BoolTrait(true, baseTime),
+		})).To(Succeed())
+
+		profile, found, err := tc.repo.GetProfileById(ctx, profileId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(profile.Traits).To(Equal(db.Traits{
+			"country": db.StringTrait("SK", baseTime.Add(time.Hour)),
+			"tier":    db.StringTrait("gold", baseTime),
+			"opt_in":  db.BoolTrait(true, baseTime),
+		}))
+
+		profiles, err := tc.repo.GetProfilesByTrait(ctx, "country", db.StringTrait("SK", time.Time{}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(HaveLen(1))
+		Expect(profiles[0].Id).To(Equal(profileId))
+
+		profiles, err = tc.repo.GetProfilesByTrait(ctx, "opt_in", db.BoolTrait(false, time.Time{}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(BeEmpty())
+
+		_, found, err = tc.repo.GetProfileById(ctx, profileId+1000)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("should record and merge profile stats", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		firstId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-1"})
+		Expect(err).NotTo(HaveOccurred())
+		secondId, err := tc.repo.InsertProfile(ctx, db.Profile{Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tc.repo.RecordEventStats(ctx, firstId, db.EventRecord{EventTimestamp: baseTime.Add(time.Hour)})).To(Succeed())
+		Expect(tc.repo.RecordEventStats(ctx, firstId, db.EventRecord{
+			EventId:        db.EventIdPurchase,
+			EventTimestamp: baseTime.Add(2 * time.Hour),
+			Revenue:        10.5,
+		})).To(Succeed())
+		Expect(tc.repo.RecordEventStats(ctx, secondId, db.EventRecord{
+			EventId:        db.EventIdPurchase,
+			EventTimestamp: baseTime,
+			Revenue:        4.25,
+		})).To(Succeed())
+
+		stats, found, err := tc.repo.GetProfileStats(ctx, firstId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(stats).To(Equal(db.ProfileStats{
+			ProfileId:     firstId,
+			FirstSeen:     baseTime.Add(time.Hour),
+			LastSeen:      baseTime.Add(2 * time.Hour),
+			TotalEvents:   2,
+			PurchaseCount: 1,
+			Revenue:       10.5,
+			LastPurchase:  baseTime.Add(2 * time.Hour),
+		}))
+
+		survivorId, err := tc.repo.MergeProfiles(ctx, []int{firstId, secondId})
+		Expect(err).NotTo(HaveOccurred())
+
+		stats, found, err = tc.repo.GetProfileStats(ctx, survivorId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(stats).To(Equal(db.ProfileStats{
+			ProfileId:     survivorId,
+			FirstSeen:     baseTime,
+			LastSeen:      baseTime.Add(2 * time.Hour),
+			TotalEvents:   3,
+			PurchaseCount: 2,
+			Revenue:       14.75,
+			LastPurchase:  baseTime.Add(2 * time.Hour),
+		}))
+
+		_, found, err = tc.repo.GetProfileStats(ctx, secondId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+	})
+
+	It("should take forgotten events back from stats and observations", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		id, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-1", Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+		first := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-1", Phone: "111"}, EventTimestamp: baseTime}
+		purchase := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-1"}, EventTimestamp: baseTime.Add(time.Hour),
+			EventId: db.EventIdPurchase, Revenue: 10}
+		for _, event := range []db.EventRecord{first, purchase} {
+			Expect(tc.repo.RecordEventStats(ctx, id, event)).To(Succeed())
+			Expect(tc.repo.RecordObservations(ctx, id, event)).To(Succeed())
+		}
+
+		tx, err := tc.connPool.Begin(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		defer tx.Rollback(ctx)
+		txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+		Expect(tc.repo.ForgetEvent(txCtx, id, first)).To(Succeed())
+
+		stats, found, err := tc.repo.GetProfileStats(txCtx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(stats.TotalEvents).To(Equal(1))
+		Expect(stats.PurchaseCount).To(Equal(1))
+		Expect(stats.Revenue).To(Equal(10.0))
+
+		rows, err := tx.Query(ctx, "SELECT identifier_type, seen_count FROM profile_identifiers WHERE profile_id = $1", id)
+		Expect(err).NotTo(HaveOccurred())
+		counts, err := pgx.CollectRows(rows, pgx.RowToStructByName[struct {
+			IdentifierType string `db:"identifier_type"`
+			SeenCount      int    `db:"seen_count"`
+		}])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counts).To(HaveLen(1))
+		Expect(counts[0].IdentifierType).To(Equal("cookie"))
+		Expect(counts[0].SeenCount).To(Equal(1))
+
+		Expect(tc.repo.ForgetEvent(ctx, id, purchase)).To(MatchError(db.ErrNoTransaction))
+	})
+
+	It("should track segment memberships and log transitions", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		eventRepo := db.NewPgEventRepository(tc.connPool)
+		firstId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-1"})
+		Expect(err).NotTo(HaveOccurred())
+		secondId, err := tc.repo.InsertProfile(ctx, db.Profile{Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+
+		transitions, err := tc.repo.UpdateSegments(ctx, firstId, []string{"buyers", "web"}, baseTime)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transitions).To(HaveLen(2))
+
+		transitions, err = tc.repo.UpdateSegments(ctx, firstId, []string{"buyers", "vip"}, baseTime.Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transitions).To(Equal([]db.SegmentTransition{
+			{ProfileId: firstId, Segment: "vip", Entered: true, OccurredAt: baseTime.Add(time.Hour)},
+			{ProfileId: firstId, Segment: "web", Entered: false, OccurredAt: baseTime.Add(time.Hour)},
+		}))
+		Expect(eventRepo.InsertSegmentTransitions(ctx, transitions)).To(Succeed())
+
+		logged, err := eventRepo.GetSegmentTransitions(ctx, firstId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logged).To(Equal(transitions))
+
+		_, err = tc.repo.UpdateSegments(ctx, secondId, []string{"app"}, baseTime)
+		Expect(err).NotTo(HaveOccurred())
+
+		survivorId, err := tc.repo.MergeProfiles(ctx, []int{firstId, secondId})
+		Expect(err).NotTo(HaveOccurred())
+
+		segments, err := tc.repo.GetProfileSegments(ctx, survivorId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(segments).To(Equal([]string{"app", "buyers", "vip"}))
+	})
+
+	It("should record consents and keep denials on merge", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		firstId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "cookie-1"})
+		Expect(err).NotTo(HaveOccurred())
+		secondId, err := tc.repo.InsertProfile(ctx, db.Profile{Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tc.repo.SetConsents(ctx, firstId, db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentDenied, SourceEventId: 1, UpdatedAt: baseTime.Add(time.Hour)},
+			{Purpose: db.PurposeWebhooks, Status: db.ConsentGranted, SourceEventId: 1, UpdatedAt: baseTime.Add(time.Hour)},
+		})).To(Succeed())
+		// An older decision does not replace a newer one
+		Expect(tc.repo.SetConsents(ctx, firstId, db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentGranted, SourceEventId: 2, UpdatedAt: baseTime},
+		})).To(Succeed())
+		Expect(tc.repo.SetConsents(ctx, secondId, db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentGranted, SourceEventId: 3, UpdatedAt: baseTime.Add(2 * time.Hour)},
+			{Purpose: db.PurposeWebhooks, Status: db.ConsentDenied, IdentifierType: "phone", SourceEventId: 3, UpdatedAt: baseTime},
+		})).To(Succeed())
+		Expect(tc.repo.SetConsents(ctx, secondId, db.Consents{{Purpose: "ads", Status: "maybe"}})).NotTo(Succeed())
+
+		survivorId, err := tc.repo.MergeProfiles(ctx, []int{firstId, secondId})
+		Expect(err).NotTo(HaveOccurred())
+
+		consents, err := tc.repo.GetConsents(ctx, []int{firstId, secondId})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consents).To(HaveLen(1))
+		Expect(consents[survivorId]).To(Equal(db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentDenied, SourceEventId: 1, UpdatedAt: baseTime.Add(time.Hour)},
+			{Purpose: db.PurposeWebhooks, Status: db.ConsentGranted, SourceEventId: 1, UpdatedAt: baseTime.Add(time.Hour)},
+			{Purpose: db.PurposeWebhooks, IdentifierType: "phone", Status: db.ConsentDenied, SourceEventId: 3, UpdatedAt: baseTime},
+		}))
+	})
+
+	It("should replace all profiles with their observations and segments and keep ids running", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		staleId, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		replaced, err := tc.repo.ReplaceAllProfiles(ctx, []db.ProfileSnapshot{{
+			Profile: db.Profile{Cookie: "cookie-1", Phone: "111"},
+			Stats:   db.ProfileStats{FirstSeen: baseTime, LastSeen: baseTime.Add(time.Hour), TotalEvents: 2},
+			Observations: []db.IdentifierObservation{
+				{IdentifierType: "cookie", Value: "cookie-1", Source: "web", FirstSeen: baseTime, LastSeen: baseTime.Add(time.Hour), SeenCount: 2},
+				{IdentifierType: "phone", Value: "111", Source: "crm", FirstSeen: baseTime, LastSeen: baseTime, SeenCount: 1},
+			},
+			Segments: []string{"vip"},
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(replaced).To(Equal(1))
+
+		profiles, err := tc.repo.GetAllProfiles(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(HaveLen(1))
+		Expect(profiles[0].Id).To(BeNumerically(">", staleId))
+
+		rows, err := tc.connPool.Query(ctx, `
+			SELECT profile_id, identifier_type, value, source, first_seen, last_seen, seen_count
+			FROM profile_identifiers ORDER BY identifier_type`)
+		Expect(err).NotTo(HaveOccurred())
+		observations, err := pgx.CollectRows(rows, pgx.RowToStructByName[db.IdentifierObservation])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(observations).To(Equal([]db.IdentifierObservation{
+			{ProfileId: profiles[0].Id, IdentifierType: "cookie", Value: "cookie-1", Source: "web", FirstSeen: baseTime, LastSeen: baseTime.Add(time.Hour), SeenCount: 2},
+			{ProfileId: profiles[0].Id, IdentifierType: "phone", Value: "111", Source: "crm", FirstSeen: baseTime, LastSeen: baseTime, SeenCount: 1},
+		}))
+
+		segments, err := tc.repo.GetProfileSegments(ctx, profiles[0].Id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(segments).To(Equal([]string{"vip"}))
+	})
+
 	Describe("Profile Merging", func() {
-		It("should merge profiles and keep the lowest values", func(ctx SpecContext) {
+		It("should merge profiles and keep the lowest values", func(spec SpecContext) {
+			ctx := db.AllWorkspaces(spec)
 			// Create first profile
 			profile1 := db.Profile{
 				Cookie:    "test-cookie",
@@ -326,8 +600,9 @@ var _ = Describe("Profile Repository", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			// Merge profiles
-			err = tc.repo.MergeProfiles(ctx, []int{profile1Id, profile2Id})
+			survivorId, err := tc.repo.MergeProfiles(ctx, []int{profile1Id, profile2Id})
 			Expect(err).NotTo(HaveOccurred())
+			Expect(survivorId).To(Equal(profile1Id))
 
 			// Verify only one profile remains
 			profiles, err := tc.repo.GetAllProfiles(ctx)
@@ -343,7 +618,8 @@ var _ = Describe("Profile Repository", func() {
 			}))
 		})
 
-		It("should preserve non-empty values when merging", func(ctx SpecContext) {
+		It("should preserve non-empty values when merging", func(spec SpecContext) {
+			ctx := db.AllWorkspaces(spec)
 			// Create first profile with some empty values
 			profile1 := db.Profile{
 				Cookie:    "test-cookie",
@@ -363,7 +639,7 @@ var _ = Describe("Profile Repository", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			// Merge profiles
-			err = tc.repo.MergeProfiles(ctx, []int{profile1Id, profile2Id})
+			_, err = tc.repo.MergeProfiles(ctx, []int{profile1Id, profile2Id})
 			Expect(err).NotTo(HaveOccurred())
 
 			// Verify merged profile preserves non-empty values
@@ -377,7 +653,8 @@ var _ = Describe("Profile Repository", func() {
 			}))
 		})
 
-		It("should handle merging multiple profiles", func(ctx SpecContext) {
+		It("should handle merging multiple profiles", func(spec SpecContext) {
+			ctx := db.AllWorkspaces(spec)
 			// Create three profiles with different values
 			profiles := []db.Profile{
 				{Cookie: "c-cookie", MessageId: "c-message", Phone: "123456789"},
@@ -393,7 +670,7 @@ var _ = Describe("Profile Repository", func() {
 			}
 
 			// Merge profiles
-			err := tc.repo.MergeProfiles(ctx, profileIds)
+			_, err := tc.repo.MergeProfiles(ctx, profileIds)
 			Expect(err).NotTo(HaveOccurred())
 
 			// Verify merged profile has the lowest values
@@ -409,5 +686,190 @@ var _ = Describe("Profile Repository", func() {
 				Phone:     "123456789",
 			}))
 		})
+
+		It("should redirect merged profiles to the latest survivor", func(spec SpecContext) {
+			ctx := db.AllWorkspaces(spec)
+			profileIds := make([]int, 3)
+			for i := range profileIds {
+				id, err := tc.repo.InsertProfile(ctx, db.Profile{Cookie: fmt.Sprintf("cookie-%d", i)})
+				Expect(err).NotTo(HaveOccurred())
+				profileIds[i] = id
+			}
+
+			firstSurvivor, err := tc.repo.MergeProfiles(ctx, profileIds[1:])
+			Expect(err).NotTo(HaveOccurred())
+			absorbed := profileIds[1]
+			if absorbed == firstSurvivor {
+				absorbed = profileIds[2]
+			}
+
+			survivorId, err := tc.repo.MergeProfiles(ctx, []int{profileIds[0], firstSurvivor})
+			Expect(err).NotTo(HaveOccurred())
+
+			// Both the earlier and the latest absorbed profile lead to the survivor
+			for _, id := range []int{absorbed, firstSurvivor} {
+				if id == survivorId {
+					continue
+				}
+				redirect, merged, err := tc.repo.GetMergeSurvivor(ctx, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(merged).To(BeTrue())
+				Expect(redirect).To(Equal(survivorId))
+			}
+
+			_, merged, err := tc.repo.GetMergeSurvivor(ctx, survivorId)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(merged).To(BeFalse())
+		})
+
+		It("should apply survivorship rules using recorded observations", func(spec SpecContext) {
+			ctx := db.AllWorkspaces(spec)
+			repo := db.NewPgProfileRepository(tc.connPool)
+			repo.SetSurvivorshipRules(db.SurvivorshipRules{
+				Survivor: db.SurvivorMostEvents,
+				Fields: map[string]db.FieldPolicy{
+					"cookie": db.PolicyMostRecent,
+					"phone":  db.PolicySourcePriority,
+				},
+				SourcePriority: []string{"crm", "web"},
+			})
+
+			baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			profile1Id, err := repo.InsertProfile(ctx, db.Profile{Cookie: "old-cookie", Phone: "111"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(repo.RecordObservations(ctx, profile1Id, db.EventRecord{
+				EventIdentifier: db.EventIdentifier{Cookie: "old-cookie", Phone: "111"},
+				EventTimestamp:  baseTime,
+				Source:          "crm",
+			})).To(Succeed())
+
+			profile2Id, err := repo.InsertProfile(ctx, db.Profile{Cookie: "new-cookie", Phone: "222"})
+			Expect(err).NotTo(HaveOccurred())
+			for i := 1; i <= 2; i++ {
+				Expect(repo.RecordObservations(ctx, profile2Id, db.EventRecord{
+					EventIdentifier: db.EventIdentifier{Cookie: "new-cookie", Phone: "222"},
+					EventTimestamp:  baseTime.Add(time.Duration(i) * time.Hour),
+					Source:          "web",
+				})).To(Succeed())
+			}
+
+			survivorId, err := repo.MergeProfiles(ctx, []int{profile1Id, profile2Id})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(survivorId).To(Equal(profile2Id))
+
+			profiles, err := repo.GetAllProfiles(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(profiles).To(Equal([]db.Profile{{Id: profile2Id, Cookie: "new-cookie", Phone: "111"}}))
+		})
+	})
+})
+
+var _ = Describe("Survivorship Rules", func() {
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	observation := func(profileId int, identifierType, value, source string, lastSeenHours, count int) db.IdentifierObservation {
+		return db.IdentifierObservation{
+			ProfileId:      profileId,
+			IdentifierType: identifierType,
+			Value:          value,
+			Source:         source,
+			FirstSeen:      baseTime,
+			LastSeen:       baseTime.Add(time.Duration(lastSeenHours) * time.Hour),
+			SeenCount:      count,
+		}
+	}
+	candidates := []db.MergeCandidate{
+		{
+			Profile: db.Profile{Id: 1, Cookie: "b-cookie", MessageId: "", Phone: "111"},
+			Observations: []db.IdentifierObservation{
+				observation(1, "cookie", "b-cookie", "web", 5, 1),
+				observation(1, "phone", "111", "crm", 1, 1),
+			},
+			Events: 1,
+		},
+		{
+			Profile: db.Profile{Id: 2, Cookie: "a-cookie", MessageId: "message", Phone: "222"},
+			Observations: []db.IdentifierObservation{
+				observation(2, "cookie", "a-cookie", "web", 1, 7),
+				observation(2, "message_id", "message", "web", 1, 7),
+				observation(2, "phone", "222", "web", 9, 7),
+			},
+			Events: 7,
+		},
+	}
+
+	DescribeTable("should pick field values and the survivor",
+		func(rules db.SurvivorshipRules, expected db.Profile) {
+			Expect(rules.Validate()).To(Succeed())
+			Expect(rules.Merge(candidates)).To(Equal(expected))
+		},
+		Entry("default rules keep the oldest profile and lowest values",
+			db.DefaultSurvivorshipRules(),
+			db.Profile{Id: 1, Cookie: "a-cookie", MessageId: "message", Phone: "111"},
+		),
+		Entry("most recent values",
+			db.SurvivorshipRules{Survivor: db.SurvivorOldest, Fields: map[string]db.FieldPolicy{
+				"cookie": db.PolicyMostRecent, "phone": db.PolicyMostRecent,
+			}},
+			db.Profile{Id: 1, Cookie: "b-cookie", MessageId: "message", Phone: "222"},
+		),
+		Entry("most frequent values on the busiest profile",
+			db.SurvivorshipRules{Survivor: db.SurvivorMostEvents, Fields: map[string]db.FieldPolicy{
+				"cookie": db.PolicyMostFrequent,
+			}},
+			db.Profile{Id: 2, Cookie: "a-cookie", MessageId: "message", Phone: "111"},
+		),
+		Entry("source priority",
+			db.SurvivorshipRules{Survivor: db.SurvivorOldest, SourcePriority: []string{"crm"}, Fields: map[string]db.FieldPolicy{
+				"phone": db.PolicySourcePriority,
+			}},
+			db.Profile{Id: 1, Cookie: "a-cookie", MessageId: "message", Phone: "111"},
+		),
+		Entry("non-empty values of the profile with most identifiers",
+			db.SurvivorshipRules{Survivor: db.SurvivorMostIdentifiers, Fields: map[string]db.FieldPolicy{
+				"cookie": db.PolicyNonEmpty, "message_id": db.PolicyNonEmpty, "phone": db.PolicyNonEmpty,
+			}},
+			db.Profile{Id: 2, Cookie: "a-cookie", MessageId: "message", Phone: "222"},
+		),
+	)
+
+	It("should merge traits by their policies", func() {
+		rules := db.DefaultSurvivorshipRules()
+		rules.Traits["signup_channel"] = db.PolicyFirstSeen
+		rules.Traits["name"] = db.PolicyNonEmpty
+
+		merged := rules.Merge([]db.MergeCandidate{
+			{Profile: db.Profile{Id: 1, Traits: db.Traits{
+				"tier":           db.StringTrait("gold", baseTime),
+				"signup_channel": db.StringTrait("web", baseTime),
+				"name":           db.StringTrait("", baseTime.Add(time.Hour)),
+			}}},
+			{Profile: db.Profile{Id: 2, Traits: db.Traits{
+				"tier":           db.StringTrait("silver", baseTime.Add(time.Hour)),
+				"signup_channel": db.StringTrait("app", baseTime.Add(time.Hour)),
+				"name":           db.StringTrait("Jane", baseTime),
+				"country":        db.StringTrait("SK", baseTime),
+			}}},
+		})
+
+		Expect(merged.Traits).To(Equal(db.Traits{
+			"tier":           db.StringTrait("silver", baseTime.Add(time.Hour)),
+			"signup_channel": db.StringTrait("web", baseTime),
+			"name":           db.StringTrait("Jane", baseTime),
+			"country":        db.StringTrait("SK", baseTime),
+		}))
+	})
+
+	It("should reject unknown policies", func() {
+		rules := db.DefaultSurvivorshipRules()
+		rules.Fields["email"] = db.PolicyMostRecent
+		Expect(rules.Validate()).NotTo(Succeed())
+
+		rules = db.DefaultSurvivorshipRules()
+		rules.Survivor = "youngest"
+		Expect(rules.Validate()).NotTo(Succeed())
+
+		rules = db.DefaultSurvivorshipRules()
+		rules.Traits["tier"] = db.PolicyMostFrequent
+		Expect(rules.Validate()).NotTo(Succeed())
 	})
 })
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// UpdateSegments replaces the segment memberships of a profile with the given segment names
+// and returns the transitions this caused, entered segments first
+func (r *PgProfileRepository) UpdateSegments(ctx context.Context, profileId int, segments []string, at time.Time) ([]SegmentTransition, error) {
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	selectQuery := "SELECT segment FROM " + r.qualify("profile_segments") + " WHERE profile_id = $1 FOR UPDATE"
+	rows, err := tx.Query(ctx, selectQuery, profileId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile segments: %w", err)
+	}
+	current, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect profile segments: %w", err)
+	}
+
+	var entered, exited []string
+	for _, segment := range segments {
+		if !slices.Contains(current, segment) {
+			entered = append(entered, segment)
+		}
+	}
+	for _, segment := range current {
+		if !slices.Contains(segments, segment) {
+			exited = append(exited, segment)
+		}
+	}
+
+	if len(entered) > 0 {
+		insertQuery := `
+			INSERT INTO ` + r.qualify("profile_segments") + ` (profile_id, segment, entered_at)
+			SELECT $1, segment, $3 FROM unnest($2::text[]) AS segment`
+		if _, err := tx.Exec(ctx, insertQuery, profileId, entered, at); err != nil {
+			return nil, fmt.Errorf("failed to insert profile segments: %w", err)
+		}
+	}
+	if len(exited) > 0 {
+		deleteQuery := "DELETE FROM " + r.qualify("profile_segments") + " WHERE profile_id = $1 AND segment = ANY($2)"
+		if _, err := tx.Exec(ctx, deleteQuery, profileId, exited); err != nil {
+			return nil, fmt.Errorf("failed to delete profile segments: %w", err)
+		}
+	}
+
+	// Commit if we started the transaction
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	transitions := make([]SegmentTransition, 0, len(entered)+len(exited))
+	for _, segment := range entered {
+		transitions = append(transitions, SegmentTransition{ProfileId: profileId, Segment: segment, Entered: true, OccurredAt: at})
+	}
+	for _, segment := range exited {
+		transitions = append(transitions, SegmentTransition{ProfileId: profileId, Segment: segment, Entered: false, OccurredAt: at})
+	}
+	return transitions, nil
+}
+
+// GetProfileSegments returns the names of the segments the profile is a member of
+func (r *PgProfileRepository) GetProfileSegments(ctx context.Context, profileId int) ([]string, error) {
+	query := "SELECT segment FROM " + r.qualify("profile_segments") + " WHERE profile_id = $1 ORDER BY segment"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, profileId)
+	} else {
+		rows, err = r.pool.Query(ctx, query, profileId)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile segments: %w", err)
+	}
+	defer rows.Close()
+
+	segments, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect profile segments: %w", err)
+	}
+	return segments, nil
+}
+
+// mergeSegments moves the segment memberships of all merged profiles to the survivor, keeping the earliest entry
+func (r *PgProfileRepository) mergeSegments(ctx context.Context, profileIds []int, survivorId int) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to merge profile segments: %w", ErrNoTransaction)
+	}
+
+	combineQuery := `
+		INSERT INTO ` + r.qualify("profile_segments") + ` AS ps (profile_id, segment, entered_at)
+		SELECT $2, segment, MIN(entered_at)
+		FROM ` + r.qualify("profile_segments") + `
+		WHERE profile_id = ANY($1)
+		GROUP BY segment
+		ON CONFLICT (profile_id, segment) DO UPDATE SET entered_at = EXCLUDED.entered_at`
+
+	if _, err := tx.Exec(ctx, combineQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to merge profile segments: %w", err)
+	}
+
+	deleteQuery := `
+		DELETE FROM ` + r.qualify("profile_segments") + `
+		WHERE profile_id = ANY($1) AND profile_id != $2`
+
+	if _, err := tx.Exec(ctx, deleteQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to delete merged profile segments: %w", err)
+	}
+	return nil
+}
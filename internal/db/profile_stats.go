@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// RecordEventStats accounts for the event in the stats of the profile it was stitched to
+func (r *PgProfileRepository) RecordEventStats(ctx context.Context, profileId int, event EventRecord) error {
+	query := `
+		INSERT INTO ` + r.qualify("profile_stats") + ` AS ps
+			(profile_id, first_seen, last_seen, total_events, purchase_count, revenue, last_purchase)
+		VALUES ($1, $2, $2, 1, $3, $4, CASE WHEN $3 > 0 THEN $2::timestamp END)
+		ON CONFLICT (profile_id) DO UPDATE SET
+			first_seen = LEAST(ps.first_seen, EXCLUDED.first_seen),
+			last_seen = GREATEST(ps.last_seen, EXCLUDED.last_seen),
+			total_events = ps.total_events + 1,
+			purchase_count = ps.purchase_count + EXCLUDED.purchase_count,
+			revenue = ps.revenue + EXCLUDED.revenue,
+			last_purchase = GREATEST(ps.last_purchase, EXCLUDED.last_purchase),
+			updated_at = EXCLUDED.updated_at`
+	args := []interface{}{profileId, event.EventTimestamp, event.purchases(), event.revenue()}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to record profile stats: %w", err)
+	}
+	return nil
+}
+
+// ForgetEvent takes the event back from the stats and identifier observations of the profile it was stitched to,
+// so stitching it again does not count it twice. Counts drop by the event, rows left without any event are removed.
+// The first and last seen timestamps are kept, stitching the event again leaves them as they are.
+func (r *PgProfileRepository) ForgetEvent(ctx context.Context, profileId int, event EventRecord) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to forget event: %w", ErrNoTransaction)
+	}
+
+	statsQuery := `
+		UPDATE ` + r.qualify("profile_stats") + ` SET
+			total_events = total_events - 1,
+			purchase_count = purchase_count - $2,
+			revenue = revenue - $3
+		WHERE profile_id = $1`
+	if _, err := tx.Exec(ctx, statsQuery, profileId, event.purchases(), event.revenue()); err != nil {
+		return fmt.Errorf("failed to forget event stats: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM "+r.qualify("profile_stats")+" WHERE profile_id = $1 AND total_events <= 0", profileId); err != nil {
+		return fmt.Errorf("failed to forget event stats: %w", err)
+	}
+
+	types := make([]string, 0, 3)
+	values := make([]string, 0, 3)
+	for _, identifier := range event.Identifiers() {
+		protected, err := r.protector.Protect(identifier.Type, identifier.Value)
+		if err != nil {
+			return fmt.Errorf("failed to protect %s: %w", identifier.Type, err)
+		}
+		types = append(types, identifier.Type)
+		values = append(values, protected)
+	}
+	observationsQuery := `
+		UPDATE ` + r.qualify("profile_identifiers") + ` pi SET seen_count = pi.seen_count - 1
+		FROM unnest($2::text[], $3::text[]) AS t(identifier_type, value)
+		WHERE pi.profile_id = $1 AND pi.identifier_type = t.identifier_type AND pi.value = t.value`
+	if _, err := tx.Exec(ctx, observationsQuery, profileId, types, values); err != nil {
+		return fmt.Errorf("failed to forget identifier observations: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM "+r.qualify("profile_identifiers")+" WHERE profile_id = $1 AND seen_count <= 0", profileId); err != nil {
+		return fmt.Errorf("failed to forget identifier observations: %w", err)
+	}
+	return nil
+}
+
+func (r *PgProfileRepository) GetProfileStats(ctx context.Context, profileId int) (ProfileStats, bool, error) {
+	stats, err := r.getStats(ctx, []int{profileId})
+	if err != nil {
+		return ProfileStats{}, false, err
+	}
+	if len(stats) == 0 {
+		return ProfileStats{}, false, nil
+	}
+	return stats[0], true, nil
+}
+
+func (r *PgProfileRepository) getStats(ctx context.Context, profileIds []int) ([]ProfileStats, error) {
+	query := `
+		SELECT profile_id, first_seen, last_seen, total_events, purchase_count, revenue::float8 AS revenue,
+			COALESCE(last_purchase, '0001-01-01') AS last_purchase
+		FROM ` + r.qualify("profile_stats") + `
+		WHERE profile_id = ANY($1)
+		ORDER BY profile_id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, profileIds)
+	} else {
+		rows, err = r.pool.Query(ctx, query, profileIds)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profile stats: %w", err)
+	}
+	defer rows.Close()
+
+	stats, err := pgx.CollectRows(rows, pgx.RowToStructByName[ProfileStats])
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to collect profile stats: %w", err)
+	}
+	return stats, nil
+}
+
+// mergeStats combines the stats of all merged profiles into the survivor's
+func (r *PgProfileRepository) mergeStats(ctx context.Context, profileIds []int, survivorId int) error {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return fmt.Errorf("failed to merge profile stats: %w", ErrNoTransaction)
+	}
+
+	combineQuery := `
+		INSERT INTO ` + r.qualify("profile_stats") + ` AS ps
+			(profile_id, first_seen, last_seen, total_events, purchase_count, revenue, last_purchase)
+		SELECT $2, MIN(first_seen), MAX(last_seen), SUM(total_events), SUM(purchase_count), SUM(revenue),
+			MAX(last_purchase)
+		FROM ` + r.qualify("profile_stats") + `
+		WHERE profile_id = ANY($1)
+		HAVING COUNT(*) > 0
+		ON CONFLICT (profile_id) DO UPDATE SET
+			first_seen = EXCLUDED.first_seen,
+			last_seen = EXCLUDED.last_seen,
+			total_events = EXCLUDED.total_events,
+			purchase_count = EXCLUDED.purchase_count,
+			revenue = EXCLUDED.revenue,
+			last_purchase = EXCLUDED.last_purchase,
+			updated_at = EXCLUDED.updated_at`
+
+	if _, err := tx.Exec(ctx, combineQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to merge profile stats: %w", err)
+	}
+
+	deleteQuery := `
+		DELETE FROM ` + r.qualify("profile_stats") + `
+		WHERE profile_id = ANY($1) AND profile_id != $2`
+
+	if _, err := tx.Exec(ctx, deleteQuery, profileIds, survivorId); err != nil {
+		return fmt.Errorf("failed to delete merged profile stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// IdentifierProtector protects identifier values at rest, see package pii. Repositories protect identifiers before
+// writing them and reveal them after reading, so the services only ever handle revealed values.
+type IdentifierProtector interface {
+	// Protect returns the value as it is stored, protecting an already protected value again is a no-op
+	Protect(identifierType, value string) (string, error)
+	// Reveal returns the value a stored one protects. Hashed values cannot be reversed and are returned as they are.
+	Reveal(identifierType, value string) (string, error)
+	// Candidates returns every form the revealed value may be stored in, across protection modes and key versions
+	Candidates(identifierType, value string) ([]string, error)
+}
+
+// PlainIdentifiers stores identifiers as they are, which is what repositories do unless given a protector
+type PlainIdentifiers struct{}
+
+func (PlainIdentifiers) Protect(_, value string) (string, error) { return value, nil }
+func (PlainIdentifiers) Reveal(_, value string) (string, error)  { return value, nil }
+func (PlainIdentifiers) Candidates(_, value string) ([]string, error) {
+	return []string{value}, nil
+}
+
+// protectIdentifiers returns the identifiers in the form they are stored in, empty values are kept empty
+func protectIdentifiers(p IdentifierProtector, identifiers EventIdentifier) (EventIdentifier, error) {
+	return MapIdentifiers(identifiers, p.Protect)
+}
+
+// revealIdentifiers returns the stored identifiers as callers expect them
+func revealIdentifiers(p IdentifierProtector, identifiers EventIdentifier) (EventIdentifier, error) {
+	return MapIdentifiers(identifiers, p.Reveal)
+}
+
+// MapIdentifiers returns the identifiers with f applied to every non-empty value
+func MapIdentifiers(identifiers EventIdentifier, f func(identifierType, value string) (string, error)) (EventIdentifier, error) {
+	var err error
+	if identifiers.Cookie != "" {
+		if identifiers.Cookie, err = f("cookie", identifiers.Cookie); err != nil {
+			return EventIdentifier{}, err
+		}
+	}
+	if identifiers.MessageId != "" {
+		if identifiers.MessageId, err = f("message_id", identifiers.MessageId); err != nil {
+			return EventIdentifier{}, err
+		}
+	}
+	if identifiers.Phone != "" {
+		if identifiers.Phone, err = f("phone", identifiers.Phone); err != nil {
+			return EventIdentifier{}, err
+		}
+	}
+	return identifiers, nil
+}
+
+// protectProfile returns the profile with its identifiers in the form they are stored in
+func protectProfile(p IdentifierProtector, profile Profile) (Profile, error) {
+	identifiers, err := protectIdentifiers(p, profileIdentifiers(profile))
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to protect identifiers of profile %d: %w", profile.Id, err)
+	}
+	profile.Cookie, profile.MessageId, profile.Phone = identifiers.Cookie, identifiers.MessageId, identifiers.Phone
+	return profile, nil
+}
+
+// revealProfiles reveals the identifiers of the profiles in place
+func revealProfiles(p IdentifierProtector, profiles []Profile) error {
+	for i := range profiles {
+		identifiers, err := revealIdentifiers(p, profileIdentifiers(profiles[i]))
+		if err != nil {
+			return fmt.Errorf("failed to reveal identifiers of profile %d: %w", profiles[i].Id, err)
+		}
+		profiles[i].Cookie, profiles[i].MessageId, profiles[i].Phone = identifiers.Cookie, identifiers.MessageId, identifiers.Phone
+	}
+	return nil
+}
+
+// revealObservations reveals the identifier values of the observations in place
+func revealObservations(p IdentifierProtector, observations []IdentifierObservation) error {
+	for i, o := range observations {
+		value, err := p.Reveal(o.IdentifierType, o.Value)
+		if err != nil {
+			return fmt.Errorf("failed to reveal %s observed on profile %d: %w", o.IdentifierType, o.ProfileId, err)
+		}
+		observations[i].Value = value
+	}
+	return nil
+}
+
+// identifierCandidates returns the stored forms of the identifiers grouped by type, with an entry for every
+// identifier name
+func identifierCandidates(p IdentifierProtector, identifiers []Identifier) (map[string][]string, error) {
+	values := identifierValuesByType(nil)
+	for _, identifier := range identifiers {
+		if _, ok := values[identifier.Type]; !ok {
+			continue
+		}
+		candidates, err := p.Candidates(identifier.Type, identifier.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to protect %s: %w", identifier.Type, err)
+		}
+		values[identifier.Type] = append(values[identifier.Type], candidates...)
+	}
+	return values, nil
+}
+
+// DataKeyPurpose is what a data key protects identifiers with
+type DataKeyPurpose string
+
+const (
+	// KeyPurposeIndex keys the hashes of identifiers. There is a single index key, as rotating it would break
+	// matching hashed values, it is only ever rewrapped.
+	KeyPurposeIndex DataKeyPurpose = "index"
+	// KeyPurposeEncryption encrypts identifiers, the newest one encrypts and every one decrypts
+	KeyPurposeEncryption DataKeyPurpose = "encryption"
+)
+
+// DataKey is a key protecting identifiers, stored wrapped by a master key which never leaves the key provider
+type DataKey struct {
+	Id          int            `db:"id"`
+	Purpose     DataKeyPurpose `db:"purpose"`
+	MasterKeyId string         `db:"master_key_id"`
+	WrappedKey  []byte         `db:"wrapped_key"`
+	CreatedAt   time.Time      `db:"created_at"`
+}
+
+// ErrNoDataKeys is returned when rotating keys before any were created
+var ErrNoDataKeys = errors.New("no data keys")
+
+// DataKeyRepository stores the wrapped data keys
+type DataKeyRepository interface {
+	GetDataKeys(ctx context.Context) ([]DataKey, error)
+	InsertDataKey(ctx context.Context, key DataKey) (int, error)
+	UpdateWrappedKey(ctx context.Context, key DataKey) error
+}
+
+type PgDataKeyRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgDataKeyRepository(pool *pgxpool.Pool) *PgDataKeyRepository {
+	return &PgDataKeyRepository{pool: pool}
+}
+
+// GetDataKeys returns every data key ordered by id, so the newest key of a purpose comes last
+func (r *PgDataKeyRepository) GetDataKeys(ctx context.Context) ([]DataKey, error) {
+	query := "SELECT id, purpose, master_key_id, wrapped_key, created_at FROM pii_data_keys ORDER BY id"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query)
+	} else {
+		rows, err = r.pool.Query(ctx, query)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query data keys: %w", err)
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, pgx.RowToStructByName[DataKey])
+}
+
+func (r *PgDataKeyRepository) InsertDataKey(ctx context.Context, key DataKey) (int, error) {
+	query := `
+		INSERT INTO pii_data_keys (purpose, master_key_id, wrapped_key, created_at)
+		VALUES ($1, $2, $3, now() AT TIME ZONE 'utc')
+		RETURNING id`
+	args := []interface{}{key.Purpose, key.MasterKeyId, key.WrappedKey}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, args...)
+	} else {
+		row = r.pool.QueryRow(ctx, query, args...)
+	}
+
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to insert data key: %w", err)
+	}
+	return id, nil
+}
+
+// UpdateWrappedKey replaces the wrapped form of the key, after it was rewrapped with another master key
+func (r *PgDataKeyRepository) UpdateWrappedKey(ctx context.Context, key DataKey) error {
+	query := "UPDATE pii_data_keys SET master_key_id = $2, wrapped_key = $3 WHERE id = $1"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, key.Id, key.MasterKeyId, key.WrappedKey)
+	} else {
+		_, err = r.pool.Exec(ctx, query, key.Id, key.MasterKeyId, key.WrappedKey)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update data key %d: %w", key.Id, err)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package db_test
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/pii"
+)
+
+var _ = Describe("Identifier protection", func() {
+	var (
+		tc          *profileTestContext
+		profileRepo *db.PgProfileRepository
+		eventRepo   *db.PgEventRepository
+		protector   *pii.Protector
+	)
+
+	newProtector := func(policy pii.Policy, keyIds ...int) *pii.Protector {
+		keys := map[int][]byte{}
+		for _, id := range keyIds {
+			keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+		}
+		p, err := pii.NewProtector(policy, bytes.Repeat([]byte{0xAA}, 32), keys)
+		Expect(err).NotTo(HaveOccurred())
+		return p
+	}
+
+	BeforeEach(func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		tc = setupProfileTest(ctx)
+		profileRepo = db.NewPgProfileRepository(tc.connPool)
+		eventRepo = db.NewPgEventRepository(tc.connPool)
+		_, err := tc.connPool.Exec(ctx, "TRUNCATE TABLE events")
+		Expect(err).NotTo(HaveOccurred())
+
+		protector = newProtector(pii.Policy{"phone": pii.ProtectEncrypt, "message_id": pii.ProtectHash}, 1)
+		profileRepo.SetProtector(protector)
+		eventRepo.SetProtector(protector)
+	})
+
+	AfterEach(func() {
+		tc.cleanup()
+	})
+
+	It("should store protected identifiers and find profiles by them", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		id, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a", MessageId: "message-a", Phone: "+15550100"})
+		Expect(err).NotTo(HaveOccurred())
+
+		var phone, messageId string
+		Expect(tc.connPool.QueryRow(ctx, "SELECT phone, message_id FROM profiles WHERE id = $1", id).
+			Scan(&phone, &messageId)).To(Succeed())
+		Expect(phone).NotTo(ContainSubstring("15550100"))
+		Expect(messageId).To(HavePrefix("pii:h:"))
+
+		profiles, found, err := profileRepo.TryGetProfilesByIdentifiers(ctx, db.EventIdentifier{Phone: "+15550100"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(profiles[0].Phone).To(Equal("+15550100"))
+		Expect(profiles[0].MessageId).To(Equal(messageId))
+
+		_, found, err = profileRepo.TryGetProfilesByIdentifiers(ctx, db.EventIdentifier{MessageId: "message-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+	})
+
+	It("should store protected event identifiers and reveal them", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		event := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "+15550100"},
+			EventTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		Expect(eventRepo.InsertEvent(ctx, event)).To(Succeed())
+
+		var stored string
+		Expect(tc.connPool.QueryRow(ctx, "SELECT identifiers->>'phone' FROM events").Scan(&stored)).To(Succeed())
+		Expect(stored).NotTo(ContainSubstring("15550100"))
+
+		events, err := eventRepo.GetEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events[0].Phone).To(Equal("+15550100"))
+
+		var matched []db.EventRecord
+		for e, err := range eventRepo.IterEventsByIdentifiers(ctx, []db.Identifier{{Type: "phone", Value: "+15550100"}}, nil, 10) {
+			Expect(err).NotTo(HaveOccurred())
+			matched = append(matched, e)
+		}
+		Expect(matched).To(HaveLen(1))
+	})
+
+	It("should reprotect stored identifiers after rotating keys", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		plain := db.NewPgProfileRepository(tc.connPool)
+		id, err := plain.InsertProfile(ctx, db.Profile{Phone: "+15550100"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(plain.RecordObservations(ctx, id, db.EventRecord{EventIdentifier: db.EventIdentifier{Phone: "+15550100"},
+			EventTimestamp: time.Now().UTC()})).To(Succeed())
+
+		rotated := newProtector(pii.Policy{"phone": pii.ProtectEncrypt}, 1, 2)
+		profileRepo.SetProtector(rotated)
+
+		tx, err := tc.connPool.Begin(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		defer tx.Rollback(ctx)
+		lastId, changed, err := profileRepo.ReprotectProfiles(context.WithValue(ctx, db.TransactionKey{}, tx), 0, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastId).To(Equal(id))
+		Expect(changed).To(Equal(1))
+		Expect(tx.Commit(ctx)).To(Succeed())
+
+		encrypted, err := rotated.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+		var phone, observed string
+		Expect(tc.connPool.QueryRow(ctx, "SELECT phone FROM profiles WHERE id = $1", id).Scan(&phone)).To(Succeed())
+		Expect(tc.connPool.QueryRow(ctx, "SELECT value FROM profile_identifiers WHERE profile_id = $1", id).
+			Scan(&observed)).To(Succeed())
+		Expect(phone).To(Equal(encrypted))
+		Expect(observed).To(Equal(encrypted))
+
+		profile, _, err := profileRepo.GetProfileById(ctx, id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profile.Phone).To(Equal("+15550100"))
+	})
+
+	It("should seal stitched events and erase them by shredding the profile key", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		_, err := tc.connPool.Exec(ctx, "TRUNCATE TABLE profile_keys")
+		Expect(err).NotTo(HaveOccurred())
+		keyfile := &pii.Keyfile{}
+		Expect(keyfile.AddKey("first")).To(Succeed())
+		keyRepo := db.NewPgProfileKeyRepository(tc.connPool)
+		eventRepo.SetSealer(pii.NewProfileKeys(keyRepo, keyfile))
+
+		event := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "+15550100"},
+			EventTimestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Traits:         db.Traits{"email": db.StringTrait("a@example.com", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}}
+		Expect(eventRepo.SealEvent(ctx, event, event.EventIdentifier, 7)).NotTo(Succeed(), "Expected an event which is not stored to fail")
+		event.Id, err = eventRepo.InsertProcessedEvent(ctx, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(eventRepo.SealEvent(ctx, event, event.EventIdentifier, 7)).To(Succeed())
+		// Sealing again keeps the event sealed with the key it was first sealed with
+		Expect(eventRepo.SealEvent(ctx, event, event.EventIdentifier, 8)).To(Succeed())
+
+		var cookie, profileKey string
+		Expect(tc.connPool.QueryRow(ctx, "SELECT identifiers->>'cookie', profile_key::text FROM events").
+			Scan(&cookie, &profileKey)).To(Succeed())
+		Expect(cookie).To(HavePrefix("pii:k" + profileKey + ":"))
+		key, found, err := keyRepo.GetLiveProfileKey(ctx, 7)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeTrue())
+		Expect(key.KeyId).To(Equal(profileKey))
+
+		events, err := eventRepo.GetEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events[0].ProfileKeyId).To(Equal(profileKey))
+		Expect(events[0].EventIdentifier).To(Equal(event.EventIdentifier))
+		Expect(events[0].Traits).To(HaveKey("email"))
+
+		var matched int
+		for _, err := range eventRepo.IterEventsByIdentifiers(ctx, nil, []int{7}, 10) {
+			Expect(err).NotTo(HaveOccurred())
+			matched++
+		}
+		Expect(matched).To(Equal(1))
+
+		Expect(keyRepo.ShredProfileKeys(ctx, []int{7})).To(Equal(1))
+		events, err = eventRepo.GetEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events[0].EventIdentifier).To(Equal(db.EventIdentifier{}))
+		Expect(events[0].Traits).To(BeNil())
+	})
+
+	It("should hand profile keys over to rebuilt profiles, so an erasure after a rebuild shreds the person's events only", func(spec SpecContext) {
+		ctx := db.AllWorkspaces(spec)
+		_, err := tc.connPool.Exec(ctx, "TRUNCATE TABLE profile_keys, dsar_requests, erasure_tombstones")
+		Expect(err).NotTo(HaveOccurred())
+		keyfile := &pii.Keyfile{}
+		Expect(keyfile.AddKey("first")).To(Succeed())
+		keyRepo := db.NewPgProfileKeyRepository(tc.connPool)
+		eventRepo.SetSealer(pii.NewProfileKeys(keyRepo, keyfile))
+		stitchingService := internal.NewStitchingService(profileRepo, eventRepo, time.Millisecond, 1, 10)
+
+		// The other person is stitched last but seen first, so the rebuild orders the profiles the other way round
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		person := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "+15550100"},
+			EventTimestamp: baseTime.Add(time.Hour)}
+		other := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-b"}, EventTimestamp: baseTime}
+		for _, event := range []db.EventRecord{person, other} {
+			Expect(eventRepo.InsertEvent(ctx, event)).To(Succeed())
+			stitchingService.Stitch(ctx)
+		}
+
+		rebuildService := internal.NewRebuildService(profileRepo, eventRepo)
+		Expect(rebuildService.Rebuild(ctx, baseTime, baseTime.Add(24*time.Hour))).To(HaveField("Profiles", 2))
+
+		dsarService := internal.NewDSARService(profileRepo, eventRepo, db.NewPgDSARRepository(tc.connPool))
+		dsarService.SetProfileKeys(keyRepo)
+		dsarCtx := db.WithWorkspace(spec, db.DefaultWorkspace)
+		erased, err := dsarService.Erase(dsarCtx, internal.DataSubject{Identifier: db.Identifier{Type: "cookie", Value: "cookie-a"}},
+			db.ErasureShred, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(erased.Status).To(Equal(db.DSARCompleted))
+
+		var document bytes.Buffer
+		access, err := dsarService.Access(dsarCtx, internal.DataSubject{Identifier: db.Identifier{Type: "cookie", Value: "cookie-b"}},
+			"legal", &document)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(access.Events).To(Equal(1))
+		Expect(document.String()).To(ContainSubstring("cookie-b"))
+		Expect(document.String()).NotTo(ContainSubstring("cookie-a"))
+
+		events, err := eventRepo.GetEventsByTimeRange(ctx, baseTime, baseTime.Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].EventIdentifier).To(Equal(other.EventIdentifier))
+		Expect(events[1].EventIdentifier).To(Equal(db.EventIdentifier{}))
+	})
+})
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ReprotectEvents stores the identifiers of up to limit events with an id above afterId in the form the current
+// protector stores them in, e.g. after rotating keys or changing the protection policy. It returns the id of the
+// last event read, zero once there are no more, and the number of events rewritten. Sealed events are skipped,
+// their identifiers are encrypted with the key of their profile.
+func (r *PgEventRepository) ReprotectEvents(ctx context.Context, afterId int, limit int) (int, int, error) {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return 0, 0, fmt.Errorf("failed to reprotect events: %w", ErrNoTransaction)
+	}
+
+	query := `
+		SELECT
+			id,
+			COALESCE(identifiers->>'cookie', '') as cookie,
+			COALESCE(identifiers->>'message_id', '') as message_id,
+			COALESCE(identifiers->>'phone', '') as phone
+		FROM events
+		WHERE id > $1 AND profile_key IS NULL
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE`
+
+	rows, err := tx.Query(ctx, query, afterId, limit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query events to reprotect: %w", err)
+	}
+	type storedIdentifiers struct {
+		Id int `db:"id"`
+		EventIdentifier
+	}
+	page, err := pgx.CollectRows(rows, pgx.RowToStructByName[storedIdentifiers])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to collect events to reprotect: %w", err)
+	}
+	if len(page) == 0 {
+		return 0, 0, nil
+	}
+
+	changed := 0
+	for _, stored := range page {
+		identifiers, err := reprotectIdentifiers(r.protector, stored.EventIdentifier)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to reprotect event %d: %w", stored.Id, err)
+		}
+		if identifiers == stored.EventIdentifier {
+			continue
+		}
+		updateQuery := `
+			UPDATE events
+			SET identifiers = identifiers || jsonb_build_object('cookie', $2::text, 'message_id', $3::text, 'phone', $4::text)
+			WHERE id = $1`
+		if _, err := tx.Exec(ctx, updateQuery, stored.Id, identifiers.Cookie, identifiers.MessageId, identifiers.Phone); err != nil {
+			return 0, 0, fmt.Errorf("failed to update event %d: %w", stored.Id, err)
+		}
+		changed++
+	}
+	return page[len(page)-1].Id, changed, nil
+}
+
+// reprotectIdentifiers converts stored identifiers to the form the protector currently stores them in
+func reprotectIdentifiers(p IdentifierProtector, stored EventIdentifier) (EventIdentifier, error) {
+	identifiers, err := revealIdentifiers(p, stored)
+	if err != nil {
+		return EventIdentifier{}, err
+	}
+	return protectIdentifiers(p, identifiers)
+}
+
+// ReprotectProfiles stores the identifiers and observed identifier values of up to limit profiles with an id above
+// afterId in the form the current protector stores them in. It returns the id of the last profile read, zero once
+// there are no more, and the number of profiles rewritten.
+func (r *PgProfileRepository) ReprotectProfiles(ctx context.Context, afterId int, limit int) (int, int, error) {
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	if tx == nil {
+		return 0, 0, fmt.Errorf("failed to reprotect profiles: %w", ErrNoTransaction)
+	}
+
+	query := `
+		SELECT id, COALESCE(cookie, '') as cookie, COALESCE(message_id, '') as message_id, COALESCE(phone, '') as phone
+		FROM ` + r.qualify("profiles") + `
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+		FOR UPDATE`
+
+	rows, err := tx.Query(ctx, query, afterId, limit)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query profiles to reprotect: %w", err)
+	}
+	type storedIdentifiers struct {
+		Id int `db:"id"`
+		EventIdentifier
+	}
+	page, err := pgx.CollectRows(rows, pgx.RowToStructByName[storedIdentifiers])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to collect profiles to reprotect: %w", err)
+	}
+	if len(page) == 0 {
+		return 0, 0, nil
+	}
+
+	changed := make(map[int]bool)
+	ids := make([]int, len(page))
+	for i, stored := range page {
+		ids[i] = stored.Id
+		identifiers, err := reprotectIdentifiers(r.protector, stored.EventIdentifier)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to reprotect profile %d: %w", stored.Id, err)
+		}
+		if identifiers == stored.EventIdentifier {
+			continue
+		}
+		updateQuery := "UPDATE " + r.qualify("profiles") + " SET cookie = $2, message_id = $3, phone = $4 WHERE id = $1"
+		if _, err := tx.Exec(ctx, updateQuery, stored.Id, identifiers.Cookie, identifiers.MessageId, identifiers.Phone); err != nil {
+			return 0, 0, fmt.Errorf("failed to update profile %d: %w", stored.Id, err)
+		}
+		changed[stored.Id] = true
+	}
+
+	observationsQuery := `
+		SELECT profile_id, identifier_type, value
+		FROM ` + r.qualify("profile_identifiers") + `
+		WHERE profile_id = ANY($1)
+		FOR UPDATE`
+	rows, err = tx.Query(ctx, observationsQuery, ids)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query observations to reprotect: %w", err)
+	}
+	observations, err := pgx.CollectRows(rows, pgx.RowToStructByNameLax[IdentifierObservation])
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to collect observations to reprotect: %w", err)
+	}
+
+	// The new form of a value may already be observed, e.g. when a value was seen again after rotating keys,
+	// in which case both observations are folded together
+	moveQuery := `
+		WITH moved AS (
+			DELETE FROM ` + r.qualify("profile_identifiers") + `
+			WHERE profile_id = $1 AND identifier_type = $2 AND value = $3
+			RETURNING profile_id, identifier_type, source, first_seen, last_seen, seen_count
+		)
+		INSERT INTO ` + r.qualify("profile_identifiers") + ` AS pi
+			(profile_id, identifier_type, value, source, first_seen, last_seen, seen_count)
+		SELECT profile_id, identifier_type, $4, source, first_seen, last_seen, seen_count FROM moved
+		ON CONFLICT (profile_id, identifier_type, value) DO UPDATE SET
+			source = CASE WHEN EXCLUDED.last_seen >= pi.last_seen THEN EXCLUDED.source ELSE pi.source END,
+			first_seen = LEAST(pi.first_seen, EXCLUDED.first_seen),
+			last_seen = GREATEST(pi.last_seen, EXCLUDED.last_seen),
+			seen_count = pi.seen_count + EXCLUDED.seen_count`
+	for _, o := range observations {
+		revealed, err := r.protector.Reveal(o.IdentifierType, o.Value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to reprotect %s observed on profile %d: %w", o.IdentifierType, o.ProfileId, err)
+		}
+		value, err := r.protector.Protect(o.IdentifierType, revealed)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to reprotect %s observed on profile %d: %w", o.IdentifierType, o.ProfileId, err)
+		}
+		if value == o.Value {
+			continue
+		}
+		if _, err := tx.Exec(ctx, moveQuery, o.ProfileId, o.IdentifierType, o.Value, value); err != nil {
+			return 0, 0, fmt.Errorf("failed to update observations of profile %d: %w", o.ProfileId, err)
+		}
+		changed[o.ProfileId] = true
+	}
+	return page[len(page)-1].Id, len(changed), nil
+}
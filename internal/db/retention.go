@@ -0,0 +1,310 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// RetainForever keeps events of a type regardless of the default retention
+const RetainForever = "forever"
+
+// RetentionRules decide how long processed events are kept before they are archived, by event type.
+// Durations are Go durations or whole days, e.g. "90d".
+type RetentionRules struct {
+	// Default applies to event types without a rule, events are kept forever when empty
+	Default string `json:"default"`
+	// EventTypes holds the retention of event types by event id, RetainForever keeps them
+	EventTypes map[int]string `json:"event_types"`
+}
+
+// LoadRetentionRules reads the rules from a JSON file, e.g. {"default": "90d", "event_types": {"101": "forever"}}
+func LoadRetentionRules(path string) (RetentionRules, error) {
+	var rules RetentionRules
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("failed to read retention rules: %w", err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("failed to parse retention rules: %w", err)
+	}
+	if err := rules.Validate(); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// Validate checks that every retention is a duration or RetainForever
+func (r RetentionRules) Validate() error {
+	if _, err := parseRetention(r.Default); err != nil {
+		return fmt.Errorf("invalid default retention: %w", err)
+	}
+	for eventId, retention := range r.EventTypes {
+		if _, err := parseRetention(retention); err != nil {
+			return fmt.Errorf("invalid retention of event type %d: %w", eventId, err)
+		}
+	}
+	return nil
+}
+
+// Cutoffs returns the times before which events expire at the given time
+func (r RetentionRules) Cutoffs(now time.Time) (RetentionCutoffs, error) {
+	var cutoffs RetentionCutoffs
+	cutoff := func(retention string) (*time.Time, error) {
+		d, err := parseRetention(retention)
+		if err != nil || d == 0 {
+			return nil, err
+		}
+		t := now.Add(-d)
+		return &t, nil
+	}
+
+	var err error
+	if cutoffs.Default, err = cutoff(r.Default); err != nil {
+		return cutoffs, err
+	}
+	for eventId := range r.EventTypes {
+		cutoffs.EventIds = append(cutoffs.EventIds, eventId)
+	}
+	slices.Sort(cutoffs.EventIds)
+	for _, eventId := range cutoffs.EventIds {
+		before, err := cutoff(r.EventTypes[eventId])
+		if err != nil {
+			return cutoffs, err
+		}
+		cutoffs.Before = append(cutoffs.Before, before)
+	}
+	return cutoffs, nil
+}
+
+// parseRetention returns the retention as a duration, zero when events are kept forever
+func parseRetention(retention string) (time.Duration, error) {
+	if retention == "" || retention == RetainForever {
+		return 0, nil
+	}
+	d, err := parseSegmentDuration(retention)
+	if err != nil || d == 0 {
+		return 0, fmt.Errorf("invalid retention %q", retention)
+	}
+	return d, nil
+}
+
+// RetentionCutoffs are the times before which processed events expire. Before holds the cutoff of the event type at
+// the same index of EventIds, nil ones and a nil Default never expire.
+type RetentionCutoffs struct {
+	EventIds []int
+	Before   []*time.Time
+	Default  *time.Time
+}
+
+// Expired reports whether a processed event expired
+func (c RetentionCutoffs) Expired(eventId int, timestamp time.Time) bool {
+	before := c.Default
+	if i := slices.Index(c.EventIds, eventId); i >= 0 {
+		before = c.Before[i]
+	}
+	return before != nil && timestamp.Before(*before)
+}
+
+// latest returns the latest cutoff, events after it never expire, nil when no event expires
+func (c RetentionCutoffs) latest() *time.Time {
+	latest := c.Default
+	for _, before := range c.Before {
+		if before != nil && (latest == nil || before.After(*latest)) {
+			latest = before
+		}
+	}
+	return latest
+}
+
+// ArchivedEvent is an event as stored, identifiers and traits stay protected or sealed as they were in the table
+type ArchivedEvent struct {
+	Id             int             `db:"id" json:"id"`
+	EventId        int             `db:"event_id" json:"event_id"`
+	EventTimestamp time.Time       `db:"event_timestamp" json:"event_timestamp"`
+	Identifiers    json.RawMessage `db:"identifiers" json:"identifiers"`
+	Source         string          `db:"source" json:"source"`
+	Traits         json.RawMessage `db:"traits" json:"traits,omitempty"`
+	Revenue        float64         `db:"revenue" json:"revenue"`
+	ProfileKey     *string         `db:"profile_key" json:"profile_key,omitempty"`
+	Consents       json.RawMessage `db:"consents" json:"consents,omitempty"`
+	Workspace      string          `db:"workspace" json:"workspace,omitempty"`
+}
+
+// ArchiveRepository moves expired events out of the events table and back
+type ArchiveRepository interface {
+	GetExpiredEvents(ctx context.Context, cutoffs RetentionCutoffs, limit int) ([]ArchivedEvent, error)
+	DeleteArchivedEvents(ctx context.Context, events []ArchivedEvent) (int, error)
+	RestoreEvents(ctx context.Context, events []ArchivedEvent) (int, error)
+	BeginTx(ctx context.Context) (pgx.Tx, error)
+}
+
+// GetExpiredEvents returns up to limit processed events older than the retention of their type, ordered by id.
+// Within a transaction the events are locked until it ends, so they cannot change between archiving and deleting.
+func (r *PgEventRepository) GetExpiredEvents(ctx context.Context, cutoffs RetentionCutoffs, limit int) ([]ArchivedEvent, error) {
+	latest := cutoffs.latest()
+	if latest == nil {
+		return nil, nil
+	}
+
+	// The latest cutoff bounds the timestamps, so partitions of recent months are pruned
+	query := `
+		SELECT
+			e.id,
+			e.event_id,
+			e.event_timestamp,
+			e.identifiers,
+			COALESCE(e.source, '') as source,
+			e.traits,
+			COALESCE(e.revenue, 0)::float8 as revenue,
+			e.profile_key::text AS profile_key,
+			e.consents,
+			e.workspace
+		FROM events e
+		LEFT JOIN unnest($1::int[], $2::timestamp[]) AS r(event_id, cutoff) ON r.event_id = e.event_id
+		WHERE e.processed = true
+			AND e.event_timestamp < $4
+			AND e.event_timestamp < CASE WHEN r.event_id IS NULL THEN $3 ELSE r.cutoff END
+			AND ` + workspaceFilter("e.workspace", 6) + `
+		ORDER BY e.id
+		LIMIT $5`
+	args := []interface{}{cutoffs.EventIds, cutoffs.Before, cutoffs.Default, *latest, limit, workspaceArg(ctx)}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query+" FOR UPDATE OF e", args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired events: %w", err)
+	}
+	defer rows.Close()
+
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByName[ArchivedEvent])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect expired events: %w", err)
+	}
+	return events, nil
+}
+
+// DeleteArchivedEvents deletes the archived events from the events table and returns the number of events deleted.
+// Their keys are kept in archived_events until they are restored, see HasArchivedEvents.
+func (r *PgEventRepository) DeleteArchivedEvents(ctx context.Context, events []ArchivedEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	ids := make([]int, len(events))
+	first, last := events[0].EventTimestamp, events[0].EventTimestamp
+	for i, event := range events {
+		ids[i] = event.Id
+		if event.EventTimestamp.Before(first) {
+			first = event.EventTimestamp
+		}
+		if event.EventTimestamp.After(last) {
+			last = event.EventTimestamp
+		}
+	}
+
+	// The time range of the events prunes the partitions searched for the ids
+	query := `
+		WITH deleted AS (
+			DELETE FROM events WHERE id = ANY($1) AND event_timestamp BETWEEN $2 AND $3
+			RETURNING id, event_timestamp, workspace
+		)
+		INSERT INTO archived_events (id, event_timestamp, workspace)
+		SELECT id, event_timestamp, workspace FROM deleted
+		ON CONFLICT (id, event_timestamp) DO NOTHING`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var tag pgconn.CommandTag
+	var err error
+	if tx != nil {
+		tag, err = tx.Exec(ctx, query, ids, first, last)
+	} else {
+		tag, err = r.pool.Exec(ctx, query, ids, first, last)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete events: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// RestoreEvents inserts archived events with their original ids as processed events, events still stored are
+// skipped, and forgets their archived keys. It returns the number of events restored.
+func (r *PgEventRepository) RestoreEvents(ctx context.Context, events []ArchivedEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode archived events: %w", err)
+	}
+
+	query := `
+		WITH restored AS (
+			INSERT INTO events (id, event_id, event_timestamp, identifiers, processed, source, traits, revenue, profile_key, consents, workspace)
+			SELECT id, event_id, event_timestamp, identifiers, true, source, traits, revenue, profile_key, consents,
+				COALESCE(workspace, '')
+			FROM jsonb_populate_recordset(NULL::events, $1::jsonb)
+			ON CONFLICT (id, event_timestamp) DO NOTHING
+			RETURNING 1
+		), unarchived AS (
+			DELETE FROM archived_events a
+			USING jsonb_populate_recordset(NULL::events, $1::jsonb) AS e
+			WHERE a.id = e.id AND a.event_timestamp = e.event_timestamp
+		)
+		SELECT COUNT(*) FROM restored`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, data)
+	} else {
+		row = r.pool.QueryRow(ctx, query, data)
+	}
+
+	var restored int
+	if err := row.Scan(&restored); err != nil {
+		return 0, fmt.Errorf("failed to restore events: %w", err)
+	}
+	return restored, nil
+}
+
+// HasArchivedEvents reports whether events were archived and not restored since, their history is missing from
+// the events table
+func (r *PgEventRepository) HasArchivedEvents(ctx context.Context) (bool, error) {
+	query := "SELECT EXISTS (SELECT 1 FROM archived_events WHERE " + workspaceFilter("workspace", 1) + ")"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var row pgx.Row
+	if tx != nil {
+		row = tx.QueryRow(ctx, query, workspaceArg(ctx))
+	} else {
+		row = r.pool.QueryRow(ctx, query, workspaceArg(ctx))
+	}
+
+	var archived bool
+	if err := row.Scan(&archived); err != nil {
+		return false, fmt.Errorf("failed to check archived events: %w", err)
+	}
+	return archived, nil
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// InsertSegmentTransitions appends segment enter and exit events to the transitions log
+func (r *PgEventRepository) InsertSegmentTransitions(ctx context.Context, transitions []SegmentTransition) error {
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	profileIds := make([]int, len(transitions))
+	segments := make([]string, len(transitions))
+	entered := make([]bool, len(transitions))
+	occurredAt := make([]time.Time, len(transitions))
+	for i, t := range transitions {
+		profileIds[i], segments[i], entered[i], occurredAt[i] = t.ProfileId, t.Segment, t.Entered, t.OccurredAt
+	}
+
+	query := `
+		INSERT INTO segment_transitions (profile_id, segment, entered, occurred_at)
+		SELECT * FROM unnest($1::int[], $2::text[], $3::bool[], $4::timestamp[])`
+	args := []interface{}{profileIds, segments, entered, occurredAt}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to insert segment transitions: %w", err)
+	}
+	return nil
+}
+
+// GetSegmentTransitions returns the logged segment transitions of a profile in the order they happened
+func (r *PgEventRepository) GetSegmentTransitions(ctx context.Context, profileId int) ([]SegmentTransition, error) {
+	query := `
+		SELECT profile_id, segment, entered, occurred_at
+		FROM segment_transitions
+		WHERE profile_id = $1
+		ORDER BY id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, profileId)
+	} else {
+		rows, err = r.pool.Query(ctx, query, profileId)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query segment transitions: %w", err)
+	}
+	defer rows.Close()
+
+	transitions, err := pgx.CollectRows(rows, pgx.RowToStructByName[SegmentTransition])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect segment transitions: %w", err)
+	}
+	return transitions, nil
+}
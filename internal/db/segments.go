@@ -0,0 +1,293 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SegmentOperator compares a profile field with the value of a condition
+type SegmentOperator string
+
+const (
+	// OpExists matches fields holding a non-empty value
+	OpExists SegmentOperator = "exists"
+	// OpMissing matches fields that are absent or empty
+	OpMissing SegmentOperator = "missing"
+	// OpEqual, OpNotEqual and the orderings compare the field with a value of the same type
+	OpEqual          SegmentOperator = "eq"
+	OpNotEqual       SegmentOperator = "ne"
+	OpGreater        SegmentOperator = "gt"
+	OpGreaterOrEqual SegmentOperator = "gte"
+	OpLess           SegmentOperator = "lt"
+	OpLessOrEqual    SegmentOperator = "lte"
+	// OpWithin matches time fields no older than the duration in the condition value, e.g. "30d" or "12h"
+	OpWithin SegmentOperator = "within"
+)
+
+// traitFieldPrefix selects a trait in a condition field, e.g. "traits.country"
+const traitFieldPrefix = "traits."
+
+// statsFields lists the profile stats usable in conditions
+var statsFields = []string{"first_seen", "last_seen", "last_purchase", "total_events", "purchase_count", "revenue"}
+
+// SegmentCondition is a single comparison of a profile identifier, trait or stat
+type SegmentCondition struct {
+	// Field is an identifier name (e.g. "phone"), a stat (e.g. "purchase_count") or a trait prefixed with "traits."
+	Field string          `json:"field"`
+	Op    SegmentOperator `json:"op"`
+	// Value is compared with the field, times are given in RFC3339 and durations of OpWithin as e.g. "30d"
+	Value any `json:"value,omitempty"`
+}
+
+// Segment is a named audience, a profile is a member when it matches all conditions in All
+// and at least one in Any, if Any is not empty
+type Segment struct {
+	Name string             `json:"name"`
+	All  []SegmentCondition `json:"all"`
+	Any  []SegmentCondition `json:"any"`
+}
+
+// SegmentTransition records a profile entering or leaving a segment
+type SegmentTransition struct {
+	ProfileId  int       `db:"profile_id"`
+	Segment    string    `db:"segment"`
+	Entered    bool      `db:"entered"`
+	OccurredAt time.Time `db:"occurred_at"`
+}
+
+// LoadSegments reads segment definitions from a JSON file holding a list of segments
+func LoadSegments(path string) ([]Segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segments: %w", err)
+	}
+	var segments []Segment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, fmt.Errorf("failed to parse segments: %w", err)
+	}
+
+	names := make(map[string]bool, len(segments))
+	for _, segment := range segments {
+		if names[segment.Name] {
+			return nil, fmt.Errorf("duplicate segment %q", segment.Name)
+		}
+		names[segment.Name] = true
+		if err := segment.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// Validate checks that the segment is named and all its conditions are well formed
+func (s Segment) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("segment without a name")
+	}
+	if len(s.All) == 0 && len(s.Any) == 0 {
+		return fmt.Errorf("segment %q has no conditions", s.Name)
+	}
+	for _, c := range slices.Concat(s.All, s.Any) {
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("invalid condition in segment %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c SegmentCondition) validate() error {
+	names := EventIdentifier{}.GetIdentifierNames()
+	isTrait := strings.HasPrefix(c.Field, traitFieldPrefix) && len(c.Field) > len(traitFieldPrefix)
+	if !isTrait && !slices.Contains(names, c.Field) && !slices.Contains(statsFields, c.Field) {
+		return fmt.Errorf("unknown field %q", c.Field)
+	}
+
+	switch c.Op {
+	case OpExists, OpMissing:
+		return nil
+	case OpEqual, OpNotEqual, OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual:
+		if c.Value == nil {
+			return fmt.Errorf("operator %q on %q requires a value", c.Op, c.Field)
+		}
+		return nil
+	case OpWithin:
+		s, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("operator %q on %q requires a duration", c.Op, c.Field)
+		}
+		_, err := parseSegmentDuration(s)
+		return err
+	}
+	return fmt.Errorf("unknown operator %q", c.Op)
+}
+
+// Matches reports whether a profile with the given stats is a member of the segment at time now
+func (s Segment) Matches(profile Profile, stats ProfileStats, now time.Time) bool {
+	for _, c := range s.All {
+		if !c.matches(profile, stats, now) {
+			return false
+		}
+	}
+	if len(s.Any) == 0 {
+		return true
+	}
+	for _, c := range s.Any {
+		if c.matches(profile, stats, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchingSegments returns the names of the segments the profile is a member of
+func MatchingSegments(segments []Segment, profile Profile, stats ProfileStats, now time.Time) []string {
+	var names []string
+	for _, segment := range segments {
+		if segment.Matches(profile, stats, now) {
+			names = append(names, segment.Name)
+		}
+	}
+	return names
+}
+
+func (c SegmentCondition) matches(profile Profile, stats ProfileStats, now time.Time) bool {
+	field, found := segmentField(c.Field, profile, stats)
+	present := found && !field.IsEmpty()
+
+	switch c.Op {
+	case OpExists:
+		return present
+	case OpMissing:
+		return !present
+	case OpWithin:
+		if !present || field.Type != TraitTime {
+			return false
+		}
+		duration, err := parseSegmentDuration(c.Value.(string))
+		return err == nil && !field.Time.Before(now.Add(-duration))
+	}
+
+	if !found {
+		// Absent fields only satisfy inequality
+		return c.Op == OpNotEqual
+	}
+	cmp, ok := compareSegmentValue(field, c.Value)
+	if !ok {
+		return false
+	}
+
+	switch c.Op {
+	case OpEqual:
+		return cmp == 0
+	case OpNotEqual:
+		return cmp != 0
+	case OpGreater:
+		return cmp > 0
+	case OpGreaterOrEqual:
+		return cmp >= 0
+	case OpLess:
+		return cmp < 0
+	case OpLessOrEqual:
+		return cmp <= 0
+	}
+	return false
+}
+
+// segmentField resolves a condition field to a typed value
+func segmentField(name string, profile Profile, stats ProfileStats) (TraitValue, bool) {
+	if trait, ok := strings.CutPrefix(name, traitFieldPrefix); ok {
+		value, found := profile.Traits[trait]
+		return value, found
+	}
+
+	switch name {
+	case "cookie":
+		return StringTrait(profile.Cookie, time.Time{}), true
+	case "message_id":
+		return StringTrait(profile.MessageId, time.Time{}), true
+	case "phone":
+		return StringTrait(profile.Phone, time.Time{}), true
+	case "first_seen":
+		return TimeTrait(stats.FirstSeen, time.Time{}), true
+	case "last_seen":
+		return TimeTrait(stats.LastSeen, time.Time{}), true
+	case "last_purchase":
+		return TimeTrait(stats.LastPurchase, time.Time{}), true
+	case "total_events":
+		return NumberTrait(float64(stats.TotalEvents), time.Time{}), true
+	case "purchase_count":
+		return NumberTrait(float64(stats.PurchaseCount), time.Time{}), true
+	case "revenue":
+		return NumberTrait(stats.Revenue, time.Time{}), true
+	}
+	return TraitValue{}, false
+}
+
+// compareSegmentValue compares the field with a condition value decoded from JSON,
+// returning false when the value does not fit the field's type
+func compareSegmentValue(field TraitValue, value any) (int, bool) {
+	switch field.Type {
+	case TraitString:
+		s, ok := value.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(field.String, s), true
+	case TraitNumber:
+		n, ok := value.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case field.Number < n:
+			return -1, true
+		case field.Number > n:
+			return 1, true
+		}
+		return 0, true
+	case TraitBool:
+		b, ok := value.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case field.Bool == b:
+			return 0, true
+		case b:
+			return -1, true
+		}
+		return 1, true
+	case TraitTime:
+		s, ok := value.(string)
+		if !ok {
+			return 0, false
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return 0, false
+		}
+		return field.Time.Compare(t), true
+	}
+	return 0, false
+}
+
+// parseSegmentDuration parses Go durations along with whole days, e.g. "30d"
+func parseSegmentDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,72 @@
+package db_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var _ = Describe("Segments", func() {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	profile := db.Profile{
+		Phone:  "111",
+		Traits: db.Traits{"country": db.StringTrait("SK", now), "vip": db.BoolTrait(true, now)},
+	}
+	stats := db.ProfileStats{
+		FirstSeen:     now.AddDate(0, -6, 0),
+		LastSeen:      now.AddDate(0, 0, -1),
+		TotalEvents:   12,
+		PurchaseCount: 2,
+		Revenue:       40,
+		LastPurchase:  now.AddDate(0, 0, -10),
+	}
+
+	DescribeTable("should evaluate conditions",
+		func(condition db.SegmentCondition, expected bool) {
+			segment := db.Segment{Name: "test", All: []db.SegmentCondition{condition}}
+			Expect(segment.Validate()).To(Succeed())
+			Expect(segment.Matches(profile, stats, now)).To(Equal(expected))
+		},
+		Entry("existing identifier", db.SegmentCondition{Field: "phone", Op: db.OpExists}, true),
+		Entry("missing identifier", db.SegmentCondition{Field: "cookie", Op: db.OpMissing}, true),
+		Entry("missing trait", db.SegmentCondition{Field: "traits.tier", Op: db.OpMissing}, true),
+		Entry("trait equality", db.SegmentCondition{Field: "traits.country", Op: db.OpEqual, Value: "SK"}, true),
+		Entry("trait inequality", db.SegmentCondition{Field: "traits.country", Op: db.OpNotEqual, Value: "CZ"}, true),
+		Entry("absent trait inequality", db.SegmentCondition{Field: "traits.tier", Op: db.OpNotEqual, Value: "gold"}, true),
+		Entry("bool trait", db.SegmentCondition{Field: "traits.vip", Op: db.OpEqual, Value: true}, true),
+		Entry("type mismatch", db.SegmentCondition{Field: "traits.vip", Op: db.OpEqual, Value: "true"}, false),
+		Entry("number comparison", db.SegmentCondition{Field: "revenue", Op: db.OpGreaterOrEqual, Value: 40.0}, true),
+		Entry("failed number comparison", db.SegmentCondition{Field: "purchase_count", Op: db.OpGreater, Value: 2.0}, false),
+		Entry("time comparison", db.SegmentCondition{Field: "first_seen", Op: db.OpLess, Value: "2024-01-01T00:00:00Z"}, true),
+		Entry("recent purchase in days", db.SegmentCondition{Field: "last_purchase", Op: db.OpWithin, Value: "30d"}, true),
+		Entry("recent purchase in hours", db.SegmentCondition{Field: "last_purchase", Op: db.OpWithin, Value: "48h"}, false),
+	)
+
+	It("should require all conditions and any of the alternatives", func() {
+		segment := db.Segment{
+			Name: "recent_buyers_with_phone",
+			All: []db.SegmentCondition{
+				{Field: "last_purchase", Op: db.OpWithin, Value: "30d"},
+				{Field: "phone", Op: db.OpExists},
+			},
+			Any: []db.SegmentCondition{
+				{Field: "traits.country", Op: db.OpEqual, Value: "CZ"},
+				{Field: "traits.vip", Op: db.OpEqual, Value: true},
+			},
+		}
+		Expect(segment.Matches(profile, stats, now)).To(BeTrue())
+		Expect(segment.Matches(profile, db.ProfileStats{}, now)).To(BeFalse())
+		Expect(db.MatchingSegments([]db.Segment{segment}, profile, stats, now)).To(Equal([]string{"recent_buyers_with_phone"}))
+	})
+
+	It("should reject malformed segments", func() {
+		Expect(db.Segment{Name: "empty"}.Validate()).NotTo(Succeed())
+		Expect(db.Segment{All: []db.SegmentCondition{{Field: "phone", Op: db.OpExists}}}.Validate()).NotTo(Succeed())
+		Expect(db.Segment{Name: "x", All: []db.SegmentCondition{{Field: "email", Op: db.OpExists}}}.Validate()).NotTo(Succeed())
+		Expect(db.Segment{Name: "x", All: []db.SegmentCondition{{Field: "phone", Op: "like"}}}.Validate()).NotTo(Succeed())
+		Expect(db.Segment{Name: "x", All: []db.SegmentCondition{{Field: "revenue", Op: db.OpGreater}}}.Validate()).NotTo(Succeed())
+		Expect(db.Segment{Name: "x", All: []db.SegmentCondition{{Field: "last_seen", Op: db.OpWithin, Value: "a week"}}}.Validate()).NotTo(Succeed())
+	})
+})
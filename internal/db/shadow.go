@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	shadowSchema  = "shadow"
+	retiredSchema = "shadow_retired"
+)
+
+// profileTables lists every table holding profile state, which is copied into the shadow namespace and swapped as a whole
+var profileTables = []string{"profiles", "profile_identifiers", "profile_stats", "profile_segments", "profile_merges", "profile_consents"}
+
+// ResetShadow recreates the shadow namespace with empty copies of the live profile tables. Shadow tables share the
+// id sequence of the live profiles table, so ids assigned in the shadow never collide with live ones.
+func (r *PgProfileRepository) ResetShadow(ctx context.Context) error {
+	if r.schema != shadowSchema {
+		return fmt.Errorf("failed to reset shadow: repository does not operate on the shadow namespace")
+	}
+
+	var query strings.Builder
+	query.WriteString("DROP SCHEMA IF EXISTS " + shadowSchema + " CASCADE;\n")
+	query.WriteString("CREATE SCHEMA " + shadowSchema + ";\n")
+	for _, table := range profileTables {
+		query.WriteString("CREATE TABLE " + shadowSchema + "." + table + " (LIKE public." + table + " INCLUDING ALL);\n")
+	}
+	// Profile keys are shared with the live profiles, the shadow only records which profiles hold them
+	query.WriteString("CREATE TABLE " + shadowSchema + ".profile_key_holders (key_id UUID PRIMARY KEY, profile_id INT NOT NULL);\n")
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query.String())
+	} else {
+		_, err = r.pool.Exec(ctx, query.String())
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to reset shadow profiles: %w", err)
+	}
+	return nil
+}
+
+// PromoteShadow atomically moves the shadow profile tables in place of the live ones and drops the old live tables.
+// Profile keys are handed over to the shadow profiles which hold them.
+func (r *PgProfileRepository) PromoteShadow(ctx context.Context) error {
+	if r.schema != shadowSchema {
+		return fmt.Errorf("failed to promote shadow: repository does not operate on the shadow namespace")
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	var err error
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	// The id sequence is owned by the live profiles table, detach it so it survives dropping the old tables
+	var query strings.Builder
+	query.WriteString("ALTER SEQUENCE public.profiles_id_seq OWNED BY NONE;\n")
+	query.WriteString("DROP SCHEMA IF EXISTS " + retiredSchema + " CASCADE;\n")
+	query.WriteString("CREATE SCHEMA " + retiredSchema + ";\n")
+	for _, table := range profileTables {
+		query.WriteString("LOCK TABLE public." + table + " IN ACCESS EXCLUSIVE MODE;\n")
+		query.WriteString("ALTER TABLE public." + table + " SET SCHEMA " + retiredSchema + ";\n")
+		query.WriteString("ALTER TABLE " + shadowSchema + "." + table + " SET SCHEMA public;\n")
+	}
+	query.WriteString("ALTER SEQUENCE public.profiles_id_seq OWNED BY public.profiles.id;\n")
+	// Hand the profile keys over to the promoted profiles, keys of retired profiles no promoted one holds are detached
+	query.WriteString("UPDATE public.profile_keys SET profile_id = NULL WHERE profile_id IS NOT NULL;\n")
+	query.WriteString("UPDATE public.profile_keys k SET profile_id = h.profile_id FROM " + shadowSchema + ".profile_key_holders h " +
+		"WHERE k.key_id = h.key_id AND k.shredded_at IS NULL;\n")
+	query.WriteString("DROP TABLE " + shadowSchema + ".profile_key_holders;\n")
+	query.WriteString("DROP SCHEMA " + retiredSchema + " CASCADE;\n")
+	query.WriteString("DROP SCHEMA " + shadowSchema + ";\n")
+
+	if _, err := tx.Exec(ctx, query.String()); err != nil {
+		return fmt.Errorf("failed to promote shadow profiles: %w", err)
+	}
+
+	// Commit if we started the transaction
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// FieldPolicy decides which value of an identifier survives when profiles are merged
+type FieldPolicy string
+
+const (
+	// PolicyLowest keeps the lexicographically lowest non-empty value
+	PolicyLowest FieldPolicy = "lowest"
+	// PolicyNonEmpty keeps the surviving profile's value unless it is empty
+	PolicyNonEmpty FieldPolicy = "non_empty"
+	// PolicyMostRecent keeps the value observed last
+	PolicyMostRecent FieldPolicy = "most_recent"
+	// PolicyFirstSeen keeps the value observed first
+	PolicyFirstSeen FieldPolicy = "first_seen"
+	// PolicyMostFrequent keeps the value observed in the most events
+	PolicyMostFrequent FieldPolicy = "most_frequent"
+	// PolicySourcePriority keeps the value coming from the highest priority source, the most recent one on ties
+	PolicySourcePriority FieldPolicy = "source_priority"
+)
+
+// SurvivorPolicy decides which profile id survives a merge
+type SurvivorPolicy string
+
+const (
+	// SurvivorOldest keeps the profile created first, which has the lowest id
+	SurvivorOldest SurvivorPolicy = "oldest"
+	// SurvivorMostEvents keeps the profile with the most stitched events
+	SurvivorMostEvents SurvivorPolicy = "most_events"
+	// SurvivorMostIdentifiers keeps the profile with the most distinct identifier values
+	SurvivorMostIdentifiers SurvivorPolicy = "most_identifiers"
+)
+
+// SurvivorshipRules configures how MergeProfiles combines profiles
+type SurvivorshipRules struct {
+	Survivor SurvivorPolicy `json:"survivor"`
+	// Fields maps identifier names (e.g. "phone") to their policy, unlisted identifiers use PolicyLowest
+	Fields map[string]FieldPolicy `json:"fields"`
+	// SourcePriority lists event sources from the most to the least trusted, unlisted sources rank last
+	SourcePriority []string `json:"source_priority"`
+	// TraitPolicy applies to traits not listed in Traits, only PolicyMostRecent, PolicyFirstSeen
+	// and PolicyNonEmpty are meaningful for traits
+	TraitPolicy FieldPolicy            `json:"trait_policy"`
+	Traits      map[string]FieldPolicy `json:"traits"`
+}
+
+// DefaultSurvivorshipRules keeps the oldest profile, the lowest value of every identifier and the most recent traits
+func DefaultSurvivorshipRules() SurvivorshipRules {
+	return SurvivorshipRules{
+		Survivor:    SurvivorOldest,
+		Fields:      map[string]FieldPolicy{},
+		TraitPolicy: PolicyMostRecent,
+		Traits:      map[string]FieldPolicy{},
+	}
+}
+
+// LoadSurvivorshipRules reads rules from a JSON file, leaving defaults for anything the file omits
+func LoadSurvivorshipRules(path string) (SurvivorshipRules, error) {
+	rules := DefaultSurvivorshipRules()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, fmt.Errorf("failed to read survivorship rules: %w", err)
+	}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("failed to parse survivorship rules: %w", err)
+	}
+	return rules, rules.Validate()
+}
+
+// UnmarshalJSON decodes rules leaving defaults for anything the JSON omits
+func (r *SurvivorshipRules) UnmarshalJSON(data []byte) error {
+	type plain SurvivorshipRules
+	rules := plain(DefaultSurvivorshipRules())
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return err
+	}
+	if rules.Fields == nil {
+		rules.Fields = map[string]FieldPolicy{}
+	}
+	if rules.Traits == nil {
+		rules.Traits = map[string]FieldPolicy{}
+	}
+	*r = SurvivorshipRules(rules)
+	return nil
+}
+
+// Validate checks that all policies are known
+func (r SurvivorshipRules) Validate() error {
+	switch r.Survivor {
+	case SurvivorOldest, SurvivorMostEvents, SurvivorMostIdentifiers:
+	default:
+		return fmt.Errorf("unknown survivor policy %q", r.Survivor)
+	}
+
+	names := EventIdentifier{}.GetIdentifierNames()
+	for field, policy := range r.Fields {
+		if !slices.Contains(names, field) {
+			return fmt.Errorf("unknown identifier %q in survivorship rules", field)
+		}
+		switch policy {
+		case PolicyLowest, PolicyNonEmpty, PolicyMostRecent, PolicyFirstSeen, PolicyMostFrequent, PolicySourcePriority:
+		default:
+			return fmt.Errorf("unknown policy %q for identifier %q", policy, field)
+		}
+	}
+
+	if err := validateTraitPolicy(r.TraitPolicy); err != nil {
+		return fmt.Errorf("invalid default trait policy: %w", err)
+	}
+	for name, policy := range r.Traits {
+		if err := validateTraitPolicy(policy); err != nil {
+			return fmt.Errorf("invalid policy for trait %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validateTraitPolicy(policy FieldPolicy) error {
+	switch policy {
+	case "", PolicyMostRecent, PolicyFirstSeen, PolicyNonEmpty:
+		return nil
+	}
+	return fmt.Errorf("policy %q does not apply to traits", policy)
+}
+
+// IdentifierObservation aggregates the sightings of one identifier value on a profile
+type IdentifierObservation struct {
+	ProfileId      int       `db:"profile_id"`
+	IdentifierType string    `db:"identifier_type"`
+	Value          string    `db:"value"`
+	Source         string    `db:"source"`
+	FirstSeen      time.Time `db:"first_seen"`
+	LastSeen       time.Time `db:"last_seen"`
+	SeenCount      int       `db:"seen_count"`
+}
+
+// MergeCandidate is a profile taking part in a merge along with the observations of its identifiers
+type MergeCandidate struct {
+	Profile      Profile
+	Observations []IdentifierObservation
+	// Events is the number of events stitched to the profile
+	Events int
+}
+
+// Merge combines the candidates into a single profile according to the rules and returns it.
+// The returned profile carries the id of the surviving candidate.
+func (r SurvivorshipRules) Merge(candidates []MergeCandidate) Profile {
+	if len(candidates) == 0 {
+		return Profile{}
+	}
+
+	survivor := r.pickSurvivor(candidates)
+
+	// Ordering candidates with the survivor first makes PolicyNonEmpty prefer its values
+	ordered := make([]MergeCandidate, 0, len(candidates))
+	ordered = append(ordered, survivor)
+	for _, c := range candidates {
+		if c.Profile.Id != survivor.Profile.Id {
+			ordered = append(ordered, c)
+		}
+	}
+	sort.SliceStable(ordered[1:], func(i, j int) bool {
+		return ordered[i+1].Profile.Id < ordered[j+1].Profile.Id
+	})
+
+	merged := Profile{Id: survivor.Profile.Id}
+	merged.Cookie = r.resolveField("cookie", ordered)
+	merged.MessageId = r.resolveField("message_id", ordered)
+	merged.Phone = r.resolveField("phone", ordered)
+	merged.Traits = r.mergeTraits(ordered)
+	return merged
+}
+
+// mergeTraits picks the surviving value of every trait present on any of the ordered candidates
+func (r SurvivorshipRules) mergeTraits(ordered []MergeCandidate) Traits {
+	var merged Traits
+	for _, c := range ordered {
+		for name, value := range c.Profile.Traits {
+			if merged == nil {
+				merged = make(Traits)
+			}
+			current, ok := merged[name]
+			if !ok {
+				merged[name] = value
+				continue
+			}
+
+			policy, ok := r.Traits[name]
+			if !ok {
+				policy = r.TraitPolicy
+			}
+			switch policy {
+			case PolicyNonEmpty:
+				// Candidates are ordered with the survivor first, earlier non-empty values win
+				if current.IsEmpty() && !value.IsEmpty() {
+					merged[name] = value
+				}
+			case PolicyFirstSeen:
+				if value.UpdatedAt.Before(current.UpdatedAt) {
+					merged[name] = value
+				}
+			default:
+				if value.UpdatedAt.After(current.UpdatedAt) {
+					merged[name] = value
+				}
+			}
+		}
+	}
+	return merged
+}
+
+func (r SurvivorshipRules) pickSurvivor(candidates []MergeCandidate) MergeCandidate {
+	score := func(c MergeCandidate) int {
+		switch r.Survivor {
+		case SurvivorMostEvents:
+			return c.Events
+		case SurvivorMostIdentifiers:
+			return distinctIdentifiers(c)
+		}
+		return 0
+	}
+
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		bestScore, cScore := score(best), score(c)
+		// The oldest profile wins ties
+		if cScore > bestScore || (cScore == bestScore && c.Profile.Id < best.Profile.Id) {
+			best = c
+		}
+	}
+	return best
+}
+
+// resolveField picks the surviving value of one identifier among the ordered candidates
+func (r SurvivorshipRules) resolveField(name string, ordered []MergeCandidate) string {
+	policy, ok := r.Fields[name]
+	if !ok {
+		policy = PolicyLowest
+	}
+
+	if policy == PolicyNonEmpty {
+		for _, c := range ordered {
+			if value, _ := profileIdentifiers(c.Profile).GetIdentifierValueByName(name); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	// Gather every known value, the current profile values may lack observations (e.g. inserted directly)
+	var values []IdentifierObservation
+	for _, c := range ordered {
+		for _, o := range candidateValues(c) {
+			if o.IdentifierType == name {
+				values = append(values, o)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	better := func(a, b IdentifierObservation) bool {
+		switch policy {
+		case PolicyMostRecent:
+			if !a.LastSeen.Equal(b.LastSeen) {
+				return a.LastSeen.After(b.LastSeen)
+			}
+		case PolicyFirstSeen:
+			// Values without observations have an unknown first sighting and rank last
+			if a.FirstSeen.IsZero() != b.FirstSeen.IsZero() {
+				return !a.FirstSeen.IsZero()
+			}
+			if !a.FirstSeen.Equal(b.FirstSeen) {
+				return a.FirstSeen.Before(b.FirstSeen)
+			}
+		case PolicyMostFrequent:
+			if a.SeenCount != b.SeenCount {
+				return a.SeenCount > b.SeenCount
+			}
+		case PolicySourcePriority:
+			if ra, rb := r.sourceRank(a.Source), r.sourceRank(b.Source); ra != rb {
+				return ra < rb
+			}
+			if !a.LastSeen.Equal(b.LastSeen) {
+				return a.LastSeen.After(b.LastSeen)
+			}
+		}
+		// Fall back to the lowest value so the outcome is deterministic
+		return a.Value < b.Value
+	}
+
+	best := values[0]
+	for _, v := range values[1:] {
+		if better(v, best) {
+			best = v
+		}
+	}
+	return best.Value
+}
+
+func (r SurvivorshipRules) sourceRank(source string) int {
+	if i := slices.Index(r.SourcePriority, source); i >= 0 {
+		return i
+	}
+	return len(r.SourcePriority)
+}
+
+// candidateValues returns the non-empty identifier values currently stored on the candidate's profile,
+// carrying the metadata of their observations when those were recorded
+func candidateValues(c MergeCandidate) []IdentifierObservation {
+	observed := make(map[string]IdentifierObservation, len(c.Observations))
+	for _, o := range c.Observations {
+		observed[o.IdentifierType+":"+o.Value] = o
+	}
+
+	values := make([]IdentifierObservation, 0, 3)
+	identifiers := profileIdentifiers(c.Profile)
+	for _, name := range identifiers.GetIdentifierNames() {
+		value, _ := identifiers.GetIdentifierValueByName(name)
+		if value == "" {
+			continue
+		}
+		o, ok := observed[name+":"+value]
+		if !ok {
+			o = IdentifierObservation{ProfileId: c.Profile.Id, IdentifierType: name, Value: value}
+		}
+		values = append(values, o)
+	}
+	return values
+}
+
+// distinctIdentifiers counts the distinct identifier values ever observed on the candidate or stored on its profile
+func distinctIdentifiers(c MergeCandidate) int {
+	seen := make(map[string]struct{}, len(c.Observations)+3)
+	for _, o := range c.Observations {
+		seen[o.IdentifierType+":"+o.Value] = struct{}{}
+	}
+	for _, o := range candidateValues(c) {
+		seen[o.IdentifierType+":"+o.Value] = struct{}{}
+	}
+	return len(seen)
+}
+
+func profileIdentifiers(p Profile) EventIdentifier {
+	return EventIdentifier{Cookie: p.Cookie, MessageId: p.MessageId, Phone: p.Phone}
+}
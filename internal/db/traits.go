@@ -0,0 +1,142 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TraitType is the type of a trait value
+type TraitType string
+
+const (
+	TraitString TraitType = "string"
+	TraitNumber TraitType = "number"
+	TraitBool   TraitType = "bool"
+	TraitTime   TraitType = "time"
+)
+
+// TraitValue is a typed profile attribute, e.g. a name, an opt-in flag or a loyalty tier.
+// UpdatedAt is the time the value was observed and decides which value wins when traits are combined.
+type TraitValue struct {
+	Type      TraitType
+	String    string
+	Number    float64
+	Bool      bool
+	Time      time.Time
+	UpdatedAt time.Time
+}
+
+func StringTrait(value string, updatedAt time.Time) TraitValue {
+	return TraitValue{Type: TraitString, String: value, UpdatedAt: updatedAt}
+}
+
+func NumberTrait(value float64, updatedAt time.Time) TraitValue {
+	return TraitValue{Type: TraitNumber, Number: value, UpdatedAt: updatedAt}
+}
+
+func BoolTrait(value bool, updatedAt time.Time) TraitValue {
+	return TraitValue{Type: TraitBool, Bool: value, UpdatedAt: updatedAt}
+}
+
+func TimeTrait(value time.Time, updatedAt time.Time) TraitValue {
+	return TraitValue{Type: TraitTime, Time: value, UpdatedAt: updatedAt}
+}
+
+// Value returns the trait value as a plain Go value of its type
+func (t TraitValue) Value() any {
+	switch t.Type {
+	case TraitString:
+		return t.String
+	case TraitNumber:
+		return t.Number
+	case TraitBool:
+		return t.Bool
+	case TraitTime:
+		return t.Time
+	}
+	return nil
+}
+
+// IsEmpty reports whether the trait holds the zero value of its type
+func (t TraitValue) IsEmpty() bool {
+	switch t.Type {
+	case TraitString:
+		return t.String == ""
+	case TraitTime:
+		return t.Time.IsZero()
+	case TraitNumber, TraitBool:
+		return false
+	}
+	return true
+}
+
+type traitValueJSON struct {
+	Type      TraitType       `json:"type"`
+	Value     json.RawMessage `json:"value"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+func (t TraitValue) MarshalJSON() ([]byte, error) {
+	value, err := json.Marshal(t.Value())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(traitValueJSON{Type: t.Type, Value: value, UpdatedAt: t.UpdatedAt})
+}
+
+func (t *TraitValue) UnmarshalJSON(data []byte) error {
+	var raw traitValueJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*t = TraitValue{Type: raw.Type, UpdatedAt: raw.UpdatedAt}
+	var err error
+	switch raw.Type {
+	case TraitString:
+		err = json.Unmarshal(raw.Value, &t.String)
+	case TraitNumber:
+		err = json.Unmarshal(raw.Value, &t.Number)
+	case TraitBool:
+		err = json.Unmarshal(raw.Value, &t.Bool)
+	case TraitTime:
+		err = json.Unmarshal(raw.Value, &t.Time)
+	default:
+		return fmt.Errorf("unknown trait type %q", raw.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s trait value: %w", raw.Type, err)
+	}
+	return nil
+}
+
+// Traits maps trait names to their values
+type Traits map[string]TraitValue
+
+// Apply returns a copy of the traits updated with the given ones. A trait is only overwritten by a value
+// observed at the same time or later, so applying events out of order keeps the most recent values.
+func (t Traits) Apply(updates Traits) Traits {
+	if len(t) == 0 && len(updates) == 0 {
+		return nil
+	}
+	merged := make(Traits, len(t)+len(updates))
+	for name, value := range t {
+		merged[name] = value
+	}
+	for name, value := range updates {
+		if current, ok := merged[name]; ok && current.UpdatedAt.After(value.UpdatedAt) {
+			continue
+		}
+		merged[name] = value
+	}
+	return merged
+}
+
+// traitsArg converts traits into a query argument, storing NULL instead of an empty object
+func traitsArg(t Traits) any {
+	if len(t) == 0 {
+		return nil
+	}
+	return t
+}
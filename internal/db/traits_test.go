@@ -0,0 +1,55 @@
+package db_test
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var _ = Describe("Traits", func() {
+	baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	It("should round trip typed values through JSON", func() {
+		traits := db.Traits{
+			"name":     db.StringTrait("Jane", baseTime),
+			"visits":   db.NumberTrait(3, baseTime),
+			"opted_in": db.BoolTrait(true, baseTime),
+			"birthday": db.TimeTrait(time.Date(1990, 5, 17, 0, 0, 0, 0, time.UTC), baseTime),
+		}
+
+		encoded, err := json.Marshal(traits)
+		Expect(err).NotTo(HaveOccurred())
+
+		var decoded db.Traits
+		Expect(json.Unmarshal(encoded, &decoded)).To(Succeed())
+		Expect(decoded).To(Equal(traits))
+	})
+
+	It("should reject unknown trait types", func() {
+		var decoded db.Traits
+		Expect(json.Unmarshal([]byte(`{"name":{"type":"blob","value":"x"}}`), &decoded)).NotTo(Succeed())
+	})
+
+	It("should only overwrite traits with values observed later", func() {
+		current := db.Traits{
+			"tier":    db.StringTrait("gold", baseTime.Add(time.Hour)),
+			"country": db.StringTrait("SK", baseTime),
+		}
+
+		applied := current.Apply(db.Traits{
+			"tier":    db.StringTrait("silver", baseTime),
+			"country": db.StringTrait("CZ", baseTime.Add(time.Hour)),
+			"name":    db.StringTrait("Jane", baseTime),
+		})
+
+		Expect(applied).To(Equal(db.Traits{
+			"tier":    db.StringTrait("gold", baseTime.Add(time.Hour)),
+			"country": db.StringTrait("CZ", baseTime.Add(time.Hour)),
+			"name":    db.StringTrait("Jane", baseTime),
+		}))
+		Expect(current["country"].String).To(Equal("SK"))
+	})
+})
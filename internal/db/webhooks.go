@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WebhookEndpoint is an HTTP endpoint notified about outbox events of the listed kinds, or of all kinds when empty
+type WebhookEndpoint struct {
+	Id        int       `db:"id"`
+	Url       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	Kinds     []string  `db:"kinds"`
+	Active    bool      `db:"active"`
+	CreatedAt time.Time `db:"created_at"`
+	// Workspace is the workspace whose events the endpoint is notified about
+	Workspace string `db:"workspace"`
+}
+
+// Consumer is the name the endpoint's outbox cursor is stored under
+func (e WebhookEndpoint) Consumer() string {
+	return fmt.Sprintf("webhook:%d", e.Id)
+}
+
+// Accepts reports whether the endpoint subscribed to events of the kind
+func (e WebhookEndpoint) Accepts(kind OutboxKind) bool {
+	return len(e.Kinds) == 0 || slices.Contains(e.Kinds, string(kind))
+}
+
+// Receives reports whether the event belongs to the workspace of the endpoint and is of a kind it subscribed to
+func (e WebhookEndpoint) Receives(event OutboxEvent) bool {
+	return event.Workspace == e.Workspace && e.Accepts(event.Kind)
+}
+
+// WebhookDelivery is a single attempt to deliver an outbox event to an endpoint
+type WebhookDelivery struct {
+	Id         int64      `db:"id"`
+	EndpointId int        `db:"endpoint_id"`
+	OutboxId   int64      `db:"outbox_id"`
+	Kind       OutboxKind `db:"kind"`
+	Attempt    int        `db:"attempt"`
+	StatusCode int        `db:"status_code"`
+	Error      string     `db:"error"`
+	DurationMs int        `db:"duration_ms"`
+	Success    bool       `db:"success"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+type WebhookRepository interface {
+	CreateWebhookEndpoint(ctx context.Context, endpoint WebhookEndpoint) (int, error)
+	GetWebhookEndpoint(ctx context.Context, id int) (WebhookEndpoint, bool, error)
+	GetWebhookEndpoints(ctx context.Context) ([]WebhookEndpoint, error)
+	SetWebhookEndpointActive(ctx context.Context, id int, active bool) error
+	RecordWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error
+	GetWebhookDeliveries(ctx context.Context, endpointId int, limit int) ([]WebhookDelivery, error)
+}
+
+type PgWebhookRepository struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgWebhookRepository(pool *pgxpool.Pool) *PgWebhookRepository {
+	return &PgWebhookRepository{pool: pool}
+}
+
+// CreateWebhookEndpoint registers an active endpoint. Its outbox cursor starts at the latest event,
+// so the endpoint only receives changes made after it was registered.
+func (r *PgWebhookRepository) CreateWebhookEndpoint(ctx context.Context, endpoint WebhookEndpoint) (int, error) {
+	workspace, err := writeWorkspace(ctx, endpoint.Workspace)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert webhook endpoint: %w", err)
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+	startedTx := false
+
+	// Start a transaction if one wasn't provided
+	if tx == nil {
+		tx, err = r.pool.Begin(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		startedTx = true
+		defer tx.Rollback(ctx)
+	}
+
+	if endpoint.Kinds == nil {
+		endpoint.Kinds = []string{}
+	}
+
+	var id int
+	insertQuery := `
+		INSERT INTO webhook_endpoints (url, secret, kinds, active, created_at, workspace)
+		VALUES ($1, $2, $3, TRUE, now() AT TIME ZONE 'utc', $4)
+		RETURNING id`
+	args := []interface{}{endpoint.Url, endpoint.Secret, endpoint.Kinds, workspace}
+	if err := tx.QueryRow(ctx, insertQuery, args...).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to insert webhook endpoint: %w", err)
+	}
+
+	cursorQuery := `
+		INSERT INTO outbox_cursors (consumer, last_tx_id, last_id, updated_at)
+		SELECT $1, COALESCE(MAX(tx_id::text::bigint), 0), COALESCE(MAX(id), 0), now()
+		FROM (SELECT tx_id, id FROM outbox ORDER BY tx_id DESC, id DESC LIMIT 1) latest`
+	if _, err := tx.Exec(ctx, cursorQuery, WebhookEndpoint{Id: id}.Consumer()); err != nil {
+		return 0, fmt.Errorf("failed to initialize webhook cursor: %w", err)
+	}
+
+	// Commit if we started the transaction
+	if startedTx {
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+	}
+
+	return id, nil
+}
+
+func (r *PgWebhookRepository) GetWebhookEndpoint(ctx context.Context, id int) (WebhookEndpoint, bool, error) {
+	endpoints, err := r.queryEndpoints(ctx, "WHERE id = $1", id)
+	if err != nil {
+		return WebhookEndpoint{}, false, err
+	}
+	if len(endpoints) == 0 {
+		return WebhookEndpoint{}, false, nil
+	}
+	return endpoints[0], true, nil
+}
+
+func (r *PgWebhookRepository) GetWebhookEndpoints(ctx context.Context) ([]WebhookEndpoint, error) {
+	return r.queryEndpoints(ctx, "")
+}
+
+func (r *PgWebhookRepository) queryEndpoints(ctx context.Context, where string, args ...any) ([]WebhookEndpoint, error) {
+	query := `
+		SELECT id, url, secret, kinds, active, created_at, workspace
+		FROM webhook_endpoints
+		` + where + `
+		ORDER BY id`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, args...)
+	} else {
+		rows, err = r.pool.Query(ctx, query, args...)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook endpoints: %w", err)
+	}
+	defer rows.Close()
+
+	endpoints, err := pgx.CollectRows(rows, pgx.RowToStructByName[WebhookEndpoint])
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to collect webhook endpoints: %w", err)
+	}
+	return endpoints, nil
+}
+
+func (r *PgWebhookRepository) SetWebhookEndpointActive(ctx context.Context, id int, active bool) error {
+	query := "UPDATE webhook_endpoints SET active = $1 WHERE id = $2"
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, active, id)
+	} else {
+		_, err = r.pool.Exec(ctx, query, active, id)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to update webhook endpoint: %w", err)
+	}
+	return nil
+}
+
+func (r *PgWebhookRepository) RecordWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries
+			(endpoint_id, outbox_id, kind, attempt, status_code, error, duration_ms, success, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	args := []interface{}{
+		delivery.EndpointId,
+		delivery.OutboxId,
+		delivery.Kind,
+		delivery.Attempt,
+		delivery.StatusCode,
+		delivery.Error,
+		delivery.DurationMs,
+		delivery.Success,
+		delivery.CreatedAt,
+	}
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var err error
+	if tx != nil {
+		_, err = tx.Exec(ctx, query, args...)
+	} else {
+		_, err = r.pool.Exec(ctx, query, args...)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns the latest delivery attempts to the endpoint, newest first
+func (r *PgWebhookRepository) GetWebhookDeliveries(ctx context.Context, endpointId int, limit int) ([]WebhookDelivery, error) {
+	query := `
+		SELECT id, endpoint_id, outbox_id, kind, attempt, status_code, error, duration_ms, success, created_at
+		FROM webhook_deliveries
+		WHERE endpoint_id = $1
+		ORDER BY id DESC
+		LIMIT $2`
+
+	// Get transaction from context if available
+	tx, _ := ctx.Value(TransactionKey{}).(pgx.Tx)
+
+	var rows pgx.Rows
+	var err error
+	if tx != nil {
+		rows, err = tx.Query(ctx, query, endpointId, limit)
+	} else {
+		rows, err = r.pool.Query(ctx, query, endpointId, limit)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries, err := pgx.CollectRows(rows, pgx.RowToStructByName[WebhookDelivery])
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
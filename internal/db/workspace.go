@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// DefaultWorkspace is the workspace of events and profiles stored without one
+const DefaultWorkspace = ""
+
+// ErrNoWorkspace is returned by repository queries made with a context neither scoped to a workspace nor marked as
+// covering every workspace
+var ErrNoWorkspace = errors.New("context is not scoped to a workspace")
+
+// workspaceKey holds the workspace repository queries are scoped to, or allWorkspaces
+type workspaceKey struct{}
+
+// allWorkspaces marks a context covering every workspace
+type allWorkspaces struct{}
+
+// WithWorkspace scopes repository queries made with the context to the workspace. Profiles, events and the rows
+// belonging to them are only found within the workspace, and rows are written to it.
+func WithWorkspace(ctx context.Context, workspace string) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, workspace)
+}
+
+// AllWorkspaces lets repository queries made with the context cover every workspace, which is meant for maintenance
+// such as rebuilds and archival. Rows are written to the workspace they name. Queries made with a context which is
+// neither scoped to a workspace nor covers all of them fail with ErrNoWorkspace.
+func AllWorkspaces(ctx context.Context) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, allWorkspaces{})
+}
+
+// WorkspaceFromContext returns the workspace the context is scoped to, false when it is not scoped to one
+func WorkspaceFromContext(ctx context.Context) (string, bool) {
+	workspace, ok := ctx.Value(workspaceKey{}).(string)
+	return workspace, ok
+}
+
+// CoversAllWorkspaces reports whether the context was marked by AllWorkspaces
+func CoversAllWorkspaces(ctx context.Context) bool {
+	_, ok := ctx.Value(workspaceKey{}).(allWorkspaces)
+	return ok
+}
+
+// missingWorkspace is the query argument of a context without a workspace, failing the query with ErrNoWorkspace
+type missingWorkspace struct{}
+
+func (missingWorkspace) Value() (driver.Value, error) {
+	return nil, ErrNoWorkspace
+}
+
+// workspaceArg is the query argument scoping a query to the workspace of the context, NULL covering every workspace
+// for a context marked by AllWorkspaces. The query fails when the context has no workspace.
+func workspaceArg(ctx context.Context) any {
+	if workspace, ok := WorkspaceFromContext(ctx); ok {
+		return workspace
+	}
+	if CoversAllWorkspaces(ctx) {
+		return nil
+	}
+	return missingWorkspace{}
+}
+
+// workspaceFilter matches rows whose column holds the workspace passed as $n, or every row when $n is NULL
+func workspaceFilter(column string, n int) string {
+	return fmt.Sprintf("($%d::text IS NULL OR %s = $%d)", n, column, n)
+}
+
+// writeWorkspace returns the workspace a row is written to, the one of the context or the given one when the
+// context covers every workspace. It fails with ErrNoWorkspace when the context has no workspace.
+func writeWorkspace(ctx context.Context, workspace string) (string, error) {
+	if scoped, ok := WorkspaceFromContext(ctx); ok {
+		return scoped, nil
+	}
+	if CoversAllWorkspaces(ctx) {
+		return workspace, nil
+	}
+	return "", ErrNoWorkspace
+}
+
+// WorkspaceConfig is the configuration of a workspace, an isolated set of events and profiles
+type WorkspaceConfig struct {
+	// IdentifierTypes lists the identifiers stitched into profiles, all of them when empty
+	IdentifierTypes []string `json:"identifier_types"`
+	// Survivorship replaces the survivorship rules for merges within the workspace
+	Survivorship *SurvivorshipRules `json:"survivorship"`
+}
+
+// Workspaces holds the configuration of workspaces by name, workspaces without one use the global configuration
+type Workspaces map[string]WorkspaceConfig
+
+// LoadWorkspaces reads the workspaces from a JSON file, e.g.
+// {"brand-a": {"identifier_types": ["cookie", "phone"], "survivorship": {"survivor": "most_events"}}}
+func LoadWorkspaces(path string) (Workspaces, error) {
+	var workspaces Workspaces
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workspaces: %w", err)
+	}
+	if err := json.Unmarshal(data, &workspaces); err != nil {
+		return nil, fmt.Errorf("failed to parse workspaces: %w", err)
+	}
+	if err := workspaces.Validate(); err != nil {
+		return nil, err
+	}
+	return workspaces, nil
+}
+
+// Validate checks the identifier types and survivorship rules of every workspace
+func (w Workspaces) Validate() error {
+	names := EventIdentifier{}.GetIdentifierNames()
+	for workspace, config := range w {
+		for _, identifierType := range config.IdentifierTypes {
+			if !slices.Contains(names, identifierType) {
+				return fmt.Errorf("unknown identifier %q in workspace %q", identifierType, workspace)
+			}
+		}
+		if config.Survivorship != nil {
+			if err := config.Survivorship.Validate(); err != nil {
+				return fmt.Errorf("invalid survivorship rules of workspace %q: %w", workspace, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AllowedIdentifiers returns the identifiers with the types the workspace does not stitch cleared
+func (w Workspaces) AllowedIdentifiers(workspace string, identifiers EventIdentifier) EventIdentifier {
+	config, ok := w[workspace]
+	if !ok || len(config.IdentifierTypes) == 0 {
+		return identifiers
+	}
+	var excluded []string
+	for _, name := range identifiers.GetIdentifierNames() {
+		if !slices.Contains(config.IdentifierTypes, name) {
+			excluded = append(excluded, name)
+		}
+	}
+	return identifiers.Without(excluded...)
+}
+
+// SurvivorshipRules returns the survivorship rules of the workspace, the given ones when it has none
+func (w Workspaces) SurvivorshipRules(workspace string, rules SurvivorshipRules) SurvivorshipRules {
+	if config, ok := w[workspace]; ok && config.Survivorship != nil {
+		return *config.Survivorship
+	}
+	return rules
+}
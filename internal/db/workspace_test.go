@@ -0,0 +1,34 @@
+package db_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var _ = Describe("Workspaces", func() {
+	workspaces := db.Workspaces{
+		"brand-a": {IdentifierTypes: []string{"cookie", "phone"},
+			Survivorship: &db.SurvivorshipRules{Survivor: db.SurvivorMostEvents}},
+		"brand-b": {},
+	}
+
+	It("should clear the identifiers a workspace does not stitch", func() {
+		identifiers := db.EventIdentifier{Cookie: "cookie-1", MessageId: "message-1", Phone: "111"}
+		Expect(workspaces.AllowedIdentifiers("brand-a", identifiers)).To(Equal(db.EventIdentifier{Cookie: "cookie-1", Phone: "111"}))
+		Expect(workspaces.AllowedIdentifiers("brand-b", identifiers)).To(Equal(identifiers))
+		Expect(workspaces.AllowedIdentifiers("unknown", identifiers)).To(Equal(identifiers))
+	})
+
+	It("should use the survivorship rules of the workspace", func() {
+		fallback := db.DefaultSurvivorshipRules()
+		Expect(workspaces.SurvivorshipRules("brand-a", fallback).Survivor).To(Equal(db.SurvivorMostEvents))
+		Expect(workspaces.SurvivorshipRules("brand-b", fallback)).To(Equal(fallback))
+	})
+
+	It("should reject unknown identifiers and survivorship rules", func() {
+		Expect(workspaces.Validate()).To(Succeed())
+		Expect(db.Workspaces{"brand-a": {IdentifierTypes: []string{"email"}}}.Validate()).NotTo(Succeed())
+		Expect(db.Workspaces{"brand-a": {Survivorship: &db.SurvivorshipRules{Survivor: "oldest_cookie"}}}.Validate()).NotTo(Succeed())
+	})
+})
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// DryRunReport describes what stitching the events would change compared to the live profiles
+type DryRunReport struct {
+	Events  int
+	Actions map[StitchAction]int
+	ProfileDiff
+}
+
+// ProfileDiff compares two sets of profiles by the identifiers they own
+type ProfileDiff struct {
+	LiveProfiles   int
+	ShadowProfiles int
+	// Unchanged live profiles map onto exactly one shadow profile with the same identifiers
+	Unchanged int
+	// Changed live profiles map onto exactly one shadow profile which gained or lost identifiers
+	Changed int
+	// Merges counts shadow profiles combining identifiers of several live profiles
+	Merges int
+	// Splits counts live profiles whose identifiers end up in several shadow profiles
+	Splits int
+	// New counts shadow profiles sharing no identifier with any live profile
+	New int
+	// Removed counts live profiles sharing no identifier with any shadow profile
+	Removed int
+}
+
+// DryRun stitches the events within the time range into the shadow profile table instead of the live one.
+// Lookups and decisions are the same as in Stitch, but no live profile is touched and no event is marked as processed.
+// Events are stitched in batches of the service's batch size, each committed on its own, so a long run neither holds
+// a single transaction open nor accumulates the locks of every event. The shadow table is kept after the run for
+// inspection.
+func (s *StitchingService) DryRun(ctx context.Context, shadowRepo db.ShadowProfileRepository, start, end time.Time) (DryRunReport, error) {
+	fail := func(err error) (DryRunReport, error) {
+		return DryRunReport{}, fmt.Errorf("dry run: %w", err)
+	}
+	// Events of every workspace are stitched, each within its workspace
+	ctx = db.AllWorkspaces(ctx)
+
+	if err := shadowRepo.ResetShadow(ctx); err != nil {
+		return fail(err)
+	}
+
+	report := DryRunReport{Actions: make(map[StitchAction]int)}
+	batch := make([]db.EventRecord, 0, s.batchSize)
+	for event, err := range s.eventRepo.IterEventsByTimeRange(ctx, start, end, db.DefaultPageSize) {
+		if err != nil {
+			return fail(err)
+		}
+		batch = append(batch, event)
+		if len(batch) < s.batchSize {
+			continue
+		}
+		if err := s.dryRunBatch(ctx, shadowRepo, batch, &report); err != nil {
+			return fail(err)
+		}
+		batch = batch[:0]
+	}
+	if err := s.dryRunBatch(ctx, shadowRepo, batch, &report); err != nil {
+		return fail(err)
+	}
+
+	live, err := profileIdentities(ctx, s.profileRepo)
+	if err != nil {
+		return fail(err)
+	}
+	shadow, err := profileIdentities(ctx, shadowRepo)
+	if err != nil {
+		return fail(err)
+	}
+	report.ProfileDiff = DiffProfiles(live, shadow)
+	return report, nil
+}
+
+// dryRunBatch stitches the events into the shadow repository in a transaction of their own and counts them in the report
+func (s *StitchingService) dryRunBatch(ctx context.Context, shadowRepo db.ShadowProfileRepository, events []db.EventRecord, report *DryRunReport) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	actions := make(map[StitchAction]int)
+	for _, event := range events {
+		result, err := s.stitchEvent(db.WithWorkspace(txCtx, event.Workspace), shadowRepo, event)
+		if err != nil {
+			return err
+		}
+		actions[result.Action]++
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	for action, count := range actions {
+		report.Actions[action] += count
+	}
+	report.Events += len(events)
+	return nil
+}
+
+// profileIdentities loads the ids and identifiers of all profiles, leaving out their traits which the diff ignores
+func profileIdentities(ctx context.Context, repo db.ProfileRepository) ([]db.Profile, error) {
+	var profiles []db.Profile
+	for p, err := range repo.IterProfiles(ctx, db.DefaultPageSize) {
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, db.Profile{Id: p.Id, Cookie: p.Cookie, MessageId: p.MessageId, Phone: p.Phone,
+			Workspace: p.Workspace})
+	}
+	return profiles, nil
+}
+
+// DiffProfiles matches live and shadow profiles through shared identifiers and classifies the differences
+func DiffProfiles(live, shadow []db.Profile) ProfileDiff {
+	diff := ProfileDiff{LiveProfiles: len(live), ShadowProfiles: len(shadow)}
+
+	liveOwners := identifierOwners(live)
+	shadowOwners := identifierOwners(shadow)
+
+	// Count the live profiles each shadow profile overlaps with
+	shadowMatches := make(map[int]int, len(shadow))
+	for _, p := range shadow {
+		overlaps := overlappingProfiles(p, liveOwners)
+		shadowMatches[p.Id] = len(overlaps)
+		switch {
+		case len(overlaps) == 0:
+			diff.New++
+		case len(overlaps) > 1:
+			diff.Merges++
+		}
+	}
+
+	shadowById := make(map[int]db.Profile, len(shadow))
+	for _, p := range shadow {
+		shadowById[p.Id] = p
+	}
+
+	for _, p := range live {
+		overlaps := overlappingProfiles(p, shadowOwners)
+		switch {
+		case len(overlaps) == 0:
+			diff.Removed++
+		case len(overlaps) > 1:
+			diff.Splits++
+		default:
+			for shadowId := range overlaps {
+				if shadowMatches[shadowId] != 1 {
+					// Part of a merge, already counted there
+					continue
+				}
+				if sameIdentifiers(p, shadowById[shadowId]) {
+					diff.Unchanged++
+				} else {
+					diff.Changed++
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// identifierOwners maps every identifier key to the id of the profile owning it
+func identifierOwners(profiles []db.Profile) map[string]int {
+	owners := make(map[string]int, len(profiles)*3)
+	for _, p := range profiles {
+		for _, key := range identifierKeys(p.Workspace, profileIdentifiers(p)) {
+			owners[key] = p.Id
+		}
+	}
+	return owners
+}
+
+// overlappingProfiles returns the ids of profiles in owners which share an identifier with p
+func overlappingProfiles(p db.Profile, owners map[string]int) map[int]struct{} {
+	overlaps := make(map[int]struct{})
+	for _, key := range identifierKeys(p.Workspace, profileIdentifiers(p)) {
+		if id, ok := owners[key]; ok {
+			overlaps[id] = struct{}{}
+		}
+	}
+	return overlaps
+}
+
+func sameIdentifiers(a, b db.Profile) bool {
+	return profileIdentifiers(a) == profileIdentifiers(b)
+}
+
+func profileIdentifiers(p db.Profile) db.EventIdentifier {
+	return db.EventIdentifier{Cookie: p.Cookie, MessageId: p.MessageId, Phone: p.Phone}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Profile Diff", func() {
+	It("should classify unchanged, changed, merged, split, new and removed profiles", func() {
+		live := []db.Profile{
+			{Id: 1, Cookie: "unchanged"},
+			{Id: 2, Cookie: "changed"},
+			{Id: 3, Cookie: "merge-a"},
+			{Id: 4, MessageId: "merge-b"},
+			{Id: 5, Cookie: "split", Phone: "555"},
+			{Id: 6, Cookie: "removed"},
+		}
+		shadow := []db.Profile{
+			{Id: 10, Cookie: "unchanged"},
+			{Id: 11, Cookie: "changed", Phone: "111"},
+			{Id: 12, Cookie: "merge-a", MessageId: "merge-b"},
+			{Id: 13, Cookie: "split"},
+			{Id: 14, Phone: "555"},
+			{Id: 15, Cookie: "new"},
+		}
+
+		Expect(DiffProfiles(live, shadow)).To(Equal(ProfileDiff{
+			LiveProfiles:   6,
+			ShadowProfiles: 6,
+			Unchanged:      1,
+			Changed:        1,
+			Merges:         1,
+			Splits:         1,
+			New:            1,
+			Removed:        1,
+		}))
+	})
+})
+
+var _ = Describe("Dry Run", func() {
+	It("should stitch into the shadow repository without touching live data", func() {
+		ctx := context.Background()
+		profileRepo := mocks.NewMockProfileRepository()
+		shadowRepo := mocks.NewMockShadowProfileRepository(profileRepo)
+		eventRepo := mocks.NewMockEventRepository()
+		stitchingSvc := NewStitchingService(profileRepo, eventRepo, time.Millisecond, 1, 10)
+
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "live-cookie"})
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			{EventIdentifier: db.EventIdentifier{Cookie: "live-cookie", Phone: "111"}, EventTimestamp: baseTime},
+			{EventIdentifier: db.EventIdentifier{Cookie: "new-cookie"}, EventTimestamp: baseTime.Add(time.Second)},
+			{EventIdentifier: db.EventIdentifier{Cookie: "new-cookie"}, EventTimestamp: baseTime.Add(2 * time.Second)},
+		}
+
+		report, err := stitchingSvc.DryRun(ctx, shadowRepo, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Events).To(Equal(3))
+		Expect(report.Actions).To(Equal(map[StitchAction]int{ActionCreated: 2, ActionEnriched: 1}))
+		Expect(report.ProfileDiff).To(Equal(ProfileDiff{
+			LiveProfiles:   1,
+			ShadowProfiles: 2,
+			Changed:        1,
+			New:            1,
+		}))
+
+		Expect(profileRepo.Profiles).To(HaveLen(1))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(3))
+		Expect(eventRepo.ProcessedEvents).To(BeEmpty())
+		Expect(shadowRepo.Promoted).To(BeFalse())
+	})
+
+	It("should commit the shadow profiles in batches of the batch size", func() {
+		ctx := context.Background()
+		profileRepo := mocks.NewMockProfileRepository()
+		shadowRepo := mocks.NewMockShadowProfileRepository(profileRepo)
+		eventRepo := mocks.NewMockEventRepository()
+		stitchingSvc := NewStitchingService(profileRepo, eventRepo, time.Millisecond, 1, 2)
+
+		baseTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := range 5 {
+			eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, db.EventRecord{
+				EventIdentifier: db.EventIdentifier{Cookie: "cookie-a"},
+				EventTimestamp:  baseTime.Add(time.Duration(i) * time.Second),
+			})
+		}
+
+		report, err := stitchingSvc.DryRun(ctx, shadowRepo, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Events).To(Equal(5))
+		Expect(report.Actions).To(Equal(map[StitchAction]int{ActionCreated: 1, ActionEnriched: 4}))
+		Expect(eventRepo.Transactions).To(Equal(3))
+	})
+})
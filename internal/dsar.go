@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+)
+
+// DataSubject names the person of a data subject request, by one of their identifiers or one of their profiles
+type DataSubject struct {
+	Identifier db.Identifier
+	// ProfileId names the person instead of Identifier when set, it may be a profile merged away since
+	ProfileId int
+}
+
+// auditIdentifier is the identifier logged for the request, the profile id when the subject is named by it
+func (d DataSubject) auditIdentifier() db.Identifier {
+	if d.ProfileId != 0 {
+		return db.Identifier{Type: "profile_id", Value: strconv.Itoa(d.ProfileId)}
+	}
+	return d.Identifier
+}
+
+func (d DataSubject) validate() error {
+	if d.ProfileId != 0 {
+		return nil
+	}
+	if _, ok := db.IdentifierByName(d.Identifier.Type, d.Identifier.Value); !ok {
+		return fmt.Errorf("unknown identifier %q", d.Identifier.Type)
+	}
+	if d.Identifier.Value == "" {
+		return fmt.Errorf("empty %s", d.Identifier.Type)
+	}
+	return nil
+}
+
+// Person is everything linking stored data to a data subject
+type Person struct {
+	// ProfileIds are the live profiles of the person
+	ProfileIds []int
+	// MergedIds are the profiles merged into them
+	MergedIds []int
+	// Identifiers are the values held or observed on the profiles along with the one naming the person,
+	// events holding any of them belong to the person
+	Identifiers []db.Identifier
+}
+
+// AllProfileIds returns the live and merged profile ids
+func (p Person) AllProfileIds() []int {
+	ids := append(slices.Clone(p.ProfileIds), p.MergedIds...)
+	slices.Sort(ids)
+	return ids
+}
+
+// DSAREvent is an event of the person in access documents
+type DSAREvent struct {
+	EventId     int             `json:"event_id"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Identifiers []db.Identifier `json:"identifiers"`
+	Source      string          `json:"source,omitempty"`
+	Traits      db.Traits       `json:"traits,omitempty"`
+	Revenue     float64         `json:"revenue,omitempty"`
+}
+
+// dsarDocument is the access document, the events of the person follow the profiles
+type dsarDocument struct {
+	RequestId   int64           `json:"request_id"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	ProfileIds  []int           `json:"profile_ids"`
+	MergedIds   []int           `json:"merged_ids"`
+	Identifiers []db.Identifier `json:"identifiers"`
+	Profiles    []export.Record `json:"profiles"`
+}
+
+// DSARService handles data subject requests: access requests export everything known about a person and
+// erasure requests remove it. Every request is logged for audit, and erased identifiers are tombstoned so
+// stitching ignores them from then on.
+type DSARService struct {
+	profileRepo db.ProfileRepository
+	eventRepo   db.EventRepository
+	dsarRepo    db.DSARRepository
+	outboxRepo  db.OutboxRepository
+	// profileKeyRepo holds the keys sealing the events of profiles, shredded by erasures in shred mode
+	profileKeyRepo db.ProfileKeyRepository
+	log            *slog.Logger
+}
+
+func NewDSARService(profileRepo db.ProfileRepository, eventRepo db.EventRepository, dsarRepo db.DSARRepository) *DSARService {
+	return &DSARService{
+		profileRepo: profileRepo,
+		eventRepo:   eventRepo,
+		dsarRepo:    dsarRepo,
+		log:         slog.Default(),
+	}
+}
+
+// SetOutbox enables removing the outbox events of erased profiles and announcing the erasure with profile.erased
+func (s *DSARService) SetOutbox(outboxRepo db.OutboxRepository) {
+	s.outboxRepo = outboxRepo
+}
+
+// SetProfileKeys enables erasing sealed events by destroying the keys of their profiles, see db.ErasureShred
+func (s *DSARService) SetProfileKeys(profileKeyRepo db.ProfileKeyRepository) {
+	s.profileKeyRepo = profileKeyRepo
+}
+
+// Access writes a JSON document holding the profiles and events of the person to w
+func (s *DSARService) Access(ctx context.Context, subject DataSubject, requestedBy string, w io.Writer) (db.DSARRequest, error) {
+	request := db.DSARRequest{Kind: db.DSARAccess, RequestedBy: requestedBy}
+	return s.handle(ctx, request, subject, func(ctx context.Context, request *db.DSARRequest, person Person, profiles []db.ProfileExport) error {
+		events, err := s.writeDocument(ctx, w, request.Id, person, profiles)
+		request.Events = events
+		return err
+	})
+}
+
+// Erase removes the profiles and events of the person and tombstones their identifiers. When w is not nil,
+// the access document is written to it first, within the same transaction.
+func (s *DSARService) Erase(ctx context.Context, subject DataSubject, mode db.ErasureMode, requestedBy string, w io.Writer) (db.DSARRequest, error) {
+	request := db.DSARRequest{Kind: db.DSARErasure, Mode: mode, RequestedBy: requestedBy}
+	return s.handle(ctx, request, subject, func(ctx context.Context, request *db.DSARRequest, person Person, profiles []db.ProfileExport) error {
+		if w != nil {
+			if _, err := s.writeDocument(ctx, w, request.Id, person, profiles); err != nil {
+				return err
+			}
+		}
+
+		if mode == db.ErasureShred {
+			if s.profileKeyRepo == nil {
+				return fmt.Errorf("erasure mode %q requires profile keys", mode)
+			}
+			if _, err := s.profileKeyRepo.ShredProfileKeys(ctx, person.AllProfileIds()); err != nil {
+				return err
+			}
+		}
+
+		events, err := s.eventRepo.EraseEventsByIdentifiers(ctx, person.Identifiers, person.AllProfileIds(), mode)
+		if err != nil {
+			return err
+		}
+		request.Events = events
+
+		if s.outboxRepo != nil {
+			// Profiles rebuilt since the outbox events were recorded have other ids, their payloads are found by the
+			// identifiers of the person
+			if _, err := s.outboxRepo.DeleteOutboxByProfiles(ctx, person.AllProfileIds(), person.Identifiers); err != nil {
+				return err
+			}
+		}
+		if len(person.ProfileIds) > 0 {
+			if err := s.eraseProfiles(ctx, person, mode); err != nil {
+				return err
+			}
+		}
+		return s.dsarRepo.InsertTombstones(ctx, request.Id, person.Identifiers)
+	})
+}
+
+// Resolve finds the profiles and identifiers of the person
+func (s *DSARService) Resolve(ctx context.Context, subject DataSubject) (Person, error) {
+	if err := subject.validate(); err != nil {
+		return Person{}, fmt.Errorf("resolve: %w", err)
+	}
+	person, _, err := s.resolve(ctx, subject)
+	if err != nil {
+		return Person{}, fmt.Errorf("resolve: %w", err)
+	}
+	return person, nil
+}
+
+// handle logs the request, then processes it in a transaction which completes the log entry. A failed request
+// is logged as such outside of the transaction.
+func (s *DSARService) handle(ctx context.Context, request db.DSARRequest, subject DataSubject,
+	process func(ctx context.Context, request *db.DSARRequest, person Person, profiles []db.ProfileExport) error) (db.DSARRequest, error) {
+	// Create a helper function for preparing failure results
+	fail := func(err error) (db.DSARRequest, error) {
+		err = fmt.Errorf("dsar %s: %w", request.Kind, err)
+		if request.Id != 0 {
+			request.Status, request.Error = db.DSARFailed, err.Error()
+			// Log the failure even when it was caused by the request being cancelled
+			if logErr := s.dsarRepo.CompleteDSARRequest(context.WithoutCancel(ctx), request); logErr != nil {
+				s.log.Error("Failed to log failed DSAR request", "request", request.Id, "error", logErr)
+			}
+		}
+		return request, err
+	}
+
+	if err := subject.validate(); err != nil {
+		return fail(err)
+	}
+	identifier := subject.auditIdentifier()
+	request.IdentifierType, request.IdentifierHash = identifier.Type, db.HashIdentifier(identifier)
+
+	var err error
+	if request.Id, err = s.dsarRepo.CreateDSARRequest(ctx, request); err != nil {
+		return fail(err)
+	}
+	request.Status = db.DSARPending
+
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	// Defer a rollback in case anything fails
+	defer tx.Rollback(ctx)
+
+	// Create a new context with the transaction
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	person, profiles, err := s.resolve(txCtx, subject)
+	if err != nil {
+		return fail(err)
+	}
+	if request.Kind == db.DSARErasure {
+		// Take the identifier locks of stitching, so no event is stitched to the person while it is erased,
+		// then resolve again in case one was stitched before the locks were taken
+		locked := person.Identifiers
+		if err := s.lockIdentifiers(txCtx, locked); err != nil {
+			return fail(err)
+		}
+		if person, profiles, err = s.resolve(txCtx, subject); err != nil {
+			return fail(err)
+		}
+		// Locking identifiers only found now in a second call could deadlock with stitching, so the request
+		// fails instead and can be retried
+		for _, identifier := range person.Identifiers {
+			if !slices.Contains(locked, identifier) {
+				return fail(ErrIdentifiersChanged)
+			}
+		}
+	}
+	request.ProfileIds = person.AllProfileIds()
+
+	if err := process(txCtx, &request, person, profiles); err != nil {
+		return fail(err)
+	}
+
+	request.Status = db.DSARCompleted
+	if err := s.dsarRepo.CompleteDSARRequest(txCtx, request); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+	return request, nil
+}
+
+// resolve follows the profiles of the subject to their survivors and collects the merged ids and identifiers
+func (s *DSARService) resolve(ctx context.Context, subject DataSubject) (Person, []db.ProfileExport, error) {
+	var found []int
+	if subject.ProfileId != 0 {
+		found = []int{subject.ProfileId}
+	} else {
+		var err error
+		if found, err = s.profileRepo.GetProfileIdsByIdentifier(ctx, subject.Identifier); err != nil {
+			return Person{}, nil, err
+		}
+	}
+
+	var person Person
+	for _, id := range found {
+		survivorId, merged, err := s.profileRepo.GetMergeSurvivor(ctx, id)
+		if err != nil {
+			return Person{}, nil, err
+		}
+		if merged {
+			id = survivorId
+		}
+		if !slices.Contains(person.ProfileIds, id) {
+			person.ProfileIds = append(person.ProfileIds, id)
+		}
+	}
+	slices.Sort(person.ProfileIds)
+
+	var profiles []db.ProfileExport
+	if len(person.ProfileIds) > 0 {
+		var err error
+		if person.MergedIds, err = s.profileRepo.GetMergedIds(ctx, person.ProfileIds); err != nil {
+			return Person{}, nil, err
+		}
+		if profiles, err = s.profileRepo.GetProfileExports(ctx, person.ProfileIds); err != nil {
+			return Person{}, nil, err
+		}
+		// A profile named by id may not exist at all
+		person.ProfileIds = person.ProfileIds[:0]
+		for _, p := range profiles {
+			person.ProfileIds = append(person.ProfileIds, p.Profile.Id)
+		}
+	}
+
+	add := func(identifier db.Identifier) {
+		if identifier.Value != "" && !slices.Contains(person.Identifiers, identifier) {
+			person.Identifiers = append(person.Identifiers, identifier)
+		}
+	}
+	if subject.ProfileId == 0 {
+		add(subject.Identifier)
+	}
+	for _, p := range profiles {
+		for _, identifier := range profileIdentifiers(p.Profile).Identifiers() {
+			add(identifier)
+		}
+		for _, o := range p.Observations {
+			add(db.Identifier{Type: o.IdentifierType, Value: o.Value})
+		}
+	}
+	slices.SortFunc(person.Identifiers, func(a, b db.Identifier) int {
+		return cmp.Compare(a.Type+":"+a.Value, b.Type+":"+b.Value)
+	})
+	return person, profiles, nil
+}
+
+// lockIdentifiers takes the locks of all identifiers in a single call, which acquires them in the order stitching
+// takes them in, so erasures and stitching never deadlock
+func (s *DSARService) lockIdentifiers(ctx context.Context, identifiers []db.Identifier) error {
+	locks := make([]db.EventIdentifier, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		lock, _ := db.IdentifierByName(identifier.Type, identifier.Value)
+		locks = append(locks, lock)
+	}
+	return s.profileRepo.LockIdentifiers(ctx, locks...)
+}
+
+// eraseProfiles removes the profile rows of the person along with their segment history, and announces the erasure
+// of every live profile so downstream consumers can remove their copies
+func (s *DSARService) eraseProfiles(ctx context.Context, person Person, mode db.ErasureMode) error {
+	profileIds := person.AllProfileIds()
+	if err := s.profileRepo.EraseProfiles(ctx, profileIds, mode); err != nil {
+		return err
+	}
+	if mode == db.ErasureDelete || mode == db.ErasureShred {
+		if err := s.eventRepo.DeleteSegmentTransitions(ctx, profileIds); err != nil {
+			return err
+		}
+	}
+
+	if s.outboxRepo == nil {
+		return nil
+	}
+	events := make([]db.OutboxEvent, 0, len(person.ProfileIds))
+	for _, id := range person.ProfileIds {
+		event, err := newOutboxEvent(db.KindProfileErased, id, ProfileChange{Profile: db.Profile{Id: id}, MergedIds: person.MergedIds})
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+	}
+	return s.outboxRepo.AppendOutbox(ctx, events)
+}
+
+// writeDocument writes the access document of the person and returns the number of events in it. Events are
+// streamed into the document as they are read, so it is written without holding them in memory.
+func (s *DSARService) writeDocument(ctx context.Context, w io.Writer, requestId int64, person Person, profiles []db.ProfileExport) (int, error) {
+	document := dsarDocument{
+		RequestId:   requestId,
+		GeneratedAt: time.Now().UTC(),
+		ProfileIds:  nonNil(person.ProfileIds),
+		MergedIds:   nonNil(person.MergedIds),
+		Identifiers: nonNil(person.Identifiers),
+		Profiles:    make([]export.Record, 0, len(profiles)),
+	}
+	for _, p := range profiles {
+		record, err := export.NewRecord(p)
+		if err != nil {
+			return 0, err
+		}
+		document.Profiles = append(document.Profiles, record)
+	}
+
+	head, err := json.Marshal(document)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode access document: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	// Reopen the document to append the events to it
+	bw.Write(head[:len(head)-1])
+	bw.WriteString(`,"events":[`)
+	events := 0
+	for event, err := range s.eventRepo.IterEventsByIdentifiers(ctx, person.Identifiers, person.AllProfileIds(), db.DefaultPageSize) {
+		if err != nil {
+			return events, err
+		}
+		encoded, err := json.Marshal(DSAREvent{
+			EventId:     event.EventId,
+			Timestamp:   event.EventTimestamp,
+			Identifiers: event.EventIdentifier.Identifiers(),
+			Source:      event.Source,
+			Traits:      event.Traits,
+			Revenue:     event.Revenue,
+		})
+		if err != nil {
+			return events, fmt.Errorf("failed to encode event: %w", err)
+		}
+		if events > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(encoded)
+		events++
+	}
+	bw.WriteString("]}\n")
+
+	if err := bw.Flush(); err != nil {
+		return events, fmt.Errorf("failed to write access document: %w", err)
+	}
+	return events, nil
+}
+
+func nonNil[T any](items []T) []T {
+	if items == nil {
+		return []T{}
+	}
+	return items
+}
@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("DSAR Service", func() {
+	var (
+		ctx         context.Context
+		profileRepo *mocks.MockProfileRepository
+		eventRepo   *mocks.MockEventRepository
+		outboxRepo  *mocks.MockOutboxRepository
+		dsarRepo    *mocks.MockDSARRepository
+		dsarSvc     *DSARService
+		baseTime    time.Time
+	)
+
+	event := func(offset int, cookie, phone string) db.EventRecord {
+		return db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: cookie, Phone: phone},
+			EventTimestamp:  baseTime.Add(time.Duration(offset) * time.Second),
+			Source:          "web",
+		}
+	}
+	phone := db.Identifier{Type: "phone", Value: "111"}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		profileRepo = mocks.NewMockProfileRepository()
+		eventRepo = mocks.NewMockEventRepository()
+		outboxRepo = mocks.NewMockOutboxRepository()
+		dsarRepo = mocks.NewMockDSARRepository()
+		dsarSvc = NewDSARService(profileRepo, eventRepo, dsarRepo)
+		dsarSvc.SetOutbox(outboxRepo)
+		baseTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		// Profile 2 holding cookie-b was merged into profile 1, profile 3 is someone else
+		eventRepo.ProcessedEvents = []db.EventRecord{
+			event(0, "cookie-a", "111"),
+			event(1, "cookie-b", ""),
+			event(2, "cookie-b", "111"),
+			event(3, "cookie-z", ""),
+		}
+		profileRepo.Profiles[1] = db.Profile{Id: 1, Cookie: "cookie-a", Phone: "111",
+			Traits: db.Traits{"email": db.StringTrait("a@example.com", baseTime)}}
+		profileRepo.Profiles[3] = db.Profile{Id: 3, Cookie: "cookie-z"}
+		profileRepo.Merges[2] = 1
+		profileRepo.Observations[1] = eventRepo.ProcessedEvents[:3]
+		profileRepo.Observations[3] = eventRepo.ProcessedEvents[3:]
+		profileRepo.Stats[1] = db.ProfileStats{ProfileId: 1, TotalEvents: 3}
+		Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{
+			{Kind: db.KindProfileCreated, ProfileId: 1}, {Kind: db.KindProfileCreated, ProfileId: 2},
+			{Kind: db.KindProfileCreated, ProfileId: 3},
+		})).To(Succeed())
+	})
+
+	It("should resolve the person through observed identifiers and merges", func() {
+		person, err := dsarSvc.Resolve(ctx, DataSubject{Identifier: db.Identifier{Type: "cookie", Value: "cookie-b"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(person.ProfileIds).To(Equal([]int{1}))
+		Expect(person.MergedIds).To(Equal([]int{2}))
+		Expect(person.Identifiers).To(Equal([]db.Identifier{
+			{Type: "cookie", Value: "cookie-a"}, {Type: "cookie", Value: "cookie-b"}, phone,
+		}))
+
+		person, err = dsarSvc.Resolve(ctx, DataSubject{ProfileId: 2})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(person.ProfileIds).To(Equal([]int{1}))
+	})
+
+	It("should export the profiles and events of the person and log the request", func() {
+		var out bytes.Buffer
+		request, err := dsarSvc.Access(ctx, DataSubject{Identifier: phone}, "legal", &out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(request.Status).To(Equal(db.DSARCompleted))
+		Expect(request.Events).To(Equal(3))
+
+		var document struct {
+			RequestId int64 `json:"request_id"`
+			MergedIds []int `json:"merged_ids"`
+			Profiles  []struct {
+				Id     int64           `json:"id"`
+				Traits json.RawMessage `json:"traits"`
+			} `json:"profiles"`
+			Events []DSAREvent `json:"events"`
+		}
+		Expect(json.Unmarshal(out.Bytes(), &document)).To(Succeed())
+		Expect(document.RequestId).To(Equal(request.Id))
+		Expect(document.MergedIds).To(Equal([]int{2}))
+		Expect(document.Profiles).To(HaveLen(1))
+		Expect(document.Profiles[0].Id).To(Equal(int64(1)))
+		Expect(string(document.Profiles[0].Traits)).To(ContainSubstring("a@example.com"))
+		Expect(document.Events).To(HaveLen(3))
+		Expect(document.Events[1].Identifiers).To(Equal([]db.Identifier{{Type: "cookie", Value: "cookie-b"}}))
+
+		Expect(dsarRepo.Requests).To(HaveLen(1))
+		logged := dsarRepo.Requests[0]
+		Expect(logged.Kind).To(Equal(db.DSARAccess))
+		Expect(logged.Status).To(Equal(db.DSARCompleted))
+		Expect(logged.IdentifierHash).To(Equal(db.HashIdentifier(phone)))
+		Expect(logged.ProfileIds).To(Equal([]int{1, 2}))
+		Expect(logged.RequestedBy).To(Equal("legal"))
+		Expect(logged.CompletedAt).NotTo(BeNil())
+
+		// Access leaves everything in place
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+		Expect(dsarRepo.Tombstones).To(BeEmpty())
+	})
+
+	It("should delete the person and tombstone their identifiers", func() {
+		request, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureDelete, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(request.Status).To(Equal(db.DSARCompleted))
+		Expect(request.Events).To(Equal(3))
+
+		Expect(profileRepo.Profiles).To(HaveKey(3))
+		Expect(profileRepo.Profiles).To(HaveLen(1))
+		Expect(profileRepo.Merges).To(BeEmpty())
+		Expect(profileRepo.Stats).NotTo(HaveKey(1))
+		Expect(eventRepo.ProcessedEvents).To(Equal([]db.EventRecord{event(3, "cookie-z", "")}))
+
+		Expect(dsarRepo.Tombstones).To(Equal(map[db.Identifier]int64{
+			{Type: "cookie", Value: "cookie-a"}: request.Id,
+			{Type: "cookie", Value: "cookie-b"}: request.Id,
+			phone:                               request.Id,
+		}))
+
+		// Outbox events of the person are replaced by the erasure
+		Expect(outboxRepo.Events).To(HaveLen(2))
+		Expect(outboxRepo.Events[0].ProfileId).To(Equal(3))
+		Expect(outboxRepo.Events[1].Kind).To(Equal(db.KindProfileErased))
+		Expect(outboxRepo.Events[1].ProfileId).To(Equal(1))
+		Expect(string(outboxRepo.Events[1].Payload)).To(ContainSubstring(`"merged_ids":[2]`))
+	})
+
+	It("should delete outbox events carrying the identifiers of the person under profile ids reassigned since", func() {
+		// Recorded before a rebuild gave the profiles of the person other ids
+		Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{
+			{Kind: db.KindProfileUpdated, ProfileId: 9, Payload: json.RawMessage(`{"profile":{"id":9,"cookie":"cookie-b"}}`)},
+			{Kind: db.KindProfileUpdated, ProfileId: 8, Payload: json.RawMessage(`{"profile":{"id":8,"cookie":"cookie-z"}}`)},
+		})).To(Succeed())
+
+		_, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureDelete, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(outboxRepo.Events).NotTo(ContainElement(HaveField("ProfileId", 9)))
+		Expect(outboxRepo.Events).To(ContainElement(HaveField("ProfileId", 8)))
+	})
+
+	It("should fail the erasure when an identifier is linked to the person while the locks are taken", func() {
+		enriching := &enrichingProfileRepository{MockProfileRepository: profileRepo, profileId: 1, phone: "222"}
+		dsarSvc = NewDSARService(enriching, eventRepo, dsarRepo)
+
+		request, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureDelete, "legal", nil)
+		Expect(err).To(MatchError(ErrIdentifiersChanged))
+		Expect(request.Status).To(Equal(db.DSARFailed))
+		Expect(profileRepo.Profiles).To(HaveKey(1))
+		Expect(dsarRepo.Tombstones).To(BeEmpty())
+	})
+
+	It("should anonymize the person keeping their stats and events", func() {
+		_, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureAnonymize, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(profileRepo.Profiles[1]).To(Equal(db.Profile{Id: 1}))
+		Expect(profileRepo.Stats).To(HaveKey(1))
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(4))
+		for _, e := range eventRepo.ProcessedEvents[1:] {
+			Expect(e.EventIdentifier).To(Equal(db.EventIdentifier{}))
+			Expect(e.Traits).To(BeNil())
+		}
+	})
+
+	It("should shred the keys of the person and anonymize events which are not sealed", func() {
+		profileKeyRepo := mocks.NewMockProfileKeyRepository()
+		dsarSvc.SetProfileKeys(profileKeyRepo)
+		for _, id := range []int{1, 2, 3} {
+			Expect(profileKeyRepo.InsertProfileKey(ctx, db.ProfileKey{ProfileId: &id})).Error().NotTo(HaveOccurred())
+		}
+		Expect(eventRepo.SealEvent(ctx, eventRepo.ProcessedEvents[0], db.EventIdentifier{}, 1)).To(Succeed())
+		Expect(eventRepo.SealEvent(ctx, eventRepo.ProcessedEvents[1], db.EventIdentifier{}, 2)).To(Succeed())
+
+		request, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureShred, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(request.Events).To(Equal(1))
+
+		// Shredded keys are detached from their profiles, the key of the other person is kept
+		Expect(profileKeyRepo.Keys).To(HaveLen(3))
+		Expect(profileKeyRepo.ProfileKeysOf(1)).To(BeEmpty())
+		Expect(profileKeyRepo.ProfileKeysOf(2)).To(BeEmpty())
+		Expect(profileKeyRepo.ProfileKeysOf(3)).To(ConsistOf(HaveField("ShreddedAt", BeNil())))
+		Expect(profileRepo.Profiles).To(HaveLen(1))
+		Expect(profileRepo.Profiles).To(HaveKey(3))
+
+		// Sealed events are left to their destroyed keys
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(4))
+		Expect(eventRepo.ProcessedEvents[0]).To(Equal(event(0, "cookie-a", "111")))
+		Expect(eventRepo.ProcessedEvents[3].EventIdentifier).To(Equal(db.EventIdentifier{}))
+	})
+
+	It("should require profile keys to shred", func() {
+		_, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureShred, "legal", nil)
+		Expect(err).To(MatchError(ContainSubstring("requires profile keys")))
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+	})
+
+	It("should write the access document before erasing", func() {
+		var out bytes.Buffer
+		request, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureDelete, "legal", &out)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out.String()).To(ContainSubstring("cookie-b"))
+		Expect(request.Events).To(Equal(3))
+	})
+
+	It("should tombstone the identifier of a person without data", func() {
+		unknown := db.Identifier{Type: "phone", Value: "999"}
+		request, err := dsarSvc.Erase(ctx, DataSubject{Identifier: unknown}, db.ErasureDelete, "", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(request.ProfileIds).To(BeEmpty())
+		Expect(dsarRepo.Tombstones).To(HaveKey(unknown))
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+	})
+
+	It("should log failed requests", func() {
+		_, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureMode("burn"), "legal", nil)
+		Expect(err).To(HaveOccurred())
+
+		Expect(dsarRepo.Requests).To(HaveLen(1))
+		Expect(dsarRepo.Requests[0].Status).To(Equal(db.DSARFailed))
+		Expect(dsarRepo.Requests[0].Error).To(ContainSubstring("burn"))
+		Expect(dsarRepo.Tombstones).To(BeEmpty())
+	})
+
+	It("should reject unknown identifiers", func() {
+		_, err := dsarSvc.Access(ctx, DataSubject{Identifier: db.Identifier{Type: "email", Value: "a@example.com"}}, "", &bytes.Buffer{})
+		Expect(err).To(MatchError(ContainSubstring("unknown identifier")))
+		Expect(dsarRepo.Requests).To(BeEmpty())
+	})
+
+	Describe("stitching after an erasure", func() {
+		var stitchingSvc *StitchingService
+
+		BeforeEach(func() {
+			_, err := dsarSvc.Erase(ctx, DataSubject{Identifier: phone}, db.ErasureDelete, "legal", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			stitchingSvc = NewStitchingService(profileRepo, eventRepo, 0, 0, 0)
+			stitchingSvc.SetOutbox(outboxRepo)
+			stitchingSvc.SetErasures(dsarRepo)
+		})
+
+		It("should skip events holding only erased identifiers", func() {
+			resolved, err := stitchingSvc.StitchNow(ctx, event(10, "cookie-b", "111"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Action).To(Equal(ActionSkipped))
+			Expect(profileRepo.Profiles).To(HaveLen(1))
+		})
+
+		It("should stitch the remaining identifiers without the erased ones", func() {
+			resolved, err := stitchingSvc.StitchNow(ctx, event(10, "cookie-z", "111"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Action).To(Equal(ActionEnriched))
+			Expect(resolved.ProfileId).To(Equal(3))
+			Expect(profileRepo.Profiles[3].Phone).To(BeEmpty())
+		})
+	})
+})
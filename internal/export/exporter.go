@@ -0,0 +1,143 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// DefaultOverlap is subtracted from stored watermarks. Changes are stamped when their transaction starts,
+// so a change committed after an export ran may carry a time before that export's watermark.
+const DefaultOverlap = time.Minute
+
+// Options describe a single export
+type Options struct {
+	Format Format
+	// Since exports only profiles changed after it, every profile when zero
+	Since time.Time
+	// Name reads Since from the watermark stored by the last export of that name, when Since is zero
+	Name string
+	// Overlap is subtracted from Since, re-exporting profiles changed shortly before it
+	Overlap time.Duration
+}
+
+// Result describes an export. Watermark is the Since of the next incremental export, the latest change
+// exported or the Since of this export when nothing changed.
+type Result struct {
+	Profiles  int64
+	Since     time.Time
+	Watermark time.Time
+}
+
+// Exporter streams profiles in pages ordered by id, so exports of any size run in constant memory. Pages are
+// read outside of a transaction, profiles merged away while the export runs may still be part of it, their
+// survivor lists them in merged_ids.
+type Exporter struct {
+	profileRepo  db.ProfileRepository
+	exportRepo   db.ExportRepository
+	pageSize     int
+	consentRules db.ConsentRules
+	log          *slog.Logger
+}
+
+func NewExporter(profileRepo db.ProfileRepository, exportRepo db.ExportRepository, pageSize int) *Exporter {
+	return &Exporter{
+		profileRepo: profileRepo,
+		exportRepo:  exportRepo,
+		pageSize:    pageSize,
+		log:         slog.Default(),
+	}
+}
+
+// SetConsentRules changes the rules applied to profiles and identifiers without an export consent decision, by
+// default everything not denied is exported
+func (e *Exporter) SetConsentRules(rules db.ConsentRules) {
+	e.consentRules = rules
+}
+
+// Export writes the profiles to w. Profiles without export consent are left out and identifiers without it are
+// removed from the profiles exported. The watermark of a named export is not stored, call SaveWatermark once
+// the output is safely persisted.
+func (e *Exporter) Export(ctx context.Context, w io.Writer, opts Options) (Result, error) {
+	fail := func(err error) (Result, error) {
+		return Result{}, fmt.Errorf("export: %w", err)
+	}
+
+	if opts.Since.IsZero() && opts.Name != "" {
+		watermark, _, err := e.exportRepo.GetExportWatermark(ctx, opts.Name)
+		if err != nil {
+			return fail(err)
+		}
+		opts.Since = watermark
+	}
+	result := Result{Since: opts.Since, Watermark: opts.Since}
+
+	since := opts.Since
+	if !since.IsZero() {
+		since = since.Add(-opts.Overlap)
+	}
+
+	writer, err := newRecordWriter(w, opts.Format)
+	if err != nil {
+		return fail(err)
+	}
+
+	for profile, err := range e.profileRepo.IterProfileExports(ctx, since, e.pageSize) {
+		if err != nil {
+			return fail(err)
+		}
+		// Skipped profiles still advance the watermark, a later grant changes the profile again
+		if profile.UpdatedAt.After(result.Watermark) {
+			result.Watermark = profile.UpdatedAt
+		}
+		if !e.consentRules.Allows(profile.Consents, db.PurposeExport, "") {
+			continue
+		}
+
+		record, err := NewRecord(e.withoutDeniedIdentifiers(profile))
+		if err != nil {
+			return fail(err)
+		}
+		if err := writer.Write(record); err != nil {
+			return fail(err)
+		}
+		result.Profiles++
+	}
+
+	if err := writer.Close(); err != nil {
+		return fail(err)
+	}
+	return result, nil
+}
+
+// withoutDeniedIdentifiers removes the identifiers of the profile and its identity graph the consents of the
+// profile do not allow exporting
+func (e *Exporter) withoutDeniedIdentifiers(profile db.ProfileExport) db.ProfileExport {
+	allowed := e.consentRules.AllowedIdentifiers(profile.Consents, db.PurposeExport, db.EventIdentifier{
+		Cookie:    profile.Profile.Cookie,
+		MessageId: profile.Profile.MessageId,
+		Phone:     profile.Profile.Phone,
+	})
+	profile.Profile.Cookie, profile.Profile.MessageId, profile.Profile.Phone = allowed.Cookie, allowed.MessageId, allowed.Phone
+
+	observations := make([]db.IdentifierObservation, 0, len(profile.Observations))
+	for _, o := range profile.Observations {
+		if e.consentRules.Allows(profile.Consents, db.PurposeExport, o.IdentifierType) {
+			observations = append(observations, o)
+		}
+	}
+	profile.Observations = observations
+	return profile
+}
+
+// SaveWatermark stores the watermark of the export, which the next export of the name starts from
+func (e *Exporter) SaveWatermark(ctx context.Context, name string, result Result) error {
+	if err := e.exportRepo.SaveExportWatermark(ctx, name, result.Watermark); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package export_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/parquet-go/parquet-go"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/export"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Exporter", func() {
+	var (
+		profileRepo *mocks.MockProfileRepository
+		exportRepo  *mocks.MockExportRepository
+		exporter    *export.Exporter
+		seen        time.Time
+	)
+
+	BeforeEach(func() {
+		profileRepo = mocks.NewMockProfileRepository()
+		exportRepo = mocks.NewMockExportRepository()
+		// A page size of 2 makes the three profiles span two pages
+		exporter = export.NewExporter(profileRepo, exportRepo, 2)
+
+		seen = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		profileRepo.Profiles[1] = db.Profile{Id: 1, Cookie: "cookie-1", Phone: "+15550100",
+			Traits: db.Traits{"plan": db.StringTrait("pro", seen)}}
+		profileRepo.Profiles[2] = db.Profile{Id: 2, MessageId: "message-2"}
+		profileRepo.Profiles[4] = db.Profile{Id: 4, Cookie: "cookie-4"}
+		profileRepo.Observations[1] = []db.EventRecord{
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-1"}, EventTimestamp: seen, Source: "web"},
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-1", Phone: "+15550100"}, EventTimestamp: seen.Add(time.Hour), Source: "crm"},
+		}
+		profileRepo.Stats[1] = db.ProfileStats{ProfileId: 1, FirstSeen: seen, LastSeen: seen.Add(time.Hour), TotalEvents: 2,
+			PurchaseCount: 1, Revenue: 9.5, LastPurchase: seen}
+		profileRepo.Segments[1] = []string{"buyers", "vip"}
+		profileRepo.Merges[3] = 1
+		profileRepo.Merges[5] = 1
+
+		profileRepo.UpdatedAt[1] = seen.Add(2 * time.Hour)
+		profileRepo.UpdatedAt[2] = seen
+		profileRepo.UpdatedAt[4] = seen.Add(3 * time.Hour)
+	})
+
+	readJSONL := func(data []byte) []export.Record {
+		var records []export.Record
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var record export.Record
+			Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+			records = append(records, record)
+		}
+		return records
+	}
+
+	It("should export every profile with its identifier graph, stats and lineage as JSONL", func(ctx SpecContext) {
+		var out bytes.Buffer
+		result, err := exporter.Export(ctx, &out, export.Options{Format: export.FormatJSONL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Profiles).To(BeEquivalentTo(3))
+		Expect(result.Watermark).To(Equal(seen.Add(3 * time.Hour)))
+
+		records := readJSONL(out.Bytes())
+		Expect(records).To(HaveLen(3))
+		Expect([]int64{records[0].Id, records[1].Id, records[2].Id}).To(Equal([]int64{1, 2, 4}))
+
+		profile := records[0]
+		Expect(profile.Cookie).To(Equal("cookie-1"))
+		Expect(string(profile.Traits)).To(ContainSubstring(`"pro"`))
+		Expect(profile.Identifiers).To(ConsistOf(
+			export.Identifier{Type: "cookie", Value: "cookie-1", Source: "crm", FirstSeen: seen, LastSeen: seen.Add(time.Hour), SeenCount: 2},
+			export.Identifier{Type: "phone", Value: "+15550100", Source: "crm", FirstSeen: seen.Add(time.Hour), LastSeen: seen.Add(time.Hour), SeenCount: 1},
+		))
+		Expect(profile.TotalEvents).To(BeEquivalentTo(2))
+		Expect(profile.Revenue).To(Equal(9.5))
+		Expect(*profile.LastPurchase).To(Equal(seen))
+		Expect(profile.Segments).To(Equal([]string{"buyers", "vip"}))
+		Expect(profile.MergedIds).To(Equal([]int64{3, 5}))
+
+		// Profiles without events leave the stats times out
+		Expect(records[1].FirstSeen).To(BeNil())
+		Expect(records[1].MergedIds).To(BeEmpty())
+	})
+
+	It("should only export profiles changed since the watermark of a named export", func(ctx SpecContext) {
+		exportRepo.Watermarks["warehouse"] = seen.Add(2 * time.Hour)
+
+		var out bytes.Buffer
+		result, err := exporter.Export(ctx, &out, export.Options{Format: export.FormatJSONL, Name: "warehouse"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Since).To(Equal(seen.Add(2 * time.Hour)))
+		Expect(readJSONL(out.Bytes())).To(HaveLen(1))
+
+		// The overlap re-exports profiles changed shortly before the watermark
+		out.Reset()
+		_, err = exporter.Export(ctx, &out, export.Options{Format: export.FormatJSONL, Name: "warehouse", Overlap: time.Minute})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readJSONL(out.Bytes())).To(HaveLen(2))
+
+		// The watermark is only stored when asked to, and never moves back
+		Expect(exportRepo.Watermarks["warehouse"]).To(Equal(seen.Add(2 * time.Hour)))
+		Expect(exporter.SaveWatermark(ctx, "warehouse", result)).To(Succeed())
+		Expect(exportRepo.Watermarks["warehouse"]).To(Equal(seen.Add(3 * time.Hour)))
+
+		out.Reset()
+		result, err = exporter.Export(ctx, &out, export.Options{Format: export.FormatJSONL, Name: "warehouse"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Profiles).To(BeZero())
+		Expect(result.Watermark).To(Equal(seen.Add(3 * time.Hour)))
+	})
+
+	It("should leave out profiles and identifiers without export consent", func(ctx SpecContext) {
+		profileRepo.Consents[1] = db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentGranted},
+			{Purpose: db.PurposeExport, IdentifierType: "phone", Status: db.ConsentDenied},
+		}
+		profileRepo.Consents[2] = db.Consents{{Purpose: db.PurposeExport, Status: db.ConsentDenied}}
+		exporter.SetConsentRules(db.ConsentRules{OptIn: []string{db.PurposeExport}})
+
+		var out bytes.Buffer
+		result, err := exporter.Export(ctx, &out, export.Options{Format: export.FormatJSONL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Profiles).To(BeEquivalentTo(1))
+		// Profiles left out still advance the watermark
+		Expect(result.Watermark).To(Equal(seen.Add(3 * time.Hour)))
+
+		records := readJSONL(out.Bytes())
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Id).To(BeEquivalentTo(1))
+		Expect(records[0].Cookie).To(Equal("cookie-1"))
+		Expect(records[0].Phone).To(BeEmpty())
+		Expect(records[0].Identifiers).To(HaveLen(1))
+		Expect(records[0].Identifiers[0].Type).To(Equal("cookie"))
+	})
+
+	It("should write CSV with nested fields as JSON", func(ctx SpecContext) {
+		var out bytes.Buffer
+		_, err := exporter.Export(ctx, &out, export.Options{Format: export.FormatCSV})
+		Expect(err).NotTo(HaveOccurred())
+
+		rows, err := csv.NewReader(&out).ReadAll()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rows).To(HaveLen(4))
+		header := rows[0]
+		column := func(row []string, name string) string {
+			for i, h := range header {
+				if h == name {
+					return row[i]
+				}
+			}
+			Fail("no column " + name)
+			return ""
+		}
+		Expect(column(rows[1], "id")).To(Equal("1"))
+		Expect(column(rows[1], "merged_ids")).To(Equal("[3,5]"))
+		Expect(column(rows[1], "segments")).To(Equal(`["buyers","vip"]`))
+		Expect(column(rows[1], "first_seen")).To(Equal("2024-05-01T12:00:00Z"))
+		Expect(column(rows[2], "first_seen")).To(BeEmpty())
+		Expect(column(rows[2], "traits")).To(Equal("{}"))
+
+		var identifiers []export.Identifier
+		Expect(json.Unmarshal([]byte(column(rows[1], "identifiers")), &identifiers)).To(Succeed())
+		Expect(identifiers).To(HaveLen(2))
+	})
+
+	It("should write Parquet", func(ctx SpecContext) {
+		var out bytes.Buffer
+		_, err := exporter.Export(ctx, &out, export.Options{Format: export.FormatParquet})
+		Expect(err).NotTo(HaveOccurred())
+
+		records, err := parquet.Read[export.Record](bytes.NewReader(out.Bytes()), int64(out.Len()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(records).To(HaveLen(3))
+		Expect(records[0].MergedIds).To(Equal([]int64{3, 5}))
+		Expect(records[0].Identifiers).To(HaveLen(2))
+		Expect(*records[0].FirstSeen).To(Equal(seen))
+		Expect(records[1].FirstSeen).To(BeNil())
+		Expect(records[2].UpdatedAt).To(Equal(seen.Add(3 * time.Hour)))
+	})
+
+	It("should stop when the context is cancelled", func(ctx SpecContext) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		var out bytes.Buffer
+		_, err := exporter.Export(cancelled, &out, export.Options{Format: export.FormatJSONL})
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(out.Len()).To(BeZero())
+	})
+
+	It("should reject unknown formats", func() {
+		_, err := export.ParseFormat("xml")
+		Expect(err).To(HaveOccurred())
+		Expect(export.ParseFormat("ndjson")).To(Equal(export.FormatJSONL))
+	})
+})
@@ -0,0 +1,133 @@
+// Package export writes profiles along with their identifier graph, aggregates and merge lineage as JSONL,
+// CSV or Parquet, either in full or incrementally from the watermark of an earlier export.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Format is the encoding of an export
+type Format string
+
+const (
+	// FormatJSONL writes one JSON object per profile and line
+	FormatJSONL Format = "jsonl"
+	// FormatCSV writes a header row followed by one row per profile, nested fields hold JSON
+	FormatCSV Format = "csv"
+	// FormatParquet writes a single Parquet file with nested fields as lists and traits as JSON
+	FormatParquet Format = "parquet"
+)
+
+// ParseFormat accepts the format names and "ndjson" for JSONL
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "jsonl", "ndjson":
+		return FormatJSONL, nil
+	case "csv":
+		return FormatCSV, nil
+	case "parquet":
+		return FormatParquet, nil
+	}
+	return "", fmt.Errorf("unknown export format %q, use jsonl, csv or parquet", name)
+}
+
+// ContentType is the media type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatCSV:
+		return "text/csv"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+// Record is an exported profile. MergedIds lists every profile that was merged into this one, so consumers
+// holding rows of those ids can fold them into this profile. Stats times are unset for profiles without events.
+type Record struct {
+	Id           int64           `json:"id" parquet:"id"`
+	Cookie       string          `json:"cookie,omitempty" parquet:"cookie,optional"`
+	MessageId    string          `json:"message_id,omitempty" parquet:"message_id,optional"`
+	Phone        string          `json:"phone,omitempty" parquet:"phone,optional"`
+	Traits       json.RawMessage `json:"traits" parquet:"traits,json"`
+	Identifiers  []Identifier    `json:"identifiers" parquet:"identifiers,list"`
+	FirstSeen    *time.Time      `json:"first_seen,omitempty" parquet:"first_seen,optional"`
+	LastSeen     *time.Time      `json:"last_seen,omitempty" parquet:"last_seen,optional"`
+	TotalEvents  int64           `json:"total_events" parquet:"total_events"`
+	Purchases    int64           `json:"purchase_count" parquet:"purchase_count"`
+	Revenue      float64         `json:"revenue" parquet:"revenue"`
+	LastPurchase *time.Time      `json:"last_purchase,omitempty" parquet:"last_purchase,optional"`
+	Segments     []string        `json:"segments" parquet:"segments,list"`
+	MergedIds    []int64         `json:"merged_ids" parquet:"merged_ids,list"`
+	UpdatedAt    time.Time       `json:"updated_at" parquet:"updated_at"`
+	Workspace    string          `json:"workspace,omitempty" parquet:"workspace,optional"`
+}
+
+// Identifier is an observed identifier value of a profile, the edges of the identity graph
+type Identifier struct {
+	Type      string    `json:"type" parquet:"type"`
+	Value     string    `json:"value" parquet:"value"`
+	Source    string    `json:"source" parquet:"source"`
+	FirstSeen time.Time `json:"first_seen" parquet:"first_seen"`
+	LastSeen  time.Time `json:"last_seen" parquet:"last_seen"`
+	SeenCount int64     `json:"seen_count" parquet:"seen_count"`
+}
+
+// NewRecord converts a profile read for export
+func NewRecord(profile db.ProfileExport) (Record, error) {
+	traits, err := json.Marshal(profile.Profile.Traits)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to encode traits of profile %d: %w", profile.Profile.Id, err)
+	}
+	if profile.Profile.Traits == nil {
+		traits = []byte("{}")
+	}
+
+	record := Record{
+		Id:           int64(profile.Profile.Id),
+		Cookie:       profile.Profile.Cookie,
+		MessageId:    profile.Profile.MessageId,
+		Phone:        profile.Profile.Phone,
+		Traits:       traits,
+		Identifiers:  make([]Identifier, 0, len(profile.Observations)),
+		FirstSeen:    optionalTime(profile.Stats.FirstSeen),
+		LastSeen:     optionalTime(profile.Stats.LastSeen),
+		TotalEvents:  int64(profile.Stats.TotalEvents),
+		Purchases:    int64(profile.Stats.PurchaseCount),
+		Revenue:      profile.Stats.Revenue,
+		LastPurchase: optionalTime(profile.Stats.LastPurchase),
+		Segments:     make([]string, 0, len(profile.Segments)),
+		MergedIds:    make([]int64, 0, len(profile.MergedIds)),
+		UpdatedAt:    profile.UpdatedAt.UTC(),
+		Workspace:    profile.Profile.Workspace,
+	}
+	for _, o := range profile.Observations {
+		record.Identifiers = append(record.Identifiers, Identifier{
+			Type:      o.IdentifierType,
+			Value:     o.Value,
+			Source:    o.Source,
+			FirstSeen: o.FirstSeen.UTC(),
+			LastSeen:  o.LastSeen.UTC(),
+			SeenCount: int64(o.SeenCount),
+		})
+	}
+	record.Segments = append(record.Segments, profile.Segments...)
+	for _, id := range profile.MergedIds {
+		record.MergedIds = append(record.MergedIds, int64(id))
+	}
+	return record, nil
+}
+
+// optionalTime leaves zero times unset
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
@@ -0,0 +1,127 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// recordWriter encodes records in a format, Close completes the output without closing the underlying writer
+type recordWriter interface {
+	Write(record Record) error
+	Close() error
+}
+
+func newRecordWriter(w io.Writer, format Format) (recordWriter, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatCSV:
+		return newCSVWriter(w)
+	case FormatParquet:
+		return &parquetWriter{w: parquet.NewGenericWriter[Record](w, parquet.Compression(&parquet.Zstd))}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) Write(record Record) error {
+	if err := j.encoder.Encode(record); err != nil {
+		return fmt.Errorf("failed to write profile %d: %w", record.Id, err)
+	}
+	return nil
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
+
+// csvHeader names the columns of CSV exports, identifiers, segments and merged_ids hold JSON arrays
+var csvHeader = []string{
+	"id", "cookie", "message_id", "phone", "traits", "identifiers", "first_seen", "last_seen",
+	"total_events", "purchase_count", "revenue", "last_purchase", "segments", "merged_ids", "updated_at",
+	"workspace",
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	c := &csvWriter{w: csv.NewWriter(w)}
+	if err := c.w.Write(csvHeader); err != nil {
+		return nil, fmt.Errorf("failed to write CSV header: %w", err)
+	}
+	return c, nil
+}
+
+func (c *csvWriter) Write(record Record) error {
+	identifiers, err := json.Marshal(record.Identifiers)
+	if err != nil {
+		return fmt.Errorf("failed to encode identifiers of profile %d: %w", record.Id, err)
+	}
+	segments, _ := json.Marshal(record.Segments)
+	mergedIds, _ := json.Marshal(record.MergedIds)
+
+	row := []string{
+		strconv.FormatInt(record.Id, 10),
+		record.Cookie,
+		record.MessageId,
+		record.Phone,
+		string(record.Traits),
+		string(identifiers),
+		csvTime(record.FirstSeen),
+		csvTime(record.LastSeen),
+		strconv.FormatInt(record.TotalEvents, 10),
+		strconv.FormatInt(record.Purchases, 10),
+		strconv.FormatFloat(record.Revenue, 'f', -1, 64),
+		csvTime(record.LastPurchase),
+		string(segments),
+		string(mergedIds),
+		record.UpdatedAt.Format(time.RFC3339Nano),
+		record.Workspace,
+	}
+	if err := c.w.Write(row); err != nil {
+		return fmt.Errorf("failed to write profile %d: %w", record.Id, err)
+	}
+	return nil
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// parquetWriter buffers rows into row groups, the file is only readable once the footer is written by Close
+type parquetWriter struct {
+	w *parquet.GenericWriter[Record]
+}
+
+func (p *parquetWriter) Write(record Record) error {
+	if _, err := p.w.Write([]Record{record}); err != nil {
+		return fmt.Errorf("failed to write parquet rows: %w", err)
+	}
+	return nil
+}
+
+func (p *parquetWriter) Close() error {
+	if err := p.w.Close(); err != nil {
+		return fmt.Errorf("failed to write parquet footer: %w", err)
+	}
+	return nil
+}
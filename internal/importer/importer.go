@@ -0,0 +1,225 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Options describe a single import
+type Options struct {
+	Path string
+	// Name is the key the progress is stored under, defaults to Path
+	Name string
+	// Format is detected from the file extension when empty
+	Format  Format
+	Mapping Mapping
+	// Source is set on events without one
+	Source string
+	// ErrorPath receives the rejected rows as NDJSON, defaults to Path with ".rejected.ndjson" appended
+	ErrorPath string
+	// Restart discards the stored progress and the error file instead of resuming
+	Restart bool
+}
+
+// Result counts the rows of an import, including the ones committed by earlier interrupted runs
+type Result struct {
+	// ResumedAt is the last line committed before this run, zero when starting from the beginning
+	ResumedAt int64
+	Lines     int64
+	Loaded    int64
+	Rejected  int64
+}
+
+// RejectedRow is a line of the error file
+type RejectedRow struct {
+	Line  int64  `json:"line"`
+	Error string `json:"error"`
+	Row   string `json:"row"`
+}
+
+// Importer loads events in batches using COPY. Each batch is committed along with the import's progress,
+// so an interrupted import resumes after the last committed line. Rejected rows are written to the error file
+// before their batch is committed, so a resumed import may repeat the rejects of the interrupted batch.
+type Importer struct {
+	eventRepo  db.EventRepository
+	importRepo db.ImportRepository
+	batchSize  int
+	log        *slog.Logger
+}
+
+func NewImporter(eventRepo db.EventRepository, importRepo db.ImportRepository, batchSize int) *Importer {
+	return &Importer{
+		eventRepo:  eventRepo,
+		importRepo: importRepo,
+		batchSize:  batchSize,
+		log:        slog.Default(),
+	}
+}
+
+func (im *Importer) Import(ctx context.Context, opts Options) (Result, error) {
+	fail := func(err error) (Result, error) {
+		return Result{}, fmt.Errorf("import: %w", err)
+	}
+
+	if opts.Name == "" {
+		opts.Name = opts.Path
+	}
+	if opts.ErrorPath == "" {
+		opts.ErrorPath = opts.Path + ".rejected.ndjson"
+	}
+	if opts.Mapping == nil {
+		opts.Mapping, _ = ParseMapping("")
+	}
+	if opts.Format == "" {
+		format, err := DetectFormat(opts.Path)
+		if err != nil {
+			return fail(err)
+		}
+		opts.Format = format
+	}
+
+	if opts.Restart {
+		if err := im.importRepo.DeleteImportCheckpoint(ctx, opts.Name); err != nil {
+			return fail(err)
+		}
+	}
+	checkpoint, _, err := im.importRepo.GetImportCheckpoint(ctx, opts.Name)
+	if err != nil {
+		return fail(err)
+	}
+	checkpoint.Name = opts.Name
+
+	file, err := os.Open(opts.Path)
+	if err != nil {
+		return fail(err)
+	}
+	defer file.Close()
+
+	rows, err := newRowReader(file, opts.Format)
+	if err != nil {
+		return fail(err)
+	}
+
+	errorFlags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if opts.Restart {
+		errorFlags |= os.O_TRUNC
+	}
+	errorFile, err := os.OpenFile(opts.ErrorPath, errorFlags, 0o644)
+	if err != nil {
+		return fail(err)
+	}
+	defer errorFile.Close()
+
+	run := &importRun{importer: im, checkpoint: checkpoint, errorFile: errorFile}
+	result := Result{ResumedAt: checkpoint.Line}
+	if checkpoint.Line > 0 {
+		im.log.Info("Resuming import", "name", opts.Name, "line", checkpoint.Line)
+	}
+
+	var line int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+
+		row, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		line = row.Line
+		if line <= checkpoint.Line {
+			continue
+		}
+
+		event, err := opts.Mapping.Event(row, opts.Source)
+		if err != nil {
+			run.rejects = append(run.rejects, RejectedRow{Line: row.Line, Error: err.Error(), Row: row.Raw})
+		} else {
+			run.events = append(run.events, event)
+		}
+
+		if len(run.events)+len(run.rejects) >= im.batchSize {
+			if err := run.commit(ctx, line); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := run.commit(ctx, max(line, checkpoint.Line)); err != nil {
+		return fail(err)
+	}
+
+	result.Lines = run.checkpoint.Line
+	result.Loaded = run.checkpoint.Loaded
+	result.Rejected = run.checkpoint.Rejected
+	return result, nil
+}
+
+// importRun holds the pending batch of an import
+type importRun struct {
+	importer   *Importer
+	checkpoint db.ImportCheckpoint
+	errorFile  *os.File
+	events     []db.EventRecord
+	rejects    []RejectedRow
+}
+
+// commit loads the pending events and stores the progress up to the line in a single transaction
+func (r *importRun) commit(ctx context.Context, line int64) error {
+	if line <= r.checkpoint.Line && len(r.events) == 0 && len(r.rejects) == 0 {
+		return nil
+	}
+
+	if len(r.rejects) > 0 {
+		encoder := json.NewEncoder(r.errorFile)
+		for _, reject := range r.rejects {
+			if err := encoder.Encode(reject); err != nil {
+				return fmt.Errorf("failed to write rejected row: %w", err)
+			}
+		}
+		if err := r.errorFile.Sync(); err != nil {
+			return fmt.Errorf("failed to write rejected rows: %w", err)
+		}
+	}
+
+	tx, err := r.importer.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	// Defer a rollback in case anything fails
+	defer tx.Rollback(ctx)
+
+	// Create a new context with the transaction
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	loaded, err := r.importer.eventRepo.CopyEvents(txCtx, r.events)
+	if err != nil {
+		return err
+	}
+
+	checkpoint := r.checkpoint
+	checkpoint.Line = line
+	checkpoint.Loaded += int64(loaded)
+	checkpoint.Rejected += int64(len(r.rejects))
+	if err := r.importer.importRepo.SaveImportCheckpoint(txCtx, checkpoint); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.importer.log.Debug("Imported batch", "name", checkpoint.Name, "line", line, "loaded", loaded, "rejected", len(r.rejects))
+	r.checkpoint = checkpoint
+	r.events, r.rejects = r.events[:0], r.rejects[:0]
+	return nil
+}
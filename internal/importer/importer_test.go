@@ -0,0 +1,205 @@
+package importer_test
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/importer"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+// interruptedEventRepository fails every copy after the first copies
+type interruptedEventRepository struct {
+	*mocks.MockEventRepository
+	copies int
+}
+
+func (r *interruptedEventRepository) CopyEvents(ctx context.Context, events []db.EventRecord) (int, error) {
+	if r.copies == 0 {
+		return 0, errors.New("connection lost")
+	}
+	r.copies--
+	return r.MockEventRepository.CopyEvents(ctx, events)
+}
+
+var _ = Describe("Importer", func() {
+	var (
+		dir        string
+		eventRepo  *mocks.MockEventRepository
+		importRepo *mocks.MockImportRepository
+	)
+
+	writeFile := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		file, err := os.Create(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		if strings.HasSuffix(name, ".gz") {
+			gz := gzip.NewWriter(file)
+			_, err = gz.Write([]byte(content))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gz.Close()).To(Succeed())
+			return path
+		}
+		_, err = file.WriteString(content)
+		Expect(err).NotTo(HaveOccurred())
+		return path
+	}
+
+	readRejects := func(path string) []importer.RejectedRow {
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var rejects []importer.RejectedRow
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var reject importer.RejectedRow
+			Expect(json.Unmarshal([]byte(line), &reject)).To(Succeed())
+			rejects = append(rejects, reject)
+		}
+		return rejects
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		eventRepo = mocks.NewMockEventRepository()
+		importRepo = mocks.NewMockImportRepository()
+	})
+
+	It("should import gzipped CSV using the column mapping and reject invalid rows", func(ctx SpecContext) {
+		path := writeFile("events.csv.gz", strings.Join([]string{
+			"anon_id,mobile,type,ts,amount,tier",
+			"c-1,+15550100,101,2024-01-02T03:04:05Z,19.99,gold",
+			",,1,2024-01-02T03:04:05Z,,",
+			"c-2,,1,yesterday,,",
+			"c-3,,70000,2024-01-02 03:04:05,,",
+			"c-4,,1",
+			"c-5,,1,2024-01-03 00:00:00,,",
+		}, "\n"))
+
+		mapping, err := importer.ParseMapping("cookie=anon_id,phone=mobile,event_id=type,event_timestamp=ts,revenue=amount,traits.tier=tier")
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := importer.NewImporter(eventRepo, importRepo, 100).Import(ctx, importer.Options{
+			Path:    path,
+			Mapping: mapping,
+			Source:  "backfill",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(importer.Result{Lines: 7, Loaded: 2, Rejected: 4}))
+
+		timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		Expect(eventRepo.UnprocessedEvents).To(Equal([]db.EventRecord{
+			{
+				EventIdentifier: db.EventIdentifier{Cookie: "c-1", Phone: "+15550100"},
+				EventId:         db.EventIdPurchase,
+				EventTimestamp:  timestamp,
+				Source:          "backfill",
+				Traits:          db.Traits{"tier": db.StringTrait("gold", timestamp)},
+				Revenue:         19.99,
+			},
+			{
+				EventIdentifier: db.EventIdentifier{Cookie: "c-5"},
+				EventId:         1,
+				EventTimestamp:  time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC),
+				Source:          "backfill",
+			},
+		}))
+
+		rejects := readRejects(path + ".rejected.ndjson")
+		Expect(rejects).To(HaveLen(4))
+		Expect(rejects[0]).To(Equal(importer.RejectedRow{Line: 3, Error: "no identifier", Row: ",,1,2024-01-02T03:04:05Z,,"}))
+		Expect(rejects[1].Error).To(ContainSubstring("invalid event_timestamp"))
+		Expect(rejects[2].Error).To(ContainSubstring("invalid event_id"))
+		Expect(rejects[3].Line).To(Equal(int64(6)))
+	})
+
+	It("should import NDJSON keeping JSON types of traits", func(ctx SpecContext) {
+		path := writeFile("events.jsonl", strings.Join([]string{
+			`{"phone": 15550100, "event_timestamp": 1704164645, "source": "crm", "vip": true, "score": 7.5}`,
+			``,
+			`{"cookie": "c-1", "event_timestamp": "2024-01-02T03:04:05Z"`,
+			`{"cookie": "c-2", "event_timestamp": "2024-01-02T03:04:05+02:00"}`,
+		}, "\n"))
+
+		mapping, err := importer.ParseMapping("traits.vip=vip,traits.score=score")
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := importer.NewImporter(eventRepo, importRepo, 100).Import(ctx, importer.Options{Path: path, Mapping: mapping})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(importer.Result{Lines: 4, Loaded: 2, Rejected: 1}))
+
+		first := eventRepo.UnprocessedEvents[0]
+		Expect(first.Phone).To(Equal("15550100"))
+		Expect(first.Source).To(Equal("crm"))
+		Expect(first.EventTimestamp).To(Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+		Expect(first.Traits).To(Equal(db.Traits{
+			"vip":   db.BoolTrait(true, first.EventTimestamp),
+			"score": db.NumberTrait(7.5, first.EventTimestamp),
+		}))
+		Expect(eventRepo.UnprocessedEvents[1].EventTimestamp).To(Equal(time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC)))
+
+		rejects := readRejects(path + ".rejected.ndjson")
+		Expect(rejects).To(HaveLen(1))
+		Expect(rejects[0].Line).To(Equal(int64(3)))
+		Expect(rejects[0].Error).To(ContainSubstring("invalid JSON"))
+	})
+
+	It("should resume an interrupted import after the last committed batch", func(ctx SpecContext) {
+		lines := []string{"cookie,event_timestamp"}
+		for _, cookie := range []string{"c-1", "c-2", "", "c-4", "c-5", "c-6", "c-7"} {
+			lines = append(lines, cookie+",2024-01-02T03:04:05Z")
+		}
+		path := writeFile("events.csv", strings.Join(lines, "\n"))
+
+		// The second batch of two rows fails
+		interrupted := &interruptedEventRepository{MockEventRepository: eventRepo, copies: 1}
+		_, err := importer.NewImporter(interrupted, importRepo, 2).Import(ctx, importer.Options{Path: path})
+		Expect(err).To(MatchError(ContainSubstring("connection lost")))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(2))
+		Expect(importRepo.Checkpoints[path].Line).To(Equal(int64(3)))
+
+		result, err := importer.NewImporter(eventRepo, importRepo, 2).Import(ctx, importer.Options{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(Equal(importer.Result{ResumedAt: 3, Lines: 8, Loaded: 6, Rejected: 1}))
+
+		cookies := make([]string, len(eventRepo.UnprocessedEvents))
+		for i, event := range eventRepo.UnprocessedEvents {
+			cookies[i] = event.Cookie
+		}
+		Expect(cookies).To(Equal([]string{"c-1", "c-2", "c-4", "c-5", "c-6", "c-7"}))
+
+		// The reject of the interrupted batch is reported again by the resumed run
+		Expect(readRejects(path + ".rejected.ndjson")).To(HaveLen(2))
+
+		// Running a finished import again loads nothing, unless restarted
+		result, err = importer.NewImporter(eventRepo, importRepo, 2).Import(ctx, importer.Options{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Loaded).To(Equal(int64(6)))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(6))
+
+		result, err = importer.NewImporter(eventRepo, importRepo, 2).Import(ctx, importer.Options{Path: path, Restart: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ResumedAt).To(BeZero())
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(12))
+		Expect(readRejects(path + ".rejected.ndjson")).To(HaveLen(1))
+	})
+
+	It("should reject unknown fields in the mapping", func() {
+		_, err := importer.ParseMapping("email=mail")
+		Expect(err).To(MatchError(ContainSubstring("unknown field")))
+		_, err = importer.ParseMapping("phone")
+		Expect(err).To(HaveOccurred())
+	})
+})
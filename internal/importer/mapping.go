@@ -0,0 +1,191 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+const (
+	fieldEventId        = "event_id"
+	fieldEventTimestamp = "event_timestamp"
+	fieldSource         = "source"
+	fieldRevenue        = "revenue"
+	traitFieldPrefix    = "traits."
+)
+
+// maxIdentifierLength is the longest identifier value profiles can store
+const maxIdentifierLength = 4096
+
+// timestampLayouts are the accepted formats of timestamps, times without a zone are taken as UTC
+var timestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04:05Z07:00"}
+
+// Mapping maps event fields to the input columns or JSON keys holding them. Fields are identifier names
+// (e.g. "phone"), "event_id", "event_timestamp", "source", "revenue" and traits as "traits.<name>".
+type Mapping map[string]string
+
+// eventFields lists every field that is read from the column of the same name unless mapped otherwise
+func eventFields() []string {
+	return append(db.EventIdentifier{}.GetIdentifierNames(), fieldEventId, fieldEventTimestamp, fieldSource, fieldRevenue)
+}
+
+// ParseMapping reads a mapping given as comma separated field=column pairs, e.g. "phone=mobile,traits.plan=tier",
+// on top of the default mapping reading every field from the column of the same name
+func ParseMapping(spec string) (Mapping, error) {
+	mapping := make(Mapping)
+	for _, field := range eventFields() {
+		mapping[field] = field
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		field, column, ok := strings.Cut(pair, "=")
+		field, column = strings.TrimSpace(field), strings.TrimSpace(column)
+		if !ok || field == "" || column == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected field=column", pair)
+		}
+		isTrait := strings.HasPrefix(field, traitFieldPrefix) && len(field) > len(traitFieldPrefix)
+		if !isTrait && !slices.Contains(eventFields(), field) {
+			return nil, fmt.Errorf("unknown field %q in mapping", field)
+		}
+		mapping[field] = column
+	}
+	return mapping, nil
+}
+
+// Event converts a row into an event, failing for rows that do not hold a valid event.
+// Rows without a source get defaultSource and traits are observed at the event timestamp.
+func (m Mapping) Event(row Row, defaultSource string) (db.EventRecord, error) {
+	if row.Err != nil {
+		return db.EventRecord{}, row.Err
+	}
+
+	var event db.EventRecord
+	event.Cookie = m.string(row, "cookie")
+	event.MessageId = m.string(row, "message_id")
+	event.Phone = m.string(row, "phone")
+	if event.EventIdentifier == (db.EventIdentifier{}) {
+		return db.EventRecord{}, fmt.Errorf("no identifier")
+	}
+	for _, name := range event.GetIdentifierNames() {
+		if value, _ := event.GetIdentifierValueByName(name); len(value) > maxIdentifierLength {
+			return db.EventRecord{}, fmt.Errorf("%s is longer than %d characters", name, maxIdentifierLength)
+		}
+	}
+
+	timestamp, err := parseTimestamp(m.value(row, fieldEventTimestamp))
+	if err != nil {
+		return db.EventRecord{}, err
+	}
+	event.EventTimestamp = timestamp
+
+	if s := m.string(row, fieldEventId); s != "" {
+		id, err := strconv.Atoi(s)
+		if err != nil || id < 0 || id > math.MaxInt16 {
+			return db.EventRecord{}, fmt.Errorf("invalid event_id %q", s)
+		}
+		event.EventId = id
+	}
+
+	if s := m.string(row, fieldRevenue); s != "" {
+		revenue, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(revenue) || math.Abs(revenue) >= 1e12 {
+			return db.EventRecord{}, fmt.Errorf("invalid revenue %q", s)
+		}
+		event.Revenue = revenue
+	}
+
+	event.Source = m.string(row, fieldSource)
+	if event.Source == "" {
+		event.Source = defaultSource
+	}
+
+	for field, column := range m {
+		name, ok := strings.CutPrefix(field, traitFieldPrefix)
+		if !ok {
+			continue
+		}
+		trait, ok := traitValue(row.Fields[column], event.EventTimestamp)
+		if !ok {
+			continue
+		}
+		if event.Traits == nil {
+			event.Traits = make(db.Traits)
+		}
+		event.Traits[name] = trait
+	}
+	return event, nil
+}
+
+func (m Mapping) value(row Row, field string) any {
+	column, ok := m[field]
+	if !ok {
+		return nil
+	}
+	return row.Fields[column]
+}
+
+// string returns the field as a string, converting JSON numbers and booleans
+func (m Mapping) string(row Row, field string) string {
+	switch v := m.value(row, field).(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// parseTimestamp accepts the timestampLayouts and unix seconds given as a JSON number
+func parseTimestamp(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case json.Number:
+		seconds, err := v.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid event_timestamp %q", v)
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			break
+		}
+		for _, layout := range timestampLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t.UTC(), nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid event_timestamp %q", v)
+	}
+	return time.Time{}, fmt.Errorf("no event_timestamp")
+}
+
+// traitValue converts a trait column, skipping empty ones. CSV traits are strings, NDJSON traits keep their JSON type.
+func traitValue(value any, observed time.Time) (db.TraitValue, bool) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return db.TraitValue{}, false
+		}
+		return db.StringTrait(v, observed), true
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return db.TraitValue{}, false
+		}
+		return db.NumberTrait(n, observed), true
+	case bool:
+		return db.BoolTrait(v, observed), true
+	}
+	return db.TraitValue{}, false
+}
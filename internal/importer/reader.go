@@ -0,0 +1,153 @@
+// Package importer bulk loads historical events from NDJSON or CSV files into the events table.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Format is the encoding of an import file
+type Format string
+
+const (
+	// FormatNDJSON holds one JSON object per line
+	FormatNDJSON Format = "ndjson"
+	// FormatCSV holds a header row naming the columns followed by one row per event
+	FormatCSV Format = "csv"
+)
+
+// DetectFormat derives the format from the file extension, ignoring a trailing .gz
+func DetectFormat(path string) (Format, error) {
+	ext := strings.ToLower(filepath.Ext(strings.TrimSuffix(strings.ToLower(path), ".gz")))
+	switch ext {
+	case ".ndjson", ".jsonl", ".json":
+		return FormatNDJSON, nil
+	case ".csv":
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("cannot detect the format of %q, use .ndjson, .jsonl or .csv", path)
+}
+
+// Row is a single record of the input. Fields holds CSV values as strings and NDJSON values as decoded
+// with json.Number for numbers. Err is set for records which could not be parsed.
+type Row struct {
+	Line   int64
+	Fields map[string]any
+	Raw    string
+	Err    error
+}
+
+// rowReader returns the rows of the input in order and io.EOF at its end
+type rowReader interface {
+	Next() (Row, error)
+}
+
+// newRowReader decodes the input in the format, decompressing it first when it starts with the gzip header
+func newRowReader(r io.Reader, format Format) (rowReader, error) {
+	buffered := bufio.NewReaderSize(r, 1<<16)
+	magic, err := buffered.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+
+	var input io.Reader = buffered
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip input: %w", err)
+		}
+		input = bufio.NewReaderSize(gz, 1<<16)
+	}
+
+	switch format {
+	case FormatNDJSON:
+		return &ndjsonReader{r: bufio.NewReaderSize(input, 1<<16)}, nil
+	case FormatCSV:
+		return newCSVReader(input)
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type ndjsonReader struct {
+	r    *bufio.Reader
+	line int64
+}
+
+func (n *ndjsonReader) Next() (Row, error) {
+	for {
+		data, err := n.r.ReadBytes('\n')
+		if len(data) == 0 && err != nil {
+			if errors.Is(err, io.EOF) {
+				return Row{}, io.EOF
+			}
+			return Row{}, fmt.Errorf("failed to read input: %w", err)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return Row{}, fmt.Errorf("failed to read input: %w", err)
+		}
+		n.line++
+
+		raw := strings.TrimSpace(string(data))
+		if raw == "" {
+			continue
+		}
+
+		row := Row{Line: n.line, Raw: raw}
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row.Fields); err != nil {
+			row.Err = fmt.Errorf("invalid JSON: %w", err)
+		} else if decoder.More() {
+			row.Err = fmt.Errorf("invalid JSON: trailing data")
+		}
+		return row, nil
+	}
+}
+
+type csvReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+func newCSVReader(input io.Reader) (*csvReader, error) {
+	r := csv.NewReader(input)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	return &csvReader{r: r, header: header}, nil
+}
+
+func (c *csvReader) Next() (Row, error) {
+	record, err := c.r.Read()
+	if errors.Is(err, io.EOF) {
+		return Row{}, io.EOF
+	}
+
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		// The reader carries on with the next record after malformed ones
+		return Row{Line: int64(parseErr.StartLine), Raw: strings.Join(record, ","), Err: parseErr.Err}, nil
+	}
+	if err != nil {
+		return Row{}, fmt.Errorf("failed to read input: %w", err)
+	}
+
+	line, _ := c.r.FieldPos(0)
+	row := Row{Line: int64(line), Fields: make(map[string]any, len(record)), Raw: strings.Join(record, ",")}
+	for i, value := range record {
+		row.Fields[c.header[i]] = value
+	}
+	return row, nil
+}
@@ -2,43 +2,216 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/tomashoffer/event-stitching/internal/db"
 )
 
+var (
+	// ErrThrottled is returned for events of a source over its rate limit
+	ErrThrottled = errors.New("ingest rate limit exceeded")
+	// ErrOverloaded is returned for events shed because the ingest queue is too full
+	ErrOverloaded = errors.New("ingest queue overloaded")
+)
+
+// maxSourceBuckets bounds the rate limits kept for sources, idle ones are dropped once it is reached
+const maxSourceBuckets = 10_000
+
+// IngestStats counts the events offered for ingestion
+type IngestStats struct {
+	Enqueued  int64 `json:"enqueued"`
+	Throttled int64 `json:"throttled"`
+	Shed      int64 `json:"shed"`
+	// ThrottledBySource counts the throttled events of the sources limited lately by workspace and source, e.g.
+	// "brand-a/web"
+	ThrottledBySource map[string]int64 `json:"throttled_by_source"`
+	QueueDepth        int              `json:"queue_depth"`
+	QueueCapacity     int              `json:"queue_capacity"`
+}
+
 type EventIngestService struct {
 	repo       db.EventRepository
 	numWorkers int
-	Queue      chan db.EventRecord
-	log        *slog.Logger
+	queue      chan db.EventRecord
+	// consentRules drop identifiers without stitching consent before events are stored, when set
+	consentRules *db.ConsentRules
+	// rate and burst limit the events of every source, unlimited when rate is zero
+	rate  float64
+	burst int
+	// shedAt is the queue depth from which events are shed instead of queued, never when zero
+	shedAt            int
+	mu                sync.Mutex
+	buckets           map[string]*tokenBucket
+	throttledBySource map[string]int64
+	enqueued          atomic.Int64
+	throttled         atomic.Int64
+	shed              atomic.Int64
+	now               func() time.Time
+	log               *slog.Logger
 }
 
 func NewEventIngestService(repo db.EventRepository, numWorkers int) *EventIngestService {
 	return &EventIngestService{
-		repo:       repo,
-		numWorkers: numWorkers,
-		Queue:      make(chan db.EventRecord, 1000),
-		log:        slog.Default(),
+		repo:              repo,
+		numWorkers:        numWorkers,
+		queue:             make(chan db.EventRecord, 1000),
+		buckets:           make(map[string]*tokenBucket),
+		throttledBySource: make(map[string]int64),
+		now:               time.Now,
+		log:               slog.Default(),
 	}
 }
 
+// SetConsentRules enables dropping identifiers the consents of their event do not allow stitching before the
+// event is stored, events left without identifiers are dropped entirely
+func (s *EventIngestService) SetConsentRules(rules db.ConsentRules) {
+	s.consentRules = &rules
+}
+
+// SetRateLimit limits each source of each workspace to rate events per second on average, in bursts of up to
+// burst events. Events over the limit are rejected with ErrThrottled. Sources are unlimited when rate is zero.
+func (s *EventIngestService) SetRateLimit(rate float64, burst int) {
+	s.rate, s.burst = rate, burst
+}
+
+// SetShedThreshold sheds events with ErrOverloaded once the queue holds depth events, instead of queueing them
+// or waiting for room. Events are only rejected by a full queue when depth is zero.
+func (s *EventIngestService) SetShedThreshold(depth int) {
+	s.shedAt = depth
+}
+
 func (s *EventIngestService) Start(ctx context.Context) {
 	for range s.numWorkers {
 		go s.IngestWorker(ctx)
 	}
 }
 
+// Enqueue queues the event for ingestion, waiting for room in the queue until the context is done. Events over
+// the rate limit of their source and events arriving while the queue is over the shed threshold are rejected
+// right away. The event belongs to the workspace of the context when it is scoped to one.
+func (s *EventIngestService) Enqueue(ctx context.Context, event db.EventRecord) error {
+	event, err := s.admit(ctx, event)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.queue <- event:
+		s.enqueued.Add(1)
+		return nil
+	}
+}
+
+// TryEnqueue queues the event for ingestion without waiting, rejecting it with ErrOverloaded when the queue is full
+// and like Enqueue otherwise
+func (s *EventIngestService) TryEnqueue(ctx context.Context, event db.EventRecord) error {
+	event, err := s.admit(ctx, event)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.queue <- event:
+		s.enqueued.Add(1)
+		return nil
+	default:
+		s.shed.Add(1)
+		return ErrOverloaded
+	}
+}
+
+// admit stamps the event with the workspace of the context and checks the shed threshold and the rate limit of the
+// source of the event within its workspace
+func (s *EventIngestService) admit(ctx context.Context, event db.EventRecord) (db.EventRecord, error) {
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		event.Workspace = workspace
+	}
+	// Shed before taking from the rate limit, so sources are not charged for events never queued
+	if s.shedAt > 0 && len(s.queue) >= s.shedAt {
+		s.shed.Add(1)
+		return event, ErrOverloaded
+	}
+	if !s.allow(event.Workspace + "/" + event.Source) {
+		s.throttled.Add(1)
+		return event, ErrThrottled
+	}
+	return event, nil
+}
+
+// allow takes an event from the rate limit of the source
+func (s *EventIngestService) allow(source string) bool {
+	if s.rate <= 0 {
+		return true
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[source]
+	if !ok {
+		if len(s.buckets) >= maxSourceBuckets {
+			s.dropIdleBuckets(now)
+		}
+		bucket = newTokenBucket(s.rate, s.burst, now)
+		s.buckets[source] = bucket
+	}
+	if !bucket.allow(now) {
+		s.throttledBySource[source]++
+		return false
+	}
+	return true
+}
+
+// dropIdleBuckets forgets the rate limits and throttled counts of sources which have not sent events for long
+// enough to refill them, they start out full again anyway. The caller must hold the lock.
+func (s *EventIngestService) dropIdleBuckets(now time.Time) {
+	for source, bucket := range s.buckets {
+		if bucket.full(now) {
+			delete(s.buckets, source)
+			delete(s.throttledBySource, source)
+		}
+	}
+}
+
+// Stats returns the counts of queued, throttled and shed events along with the depth of the queue
+func (s *EventIngestService) Stats() IngestStats {
+	s.mu.Lock()
+	bySource := maps.Clone(s.throttledBySource)
+	s.mu.Unlock()
+
+	return IngestStats{
+		Enqueued:          s.enqueued.Load(),
+		Throttled:         s.throttled.Load(),
+		Shed:              s.shed.Load(),
+		ThrottledBySource: bySource,
+		QueueDepth:        len(s.queue),
+		QueueCapacity:     cap(s.queue),
+	}
+}
+
 func (s *EventIngestService) IngestWorker(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case event, ok := <-s.Queue:
+		case event, ok := <-s.queue:
 			if !ok {
 				return
 			}
-			if err := s.repo.InsertEvent(ctx, event); err != nil {
+			if s.consentRules != nil {
+				identifiers := s.consentRules.AllowedIdentifiers(db.EventConsents(event), db.PurposeStitching, event.EventIdentifier)
+				if identifiers == (db.EventIdentifier{}) {
+					s.log.Debug("Dropping event without identifiers consented to")
+					continue
+				}
+				event.EventIdentifier = identifiers
+			}
+			if err := s.repo.InsertEvent(db.WithWorkspace(ctx, event.Workspace), event); err != nil {
 				s.log.Error("Failed to insert data", "error", err)
 				continue
 			}
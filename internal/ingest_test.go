@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("EventIngestService", func() {
+	var (
+		ctx     context.Context
+		service *EventIngestService
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		// The workers are not started, so queued events stay in the queue
+		service = NewEventIngestService(mocks.NewMockEventRepository(), 1)
+		now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		service.now = func() time.Time { return now }
+	})
+
+	It("should throttle each source of each workspace on its own", func() {
+		service.SetRateLimit(2, 3)
+
+		for range 3 {
+			Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(Succeed())
+		}
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(MatchError(ErrThrottled))
+		Expect(service.Enqueue(ctx, db.EventRecord{Source: "web"})).To(MatchError(ErrThrottled))
+
+		// Other sources and the same source of another workspace have limits of their own
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "app"})).To(Succeed())
+		Expect(service.TryEnqueue(db.WithWorkspace(ctx, "brand-a"), db.EventRecord{Source: "web"})).To(Succeed())
+
+		// Half a second refills a single event at two events per second
+		now = now.Add(500 * time.Millisecond)
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(Succeed())
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(MatchError(ErrThrottled))
+
+		stats := service.Stats()
+		Expect(stats.Enqueued).To(Equal(int64(6)))
+		Expect(stats.Throttled).To(Equal(int64(3)))
+		Expect(stats.ThrottledBySource).To(Equal(map[string]int64{"/web": 3}))
+		Expect(stats.QueueDepth).To(Equal(6))
+		Expect(service.queue).To(HaveLen(6))
+	})
+
+	It("should forget the limits and throttled counts of idle sources", func() {
+		service.SetRateLimit(1, 1)
+		Expect(service.TryEnqueue(ctx, db.EventRecord{})).To(Succeed())
+		Expect(service.TryEnqueue(ctx, db.EventRecord{})).To(MatchError(ErrThrottled))
+
+		service.mu.Lock()
+		service.dropIdleBuckets(now)
+		Expect(service.buckets).To(HaveLen(1))
+		service.dropIdleBuckets(now.Add(time.Second))
+		service.mu.Unlock()
+
+		Expect(service.buckets).To(BeEmpty())
+		Expect(service.Stats().ThrottledBySource).To(BeEmpty())
+	})
+
+	It("should reject events without waiting once the queue is full", func() {
+		for range cap(service.queue) {
+			Expect(service.TryEnqueue(ctx, db.EventRecord{})).To(Succeed())
+		}
+		Expect(service.TryEnqueue(ctx, db.EventRecord{})).To(MatchError(ErrOverloaded))
+
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		Expect(service.Enqueue(waitCtx, db.EventRecord{})).To(MatchError(context.DeadlineExceeded))
+		Expect(service.Stats().Shed).To(Equal(int64(1)))
+	})
+
+	It("should shed events once the queue reaches the threshold", func() {
+		service.SetShedThreshold(2)
+		service.SetRateLimit(1, 10)
+
+		Expect(service.Enqueue(ctx, db.EventRecord{Source: "web"})).To(Succeed())
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(Succeed())
+		Expect(service.Enqueue(ctx, db.EventRecord{Source: "web"})).To(MatchError(ErrOverloaded))
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(MatchError(ErrOverloaded))
+
+		// Shed events do not count against the rate limit of their source
+		<-service.queue
+		Expect(service.TryEnqueue(ctx, db.EventRecord{Source: "web"})).To(Succeed())
+		Expect(service.buckets["/web"].tokens).To(Equal(7.0))
+
+		stats := service.Stats()
+		Expect(stats.Shed).To(Equal(int64(2)))
+		Expect(stats.Throttled).To(BeZero())
+	})
+
+	It("should stitch ingested events into a profile which can be looked up", func() {
+		eventRepo := mocks.NewMockEventRepository()
+		profileRepo := mocks.NewMockProfileRepository()
+		service = NewEventIngestService(eventRepo, 1)
+		stitchingSvc := NewStitchingService(profileRepo, eventRepo, 0, 1, 10)
+
+		Expect(service.Enqueue(ctx, db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}, EventTimestamp: now})).To(Succeed())
+		Expect(service.Enqueue(ctx, db.EventRecord{EventIdentifier: db.EventIdentifier{MessageId: "msg-a", Phone: "111"}, EventTimestamp: now})).To(Succeed())
+
+		// The worker returns once it has inserted every queued event
+		close(service.queue)
+		service.IngestWorker(ctx)
+		stitchingSvc.Stitch(ctx)
+
+		unprocessed, err := eventRepo.GetUnProcessedEvents(ctx, 10)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unprocessed).To(BeEmpty())
+
+		details, err := NewProfileLookupService(profileRepo).GetByIdentifier(ctx, "message_id", "msg-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(details.Profile.Cookie).To(Equal("cookie-a"))
+		Expect(details.Profile.Phone).To(Equal("111"))
+		Expect(details.Stats.TotalEvents).To(Equal(2))
+	})
+})
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+var (
+	// ErrProfileNotFound is returned for profiles which never existed
+	ErrProfileNotFound = errors.New("profile not found")
+	// ErrUnknownIdentifier is returned when looking up a profile by an identifier type that does not exist
+	ErrUnknownIdentifier = errors.New("unknown identifier type")
+)
+
+// ProfileMergedError is returned for profiles which were merged into another one and are gone
+type ProfileMergedError struct {
+	ProfileId  int
+	SurvivorId int
+}
+
+func (e *ProfileMergedError) Error() string {
+	return fmt.Sprintf("profile %d was merged into profile %d", e.ProfileId, e.SurvivorId)
+}
+
+// ProfileDetails is a profile along with its aggregates and segment memberships
+type ProfileDetails struct {
+	Profile  db.Profile
+	Stats    db.ProfileStats
+	Segments []string
+	// RedirectedFrom is the requested profile id when it was merged into Profile
+	RedirectedFrom int
+}
+
+// ProfileLookupService reads stitched profiles for API clients
+type ProfileLookupService struct {
+	profileRepo db.ProfileRepository
+}
+
+func NewProfileLookupService(profileRepo db.ProfileRepository) *ProfileLookupService {
+	return &ProfileLookupService{profileRepo: profileRepo}
+}
+
+// GetById returns the profile with the given id. A profile which was merged away is resolved to the profile that
+// absorbed it when follow is set, otherwise, or when the survivor is gone as well, a *ProfileMergedError is returned.
+func (s *ProfileLookupService) GetById(ctx context.Context, id int, follow bool) (ProfileDetails, error) {
+	profile, found, err := s.profileRepo.GetProfileById(ctx, id)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	if found {
+		return s.details(ctx, profile)
+	}
+
+	survivorId, merged, err := s.profileRepo.GetMergeSurvivor(ctx, id)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	if !merged {
+		return ProfileDetails{}, ErrProfileNotFound
+	}
+	if !follow {
+		return ProfileDetails{}, &ProfileMergedError{ProfileId: id, SurvivorId: survivorId}
+	}
+
+	profile, found, err = s.profileRepo.GetProfileById(ctx, survivorId)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	if !found {
+		return ProfileDetails{}, &ProfileMergedError{ProfileId: id, SurvivorId: survivorId}
+	}
+
+	details, err := s.details(ctx, profile)
+	details.RedirectedFrom = id
+	return details, err
+}
+
+// GetByIdentifier returns the profile holding the identifier, e.g. "phone". When several profiles hold it
+// because they are yet to be merged, the one with the lowest id is returned.
+func (s *ProfileLookupService) GetByIdentifier(ctx context.Context, name string, value string) (ProfileDetails, error) {
+	identifiers, ok := db.IdentifierByName(name, value)
+	if !ok {
+		return ProfileDetails{}, fmt.Errorf("%w: %q", ErrUnknownIdentifier, name)
+	}
+	if value == "" {
+		return ProfileDetails{}, ErrProfileNotFound
+	}
+
+	profiles, found, err := s.profileRepo.TryGetProfilesByIdentifiers(ctx, identifiers)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	if !found {
+		return ProfileDetails{}, ErrProfileNotFound
+	}
+
+	profile := slices.MinFunc(profiles, func(a, b db.Profile) int { return a.Id - b.Id })
+	return s.details(ctx, profile)
+}
+
+func (s *ProfileLookupService) details(ctx context.Context, profile db.Profile) (ProfileDetails, error) {
+	stats, _, err := s.profileRepo.GetProfileStats(ctx, profile.Id)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	segments, err := s.profileRepo.GetProfileSegments(ctx, profile.Id)
+	if err != nil {
+		return ProfileDetails{}, err
+	}
+	return ProfileDetails{Profile: profile, Stats: stats, Segments: segments}, nil
+}
@@ -2,17 +2,36 @@ package mocks
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"slices"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgconn"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/tomashoffer/event-stitching/internal/db"
 )
 
-type MockPgxTx struct{}
+// MockPgxTx is a transaction whose savepoints restore the snapshot taken when they began once rolled back
+type MockPgxTx struct {
+	// Snapshot captures the state of the mocks when a savepoint begins and returns how to restore it, when set
+	Snapshot func() (restore func())
+	restore  func()
+	done     bool
+}
 
-func (m *MockPgxTx) Begin(ctx context.Context) (pgx.Tx, error) { return nil, nil }
+func (m *MockPgxTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	savepoint := &MockPgxTx{Snapshot: m.Snapshot}
+	if m.Snapshot != nil {
+		savepoint.restore = m.Snapshot()
+	}
+	return savepoint, nil
+}
 func (m *MockPgxTx) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
 	return 0, nil
 }
@@ -29,18 +48,42 @@ func (m *MockPgxTx) Query(ctx context.Context, sql string, args ...any) (pgx.Row
 }
 func (m *MockPgxTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row { return nil }
 func (m *MockPgxTx) Conn() *pgx.Conn                                               { return nil }
-func (m *MockPgxTx) Commit(ctx context.Context) error                              { return nil }
-func (m *MockPgxTx) Rollback(ctx context.Context) error                            { return nil }
+func (m *MockPgxTx) Commit(ctx context.Context) error {
+	m.done = true
+	return nil
+}
+func (m *MockPgxTx) Rollback(ctx context.Context) error {
+	if !m.done && m.restore != nil {
+		m.restore()
+	}
+	m.done = true
+	return nil
+}
 
 type MockProfileRepository struct {
-	Profiles   map[int]db.Profile
-	MergeCalls [][]int
+	Profiles     map[int]db.Profile
+	MergeCalls   [][]int
+	LockCalls    []db.EventIdentifier
+	Observations map[int][]db.EventRecord
+	Stats        map[int]db.ProfileStats
+	Segments     map[int][]string
+	Merges       map[int]int
+	Consents     map[int]db.Consents
+	// UpdatedAt holds the change times exports filter on, profiles without one only appear in full exports
+	UpdatedAt map[int]time.Time
 }
 
 func NewMockProfileRepository() *MockProfileRepository {
 	return &MockProfileRepository{
-		Profiles:   make(map[int]db.Profile),
-		MergeCalls: make([][]int, 0),
+		Profiles:     make(map[int]db.Profile),
+		MergeCalls:   make([][]int, 0),
+		LockCalls:    make([]db.EventIdentifier, 0),
+		Observations: make(map[int][]db.EventRecord),
+		Stats:        make(map[int]db.ProfileStats),
+		Segments:     make(map[int][]string),
+		Merges:       make(map[int]int),
+		Consents:     make(map[int]db.Consents),
+		UpdatedAt:    make(map[int]time.Time),
 	}
 }
 
@@ -56,8 +99,12 @@ func (m *MockProfileRepository) TryGetProfilesByIdentifiers(ctx context.Context,
 	sort.Ints(profileIds)
 
 	// Iterate through profiles in sorted order
+	workspace, scoped := db.WorkspaceFromContext(ctx)
 	for _, id := range profileIds {
 		profile := m.Profiles[id]
+		if scoped && profile.Workspace != workspace {
+			continue
+		}
 		if identifier.Cookie != "" && profile.Cookie == identifier.Cookie {
 			profiles = append(profiles, profile)
 			found = true
@@ -80,6 +127,9 @@ func (m *MockProfileRepository) TryGetProfilesByIdentifiers(ctx context.Context,
 func (m *MockProfileRepository) InsertProfile(ctx context.Context, profile db.Profile) (int, error) {
 	id := len(m.Profiles)
 	profile.Id = id
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		profile.Workspace = workspace
+	}
 	m.Profiles[id] = profile
 	return id, nil
 }
@@ -117,20 +167,337 @@ func (m *MockProfileRepository) EnrichProfileByIdentifiers(ctx context.Context,
 	return nil
 }
 
-func (m *MockProfileRepository) MergeProfiles(ctx context.Context, profileIds []int) error {
+func (m *MockProfileRepository) SurvivorshipRules(workspace string) db.SurvivorshipRules {
+	return db.DefaultSurvivorshipRules()
+}
+
+func (m *MockProfileRepository) MergeProfiles(ctx context.Context, profileIds []int) (int, error) {
 	m.MergeCalls = append(m.MergeCalls, profileIds)
+	if len(profileIds) == 0 {
+		return 0, nil
+	}
+	survivorId := slices.Min(profileIds)
+	for merged, survivor := range m.Merges {
+		if slices.Contains(profileIds, survivor) {
+			m.Merges[merged] = survivorId
+		}
+	}
+	merged := make([]db.Consents, 0, len(profileIds))
+	for _, id := range profileIds {
+		merged = append(merged, m.Consents[id])
+		if id != survivorId {
+			m.Merges[id] = survivorId
+			delete(m.Consents, id)
+		}
+	}
+	if consents := db.MergeConsents(merged...); len(consents) > 0 {
+		m.Consents[survivorId] = consents
+	}
+	return survivorId, nil
+}
+
+func (m *MockProfileRepository) GetMergeSurvivor(ctx context.Context, profileId int) (int, bool, error) {
+	survivorId, merged := m.Merges[profileId]
+	return survivorId, merged, nil
+}
+
+func (m *MockProfileRepository) RecordObservations(ctx context.Context, profileId int, event db.EventRecord) error {
+	m.Observations[profileId] = append(m.Observations[profileId], event)
+	return nil
+}
+
+func (m *MockProfileRepository) LockIdentifiers(ctx context.Context, identifiers ...db.EventIdentifier) error {
+	m.LockCalls = append(m.LockCalls, identifiers...)
+	return nil
+}
+
+func (m *MockProfileRepository) ReplaceAllProfiles(ctx context.Context, snapshots []db.ProfileSnapshot) (int, error) {
+	m.Profiles = make(map[int]db.Profile, len(snapshots))
+	m.Stats = make(map[int]db.ProfileStats, len(snapshots))
+	m.Segments = make(map[int][]string)
+	m.Merges = make(map[int]int)
+	m.Consents = make(map[int]db.Consents)
+	m.Observations = make(map[int][]db.EventRecord)
+	for _, snapshot := range snapshots {
+		id, _ := m.InsertProfile(ctx, snapshot.Profile)
+		if snapshot.Stats.TotalEvents > 0 {
+			snapshot.Stats.ProfileId = id
+			m.Stats[id] = snapshot.Stats
+		}
+		if len(snapshot.Consents) > 0 {
+			m.Consents[id] = snapshot.Consents
+		}
+		if len(snapshot.Segments) > 0 {
+			m.Segments[id] = slices.Clone(snapshot.Segments)
+		}
+	}
+	return len(snapshots), nil
+}
+
+func (m *MockProfileRepository) RecordEventStats(ctx context.Context, profileId int, event db.EventRecord) error {
+	stats := m.Stats[profileId]
+	stats.ProfileId = profileId
+	m.Stats[profileId] = stats.Add(event)
+	return nil
+}
+
+func (m *MockProfileRepository) ForgetEvent(ctx context.Context, profileId int, event db.EventRecord) error {
+	if stats, exists := m.Stats[profileId]; exists {
+		stats.TotalEvents--
+		if event.EventId == db.EventIdPurchase {
+			stats.PurchaseCount--
+			stats.Revenue -= event.Revenue
+		}
+		if stats.TotalEvents <= 0 {
+			delete(m.Stats, profileId)
+		} else {
+			m.Stats[profileId] = stats
+		}
+	}
+	observed := m.Observations[profileId]
+	if i := slices.IndexFunc(observed, func(e db.EventRecord) bool {
+		return e.EventIdentifier == event.EventIdentifier && e.EventTimestamp.Equal(event.EventTimestamp)
+	}); i >= 0 {
+		m.Observations[profileId] = slices.Delete(observed, i, i+1)
+	}
+	return nil
+}
+
+func (m *MockProfileRepository) GetProfileStats(ctx context.Context, profileId int) (db.ProfileStats, bool, error) {
+	stats, exists := m.Stats[profileId]
+	return stats, exists, nil
+}
+
+func (m *MockProfileRepository) UpdateSegments(ctx context.Context, profileId int, segments []string, at time.Time) ([]db.SegmentTransition, error) {
+	current := m.Segments[profileId]
+	transitions := make([]db.SegmentTransition, 0)
+	for _, segment := range segments {
+		if !slices.Contains(current, segment) {
+			transitions = append(transitions, db.SegmentTransition{ProfileId: profileId, Segment: segment, Entered: true, OccurredAt: at})
+		}
+	}
+	for _, segment := range current {
+		if !slices.Contains(segments, segment) {
+			transitions = append(transitions, db.SegmentTransition{ProfileId: profileId, Segment: segment, Entered: false, OccurredAt: at})
+		}
+	}
+	m.Segments[profileId] = slices.Clone(segments)
+	return transitions, nil
+}
+
+func (m *MockProfileRepository) GetProfileSegments(ctx context.Context, profileId int) ([]string, error) {
+	return m.Segments[profileId], nil
+}
+
+func (m *MockProfileRepository) GetProfileById(ctx context.Context, id int) (db.Profile, bool, error) {
+	profile, exists := m.Profiles[id]
+	return profile, exists, nil
+}
+
+func (m *MockProfileRepository) SetTraits(ctx context.Context, id int, traits db.Traits) error {
+	if profile, exists := m.Profiles[id]; exists {
+		profile.Traits = profile.Traits.Apply(traits)
+		m.Profiles[id] = profile
+	}
+	return nil
+}
+
+func (m *MockProfileRepository) SetConsents(ctx context.Context, profileId int, consents db.Consents) error {
+	for _, consent := range consents {
+		if err := consent.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(consents) > 0 {
+		m.Consents[profileId] = m.Consents[profileId].Apply(consents)
+	}
+	return nil
+}
+
+func (m *MockProfileRepository) GetConsents(ctx context.Context, profileIds []int) (map[int]db.Consents, error) {
+	consents := make(map[int]db.Consents)
+	for _, id := range profileIds {
+		if c, ok := m.Consents[id]; ok {
+			consents[id] = c
+		}
+	}
+	return consents, nil
+}
+
+func (m *MockProfileRepository) GetProfilesByTrait(ctx context.Context, name string, value db.TraitValue) ([]db.Profile, error) {
+	profileIds := make([]int, 0, len(m.Profiles))
+	for id := range m.Profiles {
+		profileIds = append(profileIds, id)
+	}
+	sort.Ints(profileIds)
+
+	profiles := make([]db.Profile, 0)
+	for _, id := range profileIds {
+		trait, ok := m.Profiles[id].Traits[name]
+		if ok && trait.Type == value.Type && trait.Value() == value.Value() {
+			profiles = append(profiles, m.Profiles[id])
+		}
+	}
+	return profiles, nil
+}
+
+func (m *MockProfileRepository) IterProfileExports(ctx context.Context, since time.Time, pageSize int) iter.Seq2[db.ProfileExport, error] {
+	profileIds := make([]int, 0, len(m.Profiles))
+	for id := range m.Profiles {
+		if since.IsZero() || m.UpdatedAt[id].After(since) {
+			profileIds = append(profileIds, id)
+		}
+	}
+	sort.Ints(profileIds)
+
+	exports, _ := m.GetProfileExports(ctx, profileIds)
+	return seq(ctx, exports)
+}
+
+func (m *MockProfileRepository) GetProfileExports(ctx context.Context, profileIds []int) ([]db.ProfileExport, error) {
+	exports := make([]db.ProfileExport, 0, len(profileIds))
+	for _, id := range profileIds {
+		profile, exists := m.Profiles[id]
+		if !exists {
+			continue
+		}
+		export := db.ProfileExport{
+			Profile:      profile,
+			Observations: m.observations(id),
+			Stats:        m.Stats[id],
+			Segments:     m.Segments[id],
+			Consents:     m.Consents[id],
+			UpdatedAt:    m.UpdatedAt[id],
+		}
+		export.MergedIds, _ = m.GetMergedIds(ctx, []int{id})
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+func (m *MockProfileRepository) GetProfileIdsByIdentifier(ctx context.Context, identifier db.Identifier) ([]int, error) {
+	profileIds := make([]int, 0)
+	for id, profile := range m.Profiles {
+		held, _ := db.EventIdentifier{Cookie: profile.Cookie, MessageId: profile.MessageId, Phone: profile.Phone}.
+			GetIdentifierValueByName(identifier.Type)
+		observed := slices.ContainsFunc(m.observations(id), func(o db.IdentifierObservation) bool {
+			return o.IdentifierType == identifier.Type && o.Value == identifier.Value
+		})
+		if held == identifier.Value || observed {
+			profileIds = append(profileIds, id)
+		}
+	}
+	sort.Ints(profileIds)
+	return profileIds, nil
+}
+
+func (m *MockProfileRepository) GetMergedIds(ctx context.Context, survivorIds []int) ([]int, error) {
+	mergedIds := make([]int, 0)
+	for mergedId, survivorId := range m.Merges {
+		if slices.Contains(survivorIds, survivorId) {
+			mergedIds = append(mergedIds, mergedId)
+		}
+	}
+	sort.Ints(mergedIds)
+	return mergedIds, nil
+}
+
+func (m *MockProfileRepository) EraseProfiles(ctx context.Context, profileIds []int, mode db.ErasureMode) error {
+	for _, id := range profileIds {
+		delete(m.Observations, id)
+		switch mode {
+		case db.ErasureDelete, db.ErasureShred:
+			delete(m.Profiles, id)
+			delete(m.Stats, id)
+			delete(m.Segments, id)
+			delete(m.Consents, id)
+			delete(m.UpdatedAt, id)
+			delete(m.Merges, id)
+		case db.ErasureAnonymize:
+			if _, exists := m.Profiles[id]; exists {
+				m.Profiles[id] = db.Profile{Id: id}
+			}
+		default:
+			return fmt.Errorf("unknown erasure mode %q", mode)
+		}
+	}
 	return nil
 }
 
+func (m *MockProfileRepository) IterProfiles(ctx context.Context, pageSize int) iter.Seq2[db.Profile, error] {
+	profileIds := make([]int, 0, len(m.Profiles))
+	for id := range m.Profiles {
+		profileIds = append(profileIds, id)
+	}
+	sort.Ints(profileIds)
+
+	profiles := make([]db.Profile, 0, len(profileIds))
+	for _, id := range profileIds {
+		profiles = append(profiles, m.Profiles[id])
+	}
+	return seq(ctx, profiles)
+}
+
+// observations folds the recorded events of the profile into identifier observations
+func (m *MockProfileRepository) observations(profileId int) []db.IdentifierObservation {
+	observations := make([]db.IdentifierObservation, 0)
+	for _, event := range m.Observations[profileId] {
+		for _, name := range event.GetIdentifierNames() {
+			value, _ := event.GetIdentifierValueByName(name)
+			if value == "" {
+				continue
+			}
+			i := slices.IndexFunc(observations, func(o db.IdentifierObservation) bool {
+				return o.IdentifierType == name && o.Value == value
+			})
+			if i < 0 {
+				observations = append(observations, db.IdentifierObservation{
+					ProfileId: profileId, IdentifierType: name, Value: value, FirstSeen: event.EventTimestamp,
+				})
+				i = len(observations) - 1
+			}
+			o := &observations[i]
+			o.Source = event.Source
+			o.LastSeen = event.EventTimestamp
+			o.SeenCount++
+		}
+	}
+	return observations
+}
+
 type MockEventRepository struct {
-	UnprocessedEvents []db.EventRecord
-	ProcessedEvents   []db.EventRecord
+	UnprocessedEvents  []db.EventRecord
+	ProcessedEvents    []db.EventRecord
+	SegmentTransitions []db.SegmentTransition
+	// SealedBy maps sealed events to the profile whose key sealed them
+	SealedBy map[EventKey]int
+	// Transactions counts the transactions begun
+	Transactions int
+	// Snapshot is handed to the transactions begun, so their savepoints can be rolled back
+	Snapshot func() (restore func())
+	// SealErr fails sealing events, when set
+	SealErr error
+	// ArchivedEvents counts the events archived and not restored yet
+	ArchivedEvents int
+	// DetachedPartitions counts the partitions detached from the events table and kept
+	DetachedPartitions int
+}
+
+// EventKey identifies an event the way the repository does
+type EventKey struct {
+	EventId        int
+	EventTimestamp time.Time
+}
+
+func eventKey(event db.EventRecord) EventKey {
+	return EventKey{EventId: event.EventId, EventTimestamp: event.EventTimestamp}
 }
 
 func NewMockEventRepository() *MockEventRepository {
 	return &MockEventRepository{
 		UnprocessedEvents: make([]db.EventRecord, 0),
 		ProcessedEvents:   make([]db.EventRecord, 0),
+		SealedBy:          make(map[EventKey]int),
 	}
 }
 
@@ -154,8 +521,14 @@ func (m *MockEventRepository) GetEvents(ctx context.Context) ([]db.EventRecord,
 	return append(m.ProcessedEvents, m.UnprocessedEvents...), nil
 }
 
-func (m *MockEventRepository) GetEventsCount(ctx context.Context) (int, error) {
-	return len(m.ProcessedEvents) + len(m.UnprocessedEvents), nil
+func (m *MockEventRepository) IterEvents(ctx context.Context, pageSize int) iter.Seq2[db.EventRecord, error] {
+	events, _ := m.GetEvents(ctx)
+	return seq(ctx, events)
+}
+
+func (m *MockEventRepository) GetEventsCount(ctx context.Context, start, end time.Time) (int, error) {
+	events, _ := m.GetEventsByTimeRange(ctx, start, end)
+	return len(events), nil
 }
 
 func (m *MockEventRepository) InsertEvent(ctx context.Context, event db.EventRecord) error {
@@ -163,6 +536,742 @@ func (m *MockEventRepository) InsertEvent(ctx context.Context, event db.EventRec
 	return nil
 }
 
+func (m *MockEventRepository) InsertProcessedEvent(ctx context.Context, event db.EventRecord) (int, error) {
+	event.Id = len(m.ProcessedEvents) + len(m.UnprocessedEvents) + 1
+	m.ProcessedEvents = append(m.ProcessedEvents, event)
+	return event.Id, nil
+}
+
+func (m *MockEventRepository) CopyEvents(ctx context.Context, events []db.EventRecord) (int, error) {
+	m.UnprocessedEvents = append(m.UnprocessedEvents, events...)
+	return len(events), nil
+}
+
 func (m *MockEventRepository) BeginTx(ctx context.Context) (pgx.Tx, error) {
+	m.Transactions++
+	return &MockPgxTx{Snapshot: m.Snapshot}, nil
+}
+
+func (m *MockEventRepository) GetEventsByTimeRange(ctx context.Context, start, end time.Time) ([]db.EventRecord, error) {
+	all := make([]db.EventRecord, 0, len(m.ProcessedEvents)+len(m.UnprocessedEvents))
+	all = append(all, m.ProcessedEvents...)
+	all = append(all, m.UnprocessedEvents...)
+
+	events := make([]db.EventRecord, 0)
+	for _, event := range all {
+		if !event.EventTimestamp.Before(start) && !event.EventTimestamp.After(end) {
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventTimestamp.Before(events[j].EventTimestamp)
+	})
+	return events, nil
+}
+
+func (m *MockEventRepository) IterEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[db.EventRecord, error] {
+	events, _ := m.GetEventsByTimeRange(ctx, start, end)
+	return seq(ctx, events)
+}
+
+func (m *MockEventRepository) MarkEventsAsProcessed(ctx context.Context, events []db.EventRecord) (int, error) {
+	remaining := make([]db.EventRecord, 0, len(m.UnprocessedEvents))
+	marked := 0
+	for _, event := range m.UnprocessedEvents {
+		if slices.ContainsFunc(events, func(e db.EventRecord) bool {
+			return e.Id == event.Id && e.EventTimestamp.Equal(event.EventTimestamp)
+		}) {
+			m.ProcessedEvents = append(m.ProcessedEvents, event)
+			marked++
+			continue
+		}
+		remaining = append(remaining, event)
+	}
+	m.UnprocessedEvents = remaining
+	return marked, nil
+}
+
+func (m *MockEventRepository) HasEventsOutsideTimeRange(ctx context.Context, start, end time.Time) (bool, error) {
+	events, _ := m.GetEvents(ctx)
+	for _, event := range events {
+		if event.EventTimestamp.Before(start) || event.EventTimestamp.After(end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockEventRepository) HasArchivedEvents(ctx context.Context) (bool, error) {
+	return m.ArchivedEvents > 0, nil
+}
+
+func (m *MockEventRepository) HasDetachedPartitions(ctx context.Context) (bool, error) {
+	return m.DetachedPartitions > 0, nil
+}
+
+func (m *MockEventRepository) IterProcessedEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[db.EventRecord, error] {
+	events := make([]db.EventRecord, 0)
+	for _, event := range m.ProcessedEvents {
+		if !event.EventTimestamp.Before(start) && !event.EventTimestamp.After(end) {
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventTimestamp.Before(events[j].EventTimestamp)
+	})
+	return seq(ctx, events)
+}
+
+func (m *MockEventRepository) ResetProcessedEvents(ctx context.Context, events []db.EventRecord) (int, error) {
+	return m.resetProcessed(func(event db.EventRecord) bool {
+		return slices.ContainsFunc(events, func(e db.EventRecord) bool {
+			return e.Id == event.Id && e.EventTimestamp.Equal(event.EventTimestamp)
+		})
+	}), nil
+}
+
+func (m *MockEventRepository) InsertSegmentTransitions(ctx context.Context, transitions []db.SegmentTransition) error {
+	m.SegmentTransitions = append(m.SegmentTransitions, transitions...)
+	return nil
+}
+
+func (m *MockEventRepository) GetSegmentTransitions(ctx context.Context, profileId int) ([]db.SegmentTransition, error) {
+	transitions := make([]db.SegmentTransition, 0)
+	for _, t := range m.SegmentTransitions {
+		if t.ProfileId == profileId {
+			transitions = append(transitions, t)
+		}
+	}
+	return transitions, nil
+}
+
+func (m *MockEventRepository) IterEventsByIdentifiers(ctx context.Context, identifiers []db.Identifier, profileIds []int, pageSize int) iter.Seq2[db.EventRecord, error] {
+	events := make([]db.EventRecord, 0)
+	for _, event := range append(m.ProcessedEvents, m.UnprocessedEvents...) {
+		if holdsAny(event, identifiers) || m.sealedByAny(event, profileIds) {
+			events = append(events, event)
+		}
+	}
+	return seq(ctx, events)
+}
+
+func (m *MockEventRepository) EraseEventsByIdentifiers(ctx context.Context, identifiers []db.Identifier, profileIds []int, mode db.ErasureMode) (int, error) {
+	if mode != db.ErasureDelete && mode != db.ErasureAnonymize && mode != db.ErasureShred {
+		return 0, fmt.Errorf("unknown erasure mode %q", mode)
+	}
+
+	erased := 0
+	anonymized := make([]db.EventRecord, 0)
+	remaining := func(events []db.EventRecord) []db.EventRecord {
+		return slices.DeleteFunc(events, func(event db.EventRecord) bool {
+			_, sealed := m.SealedBy[eventKey(event)]
+			if mode == db.ErasureShred && (sealed || !holdsAny(event, identifiers)) {
+				return false
+			}
+			if !holdsAny(event, identifiers) && !m.sealedByAny(event, profileIds) {
+				return false
+			}
+			erased++
+			if mode != db.ErasureDelete {
+				event.EventIdentifier, event.Traits = db.EventIdentifier{}, nil
+				anonymized = append(anonymized, event)
+			}
+			return true
+		})
+	}
+	m.UnprocessedEvents = remaining(m.UnprocessedEvents)
+	m.ProcessedEvents = remaining(m.ProcessedEvents)
+	m.ProcessedEvents = append(m.ProcessedEvents, anonymized...)
+	return erased, nil
+}
+
+func (m *MockEventRepository) DeleteSegmentTransitions(ctx context.Context, profileIds []int) error {
+	m.SegmentTransitions = slices.DeleteFunc(m.SegmentTransitions, func(t db.SegmentTransition) bool {
+		return slices.Contains(profileIds, t.ProfileId)
+	})
+	return nil
+}
+
+func (m *MockEventRepository) SealEvent(ctx context.Context, event db.EventRecord, identifiers db.EventIdentifier, profileId int) error {
+	if m.SealErr != nil {
+		return m.SealErr
+	}
+	if _, sealed := m.SealedBy[eventKey(event)]; !sealed {
+		m.SealedBy[eventKey(event)] = profileId
+	}
+	return nil
+}
+
+// sealedByAny reports whether the event was sealed with the key of any of the profiles
+func (m *MockEventRepository) sealedByAny(event db.EventRecord, profileIds []int) bool {
+	profileId, sealed := m.SealedBy[eventKey(event)]
+	return sealed && slices.Contains(profileIds, profileId)
+}
+
+// holdsAny reports whether the event holds any of the identifiers
+func holdsAny(event db.EventRecord, identifiers []db.Identifier) bool {
+	for _, identifier := range event.Identifiers() {
+		if slices.Contains(identifiers, identifier) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockEventRepository) resetProcessed(matches func(db.EventRecord) bool) int {
+	remaining := make([]db.EventRecord, 0, len(m.ProcessedEvents))
+	reset := 0
+	for _, event := range m.ProcessedEvents {
+		if matches(event) {
+			m.UnprocessedEvents = append(m.UnprocessedEvents, event)
+			reset++
+			continue
+		}
+		remaining = append(remaining, event)
+	}
+	m.ProcessedEvents = remaining
+	return reset
+}
+
+// MockShadowProfileRepository is an in-memory shadow table which copies its profiles into Live on promotion
+type MockShadowProfileRepository struct {
+	*MockProfileRepository
+	Live     *MockProfileRepository
+	Promoted bool
+}
+
+func NewMockShadowProfileRepository(live *MockProfileRepository) *MockShadowProfileRepository {
+	return &MockShadowProfileRepository{
+		MockProfileRepository: NewMockProfileRepository(),
+		Live:                  live,
+	}
+}
+
+func (m *MockShadowProfileRepository) ResetShadow(ctx context.Context) error {
+	m.MockProfileRepository = NewMockProfileRepository()
+	return nil
+}
+
+func (m *MockShadowProfileRepository) PromoteShadow(ctx context.Context) error {
+	m.Live.Profiles = m.Profiles
+	m.Promoted = true
+	return nil
+}
+
+type MockOutboxRepository struct {
+	Events  []db.OutboxEvent
+	Cursors map[string]db.OutboxCursor
+}
+
+func NewMockOutboxRepository() *MockOutboxRepository {
+	return &MockOutboxRepository{
+		Events:  make([]db.OutboxEvent, 0),
+		Cursors: make(map[string]db.OutboxCursor),
+	}
+}
+
+func (m *MockOutboxRepository) AppendOutbox(ctx context.Context, events []db.OutboxEvent) error {
+	for _, event := range events {
+		event.Id = 1
+		if len(m.Events) > 0 {
+			event.Id = m.Events[len(m.Events)-1].Id + 1
+		}
+		m.Events = append(m.Events, event)
+	}
+	return nil
+}
+
+func (m *MockOutboxRepository) DeleteOutboxByProfiles(ctx context.Context, profileIds []int, identifiers []db.Identifier) (int, error) {
+	before := len(m.Events)
+	m.Events = slices.DeleteFunc(m.Events, func(e db.OutboxEvent) bool {
+		var payload struct {
+			Profile map[string]any `json:"profile"`
+		}
+		_ = json.Unmarshal(e.Payload, &payload)
+		return slices.Contains(profileIds, e.ProfileId) || slices.ContainsFunc(identifiers, func(identifier db.Identifier) bool {
+			return payload.Profile[identifier.Type] == identifier.Value
+		})
+	})
+	return before - len(m.Events), nil
+}
+
+func (m *MockOutboxRepository) GetOutboxAfter(ctx context.Context, cursor db.OutboxCursor, limit int) ([]db.OutboxEvent, error) {
+	events := make([]db.OutboxEvent, 0)
+	for _, event := range m.Events {
+		if event.TxId < cursor.TxId || (event.TxId == cursor.TxId && event.Id <= cursor.Id) {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (m *MockOutboxRepository) GetOutboxRange(ctx context.Context, fromId, toId int64) ([]db.OutboxEvent, error) {
+	events := make([]db.OutboxEvent, 0)
+	for _, event := range m.Events {
+		if event.Id >= fromId && event.Id <= toId {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *MockOutboxRepository) GetOutboxCursor(ctx context.Context, consumer string) (db.OutboxCursor, error) {
+	return m.Cursors[consumer], nil
+}
+
+func (m *MockOutboxRepository) SaveOutboxCursor(ctx context.Context, consumer string, cursor db.OutboxCursor) error {
+	m.Cursors[consumer] = cursor
+	return nil
+}
+
+type MockWebhookRepository struct {
+	Endpoints  map[int]db.WebhookEndpoint
+	Deliveries []db.WebhookDelivery
+}
+
+func NewMockWebhookRepository() *MockWebhookRepository {
+	return &MockWebhookRepository{
+		Endpoints:  make(map[int]db.WebhookEndpoint),
+		Deliveries: make([]db.WebhookDelivery, 0),
+	}
+}
+
+func (m *MockWebhookRepository) CreateWebhookEndpoint(ctx context.Context, endpoint db.WebhookEndpoint) (int, error) {
+	endpoint.Id = len(m.Endpoints) + 1
+	endpoint.Active = true
+	m.Endpoints[endpoint.Id] = endpoint
+	return endpoint.Id, nil
+}
+
+func (m *MockWebhookRepository) GetWebhookEndpoint(ctx context.Context, id int) (db.WebhookEndpoint, bool, error) {
+	endpoint, exists := m.Endpoints[id]
+	return endpoint, exists, nil
+}
+
+func (m *MockWebhookRepository) GetWebhookEndpoints(ctx context.Context) ([]db.WebhookEndpoint, error) {
+	endpoints := make([]db.WebhookEndpoint, 0, len(m.Endpoints))
+	for _, endpoint := range m.Endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].Id < endpoints[j].Id })
+	return endpoints, nil
+}
+
+func (m *MockWebhookRepository) SetWebhookEndpointActive(ctx context.Context, id int, active bool) error {
+	if endpoint, exists := m.Endpoints[id]; exists {
+		endpoint.Active = active
+		m.Endpoints[id] = endpoint
+	}
+	return nil
+}
+
+func (m *MockWebhookRepository) RecordWebhookDelivery(ctx context.Context, delivery db.WebhookDelivery) error {
+	delivery.Id = int64(len(m.Deliveries) + 1)
+	m.Deliveries = append(m.Deliveries, delivery)
+	return nil
+}
+
+func (m *MockWebhookRepository) GetWebhookDeliveries(ctx context.Context, endpointId int, limit int) ([]db.WebhookDelivery, error) {
+	deliveries := make([]db.WebhookDelivery, 0)
+	for i := len(m.Deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if m.Deliveries[i].EndpointId == endpointId {
+			deliveries = append(deliveries, m.Deliveries[i])
+		}
+	}
+	return deliveries, nil
+}
+
+type MockImportRepository struct {
+	Checkpoints map[string]db.ImportCheckpoint
+}
+
+func NewMockImportRepository() *MockImportRepository {
+	return &MockImportRepository{Checkpoints: make(map[string]db.ImportCheckpoint)}
+}
+
+func (m *MockImportRepository) GetImportCheckpoint(ctx context.Context, name string) (db.ImportCheckpoint, bool, error) {
+	checkpoint, exists := m.Checkpoints[name]
+	return checkpoint, exists, nil
+}
+
+func (m *MockImportRepository) SaveImportCheckpoint(ctx context.Context, checkpoint db.ImportCheckpoint) error {
+	checkpoint.UpdatedAt = time.Now().UTC()
+	m.Checkpoints[checkpoint.Name] = checkpoint
+	return nil
+}
+
+func (m *MockImportRepository) DeleteImportCheckpoint(ctx context.Context, name string) error {
+	delete(m.Checkpoints, name)
+	return nil
+}
+
+type MockExportRepository struct {
+	Watermarks map[string]time.Time
+}
+
+func NewMockExportRepository() *MockExportRepository {
+	return &MockExportRepository{Watermarks: make(map[string]time.Time)}
+}
+
+func (m *MockExportRepository) GetExportWatermark(ctx context.Context, name string) (time.Time, bool, error) {
+	watermark, exists := m.Watermarks[name]
+	return watermark, exists, nil
+}
+
+func (m *MockExportRepository) SaveExportWatermark(ctx context.Context, name string, watermark time.Time) error {
+	m.Watermarks[name] = watermark
+	return nil
+}
+
+type MockDSARRepository struct {
+	Requests   []db.DSARRequest
+	Tombstones map[db.Identifier]int64
+}
+
+func NewMockDSARRepository() *MockDSARRepository {
+	return &MockDSARRepository{
+		Requests:   make([]db.DSARRequest, 0),
+		Tombstones: make(map[db.Identifier]int64),
+	}
+}
+
+func (m *MockDSARRepository) CreateDSARRequest(ctx context.Context, request db.DSARRequest) (int64, error) {
+	request.Id = int64(len(m.Requests) + 1)
+	request.Status = db.DSARPending
+	request.RequestedAt = time.Now().UTC()
+	m.Requests = append(m.Requests, request)
+	return request.Id, nil
+}
+
+func (m *MockDSARRepository) CompleteDSARRequest(ctx context.Context, request db.DSARRequest) error {
+	for i := range m.Requests {
+		if m.Requests[i].Id == request.Id {
+			completedAt := time.Now().UTC()
+			request.RequestedAt, request.CompletedAt = m.Requests[i].RequestedAt, &completedAt
+			m.Requests[i] = request
+			return nil
+		}
+	}
+	return fmt.Errorf("DSAR request %d not found", request.Id)
+}
+
+func (m *MockDSARRepository) GetDSARRequests(ctx context.Context, limit int) ([]db.DSARRequest, error) {
+	requests := slices.Clone(m.Requests)
+	slices.Reverse(requests)
+	return requests[:min(limit, len(requests))], nil
+}
+
+func (m *MockDSARRepository) InsertTombstones(ctx context.Context, requestId int64, identifiers []db.Identifier) error {
+	for _, identifier := range identifiers {
+		if _, exists := m.Tombstones[identifier]; !exists {
+			m.Tombstones[identifier] = requestId
+		}
+	}
+	return nil
+}
+
+func (m *MockDSARRepository) RemoveErasedIdentifiers(ctx context.Context, identifiers db.EventIdentifier) (db.EventIdentifier, error) {
+	for _, identifier := range identifiers.Identifiers() {
+		if _, erased := m.Tombstones[identifier]; erased {
+			identifiers = identifiers.Without(identifier.Type)
+		}
+	}
+	return identifiers, nil
+}
+
+type MockAPIKeyRepository struct {
+	Keys  []db.APIKey
+	Audit []db.AuditEntry
+}
+
+func NewMockAPIKeyRepository() *MockAPIKeyRepository {
+	return &MockAPIKeyRepository{
+		Keys:  make([]db.APIKey, 0),
+		Audit: make([]db.AuditEntry, 0),
+	}
+}
+
+func (m *MockAPIKeyRepository) CreateAPIKey(ctx context.Context, key db.APIKey) (int, error) {
+	key.Id = len(m.Keys) + 1
+	key.CreatedAt = time.Now().UTC()
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		key.Workspace = workspace
+	}
+	m.Keys = append(m.Keys, key)
+	return key.Id, nil
+}
+
+func (m *MockAPIKeyRepository) GetAPIKeyByHash(ctx context.Context, keyHash string) (db.APIKey, bool, error) {
+	for _, key := range m.Keys {
+		if key.KeyHash == keyHash {
+			return key, true, nil
+		}
+	}
+	return db.APIKey{}, false, nil
+}
+
+func (m *MockAPIKeyRepository) GetAPIKeys(ctx context.Context) ([]db.APIKey, error) {
+	workspace, scoped := db.WorkspaceFromContext(ctx)
+	var keys []db.APIKey
+	for _, key := range m.Keys {
+		if !scoped || key.Workspace == workspace {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *MockAPIKeyRepository) RevokeAPIKey(ctx context.Context, id int) (bool, error) {
+	workspace, scoped := db.WorkspaceFromContext(ctx)
+	for i, key := range m.Keys {
+		if key.Id == id && key.RevokedAt == nil && (!scoped || key.Workspace == workspace) {
+			revokedAt := time.Now().UTC()
+			m.Keys[i].RevokedAt = &revokedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockAPIKeyRepository) RecordAudit(ctx context.Context, entry db.AuditEntry) error {
+	entry.Id = int64(len(m.Audit) + 1)
+	entry.CreatedAt = time.Now().UTC()
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		entry.Workspace = workspace
+	}
+	m.Audit = append(m.Audit, entry)
+	return nil
+}
+
+func (m *MockAPIKeyRepository) GetAuditLog(ctx context.Context, limit int) ([]db.AuditEntry, error) {
+	entries := slices.Clone(m.Audit)
+	slices.Reverse(entries)
+	return entries[:min(limit, len(entries))], nil
+}
+
+// seq yields the items like the paginated iterators of the repositories, ending with the context's error once cancelled
+func seq[T any](ctx context.Context, items []T) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for i := 0; ; i++ {
+			if err := ctx.Err(); err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+			if i == len(items) || !yield(items[i], nil) {
+				return
+			}
+		}
+	}
+}
+
+type MockDataKeyRepository struct {
+	Keys []db.DataKey
+}
+
+func NewMockDataKeyRepository() *MockDataKeyRepository {
+	return &MockDataKeyRepository{Keys: make([]db.DataKey, 0)}
+}
+
+func (m *MockDataKeyRepository) GetDataKeys(ctx context.Context) ([]db.DataKey, error) {
+	return slices.Clone(m.Keys), nil
+}
+
+func (m *MockDataKeyRepository) InsertDataKey(ctx context.Context, key db.DataKey) (int, error) {
+	key.Id = len(m.Keys) + 1
+	key.CreatedAt = time.Now().UTC()
+	m.Keys = append(m.Keys, key)
+	return key.Id, nil
+}
+
+func (m *MockDataKeyRepository) UpdateWrappedKey(ctx context.Context, key db.DataKey) error {
+	for i := range m.Keys {
+		if m.Keys[i].Id == key.Id {
+			m.Keys[i].MasterKeyId, m.Keys[i].WrappedKey = key.MasterKeyId, key.WrappedKey
+			return nil
+		}
+	}
+	return fmt.Errorf("data key %d not found", key.Id)
+}
+
+type MockProfileKeyRepository struct {
+	// Keys holds the keys by key id
+	Keys map[string]db.ProfileKey
+}
+
+func NewMockProfileKeyRepository() *MockProfileKeyRepository {
+	return &MockProfileKeyRepository{Keys: make(map[string]db.ProfileKey)}
+}
+
+func (m *MockProfileKeyRepository) GetProfileKeys(ctx context.Context, keyIds []string) ([]db.ProfileKey, error) {
+	keys := make([]db.ProfileKey, 0)
+	for id, key := range m.Keys {
+		if slices.Contains(keyIds, id) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b db.ProfileKey) int { return strings.Compare(a.KeyId, b.KeyId) })
+	return keys, nil
+}
+
+func (m *MockProfileKeyRepository) GetLiveProfileKey(ctx context.Context, profileId int) (db.ProfileKey, bool, error) {
+	for _, key := range m.ProfileKeysOf(profileId) {
+		if !key.Shredded() {
+			return key, true, nil
+		}
+	}
+	return db.ProfileKey{}, false, nil
+}
+
+// ProfileKeysOf returns the keys held by the profile in the order they were created
+func (m *MockProfileKeyRepository) ProfileKeysOf(profileId int) []db.ProfileKey {
+	keys := make([]db.ProfileKey, 0)
+	for _, key := range m.Keys {
+		if key.ProfileId != nil && *key.ProfileId == profileId {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b db.ProfileKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return keys
+}
+
+func (m *MockProfileKeyRepository) InsertProfileKey(ctx context.Context, key db.ProfileKey) (db.ProfileKey, error) {
+	key.KeyId = uuid.NewString()
+	key.CreatedAt = time.Now().UTC()
+	m.Keys[key.KeyId] = key
+	return key, nil
+}
+
+func (m *MockProfileKeyRepository) ShredProfileKeys(ctx context.Context, profileIds []int) (int, error) {
+	shredded := 0
+	now := time.Now().UTC()
+	for id, key := range m.Keys {
+		if key.Shredded() || key.ProfileId == nil || !slices.Contains(profileIds, *key.ProfileId) {
+			continue
+		}
+		m.Keys[id] = db.ProfileKey{KeyId: id, CreatedAt: key.CreatedAt, ShreddedAt: &now}
+		shredded++
+	}
+	return shredded, nil
+}
+
+func (m *MockProfileKeyRepository) GetProfileKeysToRewrap(ctx context.Context, masterKeyId string, limit int) ([]db.ProfileKey, error) {
+	keys := make([]db.ProfileKey, 0)
+	for _, key := range m.Keys {
+		if !key.Shredded() && key.MasterKeyId != masterKeyId {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b db.ProfileKey) int { return strings.Compare(a.KeyId, b.KeyId) })
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (m *MockProfileKeyRepository) UpdateProfileKey(ctx context.Context, key db.ProfileKey) error {
+	existing, ok := m.Keys[key.KeyId]
+	if !ok || existing.Shredded() {
+		return nil
+	}
+	existing.MasterKeyId, existing.WrappedKey = key.MasterKeyId, key.WrappedKey
+	m.Keys[key.KeyId] = existing
+	return nil
+}
+
+type MockArchiveRepository struct {
+	Events []db.ArchivedEvent
+	// Unprocessed holds the ids of events not stitched yet, which are never archived
+	Unprocessed map[int]bool
+}
+
+func NewMockArchiveRepository() *MockArchiveRepository {
+	return &MockArchiveRepository{
+		Events:      make([]db.ArchivedEvent, 0),
+		Unprocessed: make(map[int]bool),
+	}
+}
+
+func (m *MockArchiveRepository) GetExpiredEvents(ctx context.Context, cutoffs db.RetentionCutoffs, limit int) ([]db.ArchivedEvent, error) {
+	expired := make([]db.ArchivedEvent, 0)
+	for _, event := range m.Events {
+		if !m.Unprocessed[event.Id] && cutoffs.Expired(event.EventId, event.EventTimestamp) && len(expired) < limit {
+			expired = append(expired, event)
+		}
+	}
+	return expired, nil
+}
+
+func (m *MockArchiveRepository) DeleteArchivedEvents(ctx context.Context, events []db.ArchivedEvent) (int, error) {
+	before := len(m.Events)
+	m.Events = slices.DeleteFunc(m.Events, func(event db.ArchivedEvent) bool {
+		return slices.ContainsFunc(events, func(archived db.ArchivedEvent) bool { return archived.Id == event.Id })
+	})
+	return before - len(m.Events), nil
+}
+
+func (m *MockArchiveRepository) RestoreEvents(ctx context.Context, events []db.ArchivedEvent) (int, error) {
+	restored := 0
+	for _, event := range events {
+		if slices.ContainsFunc(m.Events, func(stored db.ArchivedEvent) bool { return stored.Id == event.Id }) {
+			continue
+		}
+		m.Events = append(m.Events, event)
+		restored++
+	}
+	slices.SortFunc(m.Events, func(a, b db.ArchivedEvent) int { return a.Id - b.Id })
+	return restored, nil
+}
+
+func (m *MockArchiveRepository) BeginTx(ctx context.Context) (pgx.Tx, error) {
 	return &MockPgxTx{}, nil
 }
+
+type MockPartitionRepository struct {
+	Partitions []db.Partition
+	// Unprocessed holds the names of partitions with unprocessed events, which are never detached
+	Unprocessed map[string]bool
+	// Unarchived holds the names of partitions with events left, which are never dropped
+	Unarchived map[string]bool
+	Detached   []string
+	Dropped    []string
+}
+
+func NewMockPartitionRepository() *MockPartitionRepository {
+	return &MockPartitionRepository{
+		Partitions:  make([]db.Partition, 0),
+		Unprocessed: make(map[string]bool),
+		Unarchived:  make(map[string]bool),
+	}
+}
+
+func (m *MockPartitionRepository) GetPartitions(ctx context.Context) ([]db.Partition, error) {
+	return slices.Clone(m.Partitions), nil
+}
+
+func (m *MockPartitionRepository) CreatePartition(ctx context.Context, month time.Time) (int, error) {
+	name := db.PartitionName(month)
+	if slices.ContainsFunc(m.Partitions, func(p db.Partition) bool { return p.Name == name }) {
+		return 0, fmt.Errorf("partition %s already exists", name)
+	}
+	from := db.MonthStart(month)
+	m.Partitions = append(m.Partitions, db.Partition{Name: name, From: from, To: from.AddDate(0, 1, 0)})
+	slices.SortFunc(m.Partitions, func(a, b db.Partition) int { return a.From.Compare(b.From) })
+	return 0, nil
+}
+
+func (m *MockPartitionRepository) DetachPartition(ctx context.Context, partition db.Partition, drop bool) (bool, error) {
+	if m.Unprocessed[partition.Name] || drop && m.Unarchived[partition.Name] {
+		return false, nil
+	}
+	m.Partitions = slices.DeleteFunc(m.Partitions, func(p db.Partition) bool { return p.Name == partition.Name })
+	m.Detached = append(m.Detached, partition.Name)
+	if drop {
+		m.Dropped = append(m.Dropped, partition.Name)
+	}
+	return true, nil
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// ProfileChange is the payload of profile outbox events
+type ProfileChange struct {
+	Profile db.Profile `json:"profile"`
+	// MergedIds are the profiles absorbed into the profile, set on profile.merged and profile.erased
+	MergedIds []int `json:"merged_ids,omitempty"`
+	// SurvivorId is the profile which absorbed a deleted profile, set on profile.deleted caused by a merge
+	SurvivorId int `json:"survivor_id,omitempty"`
+}
+
+// SegmentChange is the payload of segment outbox events
+type SegmentChange struct {
+	Segment    string    `json:"segment"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// SetOutbox enables recording profile changes into the outbox, in the same transaction as the changes
+func (s *StitchingService) SetOutbox(outboxRepo db.OutboxRepository) {
+	s.outboxRepo = outboxRepo
+}
+
+// emitChanges records the profile changes caused by stitching a single event into the outbox.
+// Enriching a profile is only reported when it actually changed the profile.
+func (s *StitchingService) emitChanges(ctx context.Context, result stitchResult) error {
+	if s.outboxRepo == nil || result.Action == ActionSkipped {
+		return nil
+	}
+
+	profile, found, err := s.profileRepo.GetProfileById(ctx, result.ProfileId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("failed to emit changes: profile %d not found", result.ProfileId)
+	}
+
+	var events []db.OutboxEvent
+	add := func(kind db.OutboxKind, profileId int, payload any) error {
+		event, err := newOutboxEvent(kind, profileId, payload)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	}
+
+	switch result.Action {
+	case ActionCreated:
+		err = add(db.KindProfileCreated, profile.Id, ProfileChange{Profile: profile})
+	case ActionEnriched:
+		if !reflect.DeepEqual(result.Previous, profile) {
+			err = add(db.KindProfileUpdated, profile.Id, ProfileChange{Profile: profile})
+		}
+	case ActionMerged:
+		err = add(db.KindProfileMerged, profile.Id, ProfileChange{Profile: profile, MergedIds: result.MergedIds})
+		for _, id := range result.MergedIds {
+			if err != nil {
+				break
+			}
+			err = add(db.KindProfileDeleted, id, ProfileChange{Profile: db.Profile{Id: id}, SurvivorId: profile.Id})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, t := range result.Transitions {
+		kind := db.KindSegmentExited
+		if t.Entered {
+			kind = db.KindSegmentEntered
+		}
+		if err := add(kind, t.ProfileId, SegmentChange{Segment: t.Segment, OccurredAt: t.OccurredAt}); err != nil {
+			return err
+		}
+	}
+
+	return s.outboxRepo.AppendOutbox(ctx, events)
+}
+
+func newOutboxEvent(kind db.OutboxKind, profileId int, payload any) (db.OutboxEvent, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return db.OutboxEvent{}, fmt.Errorf("failed to encode %s payload: %w", kind, err)
+	}
+	return db.OutboxEvent{Kind: kind, ProfileId: profileId, Payload: encoded}, nil
+}
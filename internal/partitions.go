@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// PartitionResult describes a maintenance run of the events partitions
+type PartitionResult struct {
+	Created  []string
+	Moved    int
+	Detached []string
+	// Kept holds partitions due for detachment which still hold unprocessed events, or events not archived yet when
+	// they are dropped
+	Kept []string
+}
+
+// PartitionMaintainer keeps monthly partitions of the events table ahead of incoming events and detaches the ones
+// past the age of the policy
+type PartitionMaintainer struct {
+	partitionRepo db.PartitionRepository
+	policy        db.PartitionPolicy
+	log           *slog.Logger
+}
+
+func NewPartitionMaintainer(partitionRepo db.PartitionRepository, policy db.PartitionPolicy) *PartitionMaintainer {
+	return &PartitionMaintainer{
+		partitionRepo: partitionRepo,
+		policy:        policy,
+		log:           slog.Default(),
+	}
+}
+
+// Start maintains the partitions every interval until the context is cancelled
+func (m *PartitionMaintainer) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		for {
+			result, err := m.Maintain(ctx, time.Now().UTC())
+			if err != nil {
+				m.log.Error("Failed to maintain event partitions", "error", err)
+			} else if len(result.Created) > 0 || len(result.Detached) > 0 {
+				m.log.Info("Maintained event partitions", "created", result.Created, "moved", result.Moved, "detached", result.Detached)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Maintain creates the missing partitions from the month of the policy, or the current one, up to the months ahead,
+// then detaches the partitions ending before the detach age
+func (m *PartitionMaintainer) Maintain(ctx context.Context, now time.Time) (PartitionResult, error) {
+	var result PartitionResult
+	fail := func(err error) (PartitionResult, error) {
+		return result, fmt.Errorf("partitions: %w", err)
+	}
+
+	detachBefore, err := m.policy.DetachBefore(now)
+	if err != nil {
+		return fail(err)
+	}
+	partitions, err := m.partitionRepo.GetPartitions(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	existing := make(map[string]bool, len(partitions))
+	for _, partition := range partitions {
+		existing[partition.Name] = true
+	}
+
+	from := db.MonthStart(now)
+	if !m.policy.From.IsZero() && m.policy.From.Before(from) {
+		from = db.MonthStart(m.policy.From)
+	}
+	to := db.MonthStart(now).AddDate(0, m.policy.Ahead, 0)
+	for month := from; !month.After(to); month = month.AddDate(0, 1, 0) {
+		name := db.PartitionName(month)
+		// Months due for detachment are not created again
+		if existing[name] || (detachBefore != nil && !month.AddDate(0, 1, 0).After(*detachBefore)) {
+			continue
+		}
+		moved, err := m.partitionRepo.CreatePartition(ctx, month)
+		if err != nil {
+			return fail(err)
+		}
+		result.Created = append(result.Created, name)
+		result.Moved += moved
+	}
+
+	if detachBefore == nil {
+		return result, nil
+	}
+	for _, partition := range partitions {
+		if partition.To.After(*detachBefore) {
+			continue
+		}
+		detached, err := m.partitionRepo.DetachPartition(ctx, partition, m.policy.Drop)
+		if err != nil {
+			return fail(err)
+		}
+		if !detached {
+			m.log.Warn("Partition holds unprocessed events or events to archive before dropping it, keeping it attached",
+				"partition", partition.Name)
+			result.Kept = append(result.Kept, partition.Name)
+			continue
+		}
+		result.Detached = append(result.Detached, partition.Name)
+	}
+	return result, nil
+}
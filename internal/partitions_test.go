@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Partition Maintainer", func() {
+	var (
+		ctx           context.Context
+		partitionRepo *mocks.MockPartitionRepository
+		now           time.Time
+	)
+
+	names := func() []string {
+		result := make([]string, 0)
+		for _, partition := range partitionRepo.Partitions {
+			result = append(result, partition.Name)
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		partitionRepo = mocks.NewMockPartitionRepository()
+		now = time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("should create the current month and the months ahead once", func() {
+		maintainer := NewPartitionMaintainer(partitionRepo, db.PartitionPolicy{Ahead: 2})
+
+		result, err := maintainer.Maintain(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(Equal([]string{"events_2024_06", "events_2024_07", "events_2024_08"}))
+		Expect(partitionRepo.Partitions[0].From).To(Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)))
+		Expect(partitionRepo.Partitions[0].To).To(Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)))
+
+		result, err = maintainer.Maintain(ctx, now.AddDate(0, 1, 0))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(Equal([]string{"events_2024_09"}))
+	})
+
+	It("should create partitions back to the month of the policy", func() {
+		maintainer := NewPartitionMaintainer(partitionRepo, db.PartitionPolicy{From: time.Date(2024, 4, 20, 0, 0, 0, 0, time.UTC)})
+
+		result, err := maintainer.Maintain(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Created).To(Equal([]string{"events_2024_04", "events_2024_05", "events_2024_06"}))
+	})
+
+	It("should detach partitions past the age unless they hold unprocessed events", func() {
+		policy := db.PartitionPolicy{From: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), DetachAfter: "90d", Drop: true}
+		Expect(policy.Validate()).To(Succeed())
+		for _, month := range []int{1, 2, 3, 4, 5, 6} {
+			_, err := partitionRepo.CreatePartition(ctx, time.Date(2024, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		partitionRepo.Unprocessed["events_2024_02"] = true
+
+		result, err := NewPartitionMaintainer(partitionRepo, policy).Maintain(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		// Partitions ending before March 17 are due, January and February, so January is not created again
+		Expect(result.Created).To(BeEmpty())
+		Expect(result.Detached).To(Equal([]string{"events_2024_01"}))
+		Expect(result.Kept).To(Equal([]string{"events_2024_02"}))
+		Expect(partitionRepo.Dropped).To(Equal([]string{"events_2024_01"}))
+		Expect(names()).To(Equal([]string{"events_2024_02", "events_2024_03", "events_2024_04", "events_2024_05", "events_2024_06"}))
+	})
+
+	It("should only drop partitions whose events were archived", func() {
+		policy := db.PartitionPolicy{DetachAfter: "90d", Drop: true}
+		for _, month := range []int{1, 2} {
+			_, err := partitionRepo.CreatePartition(ctx, time.Date(2024, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		partitionRepo.Unarchived["events_2024_01"] = true
+
+		result, err := NewPartitionMaintainer(partitionRepo, policy).Maintain(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Kept).To(Equal([]string{"events_2024_01"}))
+		Expect(partitionRepo.Dropped).To(Equal([]string{"events_2024_02"}))
+
+		// Detached partitions are kept as standalone tables, so they need not be archived
+		policy.Drop = false
+		result, err = NewPartitionMaintainer(partitionRepo, policy).Maintain(ctx, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Detached).To(Equal([]string{"events_2024_01"}))
+	})
+
+	It("should reject invalid policies", func() {
+		Expect(db.PartitionPolicy{Ahead: -1}.Validate()).NotTo(Succeed())
+		Expect(db.PartitionPolicy{DetachAfter: "soon"}.Validate()).NotTo(Succeed())
+		Expect(db.PartitionPolicy{Ahead: 3, DetachAfter: "365d"}.Validate()).To(Succeed())
+	})
+})
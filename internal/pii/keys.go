@@ -0,0 +1,154 @@
+package pii
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeyProvider wraps and unwraps data keys with master keys it holds, e.g. a KMS or a local keyfile.
+// Master keys never leave the provider, only the wrapped data keys are stored in the database.
+type KeyProvider interface {
+	// CurrentKeyId names the master key wrapping new data keys
+	CurrentKeyId() string
+	Wrap(ctx context.Context, keyId string, plaintext []byte) ([]byte, error)
+	Unwrap(ctx context.Context, keyId string, ciphertext []byte) ([]byte, error)
+}
+
+// masterKeySize is the size of master and data keys, AES-256
+const masterKeySize = 32
+
+// Keyfile is a KeyProvider holding the master keys in a local JSON file, e.g.
+// {"current": "2024-06", "keys": {"2024-06": "<base64 of 32 random bytes>"}}
+type Keyfile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// LoadKeyfile reads the master keys from the file
+func LoadKeyfile(path string) (*Keyfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	var keyfile Keyfile
+	if err := json.Unmarshal(data, &keyfile); err != nil {
+		return nil, fmt.Errorf("failed to parse keyfile: %w", err)
+	}
+	return &keyfile, keyfile.Validate()
+}
+
+// Validate checks that the current key exists and all keys have the right size
+func (k *Keyfile) Validate() error {
+	if _, ok := k.Keys[k.Current]; !ok {
+		return fmt.Errorf("current master key %q is not in the keyfile", k.Current)
+	}
+	for id, key := range k.Keys {
+		if len(key) != masterKeySize {
+			return fmt.Errorf("master key %q must be %d bytes, got %d", id, masterKeySize, len(key))
+		}
+	}
+	return nil
+}
+
+// AddKey generates a new master key and makes it the current one. Data keys wrapped with the previous key still
+// unwrap, until they are rewrapped and the previous key is removed from the file.
+func (k *Keyfile) AddKey(id string) error {
+	if id == "" {
+		return errors.New("master key id must not be empty")
+	}
+	if _, ok := k.Keys[id]; ok {
+		return fmt.Errorf("master key %q already exists", id)
+	}
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("failed to generate master key: %w", err)
+	}
+	if k.Keys == nil {
+		k.Keys = map[string][]byte{}
+	}
+	k.Keys[id] = key
+	k.Current = id
+	return nil
+}
+
+// Save writes the keyfile readable by its owner only, replacing the file at once
+func (k *Keyfile) Save(path string) error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	// CreateTemp creates the file with mode 0600
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (k *Keyfile) CurrentKeyId() string {
+	return k.Current
+}
+
+// Wrap encrypts the data key with AES-GCM under the master key, prefixing the random nonce
+func (k *Keyfile) Wrap(_ context.Context, keyId string, plaintext []byte) ([]byte, error) {
+	aead, err := k.aead(keyId)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(keyId)), nil
+}
+
+func (k *Keyfile) Unwrap(_ context.Context, keyId string, ciphertext []byte) ([]byte, error) {
+	aead, err := k.aead(keyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(keyId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key with master key %q: %w", keyId, err)
+	}
+	return plaintext, nil
+}
+
+func (k *Keyfile) aead(keyId string) (cipher.AEAD, error) {
+	key, ok := k.Keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyId)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package pii
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Protection is how an identifier is stored
+type Protection string
+
+const (
+	// ProtectPlain stores the value as it is
+	ProtectPlain Protection = "plain"
+	// ProtectHash stores a keyed hash of the value, which still matches equal values but cannot be reversed,
+	// for identifiers only needed for stitching
+	ProtectHash Protection = "hash"
+	// ProtectEncrypt stores the value encrypted with the current encryption key, for identifiers which must be
+	// recovered, e.g. to export them
+	ProtectEncrypt Protection = "encrypt"
+)
+
+// Policy maps identifier names to their protection, unlisted identifiers are stored in plain,
+// e.g. {"phone": "encrypt", "message_id": "hash"}
+type Policy map[string]Protection
+
+// LoadPolicy reads the policy from a JSON file
+func LoadPolicy(path string) (Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read protection policy: %w", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse protection policy: %w", err)
+	}
+	return policy, policy.Validate()
+}
+
+// Validate checks that the identifiers and protections are known
+func (p Policy) Validate() error {
+	for name, protection := range p {
+		if _, ok := db.IdentifierByName(name, ""); !ok {
+			return fmt.Errorf("unknown identifier %q", name)
+		}
+		switch protection {
+		case ProtectPlain, ProtectHash, ProtectEncrypt:
+		default:
+			return fmt.Errorf("unknown protection %q of %q", protection, name)
+		}
+	}
+	return nil
+}
+
+// protection returns how the identifier is stored
+func (p Policy) protection(name string) Protection {
+	if protection, ok := p[name]; ok {
+		return protection
+	}
+	return ProtectPlain
+}
@@ -0,0 +1,232 @@
+package pii
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Sealed values are stored as "pii:k<key id>:<ciphertext>", base64url encoded. The traits of a sealed event
+// are stored as a single string trait named sealedTrait holding the sealed JSON of the traits.
+const (
+	sealPrefix  = "pii:k"
+	sealedTrait = "pii:sealed"
+	// traitsAAD binds sealed traits, identifiers are bound to their type
+	traitsAAD = "traits"
+)
+
+// rewrapPageSize is the number of profile keys rewrapped per query
+const rewrapPageSize = 500
+
+// ProfileKeys implements db.EventSealer with data keys held by profiles, generated when the first event of a profile
+// without a live key is sealed and stored wrapped by the current master key. Values are sealed with AES-GCM under
+// a random nonce and name the key sealing them, so they are opened whichever profile holds the key by then.
+// Keys are read for every call rather than cached, so a shredded key stops opening events at once.
+type ProfileKeys struct {
+	repo     db.ProfileKeyRepository
+	provider KeyProvider
+}
+
+var _ db.EventSealer = (*ProfileKeys)(nil)
+
+func NewProfileKeys(repo db.ProfileKeyRepository, provider KeyProvider) *ProfileKeys {
+	return &ProfileKeys{repo: repo, provider: provider}
+}
+
+// Seal returns the event with its identifiers and traits sealed with a live key of the profile, creating a key
+// when the profile has none
+func (k *ProfileKeys) Seal(ctx context.Context, profileId int, event db.EventRecord) (db.EventRecord, error) {
+	keyId, aead, err := k.profileKey(ctx, profileId)
+	if err != nil {
+		return db.EventRecord{}, err
+	}
+	event.ProfileKeyId = keyId
+	seal := func(aad, value string) (string, error) {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		sealed := aead.Seal(nonce, nonce, []byte(value), []byte(aad))
+		return sealPrefix + keyId + ":" + encoding.EncodeToString(sealed), nil
+	}
+
+	if event.EventIdentifier, err = db.MapIdentifiers(event.EventIdentifier, seal); err != nil {
+		return db.EventRecord{}, err
+	}
+	if len(event.Traits) > 0 {
+		data, err := json.Marshal(event.Traits)
+		if err != nil {
+			return db.EventRecord{}, fmt.Errorf("failed to encode traits: %w", err)
+		}
+		sealed, err := seal(traitsAAD, string(data))
+		if err != nil {
+			return db.EventRecord{}, err
+		}
+		event.Traits = db.Traits{sealedTrait: db.StringTrait(sealed, time.Time{})}
+	}
+	return event, nil
+}
+
+// Open opens the sealed events in place, reading the keys sealing them at once. Events sealed with shredded keys
+// are left without identifiers and traits.
+func (k *ProfileKeys) Open(ctx context.Context, events []db.EventRecord) error {
+	var keyIds []string
+	for _, event := range events {
+		for _, value := range sealedValues(event) {
+			if id, _, ok := parseSealed(value); ok {
+				keyIds = append(keyIds, id)
+			}
+		}
+	}
+	if len(keyIds) == 0 {
+		return nil
+	}
+
+	keys, err := k.repo.GetProfileKeys(ctx, keyIds)
+	if err != nil {
+		return err
+	}
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for _, key := range keys {
+		if key.Shredded() {
+			continue
+		}
+		if aeads[key.KeyId], err = k.unwrap(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	for i := range events {
+		open := func(aad, value string) (string, error) {
+			id, sealed, ok := parseSealed(value)
+			if !ok {
+				return value, nil
+			}
+			aead, ok := aeads[id]
+			if !ok {
+				// The key was shredded, the value is gone
+				return "", nil
+			}
+			return openValue(aead, aad, sealed)
+		}
+
+		identifiers, err := db.MapIdentifiers(events[i].EventIdentifier, open)
+		if err != nil {
+			return fmt.Errorf("failed to open event %d: %w", events[i].EventId, err)
+		}
+		events[i].EventIdentifier = identifiers
+
+		trait, ok := events[i].Traits[sealedTrait]
+		if !ok {
+			continue
+		}
+		data, err := open(traitsAAD, trait.String)
+		if err != nil {
+			return fmt.Errorf("failed to open traits of event %d: %w", events[i].EventId, err)
+		}
+		events[i].Traits = nil
+		if data != "" {
+			if err := json.Unmarshal([]byte(data), &events[i].Traits); err != nil {
+				return fmt.Errorf("failed to decode traits of event %d: %w", events[i].EventId, err)
+			}
+		}
+	}
+	return nil
+}
+
+// profileKey returns the id and the key of the profile, creating a key if the profile has no live one
+func (k *ProfileKeys) profileKey(ctx context.Context, profileId int) (string, cipher.AEAD, error) {
+	key, found, err := k.repo.GetLiveProfileKey(ctx, profileId)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !found {
+		plaintext := make([]byte, masterKeySize)
+		if _, err := rand.Read(plaintext); err != nil {
+			return "", nil, fmt.Errorf("failed to generate profile key: %w", err)
+		}
+		key = db.ProfileKey{ProfileId: &profileId, MasterKeyId: k.provider.CurrentKeyId()}
+		if key.WrappedKey, err = k.provider.Wrap(ctx, key.MasterKeyId, plaintext); err != nil {
+			return "", nil, fmt.Errorf("failed to wrap profile key: %w", err)
+		}
+		if key, err = k.repo.InsertProfileKey(ctx, key); err != nil {
+			return "", nil, err
+		}
+	}
+
+	aead, err := k.unwrap(ctx, key)
+	return key.KeyId, aead, err
+}
+
+func (k *ProfileKeys) unwrap(ctx context.Context, key db.ProfileKey) (cipher.AEAD, error) {
+	plaintext, err := k.provider.Unwrap(ctx, key.MasterKeyId, key.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap profile key %s: %w", key.KeyId, err)
+	}
+	return newAEAD(plaintext)
+}
+
+// RewrapProfileKeys wraps every live profile key with the current master key and returns the number of keys
+// rewrapped
+func RewrapProfileKeys(ctx context.Context, repo db.ProfileKeyRepository, provider KeyProvider) (int, error) {
+	current := provider.CurrentKeyId()
+	rewrapped := 0
+	for {
+		keys, err := repo.GetProfileKeysToRewrap(ctx, current, rewrapPageSize)
+		if err != nil || len(keys) == 0 {
+			return rewrapped, err
+		}
+		for _, key := range keys {
+			plaintext, err := provider.Unwrap(ctx, key.MasterKeyId, key.WrappedKey)
+			if err != nil {
+				return rewrapped, fmt.Errorf("failed to unwrap profile key %s: %w", key.KeyId, err)
+			}
+			if key.WrappedKey, err = provider.Wrap(ctx, current, plaintext); err != nil {
+				return rewrapped, fmt.Errorf("failed to wrap profile key %s: %w", key.KeyId, err)
+			}
+			key.MasterKeyId = current
+			if err := repo.UpdateProfileKey(ctx, key); err != nil {
+				return rewrapped, err
+			}
+			rewrapped++
+		}
+	}
+}
+
+// sealedValues returns the stored values of the event which may be sealed
+func sealedValues(event db.EventRecord) []string {
+	values := []string{event.Cookie, event.MessageId, event.Phone}
+	if trait, ok := event.Traits[sealedTrait]; ok {
+		values = append(values, trait.String)
+	}
+	return values
+}
+
+// parseSealed returns the id of the key which sealed the value and the ciphertext, if the value is sealed
+func parseSealed(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, sealPrefix) {
+		return "", "", false
+	}
+	keyId, sealed, ok := strings.Cut(strings.TrimPrefix(value, sealPrefix), ":")
+	return keyId, sealed, ok && uuid.Validate(keyId) == nil
+}
+
+func openValue(aead cipher.AEAD, aad, sealed string) (string, error) {
+	data, err := encoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed sealed %s", aad)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("failed to open sealed %s: %w", aad, err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,139 @@
+package pii_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+	"github.com/tomashoffer/event-stitching/internal/pii"
+)
+
+var _ = Describe("Profile keys", func() {
+	var (
+		ctx     context.Context
+		keyRepo *mocks.MockProfileKeyRepository
+		keyfile *pii.Keyfile
+		keys    *pii.ProfileKeys
+		event   db.EventRecord
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		keyRepo = mocks.NewMockProfileKeyRepository()
+		keyfile = &pii.Keyfile{}
+		Expect(keyfile.AddKey("first")).To(Succeed())
+		keys = pii.NewProfileKeys(keyRepo, keyfile)
+
+		timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		event = db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "+15550100"},
+			EventTimestamp:  timestamp,
+			Traits:          db.Traits{"email": db.StringTrait("a@example.com", timestamp)},
+			Revenue:         9.99,
+		}
+	})
+
+	It("should seal events with a key created for the profile and open them", func() {
+		sealed, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyRepo.Keys).To(HaveKey(sealed.ProfileKeyId))
+		Expect(*keyRepo.Keys[sealed.ProfileKeyId].ProfileId).To(Equal(7))
+		Expect(keyRepo.Keys[sealed.ProfileKeyId].MasterKeyId).To(Equal("first"))
+
+		Expect(sealed.Cookie).To(HavePrefix("pii:k" + sealed.ProfileKeyId + ":"))
+		Expect(sealed.Phone).NotTo(ContainSubstring("15550100"))
+		Expect(sealed.MessageId).To(BeEmpty())
+		Expect(sealed.Traits).To(HaveLen(1))
+		Expect(sealed.Traits).NotTo(HaveKey("email"))
+		Expect(sealed.Revenue).To(Equal(9.99))
+
+		// Plain events are opened as they are
+		plain := db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-b"}}
+		events := []db.EventRecord{sealed, plain}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(event.EventIdentifier))
+		Expect(events[0].Traits).To(Equal(event.Traits))
+		Expect(events[1]).To(Equal(plain))
+	})
+
+	It("should reuse the key of the profile", func() {
+		first, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyRepo.Keys).To(HaveLen(1))
+		Expect(second.ProfileKeyId).To(Equal(first.ProfileKeyId))
+		// Nonces are random, so equal values seal differently
+		Expect(second.Cookie).NotTo(Equal(first.Cookie))
+	})
+
+	It("should leave events of shredded profiles without identifiers and traits", func() {
+		sealed, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+		other, err := keys.Seal(ctx, 8, event)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(keyRepo.ShredProfileKeys(ctx, []int{7})).To(Equal(1))
+
+		events := []db.EventRecord{sealed, other}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(db.EventIdentifier{}))
+		Expect(events[0].Traits).To(BeNil())
+		Expect(events[0].Revenue).To(Equal(9.99))
+		Expect(events[1].EventIdentifier).To(Equal(event.EventIdentifier))
+
+		// New events of the profile are sealed with a new key, the shredded one is never used again
+		resealed, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resealed.ProfileKeyId).NotTo(Equal(sealed.ProfileKeyId))
+		events = []db.EventRecord{sealed, resealed}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(db.EventIdentifier{}))
+		Expect(events[1].EventIdentifier).To(Equal(event.EventIdentifier))
+	})
+
+	It("should open events whichever profile holds their key and shred it along with that profile", func() {
+		sealed, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Merges and rebuilds hand the keys over to another profile
+		key := keyRepo.Keys[sealed.ProfileKeyId]
+		survivor := 9
+		key.ProfileId = &survivor
+		keyRepo.Keys[key.KeyId] = key
+
+		other, err := keys.Seal(ctx, 9, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.ProfileKeyId).To(Equal(sealed.ProfileKeyId))
+		events := []db.EventRecord{sealed}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(event.EventIdentifier))
+
+		Expect(keyRepo.ShredProfileKeys(ctx, []int{7})).To(Equal(0))
+		Expect(keyRepo.ShredProfileKeys(ctx, []int{9})).To(Equal(1))
+		events = []db.EventRecord{sealed}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(db.EventIdentifier{}))
+	})
+
+	It("should rewrap live profile keys with a new master key", func() {
+		sealed, err := keys.Seal(ctx, 7, event)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = keys.Seal(ctx, 8, event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyRepo.ShredProfileKeys(ctx, []int{8})).To(Equal(1))
+
+		Expect(keyfile.AddKey("second")).To(Succeed())
+		Expect(pii.RewrapProfileKeys(ctx, keyRepo, keyfile)).To(Equal(1))
+		Expect(keyRepo.Keys[sealed.ProfileKeyId].MasterKeyId).To(Equal("second"))
+
+		delete(keyfile.Keys, "first")
+		events := []db.EventRecord{sealed}
+		Expect(keys.Open(ctx, events)).To(Succeed())
+		Expect(events[0].EventIdentifier).To(Equal(event.EventIdentifier))
+	})
+})
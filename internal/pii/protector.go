@@ -0,0 +1,242 @@
+package pii
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Protected values are stored as tokens, "pii:h:<hash>" for hashed values and "pii:e<key id>:<ciphertext>" for
+// encrypted ones, both base64url encoded. Values without the prefix are stored in plain.
+const (
+	hashPrefix    = "pii:h:"
+	encryptPrefix = "pii:e"
+)
+
+var encoding = base64.RawURLEncoding
+
+// Protector implements db.IdentifierProtector. Hashes are HMAC-SHA256 under the index key. Values are encrypted
+// with AES-GCM under the current encryption key, using a nonce derived from the value, so equal values encrypt to
+// equal tokens and protected values can be looked up like plain ones.
+type Protector struct {
+	policy   Policy
+	indexKey []byte
+	keys     map[int]cipher.AEAD
+	// keyIds lists the encryption keys in ascending order, the last one is the current one
+	keyIds []int
+}
+
+var _ db.IdentifierProtector = (*Protector)(nil)
+
+// NewProtector returns a protector using the index key for hashes and the encryption keys by id,
+// encrypting with the highest id
+func NewProtector(policy Policy, indexKey []byte, encryptionKeys map[int][]byte) (*Protector, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if len(indexKey) != masterKeySize {
+		return nil, fmt.Errorf("index key must be %d bytes, got %d", masterKeySize, len(indexKey))
+	}
+	if len(encryptionKeys) == 0 {
+		return nil, errors.New("at least one encryption key is required")
+	}
+
+	p := &Protector{policy: policy, indexKey: indexKey, keys: make(map[int]cipher.AEAD, len(encryptionKeys))}
+	for id, key := range encryptionKeys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %w", id, err)
+		}
+		p.keys[id] = aead
+		p.keyIds = append(p.keyIds, id)
+	}
+	slices.Sort(p.keyIds)
+	return p, nil
+}
+
+// Protect returns the value as the policy stores it. Protected values are revealed first, so protecting a value
+// encrypted with an older key encrypts it with the current one. Hashed values are kept as they are.
+func (p *Protector) Protect(identifierType, value string) (string, error) {
+	value, err := p.Reveal(identifierType, value)
+	if err != nil || value == "" || strings.HasPrefix(value, hashPrefix) {
+		return value, err
+	}
+
+	switch p.policy.protection(identifierType) {
+	case ProtectHash:
+		return p.hash(identifierType, value), nil
+	case ProtectEncrypt:
+		return p.encrypt(p.keyIds[len(p.keyIds)-1], identifierType, value), nil
+	default:
+		return value, nil
+	}
+}
+
+// Reveal decrypts encrypted values, plain and hashed values are returned as they are
+func (p *Protector) Reveal(identifierType, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptPrefix) {
+		return value, nil
+	}
+	version, sealed, ok := strings.Cut(strings.TrimPrefix(value, encryptPrefix), ":")
+	keyId, err := strconv.Atoi(version)
+	if !ok || err != nil {
+		// Not a token, a plain value which happens to start like one
+		return value, nil
+	}
+	aead, ok := p.keys[keyId]
+	if !ok {
+		return "", fmt.Errorf("unknown encryption key %d", keyId)
+	}
+	data, err := encoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed %s token", identifierType)
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(identifierType))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", identifierType, err)
+	}
+	return string(plaintext), nil
+}
+
+// Candidates returns the value in plain, hashed and encrypted with every encryption key, which covers values
+// written under any policy and before any rotation. Hashed values are only stored as they are.
+func (p *Protector) Candidates(identifierType, value string) ([]string, error) {
+	value, err := p.Reveal(identifierType, value)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" || strings.HasPrefix(value, hashPrefix) {
+		return []string{value}, nil
+	}
+
+	candidates := []string{value, p.hash(identifierType, value)}
+	for _, keyId := range p.keyIds {
+		candidates = append(candidates, p.encrypt(keyId, identifierType, value))
+	}
+	return candidates, nil
+}
+
+func (p *Protector) hash(identifierType, value string) string {
+	mac := hmac.New(sha256.New, p.indexKey)
+	mac.Write([]byte(identifierType + ":" + value))
+	return hashPrefix + encoding.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt seals the value bound to its identifier type, so a token cannot be moved to another identifier
+func (p *Protector) encrypt(keyId int, identifierType, value string) string {
+	aead := p.keys[keyId]
+	mac := hmac.New(sha256.New, p.indexKey)
+	mac.Write([]byte("nonce:" + strconv.Itoa(keyId) + ":" + identifierType + ":" + value))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(identifierType))
+	return encryptPrefix + strconv.Itoa(keyId) + ":" + encoding.EncodeToString(sealed)
+}
+
+// LoadProtector unwraps the data keys with the provider, creating the index key and a first encryption key
+// when there are none yet
+func LoadProtector(ctx context.Context, repo db.DataKeyRepository, provider KeyProvider, policy Policy) (*Protector, error) {
+	keys, err := repo.GetDataKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(keys, func(k db.DataKey) bool { return k.Purpose == db.KeyPurposeIndex }) {
+		if _, err := newDataKey(ctx, repo, provider, db.KeyPurposeIndex); err != nil {
+			return nil, err
+		}
+	}
+	if !slices.ContainsFunc(keys, func(k db.DataKey) bool { return k.Purpose == db.KeyPurposeEncryption }) {
+		if _, err := newDataKey(ctx, repo, provider, db.KeyPurposeEncryption); err != nil {
+			return nil, err
+		}
+	}
+	if keys, err = repo.GetDataKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	var indexKey []byte
+	encryptionKeys := map[int][]byte{}
+	for _, key := range keys {
+		plaintext, err := provider.Unwrap(ctx, key.MasterKeyId, key.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key %d: %w", key.Id, err)
+		}
+		switch key.Purpose {
+		case db.KeyPurposeIndex:
+			// The first index key wins, so processes creating one at the same time agree on it
+			if indexKey == nil {
+				indexKey = plaintext
+			}
+		case db.KeyPurposeEncryption:
+			encryptionKeys[key.Id] = plaintext
+		}
+	}
+	return NewProtector(policy, indexKey, encryptionKeys)
+}
+
+// RotateEncryptionKey adds a new encryption key, which encrypts identifiers written from then on. Identifiers
+// encrypted with older keys still decrypt, until the stored identifiers are reprotected with the new key.
+func RotateEncryptionKey(ctx context.Context, repo db.DataKeyRepository, provider KeyProvider) (int, error) {
+	keys, err := repo.GetDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("failed to rotate encryption key: %w", db.ErrNoDataKeys)
+	}
+	return newDataKey(ctx, repo, provider, db.KeyPurposeEncryption)
+}
+
+// RewrapDataKeys wraps every data key with the current master key, after which older master keys can be retired.
+// It returns the number of keys rewrapped.
+func RewrapDataKeys(ctx context.Context, repo db.DataKeyRepository, provider KeyProvider) (int, error) {
+	keys, err := repo.GetDataKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	current := provider.CurrentKeyId()
+	rewrapped := 0
+	for _, key := range keys {
+		if key.MasterKeyId == current {
+			continue
+		}
+		plaintext, err := provider.Unwrap(ctx, key.MasterKeyId, key.WrappedKey)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to unwrap data key %d: %w", key.Id, err)
+		}
+		if key.WrappedKey, err = provider.Wrap(ctx, current, plaintext); err != nil {
+			return rewrapped, fmt.Errorf("failed to wrap data key %d: %w", key.Id, err)
+		}
+		key.MasterKeyId = current
+		if err := repo.UpdateWrappedKey(ctx, key); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// newDataKey generates a data key and stores it wrapped with the current master key
+func newDataKey(ctx context.Context, repo db.DataKeyRepository, provider KeyProvider, purpose db.DataKeyPurpose) (int, error) {
+	plaintext := make([]byte, masterKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return 0, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	keyId := provider.CurrentKeyId()
+	wrapped, err := provider.Wrap(ctx, keyId, plaintext)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return repo.InsertDataKey(ctx, db.DataKey{Purpose: purpose, MasterKeyId: keyId, WrappedKey: wrapped})
+}
@@ -0,0 +1,143 @@
+package pii_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+	"github.com/tomashoffer/event-stitching/internal/pii"
+)
+
+var _ = Describe("Protector", func() {
+	var (
+		ctx       context.Context
+		keyRepo   *mocks.MockDataKeyRepository
+		keyfile   *pii.Keyfile
+		policy    pii.Policy
+		protector *pii.Protector
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		keyRepo = mocks.NewMockDataKeyRepository()
+		keyfile = &pii.Keyfile{}
+		Expect(keyfile.AddKey("first")).To(Succeed())
+		policy = pii.Policy{"phone": pii.ProtectEncrypt, "message_id": pii.ProtectHash}
+
+		var err error
+		protector, err = pii.LoadProtector(ctx, keyRepo, keyfile, policy)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should create the data keys wrapped with the master key", func() {
+		Expect(keyRepo.Keys).To(HaveLen(2))
+		Expect(keyRepo.Keys[0].Purpose).To(Equal(db.KeyPurposeIndex))
+		Expect(keyRepo.Keys[1].Purpose).To(Equal(db.KeyPurposeEncryption))
+		Expect(keyRepo.Keys[1].MasterKeyId).To(Equal("first"))
+
+		// Loading again reuses the stored keys
+		again, err := pii.LoadProtector(ctx, keyRepo, keyfile, policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyRepo.Keys).To(HaveLen(2))
+		encrypted, err := protector.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.Reveal("phone", encrypted)).To(Equal("+15550100"))
+	})
+
+	It("should encrypt recoverable identifiers deterministically", func() {
+		encrypted, err := protector.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encrypted).NotTo(ContainSubstring("15550100"))
+		Expect(protector.Protect("phone", "+15550100")).To(Equal(encrypted))
+		// Protecting a stored value again leaves it as it is
+		Expect(protector.Protect("phone", encrypted)).To(Equal(encrypted))
+		Expect(protector.Reveal("phone", encrypted)).To(Equal("+15550100"))
+
+		// The ciphertext is bound to the identifier type
+		_, err = protector.Reveal("cookie", encrypted)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should hash matching-only identifiers", func() {
+		hashed, err := protector.Protect("message_id", "message-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hashed).To(HavePrefix("pii:h:"))
+		Expect(protector.Protect("message_id", hashed)).To(Equal(hashed))
+		Expect(protector.Reveal("message_id", hashed)).To(Equal(hashed))
+		Expect(protector.Candidates("message_id", "message-1")).To(ContainElement(hashed))
+		Expect(protector.Candidates("message_id", hashed)).To(Equal([]string{hashed}))
+	})
+
+	It("should keep unlisted identifiers and empty values in plain", func() {
+		Expect(protector.Protect("cookie", "cookie-1")).To(Equal("cookie-1"))
+		Expect(protector.Protect("phone", "")).To(Equal(""))
+		Expect(protector.Reveal("cookie", "cookie-1")).To(Equal("cookie-1"))
+	})
+
+	It("should still match and reveal values after rotating the encryption key", func() {
+		before, err := protector.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = pii.RotateEncryptionKey(ctx, keyRepo, keyfile)
+		Expect(err).NotTo(HaveOccurred())
+		rotated, err := pii.LoadProtector(ctx, keyRepo, keyfile, policy)
+		Expect(err).NotTo(HaveOccurred())
+
+		after, err := rotated.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).NotTo(Equal(before))
+		Expect(rotated.Reveal("phone", before)).To(Equal("+15550100"))
+		// Reprotecting a value stored with the old key moves it to the new one
+		Expect(rotated.Protect("phone", before)).To(Equal(after))
+
+		candidates, err := rotated.Candidates("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(candidates).To(ContainElements("+15550100", before, after))
+	})
+
+	It("should rewrap data keys with a new master key", func() {
+		encrypted, err := protector.Protect("phone", "+15550100")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(keyfile.AddKey("second")).To(Succeed())
+		rewrapped, err := pii.RewrapDataKeys(ctx, keyRepo, keyfile)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rewrapped).To(Equal(2))
+
+		// The first master key can be retired
+		delete(keyfile.Keys, "first")
+		reloaded, err := pii.LoadProtector(ctx, keyRepo, keyfile, policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reloaded.Reveal("phone", encrypted)).To(Equal("+15550100"))
+	})
+
+	It("should reject unknown identifiers in the policy", func() {
+		_, err := pii.LoadProtector(ctx, keyRepo, keyfile, pii.Policy{"email": pii.ProtectHash})
+		Expect(err).To(MatchError(ContainSubstring("unknown identifier")))
+	})
+})
+
+var _ = Describe("Keyfile", func() {
+	It("should save and load the master keys", func(ctx SpecContext) {
+		path := filepath.Join(GinkgoT().TempDir(), "keys.json")
+		keyfile := &pii.Keyfile{}
+		Expect(keyfile.AddKey("first")).To(Succeed())
+		Expect(keyfile.AddKey("first")).To(MatchError(ContainSubstring("already exists")))
+		Expect(keyfile.Save(path)).To(Succeed())
+
+		loaded, err := pii.LoadKeyfile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded.CurrentKeyId()).To(Equal("first"))
+
+		wrapped, err := keyfile.Wrap(ctx, "first", []byte("data key"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bytes.Contains(wrapped, []byte("data key"))).To(BeFalse())
+		Expect(loaded.Unwrap(ctx, "first", wrapped)).To(Equal([]byte("data key")))
+		_, err = loaded.Unwrap(ctx, "second", wrapped)
+		Expect(err).To(MatchError(ContainSubstring("unknown master key")))
+	})
+})
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"math"
+	"time"
+)
+
+// tokenBucket allows rate requests per second on average, in bursts of up to burst requests.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, a burst below one is the rate rounded up
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	size := float64(burst)
+	if burst < 1 {
+		size = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: size, tokens: size, last: now}
+}
+
+// allow takes a token, false when the bucket is empty
+func (b *tokenBucket) allow(now time.Time) bool {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket refilled completely, so dropping it changes nothing
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
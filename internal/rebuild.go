@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// RebuildStats summarizes the outcome of a full profile rebuild
+type RebuildStats struct {
+	Events          int
+	Profiles        int
+	ProcessedEvents int
+	Duration        time.Duration
+}
+
+var ErrPartialRebuild = errors.New("rebuild replaces all profiles and its time range must cover every stored event")
+
+var ErrArchivedEvents = errors.New("rebuild replaces all profiles and would drop the history of archived events, restore them first")
+
+var ErrRebuildWorkspace = errors.New("rebuild replaces the profiles of every workspace and must be run for all of them")
+
+var ErrDetachedPartitions = errors.New("rebuild replaces all profiles and would drop the history of detached partitions, attach them again first")
+
+// RebuildService recomputes all profiles from scratch by finding connected components of identifiers in memory,
+// instead of stitching events one by one through SQL.
+type RebuildService struct {
+	stitchRules
+	profileRepo db.ProfileRepository
+	eventRepo   db.EventRepository
+	log         *slog.Logger
+}
+
+func NewRebuildService(profileRepo db.ProfileRepository, eventRepo db.EventRepository) *RebuildService {
+	return &RebuildService{
+		profileRepo: profileRepo,
+		eventRepo:   eventRepo,
+		log:         slog.Default(),
+	}
+}
+
+// Rebuild replaces all profiles with the ones computed from events within the given time range and marks
+// the events it read as processed, events stored meanwhile are left to the stitching workers. Everything happens
+// in a single transaction, so readers either see the old or the rebuilt profiles. Profile ids are reassigned
+// during the rebuild. As every profile is replaced, the range must cover every stored event, otherwise
+// ErrPartialRebuild is returned and nothing changes, as it is with ErrArchivedEvents and ErrDetachedPartitions while
+// archived events are not restored or detached partitions not attached again. The profiles of every workspace are
+// replaced, so the context must be marked by db.AllWorkspaces, otherwise ErrRebuildWorkspace is returned.
+func (s *RebuildService) Rebuild(ctx context.Context, start, end time.Time) (RebuildStats, error) {
+	fail := func(err error) (RebuildStats, error) {
+		return RebuildStats{}, fmt.Errorf("rebuild: %w", err)
+	}
+	startTime := time.Now()
+	if !db.CoversAllWorkspaces(ctx) {
+		return fail(ErrRebuildWorkspace)
+	}
+
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback(ctx)
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	// Profiles are merged with the survivorship rules of the repository, like stitching merges them
+	builder := newProfileBuilder(&s.stitchRules, s.profileRepo.SurvivorshipRules)
+	profiles, stats, err := rebuildProfiles(txCtx, s.eventRepo, builder, start, end)
+	if err != nil {
+		return fail(err)
+	}
+	s.log.Info("Computed profiles", "events", stats.Events, "profiles", stats.Profiles)
+
+	if _, err := s.profileRepo.ReplaceAllProfiles(txCtx, profiles); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+
+	stats.Duration = time.Since(startTime)
+	return stats, nil
+}
+
+// rebuildProfiles computes the profiles of every stored event within the transaction of the context, along with
+// their segments, and marks the events it read as processed. The range must cover every stored event, as the
+// profiles replace all others, otherwise ErrPartialRebuild is returned. Events archived and not restored since are
+// missing from the events table, their history would be dropped as well, so ErrArchivedEvents is returned instead,
+// and ErrDetachedPartitions for the events of partitions detached from it.
+func rebuildProfiles(ctx context.Context, eventRepo db.EventRepository, builder *profileBuilder, start, end time.Time) ([]db.ProfileSnapshot, RebuildStats, error) {
+	outside, err := eventRepo.HasEventsOutsideTimeRange(ctx, start, end)
+	if err != nil {
+		return nil, RebuildStats{}, err
+	}
+	if outside {
+		return nil, RebuildStats{}, ErrPartialRebuild
+	}
+	archived, err := eventRepo.HasArchivedEvents(ctx)
+	if err != nil {
+		return nil, RebuildStats{}, err
+	}
+	if archived {
+		return nil, RebuildStats{}, ErrArchivedEvents
+	}
+	detached, err := eventRepo.HasDetachedPartitions(ctx)
+	if err != nil {
+		return nil, RebuildStats{}, err
+	}
+	if detached {
+		return nil, RebuildStats{}, ErrDetachedPartitions
+	}
+
+	var stats RebuildStats
+	batch := make([]db.EventRecord, 0, db.DefaultPageSize)
+	flush := func() error {
+		n, err := eventRepo.MarkEventsAsProcessed(ctx, batch)
+		stats.ProcessedEvents += n
+		batch = batch[:0]
+		return err
+	}
+	for event, err := range eventRepo.IterEventsByTimeRange(ctx, start, end, db.DefaultPageSize) {
+		if err != nil {
+			return nil, RebuildStats{}, err
+		}
+		if err := builder.Add(ctx, event); err != nil {
+			return nil, RebuildStats{}, err
+		}
+		stats.Events++
+		batch = append(batch, event)
+		if len(batch) == db.DefaultPageSize {
+			if err := flush(); err != nil {
+				return nil, RebuildStats{}, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, RebuildStats{}, err
+	}
+
+	profiles := builder.Profiles()
+	builder.assignSegments(profiles, time.Now().UTC())
+	stats.Profiles = len(profiles)
+	return profiles, stats, nil
+}
+
+// BuildProfiles groups events into profiles, one per connected component of identifiers shared between events,
+// using the default survivorship rules. Profiles are ordered by their earliest event. Like incremental stitching,
+// an event joining a single profile enriches it with its identifiers, and an event connecting several profiles
+// merges them according to the survivorship rules. Traits keep their most recent values, stats cover all events
+// of the component, as do the observations of its identifiers. Identifiers the consents of their event deny
+// stitching are left out, as are erased ones during rebuilds and replays. Events of different workspaces never share a profile.
+func BuildProfiles(events []db.EventRecord) []db.ProfileSnapshot {
+	builder := newProfileBuilder(&stitchRules{}, func(string) db.SurvivorshipRules { return db.DefaultSurvivorshipRules() })
+	for _, event := range events {
+		// Without erasures adding an event cannot fail
+		_ = builder.Add(context.Background(), event)
+	}
+	return builder.Profiles()
+}
+
+// profileBuilder computes the profiles of BuildProfiles in a single pass, so events can be streamed through it.
+// It holds the identifiers and profiles in memory but not the events.
+type profileBuilder struct {
+	uf         *unionFind
+	components map[string]*component
+	// rules decide the identifiers stitched and the segments of the profiles like they do for stitching
+	rules *stitchRules
+	// survivorship returns the rules merging the profiles of a workspace
+	survivorship func(workspace string) db.SurvivorshipRules
+	// created counts the components created, standing in for the ids incremental stitching assigns to profiles
+	created int
+}
+
+// component is the profile being built for a set of connected identifiers
+type component struct {
+	// id orders components by creation, the oldest survives merges under SurvivorOldest
+	id        int
+	profile   db.Profile
+	stats     db.ProfileStats
+	consents  db.Consents
+	firstSeen time.Time
+	// keyIds are the profile keys sealing events of the component
+	keyIds       []string
+	observations map[db.Identifier]db.IdentifierObservation
+}
+
+func newProfileBuilder(rules *stitchRules, survivorship func(workspace string) db.SurvivorshipRules) *profileBuilder {
+	return &profileBuilder{
+		uf:           newUnionFind(),
+		components:   make(map[string]*component),
+		rules:        rules,
+		survivorship: survivorship,
+	}
+}
+
+// Add accounts for the event in the profile of its identifiers, merging the profiles the event connects. Erased
+// identifiers are looked up within the workspace of the event.
+func (b *profileBuilder) Add(ctx context.Context, event db.EventRecord) error {
+	identifiers, err := b.rules.stitchedIdentifiers(ctx, event)
+	if err != nil {
+		return err
+	}
+	event.EventIdentifier = identifiers
+	consents := db.EventConsents(event)
+	keys := identifierKeys(event.Workspace, event.EventIdentifier)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var found []*component
+	for _, key := range keys {
+		if previous, ok := b.components[b.uf.Find(key)]; ok {
+			delete(b.components, b.uf.Find(key))
+			found = append(found, previous)
+		}
+		b.uf.Union(keys[0], key)
+	}
+
+	var c *component
+	switch len(found) {
+	case 0:
+		c = &component{id: b.created, firstSeen: event.EventTimestamp}
+		b.created++
+		c.profile.Workspace = event.Workspace
+		c.enrich(event.EventIdentifier)
+	case 1:
+		c = found[0]
+		c.enrich(event.EventIdentifier)
+	default:
+		// Like MergeProfiles the merged profile keeps the identifiers resolved by the rules
+		c = b.merge(found)
+	}
+	b.components[b.uf.Find(keys[0])] = c
+
+	if event.EventTimestamp.Before(c.firstSeen) {
+		c.firstSeen = event.EventTimestamp
+	}
+	c.profile.Traits = c.profile.Traits.Apply(event.Traits)
+	c.stats = c.stats.Add(event)
+	c.consents = c.consents.Apply(consents)
+	c.addKeyIds(event.ProfileKeyId)
+	for _, identifier := range event.Identifiers() {
+		c.observe(db.IdentifierObservation{
+			IdentifierType: identifier.Type,
+			Value:          identifier.Value,
+			Source:         event.Source,
+			FirstSeen:      event.EventTimestamp,
+			LastSeen:       event.EventTimestamp,
+			SeenCount:      1,
+		})
+	}
+	return nil
+}
+
+// enrich sets the non-empty identifiers on the profile like EnrichProfileByIdentifiers does
+func (c *component) enrich(identifiers db.EventIdentifier) {
+	if identifiers.Cookie != "" {
+		c.profile.Cookie = identifiers.Cookie
+	}
+	if identifiers.MessageId != "" {
+		c.profile.MessageId = identifiers.MessageId
+	}
+	if identifiers.Phone != "" {
+		c.profile.Phone = identifiers.Phone
+	}
+}
+
+// merge combines the components into the one surviving according to the survivorship rules of their workspace,
+// which resolve the identifiers and traits of the merged profile
+func (b *profileBuilder) merge(components []*component) *component {
+	workspace := components[0].profile.Workspace
+	candidates := make([]db.MergeCandidate, len(components))
+	for i, c := range components {
+		profile := c.profile
+		profile.Id = c.id
+		candidates[i] = db.MergeCandidate{Profile: profile, Observations: c.sortedObservations(), Events: c.stats.TotalEvents}
+	}
+	merged := b.survivorship(workspace).Merge(candidates)
+
+	survivor := components[slices.IndexFunc(components, func(c *component) bool { return c.id == merged.Id })]
+	for _, other := range components {
+		if other != survivor {
+			survivor.combine(other)
+		}
+	}
+	merged.Id = 0
+	merged.Workspace = workspace
+	survivor.profile = merged
+	return survivor
+}
+
+// observe accounts for sightings of an identifier value like RecordObservations does, the source of the latest
+// sighting is kept
+func (c *component) observe(o db.IdentifierObservation) {
+	if c.observations == nil {
+		c.observations = make(map[db.Identifier]db.IdentifierObservation)
+	}
+	key := db.Identifier{Type: o.IdentifierType, Value: o.Value}
+	current, ok := c.observations[key]
+	if !ok {
+		c.observations[key] = o
+		return
+	}
+	if !o.LastSeen.Before(current.LastSeen) {
+		current.Source = o.Source
+		current.LastSeen = o.LastSeen
+	}
+	if o.FirstSeen.Before(current.FirstSeen) {
+		current.FirstSeen = o.FirstSeen
+	}
+	current.SeenCount += o.SeenCount
+	c.observations[key] = current
+}
+
+// addKeyIds adds the non-empty keys the component does not hold yet
+func (c *component) addKeyIds(keyIds ...string) {
+	for _, keyId := range keyIds {
+		if keyId != "" && !slices.Contains(c.keyIds, keyId) {
+			c.keyIds = append(c.keyIds, keyId)
+		}
+	}
+}
+
+// combine folds everything but the profile of the other component into c, the profile is resolved by merge
+func (c *component) combine(other *component) {
+	if other.firstSeen.Before(c.firstSeen) {
+		c.firstSeen = other.firstSeen
+	}
+	c.stats = c.stats.Combine(other.stats)
+	c.consents = db.MergeConsents(c.consents, other.consents)
+	c.addKeyIds(other.keyIds...)
+	for _, o := range other.observations {
+		c.observe(o)
+	}
+}
+
+// Profiles returns the profiles of all components ordered by their earliest event. A profile key whose events ended
+// up in several profiles, e.g. after an identifier connecting them was erased, is held by the earliest of them.
+func (b *profileBuilder) Profiles() []db.ProfileSnapshot {
+	ordered := make([]*component, 0, len(b.components))
+	for _, c := range b.components {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if !ordered[i].firstSeen.Equal(ordered[j].firstSeen) {
+			return ordered[i].firstSeen.Before(ordered[j].firstSeen)
+		}
+		return ordered[i].profile.Workspace+ordered[i].profile.Cookie+ordered[i].profile.MessageId+ordered[i].profile.Phone <
+			ordered[j].profile.Workspace+ordered[j].profile.Cookie+ordered[j].profile.MessageId+ordered[j].profile.Phone
+	})
+
+	held := make(map[string]bool)
+	profiles := make([]db.ProfileSnapshot, len(ordered))
+	for i, c := range ordered {
+		var keyIds []string
+		for _, keyId := range c.keyIds {
+			if !held[keyId] {
+				held[keyId] = true
+				keyIds = append(keyIds, keyId)
+			}
+		}
+		profiles[i] = db.ProfileSnapshot{Profile: c.profile, Stats: c.stats, Consents: c.consents, KeyIds: keyIds,
+			Observations: c.sortedObservations()}
+	}
+	return profiles
+}
+
+// sortedObservations returns the observations ordered by identifier type and value
+func (c *component) sortedObservations() []db.IdentifierObservation {
+	if len(c.observations) == 0 {
+		return nil
+	}
+	observations := make([]db.IdentifierObservation, 0, len(c.observations))
+	for _, o := range c.observations {
+		observations = append(observations, o)
+	}
+	sort.Slice(observations, func(i, j int) bool {
+		if observations[i].IdentifierType != observations[j].IdentifierType {
+			return observations[i].IdentifierType < observations[j].IdentifierType
+		}
+		return observations[i].Value < observations[j].Value
+	})
+	return observations
+}
+
+// assignSegments sets the segments every profile matches at the time like the stitching service does
+func (b *profileBuilder) assignSegments(profiles []db.ProfileSnapshot, now time.Time) {
+	if len(b.rules.segments) == 0 {
+		return
+	}
+	for i, snapshot := range profiles {
+		profiles[i].Segments = b.rules.memberships(snapshot.Profile, snapshot.Stats, snapshot.Consents, now)
+	}
+}
+
+// identifierKeys returns the union-find keys of all non-empty identifiers, namespaced by workspace and identifier name
+func identifierKeys(workspace string, identifiers db.EventIdentifier) []string {
+	prefix := ""
+	if workspace != db.DefaultWorkspace {
+		prefix = workspace + "/"
+	}
+	keys := make([]string, 0, 3)
+	for _, name := range identifiers.GetIdentifierNames() {
+		value, _ := identifiers.GetIdentifierValueByName(name)
+		if value == "" {
+			continue
+		}
+		keys = append(keys, prefix+name+":"+value)
+	}
+	return keys
+}
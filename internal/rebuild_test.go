@@ -0,0 +1,323 @@
+package internal
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Union Find", func() {
+	It("should join transitively connected keys", func() {
+		uf := newUnionFind()
+		uf.Union("a", "b")
+		uf.Union("c", "d")
+		uf.Union("b", "c")
+		uf.Add("e")
+
+		Expect(uf.Find("a")).To(Equal(uf.Find("d")))
+		Expect(uf.Find("e")).NotTo(Equal(uf.Find("a")))
+		Expect(uf.Len()).To(Equal(2))
+	})
+})
+
+var _ = Describe("Rebuild Service", func() {
+	var (
+		ctx         context.Context
+		profileRepo *mocks.MockProfileRepository
+		eventRepo   *mocks.MockEventRepository
+		rebuildSvc  *RebuildService
+		baseTime    time.Time
+	)
+
+	event := func(offset int, cookie, messageId, phone string) db.EventRecord {
+		return db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: cookie, MessageId: messageId, Phone: phone},
+			EventTimestamp:  baseTime.Add(time.Duration(offset) * time.Second),
+		}
+	}
+	at := func(offset int) time.Time {
+		return baseTime.Add(time.Duration(offset) * time.Second)
+	}
+
+	BeforeEach(func() {
+		ctx = db.AllWorkspaces(context.Background())
+		profileRepo = mocks.NewMockProfileRepository()
+		eventRepo = mocks.NewMockEventRepository()
+		rebuildSvc = NewRebuildService(profileRepo, eventRepo)
+		baseTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	})
+
+	It("should build one profile per connected component of identifiers", func() {
+		events := []db.EventRecord{
+			event(0, "cookie-a", "", ""),
+			event(1, "cookie-b", "", "111"),
+			event(2, "cookie-a", "message-a", ""),
+			event(3, "", "message-a", "111"),
+			event(4, "cookie-c", "", ""),
+			event(5, "", "", ""),
+		}
+
+		events[2].Source = "crm"
+
+		profiles := BuildProfiles(events)
+		Expect(profiles).To(Equal([]db.ProfileSnapshot{
+			{
+				Profile: db.Profile{Cookie: "cookie-a", MessageId: "message-a", Phone: "111"},
+				Stats:   db.ProfileStats{FirstSeen: baseTime, LastSeen: baseTime.Add(3 * time.Second), TotalEvents: 4},
+				Observations: []db.IdentifierObservation{
+					{IdentifierType: "cookie", Value: "cookie-a", Source: "crm", FirstSeen: at(0), LastSeen: at(2), SeenCount: 2},
+					{IdentifierType: "cookie", Value: "cookie-b", FirstSeen: at(1), LastSeen: at(1), SeenCount: 1},
+					{IdentifierType: "message_id", Value: "message-a", FirstSeen: at(2), LastSeen: at(3), SeenCount: 2},
+					{IdentifierType: "phone", Value: "111", FirstSeen: at(1), LastSeen: at(3), SeenCount: 2},
+				},
+			},
+			{
+				Profile: db.Profile{Cookie: "cookie-c"},
+				Stats:   db.ProfileStats{FirstSeen: baseTime.Add(4 * time.Second), LastSeen: baseTime.Add(4 * time.Second), TotalEvents: 1},
+				Observations: []db.IdentifierObservation{
+					{IdentifierType: "cookie", Value: "cookie-c", FirstSeen: at(4), LastSeen: at(4), SeenCount: 1},
+				},
+			},
+		}))
+	})
+
+	It("should enrich profiles with the identifiers of later events and merge them by the survivorship rules", func() {
+		rules := db.DefaultSurvivorshipRules()
+		rules.Fields["cookie"] = db.PolicyMostRecent
+		brandRules := db.DefaultSurvivorshipRules()
+		workspaces := db.Workspaces{"brand-a": {Survivorship: &brandRules}}
+
+		events := []db.EventRecord{
+			event(0, "cookie-a", "", "111"),
+			event(1, "cookie-b", "message-b", ""),
+			event(2, "cookie-b", "", ""),
+			event(3, "", "message-b", "111"),
+			event(4, "cookie-c", "", ""),
+		}
+		for _, e := range events {
+			e.Workspace = "brand-a"
+			e.EventTimestamp = e.EventTimestamp.Add(time.Minute)
+			events = append(events, e)
+		}
+
+		builder := newProfileBuilder(&stitchRules{workspaces: workspaces}, func(workspace string) db.SurvivorshipRules {
+			return workspaces.SurvivorshipRules(workspace, rules)
+		})
+		for _, e := range events {
+			Expect(builder.Add(ctx, e)).To(Succeed())
+		}
+		profiles := builder.Profiles()
+		Expect(profiles).To(HaveLen(4))
+		// The default workspace keeps the most recent cookie
+		Expect(profiles[0].Profile).To(Equal(db.Profile{Cookie: "cookie-b", MessageId: "message-b", Phone: "111"}))
+		Expect(profiles[0].Stats.TotalEvents).To(Equal(4))
+		Expect(profiles[1].Profile).To(Equal(db.Profile{Cookie: "cookie-c"}))
+		// The workspace rules keep the lowest cookie
+		Expect(profiles[2].Profile).To(Equal(db.Profile{Cookie: "cookie-a", MessageId: "message-b", Phone: "111", Workspace: "brand-a"}))
+		Expect(profiles[3].Profile).To(Equal(db.Profile{Cookie: "cookie-c", Workspace: "brand-a"}))
+	})
+
+	It("should sum purchases and revenue per profile", func() {
+		purchase := event(1, "cookie-a", "", "")
+		purchase.EventId = db.EventIdPurchase
+		purchase.Revenue = 12.5
+
+		profiles := BuildProfiles([]db.EventRecord{event(0, "cookie-a", "", ""), purchase})
+		Expect(profiles).To(HaveLen(1))
+		Expect(profiles[0].Stats.PurchaseCount).To(Equal(1))
+		Expect(profiles[0].Stats.Revenue).To(Equal(12.5))
+	})
+
+	It("should leave out identifiers without stitching consent and record the consents of events", func() {
+		denied := event(1, "cookie-a", "", "111")
+		denied.Consents = db.Consents{
+			{Purpose: db.PurposeStitching, IdentifierType: "phone", Status: db.ConsentDenied},
+			{Purpose: db.PurposeExport, Status: db.ConsentDenied},
+		}
+		granted := event(2, "cookie-b", "", "111")
+		granted.Consents = db.Consents{{Purpose: db.PurposeExport, Status: db.ConsentGranted}}
+
+		profiles := BuildProfiles([]db.EventRecord{event(0, "cookie-a", "", ""), denied, granted})
+		Expect(profiles).To(HaveLen(2))
+		Expect(profiles[0].Profile).To(Equal(db.Profile{Cookie: "cookie-a"}))
+		Expect(profiles[0].Consents).To(Equal(db.Consents{
+			{Purpose: db.PurposeExport, Status: db.ConsentDenied, UpdatedAt: baseTime.Add(time.Second)},
+			{Purpose: db.PurposeStitching, IdentifierType: "phone", Status: db.ConsentDenied, UpdatedAt: baseTime.Add(time.Second)},
+		}))
+		Expect(profiles[1].Profile).To(Equal(db.Profile{Cookie: "cookie-b", Phone: "111"}))
+	})
+
+	It("should keep events of different workspaces in separate profiles", func() {
+		brandA := event(0, "cookie-a", "", "111")
+		brandA.Workspace = "brand-a"
+		brandB := event(1, "cookie-b", "", "111")
+		brandB.Workspace = "brand-b"
+
+		profiles := BuildProfiles([]db.EventRecord{brandA, brandB, event(2, "cookie-c", "", "111")})
+		Expect(profiles).To(HaveLen(3))
+		Expect(profiles[0].Profile).To(Equal(db.Profile{Cookie: "cookie-a", Phone: "111", Workspace: "brand-a"}))
+		Expect(profiles[1].Profile).To(Equal(db.Profile{Cookie: "cookie-b", Phone: "111", Workspace: "brand-b"}))
+		Expect(profiles[2].Profile).To(Equal(db.Profile{Cookie: "cookie-c", Phone: "111"}))
+	})
+
+	It("should replace stored profiles along with their segments and mark events in range as processed", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			event(0, "cookie-a", "", "111"),
+			event(1, "cookie-b", "", "111"),
+			event(2, "cookie-c", "", ""),
+		}
+		rebuildSvc.SetSegments([]db.Segment{{Name: "with_phone", All: []db.SegmentCondition{{Field: "phone", Op: db.OpExists}}}})
+
+		stats, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Events).To(Equal(3))
+		Expect(stats.Profiles).To(Equal(2))
+		Expect(stats.ProcessedEvents).To(Equal(3))
+
+		profiles, err := profileRepo.GetAllProfiles(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(ConsistOf(
+			And(HaveField("Cookie", "cookie-b"), HaveField("Phone", "111")),
+			And(HaveField("Cookie", "cookie-c"), HaveField("Phone", "")),
+		))
+		Expect(profileRepo.Segments).To(HaveLen(1))
+		for id, segments := range profileRepo.Segments {
+			Expect(profileRepo.Profiles[id].Phone).To(Equal("111"))
+			Expect(segments).To(Equal([]string{"with_phone"}))
+		}
+		Expect(eventRepo.UnprocessedEvents).To(BeEmpty())
+	})
+
+	It("should merge profiles with the survivorship rules of the profile repository", func() {
+		rules := db.DefaultSurvivorshipRules()
+		rules.Fields["cookie"] = db.PolicyMostRecent
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			event(0, "cookie-a", "", "111"),
+			event(1, "cookie-b", "message-b", ""),
+			event(2, "", "message-b", "111"),
+		}
+		rebuildSvc = NewRebuildService(&survivorshipProfileRepository{MockProfileRepository: profileRepo, rules: rules}, eventRepo)
+
+		_, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profileRepo.Profiles).To(ConsistOf(HaveField("Cookie", "cookie-b")))
+	})
+
+	It("should leave events stored while reading unprocessed", func() {
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(0, "cookie-a", "", "111")}
+		late := event(30, "cookie-late", "", "")
+		rebuildSvc = NewRebuildService(profileRepo, &lateEventRepository{MockEventRepository: eventRepo, late: late})
+
+		stats, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Events).To(Equal(1))
+		Expect(stats.ProcessedEvents).To(Equal(1))
+		Expect(eventRepo.UnprocessedEvents).To(ConsistOf(late))
+	})
+
+	It("should refuse a range leaving out stored events without replacing profiles", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			event(0, "cookie-a", "", "111"),
+			event(100, "cookie-out-of-range", "", ""),
+		}
+
+		_, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).To(MatchError(ErrPartialRebuild))
+		Expect(profileRepo.Profiles).To(ConsistOf(db.Profile{Cookie: "stale-cookie"}))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(2))
+	})
+
+	It("should refuse to rebuild within a single workspace, as the profiles of every workspace are replaced", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie", Workspace: "brand-b"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(0, "cookie-a", "", "111")}
+
+		_, err := rebuildSvc.Rebuild(db.WithWorkspace(context.Background(), "brand-a"), baseTime, baseTime.Add(time.Minute))
+		Expect(err).To(MatchError(ErrRebuildWorkspace))
+		Expect(profileRepo.Profiles).To(ConsistOf(db.Profile{Cookie: "stale-cookie", Workspace: "brand-b"}))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(1))
+	})
+
+	It("should refuse to drop the history of archived events without replacing profiles", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(0, "cookie-a", "", "111")}
+		eventRepo.ArchivedEvents = 1
+
+		_, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).To(MatchError(ErrArchivedEvents))
+		Expect(profileRepo.Profiles).To(ConsistOf(db.Profile{Cookie: "stale-cookie"}))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(1))
+	})
+
+	It("should refuse to drop the history of detached partitions", func() {
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(0, "cookie-a", "", "111")}
+		eventRepo.DetachedPartitions = 1
+
+		_, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).To(MatchError(ErrDetachedPartitions))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(1))
+	})
+
+	It("should leave erased identifiers out of rebuilt profiles, so they cannot be looked up again", func() {
+		dsarRepo := mocks.NewMockDSARRepository()
+		eventRepo.ProcessedEvents = []db.EventRecord{event(0, "cookie-a", "", "111")}
+		profileRepo.Profiles[0] = db.Profile{Cookie: "cookie-a", Phone: "111"}
+		_, err := NewDSARService(profileRepo, eventRepo, dsarRepo).Erase(ctx,
+			DataSubject{Identifier: db.Identifier{Type: "phone", Value: "111"}}, db.ErasureDelete, "legal", nil)
+		Expect(err).NotTo(HaveOccurred())
+		// Events carrying the erased phone keep arriving after the erasure
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(1, "cookie-b", "", "111"), event(2, "cookie-c", "", "111")}
+
+		rebuildSvc.SetErasures(dsarRepo)
+		stats, err := rebuildSvc.Rebuild(ctx, baseTime, baseTime.Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.Profiles).To(Equal(2))
+
+		lookupSvc := NewProfileLookupService(profileRepo)
+		_, err = lookupSvc.GetByIdentifier(ctx, "phone", "111")
+		Expect(err).To(MatchError(ErrProfileNotFound))
+		details, err := lookupSvc.GetByIdentifier(ctx, "cookie", "cookie-b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(details.Profile.Phone).To(BeEmpty())
+	})
+
+	It("should give up without replacing profiles when cancelled while reading events", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{event(0, "cookie-a", "", "")}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := rebuildSvc.Rebuild(cancelled, baseTime, baseTime.Add(time.Minute))
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(profileRepo.Profiles).To(ConsistOf(db.Profile{Cookie: "stale-cookie"}))
+	})
+})
+
+// survivorshipProfileRepository merges profiles with rules of its own, like a repository configured with them
+type survivorshipProfileRepository struct {
+	*mocks.MockProfileRepository
+	rules db.SurvivorshipRules
+}
+
+func (r *survivorshipProfileRepository) SurvivorshipRules(workspace string) db.SurvivorshipRules {
+	return r.rules
+}
+
+// lateEventRepository stores an event in range once the rebuild has read its events, as an import committing
+// meanwhile would
+type lateEventRepository struct {
+	*mocks.MockEventRepository
+	late db.EventRecord
+}
+
+func (r *lateEventRepository) IterEventsByTimeRange(ctx context.Context, start, end time.Time, pageSize int) iter.Seq2[db.EventRecord, error] {
+	events := r.MockEventRepository.IterEventsByTimeRange(ctx, start, end, pageSize)
+	r.UnprocessedEvents = append(r.UnprocessedEvents, r.late)
+	return events
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// OutboxSink delivers outbox events to a downstream consumer. Deliver must only return nil once every event
+// of the batch was accepted, events of a failed batch are delivered again.
+type OutboxSink interface {
+	Deliver(ctx context.Context, events []db.OutboxEvent) error
+}
+
+// OutboxRelay moves outbox events to a sink with at-least-once semantics. Its position is stored under the consumer
+// name after every delivered batch, so a restarted relay resumes where it stopped. Events of other workspaces than
+// the one set and of profiles without consent are skipped, and the cursor moves past them.
+type OutboxRelay struct {
+	outboxRepo   db.OutboxRepository
+	sink         OutboxSink
+	consumer     string
+	interval     time.Duration
+	batchSize    int
+	workspace    *string
+	profileRepo  db.ProfileRepository
+	consentRules db.ConsentRules
+	log          *slog.Logger
+}
+
+func NewOutboxRelay(outboxRepo db.OutboxRepository, sink OutboxSink, consumer string, interval time.Duration, batchSize int) *OutboxRelay {
+	return &OutboxRelay{
+		outboxRepo: outboxRepo,
+		sink:       sink,
+		consumer:   consumer,
+		interval:   interval,
+		batchSize:  batchSize,
+		log:        slog.Default(),
+	}
+}
+
+// SetWorkspace limits the events delivered to the ones of the workspace, events of every workspace are delivered
+// otherwise
+func (r *OutboxRelay) SetWorkspace(workspace string) {
+	r.workspace = &workspace
+}
+
+// SetConsents enables skipping events of profiles the consents read from profileRepo do not allow sending out, see
+// ConsentedOutboxEvents
+func (r *OutboxRelay) SetConsents(profileRepo db.ProfileRepository, rules db.ConsentRules) {
+	r.profileRepo, r.consentRules = profileRepo, rules
+}
+
+func (r *OutboxRelay) Start(ctx context.Context) {
+	go r.relayWorker(ctx)
+}
+
+// relayWorker relays events until the context is cancelled, pausing for the interval whenever the outbox
+// is drained or delivery fails
+func (r *OutboxRelay) relayWorker(ctx context.Context) {
+	for {
+		delivered, err := r.RelayOnce(ctx)
+		if err != nil {
+			r.log.Error("Failed to relay outbox events", "consumer", r.consumer, "error", err)
+		}
+		if err == nil && delivered == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// RelayOnce delivers the next batch of events following the consumer's cursor and advances the cursor. It returns
+// the number of events the cursor moved past, skipped ones included.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	fail := func(err error) (int, error) {
+		return 0, fmt.Errorf("relay: %w", err)
+	}
+
+	cursor, err := r.outboxRepo.GetOutboxCursor(ctx, r.consumer)
+	if err != nil {
+		return fail(err)
+	}
+
+	events, err := r.outboxRepo.GetOutboxAfter(ctx, cursor, r.batchSize)
+	if err != nil {
+		return fail(err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	deliverable, err := r.deliverable(ctx, events)
+	if err != nil {
+		return fail(err)
+	}
+	if len(deliverable) > 0 {
+		if err := r.sink.Deliver(ctx, deliverable); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := r.outboxRepo.SaveOutboxCursor(ctx, r.consumer, events[len(events)-1].Cursor()); err != nil {
+		return fail(err)
+	}
+	r.log.Debug("Relayed outbox events", "consumer", r.consumer, "count", len(deliverable), "skipped", len(events)-len(deliverable))
+	return len(events), nil
+}
+
+// deliverable returns the events of the relay's workspace their profiles consent to sending out
+func (r *OutboxRelay) deliverable(ctx context.Context, events []db.OutboxEvent) ([]db.OutboxEvent, error) {
+	if r.workspace != nil {
+		inWorkspace := make([]db.OutboxEvent, 0, len(events))
+		for _, event := range events {
+			if event.Workspace == *r.workspace {
+				inWorkspace = append(inWorkspace, event)
+			}
+		}
+		events = inWorkspace
+	}
+	if r.profileRepo == nil {
+		return events, nil
+	}
+	return ConsentedOutboxEvents(ctx, r.profileRepo, r.consentRules, events)
+}
+
+// ConsentedOutboxEvents returns the events whose profiles the consents read from profileRepo allow sending to
+// webhooks and relay sinks. Erasure notices are always kept, so consumers can delete what they hold.
+func ConsentedOutboxEvents(ctx context.Context, profileRepo db.ProfileRepository, rules db.ConsentRules, events []db.OutboxEvent) ([]db.OutboxEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	profileIds := make([]int, len(events))
+	for i, event := range events {
+		profileIds[i] = event.ProfileId
+	}
+	consents, err := profileRepo.GetConsents(ctx, profileIds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consents of outbox events: %w", err)
+	}
+
+	consented := make([]db.OutboxEvent, 0, len(events))
+	for _, event := range events {
+		if event.Kind == db.KindProfileErased || rules.Allows(consents[event.ProfileId], db.PurposeWebhooks, "") {
+			consented = append(consented, event)
+		}
+	}
+	return consented, nil
+}
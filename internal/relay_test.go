@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+type recordingSink struct {
+	batches [][]db.OutboxEvent
+	err     error
+}
+
+func (s *recordingSink) Deliver(ctx context.Context, events []db.OutboxEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+var _ = Describe("Outbox", func() {
+	var (
+		ctx          context.Context
+		profileRepo  *mocks.MockProfileRepository
+		eventRepo    *mocks.MockEventRepository
+		outboxRepo   *mocks.MockOutboxRepository
+		stitchingSvc *StitchingService
+	)
+
+	kinds := func(events []db.OutboxEvent) []db.OutboxKind {
+		result := make([]db.OutboxKind, len(events))
+		for i, e := range events {
+			result[i] = e.Kind
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		profileRepo = mocks.NewMockProfileRepository()
+		eventRepo = mocks.NewMockEventRepository()
+		outboxRepo = mocks.NewMockOutboxRepository()
+		stitchingSvc = NewStitchingService(profileRepo, eventRepo, time.Millisecond, 1, 10)
+		stitchingSvc.SetOutbox(outboxRepo)
+	})
+
+	It("should record profile changes made by stitching", func() {
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a"}},
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a"}},
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}},
+			{EventIdentifier: db.EventIdentifier{Phone: "222"}},
+		}
+		stitchingSvc.Stitch(ctx)
+
+		Expect(kinds(outboxRepo.Events)).To(Equal([]db.OutboxKind{
+			db.KindProfileCreated, db.KindProfileUpdated, db.KindProfileCreated,
+		}))
+
+		var change ProfileChange
+		Expect(json.Unmarshal(outboxRepo.Events[1].Payload, &change)).To(Succeed())
+		Expect(change.Profile).To(Equal(db.Profile{Id: 0, Cookie: "cookie-a", Phone: "111"}))
+	})
+
+	It("should record merges along with the absorbed profiles", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a"})
+		profileRepo.InsertProfile(ctx, db.Profile{Phone: "111"})
+		eventRepo.UnprocessedEvents = []db.EventRecord{
+			{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}},
+		}
+		stitchingSvc.Stitch(ctx)
+
+		Expect(kinds(outboxRepo.Events)).To(Equal([]db.OutboxKind{db.KindProfileMerged, db.KindProfileDeleted}))
+
+		var merged, deleted ProfileChange
+		Expect(json.Unmarshal(outboxRepo.Events[0].Payload, &merged)).To(Succeed())
+		Expect(merged.MergedIds).To(Equal([]int{1}))
+		Expect(json.Unmarshal(outboxRepo.Events[1].Payload, &deleted)).To(Succeed())
+		Expect(outboxRepo.Events[1].ProfileId).To(Equal(1))
+		Expect(deleted.SurvivorId).To(Equal(0))
+	})
+
+	It("should record segment transitions", func() {
+		stitchingSvc.SetSegments([]db.Segment{{Name: "with_phone", All: []db.SegmentCondition{{Field: "phone", Op: db.OpExists}}}})
+		eventRepo.UnprocessedEvents = []db.EventRecord{{EventIdentifier: db.EventIdentifier{Phone: "111"}}}
+		stitchingSvc.Stitch(ctx)
+
+		Expect(kinds(outboxRepo.Events)).To(Equal([]db.OutboxKind{db.KindProfileCreated, db.KindSegmentEntered}))
+		var change SegmentChange
+		Expect(json.Unmarshal(outboxRepo.Events[1].Payload, &change)).To(Succeed())
+		Expect(change.Segment).To(Equal("with_phone"))
+	})
+
+	It("should relay batches and resume from the stored cursor", func() {
+		for i := range 5 {
+			event, err := newOutboxEvent(db.KindProfileCreated, i, ProfileChange{Profile: db.Profile{Id: i}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{event})).To(Succeed())
+		}
+
+		sink := &recordingSink{}
+		relay := NewOutboxRelay(outboxRepo, sink, "crm", time.Millisecond, 3)
+
+		delivered, err := relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(Equal(3))
+		Expect(outboxRepo.Cursors["crm"]).To(Equal(db.OutboxCursor{Id: 3}))
+
+		// A relay restarted under the same consumer continues after the last delivered event
+		relay = NewOutboxRelay(outboxRepo, sink, "crm", time.Millisecond, 3)
+		delivered, err = relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(Equal(2))
+		Expect(sink.batches).To(HaveLen(2))
+		Expect(sink.batches[1][0].Id).To(Equal(int64(4)))
+
+		delivered, err = relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(BeZero())
+	})
+
+	It("should not advance the cursor when delivery fails", func() {
+		event, err := newOutboxEvent(db.KindProfileCreated, 1, ProfileChange{Profile: db.Profile{Id: 1}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{event})).To(Succeed())
+
+		sink := &recordingSink{err: errors.New("unavailable")}
+		relay := NewOutboxRelay(outboxRepo, sink, "crm", time.Millisecond, 10)
+
+		_, err = relay.RelayOnce(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(outboxRepo.Cursors).NotTo(HaveKey("crm"))
+
+		sink.err = nil
+		delivered, err := relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(Equal(1))
+	})
+
+	It("should skip events of other workspaces and of profiles without consent, moving the cursor past them", func() {
+		for i, workspace := range []string{"brand-a", "brand-b", "brand-a", "brand-a"} {
+			event, err := newOutboxEvent(db.KindProfileUpdated, i, ProfileChange{Profile: db.Profile{Id: i, Workspace: workspace}})
+			Expect(err).NotTo(HaveOccurred())
+			event.Workspace = workspace
+			if i == 3 {
+				event.Kind = db.KindProfileErased
+			}
+			Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{event})).To(Succeed())
+		}
+		profileRepo.Consents[0] = db.Consents{{Purpose: db.PurposeWebhooks, Status: db.ConsentGranted}}
+
+		sink := &recordingSink{}
+		relay := NewOutboxRelay(outboxRepo, sink, "crm", time.Millisecond, 10)
+		relay.SetWorkspace("brand-a")
+		relay.SetConsents(profileRepo, db.ConsentRules{OptIn: []string{db.PurposeWebhooks}})
+
+		delivered, err := relay.RelayOnce(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(delivered).To(Equal(4))
+		Expect(sink.batches).To(HaveLen(1))
+		// The erasure notice is delivered regardless of consent
+		Expect(sink.batches[0]).To(HaveLen(2))
+		Expect(sink.batches[0][0].ProfileId).To(Equal(0))
+		Expect(sink.batches[0][1].Kind).To(Equal(db.KindProfileErased))
+		Expect(outboxRepo.Cursors["crm"]).To(Equal(db.OutboxCursor{Id: 4}))
+	})
+})
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// ReplayRequest selects the historical events to re-stitch
+type ReplayRequest struct {
+	Start time.Time
+	End   time.Time
+	// Identifiers limits the replay to events carrying any of the non-empty identifiers
+	Identifiers db.EventIdentifier
+	// Shadow rebuilds all profiles from the selected events into the shadow table and swaps it in,
+	// instead of handing the events back to the stitching workers. The time range must cover every stored event, and
+	// archived events must be restored and detached partitions attached again first. It covers every workspace.
+	Shadow bool
+}
+
+// ReplayResult summarizes what a replay changed
+type ReplayResult struct {
+	ResetEvents int
+	Profiles    int
+	Shadow      bool
+}
+
+var ErrShadowReplayByIdentifiers = errors.New("shadow replay rebuilds all profiles and cannot be limited to identifiers")
+
+// ReplayService re-stitches historical events after a bug fix or a change of matching rules
+type ReplayService struct {
+	stitchRules
+	eventRepo   db.EventRepository
+	profileRepo db.ProfileRepository
+	shadowRepo  db.ShadowProfileRepository
+	log         *slog.Logger
+}
+
+func NewReplayService(eventRepo db.EventRepository, profileRepo db.ProfileRepository, shadowRepo db.ShadowProfileRepository) *ReplayService {
+	return &ReplayService{
+		eventRepo:   eventRepo,
+		profileRepo: profileRepo,
+		shadowRepo:  shadowRepo,
+		log:         slog.Default(),
+	}
+}
+
+// Replay either resets the processing state of the selected events, so the stitching workers pick them up again,
+// or rebuilds the profiles into the shadow table and atomically promotes it. Events handed back to the stitching
+// workers are first taken back from the stats and identifier observations of their profiles, so they are not
+// counted twice. Events of the workspace of the context are replayed, or of every workspace when it is marked by
+// db.AllWorkspaces, which shadow replays require as they replace the profiles of every workspace.
+func (s *ReplayService) Replay(ctx context.Context, req ReplayRequest) (ReplayResult, error) {
+	if req.Shadow {
+		return s.replayIntoShadow(ctx, req)
+	}
+
+	fail := func(err error) (ReplayResult, error) {
+		return ReplayResult{}, fmt.Errorf("replay: %w", err)
+	}
+
+	// Aggregates and processing state change together, so an interrupted replay leaves nothing counted twice
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback(ctx)
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	reset := 0
+	batch := make([]db.EventRecord, 0, db.DefaultPageSize)
+	flush := func() error {
+		n, err := s.eventRepo.ResetProcessedEvents(txCtx, batch)
+		reset += n
+		batch = batch[:0]
+		return err
+	}
+	for event, err := range s.eventRepo.IterProcessedEventsByTimeRange(txCtx, req.Start, req.End, db.DefaultPageSize) {
+		if err != nil {
+			return fail(err)
+		}
+		if req.Identifiers != (db.EventIdentifier{}) && !sharesIdentifier(event.EventIdentifier, req.Identifiers) {
+			continue
+		}
+		if err := s.forgetEvent(txCtx, event); err != nil {
+			return fail(err)
+		}
+		batch = append(batch, event)
+		if len(batch) == db.DefaultPageSize {
+			if err := flush(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+
+	s.log.Info("Reset processing state of events", "count", reset)
+	return ReplayResult{ResetEvents: reset}, nil
+}
+
+// forgetEvent takes the stitched event back from the profile holding the identifiers it was stitched with
+func (s *ReplayService) forgetEvent(ctx context.Context, event db.EventRecord) error {
+	ctx = db.WithWorkspace(ctx, event.Workspace)
+	identifiers, err := s.stitchedIdentifiers(ctx, event)
+	if err != nil {
+		return err
+	}
+	event.EventIdentifier = identifiers
+
+	for _, identifier := range event.Identifiers() {
+		profileIds, err := s.profileRepo.GetProfileIdsByIdentifier(ctx, identifier)
+		if err != nil {
+			return err
+		}
+		if len(profileIds) > 0 {
+			return s.profileRepo.ForgetEvent(ctx, profileIds[0], event)
+		}
+	}
+	return nil
+}
+
+// sharesIdentifier reports whether the event carries any of the non-empty identifiers
+func sharesIdentifier(event, identifiers db.EventIdentifier) bool {
+	for _, identifier := range identifiers.Identifiers() {
+		if value, _ := event.GetIdentifierValueByName(identifier.Type); value == identifier.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ReplayService) replayIntoShadow(ctx context.Context, req ReplayRequest) (ReplayResult, error) {
+	fail := func(err error) (ReplayResult, error) {
+		return ReplayResult{}, fmt.Errorf("shadow replay: %w", err)
+	}
+
+	if req.Identifiers != (db.EventIdentifier{}) {
+		return fail(ErrShadowReplayByIdentifiers)
+	}
+	if !db.CoversAllWorkspaces(ctx) {
+		return fail(ErrRebuildWorkspace)
+	}
+
+	// Rebuild and swap within one transaction, so the live table is never observed half-built
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback(ctx)
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	if err := s.shadowRepo.ResetShadow(txCtx); err != nil {
+		return fail(err)
+	}
+
+	// The promoted shadow replaces every live profile, so it is built the way rebuilds are, from every stored event
+	builder := newProfileBuilder(&s.stitchRules, s.shadowRepo.SurvivorshipRules)
+	profiles, stats, err := rebuildProfiles(txCtx, s.eventRepo, builder, req.Start, req.End)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := s.shadowRepo.ReplaceAllProfiles(txCtx, profiles); err != nil {
+		return fail(err)
+	}
+
+	if err := s.shadowRepo.PromoteShadow(txCtx); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+
+	s.log.Info("Promoted shadow profiles", "events", stats.Events, "profiles", stats.Profiles)
+	return ReplayResult{ResetEvents: stats.Events, Profiles: stats.Profiles, Shadow: true}, nil
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+var _ = Describe("Replay Service", func() {
+	var (
+		ctx         context.Context
+		profileRepo *mocks.MockProfileRepository
+		shadowRepo  *mocks.MockShadowProfileRepository
+		eventRepo   *mocks.MockEventRepository
+		replaySvc   *ReplayService
+		baseTime    time.Time
+	)
+
+	event := func(offset int, cookie, phone string) db.EventRecord {
+		return db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: cookie, Phone: phone},
+			EventTimestamp:  baseTime.Add(time.Duration(offset) * time.Second),
+		}
+	}
+
+	BeforeEach(func() {
+		ctx = db.AllWorkspaces(context.Background())
+		profileRepo = mocks.NewMockProfileRepository()
+		shadowRepo = mocks.NewMockShadowProfileRepository(profileRepo)
+		eventRepo = mocks.NewMockEventRepository()
+		replaySvc = NewReplayService(eventRepo, profileRepo, shadowRepo)
+		baseTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		eventRepo.ProcessedEvents = []db.EventRecord{
+			event(0, "cookie-a", "111"),
+			event(1, "cookie-b", "111"),
+			event(2, "cookie-c", ""),
+			event(100, "cookie-a", ""),
+		}
+	})
+
+	It("should reset processing state of events in the time range", func() {
+		result, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Minute)})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ResetEvents).To(Equal(3))
+		Expect(eventRepo.UnprocessedEvents).To(HaveLen(3))
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(1))
+	})
+
+	It("should reset processing state of events carrying the identifiers", func() {
+		result, err := replaySvc.Replay(ctx, ReplayRequest{
+			Start:       baseTime,
+			End:         baseTime.Add(time.Hour),
+			Identifiers: db.EventIdentifier{Cookie: "cookie-a"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ResetEvents).To(Equal(2))
+		Expect(eventRepo.UnprocessedEvents).To(ConsistOf(event(0, "cookie-a", "111"), event(100, "cookie-a", "")))
+	})
+
+	It("should take replayed events back from their profiles, so stitching them again counts them once", func() {
+		eventRepo.UnprocessedEvents = eventRepo.ProcessedEvents
+		eventRepo.ProcessedEvents = nil
+		purchase := event(3, "cookie-c", "")
+		purchase.EventId = db.EventIdPurchase
+		purchase.Revenue = 10
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, purchase)
+		stitchingSvc := NewStitchingService(profileRepo, eventRepo, time.Millisecond, 1, 10)
+		stitchingSvc.Stitch(ctx)
+		stitched := maps.Clone(profileRepo.Stats)
+		observed := make(map[int][]db.EventRecord)
+		for id, events := range profileRepo.Observations {
+			observed[id] = slices.Clone(events)
+		}
+
+		result, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Hour), Identifiers: db.EventIdentifier{Cookie: "cookie-c"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.ResetEvents).To(Equal(2))
+		Expect(profileRepo.Stats).To(HaveLen(len(stitched) - 1))
+
+		stitchingSvc.Stitch(ctx)
+		Expect(profileRepo.Stats).To(Equal(stitched))
+		Expect(profileRepo.Observations).To(HaveLen(len(observed)))
+		for id, events := range observed {
+			Expect(profileRepo.Observations[id]).To(ConsistOf(events))
+		}
+	})
+
+	It("should rebuild profiles into the shadow table and promote it", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+
+		result, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Hour), Shadow: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Profiles).To(Equal(2))
+		Expect(shadowRepo.Promoted).To(BeTrue())
+
+		profiles, err := profileRepo.GetAllProfiles(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(ConsistOf(
+			db.Profile{Id: 0, Cookie: "cookie-a", Phone: "111"},
+			db.Profile{Id: 1, Cookie: "cookie-c"},
+		))
+	})
+
+	It("should leave events stored during a shadow replay to the stitching workers", func() {
+		late := event(120, "cookie-late", "")
+		replaySvc = NewReplayService(&lateEventRepository{MockEventRepository: eventRepo, late: late}, profileRepo, shadowRepo)
+
+		result, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Hour), Shadow: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Profiles).To(Equal(2))
+		Expect(eventRepo.UnprocessedEvents).To(ConsistOf(late))
+	})
+
+	It("should refuse a shadow replay leaving out stored events", func() {
+		profileRepo.InsertProfile(ctx, db.Profile{Cookie: "stale-cookie"})
+
+		_, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Minute), Shadow: true})
+		Expect(err).To(MatchError(ErrPartialRebuild))
+		Expect(shadowRepo.Promoted).To(BeFalse())
+		Expect(profileRepo.Profiles).To(ConsistOf(db.Profile{Cookie: "stale-cookie"}))
+	})
+
+	It("should refuse a shadow replay while archived events are not restored", func() {
+		eventRepo.ArchivedEvents = 1
+
+		_, err := replaySvc.Replay(ctx, ReplayRequest{Start: baseTime, End: baseTime.Add(time.Hour), Shadow: true})
+		Expect(err).To(MatchError(ErrArchivedEvents))
+		Expect(shadowRepo.Promoted).To(BeFalse())
+	})
+
+	It("should refuse a shadow replay within a single workspace, as the profiles of every workspace are replaced", func() {
+		_, err := replaySvc.Replay(db.WithWorkspace(context.Background(), "brand-a"),
+			ReplayRequest{Start: baseTime, End: baseTime.Add(time.Hour), Shadow: true})
+		Expect(err).To(MatchError(ErrRebuildWorkspace))
+		Expect(shadowRepo.Promoted).To(BeFalse())
+	})
+
+	It("should refuse a shadow replay limited to identifiers", func() {
+		_, err := replaySvc.Replay(ctx, ReplayRequest{
+			End:         baseTime.Add(time.Hour),
+			Identifiers: db.EventIdentifier{Cookie: "cookie-a"},
+			Shadow:      true,
+		})
+		Expect(err).To(MatchError(ErrShadowReplayByIdentifiers))
+		Expect(shadowRepo.Promoted).To(BeFalse())
+	})
+})
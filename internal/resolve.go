@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// ErrTooFewProfiles is returned when merging less than two distinct profiles
+var ErrTooFewProfiles = errors.New("at least two profiles are required to merge")
+
+// ErrIdentifiersChanged is returned when identifiers were stitched to a profile while their locks were being taken.
+// The request can be retried.
+var ErrIdentifiersChanged = errors.New("identifiers changed while they were locked")
+
+// ResolvedIdentity is the outcome of stitching a single event synchronously
+type ResolvedIdentity struct {
+	ProfileId int
+	Action    StitchAction
+	// MergedIds are the profiles absorbed into ProfileId when the event caused a merge
+	MergedIds []int
+}
+
+// Merged reports whether the event caused profiles to be merged
+func (r ResolvedIdentity) Merged() bool {
+	return r.Action == ActionMerged
+}
+
+// StitchNow ingests the event and stitches it in a single transaction, returning the profile it resolved to.
+// The event is stored as processed, so the stitching workers never stitch it again. Stitching takes the same
+// identifier locks as the workers, so it is serialized with them for events sharing an identifier. Unlike the
+// workers, any failure rolls back the whole transaction, including the event. The event belongs to the workspace
+// of the context when it is scoped to one.
+func (s *StitchingService) StitchNow(ctx context.Context, event db.EventRecord) (ResolvedIdentity, error) {
+	// Create a helper function for preparing failure results
+	fail := func(err error) (ResolvedIdentity, error) {
+		return ResolvedIdentity{}, fmt.Errorf("stitch now: %w", err)
+	}
+
+	if workspace, ok := db.WorkspaceFromContext(ctx); ok {
+		event.Workspace = workspace
+	} else {
+		ctx = db.WithWorkspace(ctx, event.Workspace)
+	}
+
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	// Defer a rollback in case anything fails
+	defer tx.Rollback(ctx)
+
+	// Create a new context with the transaction
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	event.Id, err = s.eventRepo.InsertProcessedEvent(txCtx, event)
+	if err != nil {
+		return fail(err)
+	}
+
+	result, err := s.stitchEvent(txCtx, s.profileRepo, event)
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := s.sealEvent(txCtx, event, result); err != nil {
+		return fail(err)
+	}
+
+	if err := s.eventRepo.InsertSegmentTransitions(txCtx, result.Transitions); err != nil {
+		return fail(err)
+	}
+
+	if err := s.emitChanges(txCtx, result); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+
+	return ResolvedIdentity{ProfileId: result.ProfileId, Action: result.Action, MergedIds: result.MergedIds}, nil
+}
+
+// MergeNow merges the profiles into the one chosen by the survivorship rules, for links between profiles which
+// no event holds. The merge is reported like merges caused by events, and the survivor's segments are
+// reevaluated. Profiles are looked up within the workspace of the context, unknown ones fail the merge.
+func (s *StitchingService) MergeNow(ctx context.Context, profileIds []int) (ResolvedIdentity, error) {
+	// Create a helper function for preparing failure results
+	fail := func(err error) (ResolvedIdentity, error) {
+		return ResolvedIdentity{}, fmt.Errorf("merge now: %w", err)
+	}
+
+	profileIds = slices.Compact(slices.Sorted(slices.Values(profileIds)))
+	if len(profileIds) < 2 {
+		return fail(ErrTooFewProfiles)
+	}
+
+	tx, err := s.eventRepo.BeginTx(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	// Defer a rollback in case anything fails
+	defer tx.Rollback(ctx)
+
+	// Create a new context with the transaction
+	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
+
+	// Serialize with stitching of events holding identifiers of the profiles. The locks are taken in a single
+	// call, which acquires them in the order stitching takes them, so the merge cannot deadlock with it.
+	identifiers, err := s.readProfileIdentifiers(txCtx, profileIds)
+	if err != nil {
+		return fail(err)
+	}
+	if err := s.profileRepo.LockIdentifiers(txCtx, identifiers...); err != nil {
+		return fail(err)
+	}
+	// Read the profiles again under the locks, an event stitched before they were taken may have changed them.
+	// Locking the new identifiers in a second call could deadlock with stitching, so the merge fails instead.
+	locked, err := s.readProfileIdentifiers(txCtx, profileIds)
+	if err != nil {
+		return fail(err)
+	}
+	if !slices.Equal(locked, identifiers) {
+		return fail(ErrIdentifiersChanged)
+	}
+
+	survivorId, err := s.profileRepo.MergeProfiles(txCtx, profileIds)
+	if err != nil {
+		return fail(err)
+	}
+	result := stitchResult{Action: ActionMerged, ProfileId: survivorId}
+	for _, id := range profileIds {
+		if id != survivorId {
+			result.MergedIds = append(result.MergedIds, id)
+		}
+	}
+
+	if result.Transitions, err = s.evaluateSegments(txCtx, s.profileRepo, survivorId); err != nil {
+		return fail(err)
+	}
+
+	if err := s.eventRepo.InsertSegmentTransitions(txCtx, result.Transitions); err != nil {
+		return fail(err)
+	}
+
+	if err := s.emitChanges(txCtx, result); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fail(err)
+	}
+
+	return ResolvedIdentity{ProfileId: result.ProfileId, Action: result.Action, MergedIds: result.MergedIds}, nil
+}
+
+// readProfileIdentifiers reads the identifiers of the profiles, failing when one of them does not exist
+func (s *StitchingService) readProfileIdentifiers(ctx context.Context, profileIds []int) ([]db.EventIdentifier, error) {
+	identifiers := make([]db.EventIdentifier, 0, len(profileIds))
+	for _, id := range profileIds {
+		profile, found, err := s.profileRepo.GetProfileById(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %d", ErrProfileNotFound, id)
+		}
+		identifiers = append(identifiers, profileIdentifiers(profile))
+	}
+	return identifiers, nil
+}
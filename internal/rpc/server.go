@@ -0,0 +1,307 @@
+// Package rpc serves event ingestion and profile resolution over gRPC, see stitchingpb/stitching.proto.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/rpc/stitchingpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultTimeout bounds unary calls made without a deadline
+const DefaultTimeout = 5 * time.Second
+
+// APIKeyMetadata is the metadata key carrying the API key which authenticates a call as a workspace
+const APIKeyMetadata = "x-api-key"
+
+type Server struct {
+	stitchingpb.UnimplementedStitchingServer
+	ingestService *internal.EventIngestService
+	profileRepo   db.ProfileRepository
+	lookup        *internal.ProfileLookupService
+	keys          *internal.APIKeyService
+	log           *slog.Logger
+}
+
+func NewServer(ingestService *internal.EventIngestService, profileRepo db.ProfileRepository) *Server {
+	return &Server{
+		ingestService: ingestService,
+		profileRepo:   profileRepo,
+		lookup:        internal.NewProfileLookupService(profileRepo),
+		log:           slog.Default(),
+	}
+}
+
+// SetAPIKeys requires calls to authenticate with an API key once the service requires them, calls carrying a key
+// authenticate with it regardless. Authenticated calls only see and ingest into the key's workspace, ingesting needs
+// the ingest scope, the other calls profiles:read. Otherwise calls operate on the default workspace.
+func (s *Server) SetAPIKeys(keys *internal.APIKeyService) {
+	s.keys = keys
+}
+
+// scope returns the context scoped to the workspace the call authenticated as, once checked that its key grants
+// the scope. A streaming call takes a single request from the rate limit of its key.
+func (s *Server) scope(ctx context.Context, scope db.Scope) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	secret := ""
+	if keys := md.Get(APIKeyMetadata); len(keys) > 0 {
+		secret = keys[0]
+	}
+	// Calls carrying a key authenticate with it even when keys are not required
+	if s.keys == nil || (!s.keys.Required() && secret == "") {
+		return db.WithWorkspace(ctx, db.DefaultWorkspace), nil
+	}
+	key, err := s.keys.Authenticate(ctx, secret)
+	switch {
+	case errors.Is(err, internal.ErrInvalidAPIKey), errors.Is(err, internal.ErrAPIKeyExpired):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, internal.ErrRateLimited):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case err != nil:
+		return nil, s.statusError(ctx, err)
+	}
+	ctx = internal.WithAPIKey(db.WithWorkspace(ctx, key.Workspace), key)
+	if err := internal.Authorize(ctx, scope); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return ctx, nil
+}
+
+// NewGRPCServer returns a gRPC server exposing the service, applying the timeout to unary calls without a deadline
+func NewGRPCServer(server *Server, timeout time.Duration, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(DeadlineInterceptor(timeout)))
+	grpcServer := grpc.NewServer(opts...)
+	stitchingpb.RegisterStitchingServer(grpcServer, server)
+	return grpcServer
+}
+
+// DeadlineInterceptor sets the timeout on unary calls whose client did not set a deadline
+func DeadlineInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return handler(ctx, req)
+	}
+}
+
+// IngestEvents queues the streamed events without waiting for room in the ingest queue. Events over the rate limit
+// of their source, or rejected by a full or overloaded queue, fail the stream with RESOURCE_EXHAUSTED. Events
+// queued before a failure are ingested, their count is attached to the status as an IngestEventsResponse detail.
+func (s *Server) IngestEvents(stream grpc.ClientStreamingServer[stitchingpb.Event, stitchingpb.IngestEventsResponse]) error {
+	ctx, err := s.scope(stream.Context(), db.ScopeIngest)
+	if err != nil {
+		return err
+	}
+	var accepted int64
+	for {
+		event, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&stitchingpb.IngestEventsResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+
+		record, err := eventRecord(event, time.Now().UTC())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "event %d: %v", accepted, err)
+		}
+		if err := s.ingestService.TryEnqueue(ctx, record); err != nil {
+			return rejected(status.Convert(s.statusError(ctx, err)), accepted)
+		}
+		accepted++
+	}
+}
+
+func (s *Server) ResolveIdentity(ctx context.Context, req *stitchingpb.ResolveIdentityRequest) (*stitchingpb.ResolveIdentityResponse, error) {
+	ctx, err := s.scope(ctx, db.ScopeReadProfiles)
+	if err != nil {
+		return nil, err
+	}
+	identifiers := eventIdentifier(req.GetIdentifiers())
+	if identifiers == (db.EventIdentifier{}) {
+		return nil, status.Error(codes.InvalidArgument, "at least one identifier is required")
+	}
+
+	profiles, found, err := s.profileRepo.TryGetProfilesByIdentifiers(ctx, identifiers)
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, internal.ErrProfileNotFound.Error())
+	}
+
+	resp := &stitchingpb.ResolveIdentityResponse{ProfileId: int64(profiles[0].Id)}
+	for _, profile := range profiles {
+		resp.ProfileId = min(resp.ProfileId, int64(profile.Id))
+		resp.MatchingProfileIds = append(resp.MatchingProfileIds, int64(profile.Id))
+	}
+	return resp, nil
+}
+
+func (s *Server) GetProfile(ctx context.Context, req *stitchingpb.GetProfileRequest) (*stitchingpb.Profile, error) {
+	ctx, err := s.scope(ctx, db.ScopeReadProfiles)
+	if err != nil {
+		return nil, err
+	}
+	details, err := s.lookup.GetById(ctx, int(req.GetId()), !req.GetNoRedirect())
+	if err != nil {
+		return nil, s.statusError(ctx, err)
+	}
+	return profileMessage(details), nil
+}
+
+// statusError maps lookup and repository errors to gRPC status codes. A profile which was merged away
+// is NOT_FOUND with a MergedProfile detail naming the survivor.
+func (s *Server) statusError(ctx context.Context, err error) error {
+	var merged *internal.ProfileMergedError
+	switch {
+	case errors.As(err, &merged):
+		st := status.New(codes.NotFound, merged.Error())
+		detailed, detailErr := st.WithDetails(&stitchingpb.MergedProfile{
+			ProfileId:  int64(merged.ProfileId),
+			SurvivorId: int64(merged.SurvivorId),
+		})
+		if detailErr != nil {
+			return st.Err()
+		}
+		return detailed.Err()
+	case errors.Is(err, internal.ErrProfileNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, internal.ErrUnknownIdentifier):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, internal.ErrThrottled), errors.Is(err, internal.ErrOverloaded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	case ctx.Err() != nil:
+		// Database errors caused by an expired deadline do not always wrap the context error
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	s.log.Error("gRPC call failed", "error", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// rejected returns the status of a failed ingest stream along with the count of events accepted before it
+func rejected(st *status.Status, accepted int64) error {
+	detailed, err := st.WithDetails(&stitchingpb.IngestEventsResponse{Accepted: accepted})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func eventIdentifier(identifiers *stitchingpb.Identifiers) db.EventIdentifier {
+	return db.EventIdentifier{
+		Cookie:    identifiers.GetCookie(),
+		MessageId: identifiers.GetMessageId(),
+		Phone:     identifiers.GetPhone(),
+	}
+}
+
+// eventRecord converts an ingested event, traits without an observation time are observed at the event timestamp
+func eventRecord(event *stitchingpb.Event, received time.Time) (db.EventRecord, error) {
+	record := db.EventRecord{
+		EventIdentifier: eventIdentifier(event.GetIdentifiers()),
+		EventId:         int(event.GetEventId()),
+		EventTimestamp:  received,
+		Source:          event.GetSource(),
+		Revenue:         event.GetRevenue(),
+	}
+	if record.EventIdentifier == (db.EventIdentifier{}) {
+		return db.EventRecord{}, fmt.Errorf("event without identifiers")
+	}
+	if event.GetTimestamp() != nil {
+		record.EventTimestamp = event.GetTimestamp().AsTime()
+	}
+
+	if len(event.GetTraits()) > 0 {
+		record.Traits = make(db.Traits, len(event.GetTraits()))
+	}
+	for name, value := range event.GetTraits() {
+		trait, err := traitValue(value, record.EventTimestamp)
+		if err != nil {
+			return db.EventRecord{}, fmt.Errorf("trait %q: %w", name, err)
+		}
+		record.Traits[name] = trait
+	}
+	return record, nil
+}
+
+func traitValue(value *stitchingpb.TraitValue, observed time.Time) (db.TraitValue, error) {
+	if value.GetUpdatedAt() != nil {
+		observed = value.GetUpdatedAt().AsTime()
+	}
+	switch v := value.GetValue().(type) {
+	case *stitchingpb.TraitValue_StringValue:
+		return db.StringTrait(v.StringValue, observed), nil
+	case *stitchingpb.TraitValue_NumberValue:
+		return db.NumberTrait(v.NumberValue, observed), nil
+	case *stitchingpb.TraitValue_BoolValue:
+		return db.BoolTrait(v.BoolValue, observed), nil
+	case *stitchingpb.TraitValue_TimeValue:
+		return db.TimeTrait(v.TimeValue.AsTime(), observed), nil
+	}
+	return db.TraitValue{}, fmt.Errorf("value is missing")
+}
+
+func profileMessage(details internal.ProfileDetails) *stitchingpb.Profile {
+	profile := details.Profile
+	message := &stitchingpb.Profile{
+		Id:             int64(profile.Id),
+		RedirectedFrom: int64(details.RedirectedFrom),
+		Identifiers: &stitchingpb.Identifiers{
+			Cookie:    profile.Cookie,
+			MessageId: profile.MessageId,
+			Phone:     profile.Phone,
+		},
+		Traits: make(map[string]*stitchingpb.TraitValue, len(profile.Traits)),
+		Stats: &stitchingpb.ProfileStats{
+			FirstSeen:     timestamp(details.Stats.FirstSeen),
+			LastSeen:      timestamp(details.Stats.LastSeen),
+			LastPurchase:  timestamp(details.Stats.LastPurchase),
+			TotalEvents:   int64(details.Stats.TotalEvents),
+			PurchaseCount: int64(details.Stats.PurchaseCount),
+			Revenue:       details.Stats.Revenue,
+		},
+		Segments: details.Segments,
+	}
+
+	for name, trait := range profile.Traits {
+		value := &stitchingpb.TraitValue{UpdatedAt: timestamp(trait.UpdatedAt)}
+		switch trait.Type {
+		case db.TraitString:
+			value.Value = &stitchingpb.TraitValue_StringValue{StringValue: trait.String}
+		case db.TraitNumber:
+			value.Value = &stitchingpb.TraitValue_NumberValue{NumberValue: trait.Number}
+		case db.TraitBool:
+			value.Value = &stitchingpb.TraitValue_BoolValue{BoolValue: trait.Bool}
+		case db.TraitTime:
+			value.Value = &stitchingpb.TraitValue_TimeValue{TimeValue: timestamppb.New(trait.Time)}
+		}
+		message.Traits[name] = value
+	}
+	return message
+}
+
+// timestamp converts the time, leaving zero times unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
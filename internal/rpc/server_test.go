@@ -0,0 +1,185 @@
+package rpc_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+	"github.com/tomashoffer/event-stitching/internal/rpc"
+	"github.com/tomashoffer/event-stitching/internal/rpc/stitchingpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		profileRepo   *mocks.MockProfileRepository
+		eventRepo     *mocks.MockEventRepository
+		ingestService *internal.EventIngestService
+		client        stitchingpb.StitchingClient
+	)
+
+	// ingested runs an ingest worker until the queue is empty and returns the events it inserted
+	ingested := func() []db.EventRecord {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ingestService.IngestWorker(ctx)
+		}()
+		Eventually(func() int { return ingestService.Stats().QueueDepth }).Should(BeZero())
+		cancel()
+		<-done
+		return eventRepo.UnprocessedEvents
+	}
+
+	BeforeEach(func() {
+		profileRepo = mocks.NewMockProfileRepository()
+		profileRepo.Profiles[1] = db.Profile{Id: 1, Cookie: "cookie-1", Phone: "+15550100",
+			Traits: db.Traits{"plan": db.StringTrait("pro", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))}}
+		profileRepo.Profiles[2] = db.Profile{Id: 2, Phone: "+15550100"}
+		profileRepo.Stats[1] = db.ProfileStats{ProfileId: 1, TotalEvents: 2, PurchaseCount: 1, Revenue: 9.5}
+		profileRepo.Segments[1] = []string{"buyers"}
+		profileRepo.Merges[3] = 1
+
+		// The ingest workers are not started, so queued events stay in the queue
+		eventRepo = mocks.NewMockEventRepository()
+		ingestService = internal.NewEventIngestService(eventRepo, 1)
+
+		listener := bufconn.Listen(1 << 20)
+		grpcServer := rpc.NewGRPCServer(rpc.NewServer(ingestService, profileRepo), time.Second)
+		go grpcServer.Serve(listener)
+		DeferCleanup(grpcServer.Stop)
+
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return listener.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+		client = stitchingpb.NewStitchingClient(conn)
+	})
+
+	It("should queue streamed events for ingestion", func(ctx SpecContext) {
+		stream, err := client.IngestEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		timestamp := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+		Expect(stream.Send(&stitchingpb.Event{
+			Identifiers: &stitchingpb.Identifiers{Cookie: "cookie-9"},
+			EventId:     db.EventIdIdentify,
+			Timestamp:   timestamppb.New(timestamp),
+			Traits: map[string]*stitchingpb.TraitValue{
+				"vip": {Value: &stitchingpb.TraitValue_BoolValue{BoolValue: true}},
+			},
+		})).To(Succeed())
+		Expect(stream.Send(&stitchingpb.Event{
+			Identifiers: &stitchingpb.Identifiers{Phone: "+15550199"},
+			EventId:     db.EventIdPurchase,
+			Revenue:     12,
+		})).To(Succeed())
+
+		resp, err := stream.CloseAndRecv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetAccepted()).To(Equal(int64(2)))
+
+		events := ingested()
+		Expect(events).To(HaveLen(2))
+		first := events[0]
+		Expect(first.Cookie).To(Equal("cookie-9"))
+		Expect(first.EventTimestamp).To(Equal(timestamp))
+		Expect(first.Traits["vip"]).To(Equal(db.BoolTrait(true, timestamp)))
+		second := events[1]
+		Expect(second.Revenue).To(Equal(12.0))
+		Expect(second.EventTimestamp).NotTo(BeZero())
+	})
+
+	It("should reject events without identifiers", func(ctx SpecContext) {
+		stream, err := client.IngestEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&stitchingpb.Event{EventId: 1})).To(Succeed())
+
+		_, err = stream.CloseAndRecv()
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+		Expect(ingestService.Stats().QueueDepth).To(BeZero())
+	})
+
+	It("should resolve identifiers to profiles", func(ctx SpecContext) {
+		resp, err := client.ResolveIdentity(ctx, &stitchingpb.ResolveIdentityRequest{
+			Identifiers: &stitchingpb.Identifiers{Phone: "+15550100"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.GetProfileId()).To(Equal(int64(1)))
+		Expect(resp.GetMatchingProfileIds()).To(ConsistOf(int64(1), int64(2)))
+
+		_, err = client.ResolveIdentity(ctx, &stitchingpb.ResolveIdentityRequest{
+			Identifiers: &stitchingpb.Identifiers{Cookie: "unknown"},
+		})
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+
+		_, err = client.ResolveIdentity(ctx, &stitchingpb.ResolveIdentityRequest{})
+		Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+	})
+
+	It("should return profiles and map merged ids", func(ctx SpecContext) {
+		profile, err := client.GetProfile(ctx, &stitchingpb.GetProfileRequest{Id: 3})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profile.GetId()).To(Equal(int64(1)))
+		Expect(profile.GetRedirectedFrom()).To(Equal(int64(3)))
+		Expect(profile.GetIdentifiers().GetCookie()).To(Equal("cookie-1"))
+		Expect(profile.GetTraits()["plan"].GetStringValue()).To(Equal("pro"))
+		Expect(profile.GetStats().GetRevenue()).To(Equal(9.5))
+		Expect(profile.GetStats().GetFirstSeen()).To(BeNil())
+		Expect(profile.GetSegments()).To(Equal([]string{"buyers"}))
+
+		_, err = client.GetProfile(ctx, &stitchingpb.GetProfileRequest{Id: 3, NoRedirect: true})
+		st := status.Convert(err)
+		Expect(st.Code()).To(Equal(codes.NotFound))
+		Expect(st.Details()).To(HaveLen(1))
+		Expect(st.Details()[0].(*stitchingpb.MergedProfile).GetSurvivorId()).To(Equal(int64(1)))
+
+		_, err = client.GetProfile(ctx, &stitchingpb.GetProfileRequest{Id: 99})
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+	})
+
+	It("should reject events over the rate limit of their source along with the count accepted", func(ctx SpecContext) {
+		ingestService.SetRateLimit(1, 2)
+
+		stream, err := client.IngestEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		for _, source := range []string{"web", "app", "web", "web"} {
+			Expect(stream.Send(&stitchingpb.Event{Identifiers: &stitchingpb.Identifiers{Cookie: "cookie-1"}, Source: source})).To(Succeed())
+		}
+
+		_, err = stream.CloseAndRecv()
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+		Expect(status.Convert(err).Details()).To(ConsistOf(HaveField("Accepted", int64(3))))
+		Expect(ingestService.Stats().QueueDepth).To(Equal(3))
+		Expect(ingestService.Stats().ThrottledBySource).To(Equal(map[string]int64{"/web": 1}))
+	})
+
+	It("should reject events right away once the ingest queue is full", func(ctx SpecContext) {
+		for range ingestService.Stats().QueueCapacity {
+			Expect(ingestService.TryEnqueue(ctx, db.EventRecord{})).To(Succeed())
+		}
+
+		stream, err := client.IngestEvents(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stream.Send(&stitchingpb.Event{Identifiers: &stitchingpb.Identifiers{Cookie: "late"}})).To(Succeed())
+
+		_, err = stream.CloseAndRecv()
+		Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+		Expect(status.Convert(err).Details()).To(ConsistOf(HaveField("Accepted", int64(0))))
+		Expect(ingestService.Stats().Shed).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,4 @@
+// Package stitchingpb holds the protobuf messages and gRPC stubs generated from stitching.proto.
+package stitchingpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative stitching.proto
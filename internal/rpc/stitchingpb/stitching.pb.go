@@ -0,0 +1,865 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: stitching.proto
+
+package stitchingpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Identifiers struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Cookie        string                 `protobuf:"bytes,1,opt,name=cookie,proto3" json:"cookie,omitempty"`
+	MessageId     string                 `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Phone         string                 `protobuf:"bytes,3,opt,name=phone,proto3" json:"phone,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Identifiers) Reset() {
+	*x = Identifiers{}
+	mi := &file_stitching_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Identifiers) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Identifiers) ProtoMessage() {}
+
+func (x *Identifiers) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Identifiers.ProtoReflect.Descriptor instead.
+func (*Identifiers) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Identifiers) GetCookie() string {
+	if x != nil {
+		return x.Cookie
+	}
+	return ""
+}
+
+func (x *Identifiers) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *Identifiers) GetPhone() string {
+	if x != nil {
+		return x.Phone
+	}
+	return ""
+}
+
+type TraitValue struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Value:
+	//
+	//	*TraitValue_StringValue
+	//	*TraitValue_NumberValue
+	//	*TraitValue_BoolValue
+	//	*TraitValue_TimeValue
+	Value isTraitValue_Value `protobuf_oneof:"value"`
+	// updated_at is the time the value was observed, unset on ingested events where the event timestamp is used
+	UpdatedAt     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TraitValue) Reset() {
+	*x = TraitValue{}
+	mi := &file_stitching_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TraitValue) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TraitValue) ProtoMessage() {}
+
+func (x *TraitValue) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TraitValue.ProtoReflect.Descriptor instead.
+func (*TraitValue) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *TraitValue) GetValue() isTraitValue_Value {
+	if x != nil {
+		return x.Value
+	}
+	return nil
+}
+
+func (x *TraitValue) GetStringValue() string {
+	if x != nil {
+		if x, ok := x.Value.(*TraitValue_StringValue); ok {
+			return x.StringValue
+		}
+	}
+	return ""
+}
+
+func (x *TraitValue) GetNumberValue() float64 {
+	if x != nil {
+		if x, ok := x.Value.(*TraitValue_NumberValue); ok {
+			return x.NumberValue
+		}
+	}
+	return 0
+}
+
+func (x *TraitValue) GetBoolValue() bool {
+	if x != nil {
+		if x, ok := x.Value.(*TraitValue_BoolValue); ok {
+			return x.BoolValue
+		}
+	}
+	return false
+}
+
+func (x *TraitValue) GetTimeValue() *timestamppb.Timestamp {
+	if x != nil {
+		if x, ok := x.Value.(*TraitValue_TimeValue); ok {
+			return x.TimeValue
+		}
+	}
+	return nil
+}
+
+func (x *TraitValue) GetUpdatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return nil
+}
+
+type isTraitValue_Value interface {
+	isTraitValue_Value()
+}
+
+type TraitValue_StringValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+}
+
+type TraitValue_NumberValue struct {
+	NumberValue float64 `protobuf:"fixed64,2,opt,name=number_value,json=numberValue,proto3,oneof"`
+}
+
+type TraitValue_BoolValue struct {
+	BoolValue bool `protobuf:"varint,3,opt,name=bool_value,json=boolValue,proto3,oneof"`
+}
+
+type TraitValue_TimeValue struct {
+	TimeValue *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=time_value,json=timeValue,proto3,oneof"`
+}
+
+func (*TraitValue_StringValue) isTraitValue_Value() {}
+
+func (*TraitValue_NumberValue) isTraitValue_Value() {}
+
+func (*TraitValue_BoolValue) isTraitValue_Value() {}
+
+func (*TraitValue_TimeValue) isTraitValue_Value() {}
+
+type Event struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Identifiers *Identifiers           `protobuf:"bytes,1,opt,name=identifiers,proto3" json:"identifiers,omitempty"`
+	EventId     int32                  `protobuf:"varint,2,opt,name=event_id,json=eventId,proto3" json:"event_id,omitempty"`
+	// timestamp defaults to the time the event was received
+	Timestamp     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Source        string                 `protobuf:"bytes,4,opt,name=source,proto3" json:"source,omitempty"`
+	Traits        map[string]*TraitValue `protobuf:"bytes,5,rep,name=traits,proto3" json:"traits,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Revenue       float64                `protobuf:"fixed64,6,opt,name=revenue,proto3" json:"revenue,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Event) Reset() {
+	*x = Event{}
+	mi := &file_stitching_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Event) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Event) ProtoMessage() {}
+
+func (x *Event) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Event.ProtoReflect.Descriptor instead.
+func (*Event) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Event) GetIdentifiers() *Identifiers {
+	if x != nil {
+		return x.Identifiers
+	}
+	return nil
+}
+
+func (x *Event) GetEventId() int32 {
+	if x != nil {
+		return x.EventId
+	}
+	return 0
+}
+
+func (x *Event) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Event) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *Event) GetTraits() map[string]*TraitValue {
+	if x != nil {
+		return x.Traits
+	}
+	return nil
+}
+
+func (x *Event) GetRevenue() float64 {
+	if x != nil {
+		return x.Revenue
+	}
+	return 0
+}
+
+type IngestEventsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Accepted      int64                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestEventsResponse) Reset() {
+	*x = IngestEventsResponse{}
+	mi := &file_stitching_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestEventsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestEventsResponse) ProtoMessage() {}
+
+func (x *IngestEventsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestEventsResponse.ProtoReflect.Descriptor instead.
+func (*IngestEventsResponse) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *IngestEventsResponse) GetAccepted() int64 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+type ResolveIdentityRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Identifiers   *Identifiers           `protobuf:"bytes,1,opt,name=identifiers,proto3" json:"identifiers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ResolveIdentityRequest) Reset() {
+	*x = ResolveIdentityRequest{}
+	mi := &file_stitching_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResolveIdentityRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResolveIdentityRequest) ProtoMessage() {}
+
+func (x *ResolveIdentityRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResolveIdentityRequest.ProtoReflect.Descriptor instead.
+func (*ResolveIdentityRequest) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ResolveIdentityRequest) GetIdentifiers() *Identifiers {
+	if x != nil {
+		return x.Identifiers
+	}
+	return nil
+}
+
+type ResolveIdentityResponse struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	ProfileId int64                  `protobuf:"varint,1,opt,name=profile_id,json=profileId,proto3" json:"profile_id,omitempty"`
+	// matching_profile_ids lists every profile holding the identifiers, more than one until they are merged
+	MatchingProfileIds []int64 `protobuf:"varint,2,rep,packed,name=matching_profile_ids,json=matchingProfileIds,proto3" json:"matching_profile_ids,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *ResolveIdentityResponse) Reset() {
+	*x = ResolveIdentityResponse{}
+	mi := &file_stitching_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ResolveIdentityResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ResolveIdentityResponse) ProtoMessage() {}
+
+func (x *ResolveIdentityResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ResolveIdentityResponse.ProtoReflect.Descriptor instead.
+func (*ResolveIdentityResponse) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ResolveIdentityResponse) GetProfileId() int64 {
+	if x != nil {
+		return x.ProfileId
+	}
+	return 0
+}
+
+func (x *ResolveIdentityResponse) GetMatchingProfileIds() []int64 {
+	if x != nil {
+		return x.MatchingProfileIds
+	}
+	return nil
+}
+
+type GetProfileRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// no_redirect fails with NOT_FOUND and a MergedProfile detail instead of returning the profile a merged id was merged into
+	NoRedirect    bool `protobuf:"varint,2,opt,name=no_redirect,json=noRedirect,proto3" json:"no_redirect,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetProfileRequest) Reset() {
+	*x = GetProfileRequest{}
+	mi := &file_stitching_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetProfileRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetProfileRequest) ProtoMessage() {}
+
+func (x *GetProfileRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetProfileRequest.ProtoReflect.Descriptor instead.
+func (*GetProfileRequest) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *GetProfileRequest) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *GetProfileRequest) GetNoRedirect() bool {
+	if x != nil {
+		return x.NoRedirect
+	}
+	return false
+}
+
+type ProfileStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FirstSeen     *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=first_seen,json=firstSeen,proto3" json:"first_seen,omitempty"`
+	LastSeen      *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=last_seen,json=lastSeen,proto3" json:"last_seen,omitempty"`
+	LastPurchase  *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=last_purchase,json=lastPurchase,proto3" json:"last_purchase,omitempty"`
+	TotalEvents   int64                  `protobuf:"varint,4,opt,name=total_events,json=totalEvents,proto3" json:"total_events,omitempty"`
+	PurchaseCount int64                  `protobuf:"varint,5,opt,name=purchase_count,json=purchaseCount,proto3" json:"purchase_count,omitempty"`
+	Revenue       float64                `protobuf:"fixed64,6,opt,name=revenue,proto3" json:"revenue,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProfileStats) Reset() {
+	*x = ProfileStats{}
+	mi := &file_stitching_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProfileStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProfileStats) ProtoMessage() {}
+
+func (x *ProfileStats) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProfileStats.ProtoReflect.Descriptor instead.
+func (*ProfileStats) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ProfileStats) GetFirstSeen() *timestamppb.Timestamp {
+	if x != nil {
+		return x.FirstSeen
+	}
+	return nil
+}
+
+func (x *ProfileStats) GetLastSeen() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastSeen
+	}
+	return nil
+}
+
+func (x *ProfileStats) GetLastPurchase() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastPurchase
+	}
+	return nil
+}
+
+func (x *ProfileStats) GetTotalEvents() int64 {
+	if x != nil {
+		return x.TotalEvents
+	}
+	return 0
+}
+
+func (x *ProfileStats) GetPurchaseCount() int64 {
+	if x != nil {
+		return x.PurchaseCount
+	}
+	return 0
+}
+
+func (x *ProfileStats) GetRevenue() float64 {
+	if x != nil {
+		return x.Revenue
+	}
+	return 0
+}
+
+type Profile struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	// redirected_from is the requested id when it was merged into this profile
+	RedirectedFrom int64                  `protobuf:"varint,2,opt,name=redirected_from,json=redirectedFrom,proto3" json:"redirected_from,omitempty"`
+	Identifiers    *Identifiers           `protobuf:"bytes,3,opt,name=identifiers,proto3" json:"identifiers,omitempty"`
+	Traits         map[string]*TraitValue `protobuf:"bytes,4,rep,name=traits,proto3" json:"traits,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Stats          *ProfileStats          `protobuf:"bytes,5,opt,name=stats,proto3" json:"stats,omitempty"`
+	Segments       []string               `protobuf:"bytes,6,rep,name=segments,proto3" json:"segments,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *Profile) Reset() {
+	*x = Profile{}
+	mi := &file_stitching_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Profile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Profile) ProtoMessage() {}
+
+func (x *Profile) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Profile.ProtoReflect.Descriptor instead.
+func (*Profile) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Profile) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Profile) GetRedirectedFrom() int64 {
+	if x != nil {
+		return x.RedirectedFrom
+	}
+	return 0
+}
+
+func (x *Profile) GetIdentifiers() *Identifiers {
+	if x != nil {
+		return x.Identifiers
+	}
+	return nil
+}
+
+func (x *Profile) GetTraits() map[string]*TraitValue {
+	if x != nil {
+		return x.Traits
+	}
+	return nil
+}
+
+func (x *Profile) GetStats() *ProfileStats {
+	if x != nil {
+		return x.Stats
+	}
+	return nil
+}
+
+func (x *Profile) GetSegments() []string {
+	if x != nil {
+		return x.Segments
+	}
+	return nil
+}
+
+// MergedProfile is attached to the NOT_FOUND status of a profile which was merged into another one
+type MergedProfile struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ProfileId     int64                  `protobuf:"varint,1,opt,name=profile_id,json=profileId,proto3" json:"profile_id,omitempty"`
+	SurvivorId    int64                  `protobuf:"varint,2,opt,name=survivor_id,json=survivorId,proto3" json:"survivor_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MergedProfile) Reset() {
+	*x = MergedProfile{}
+	mi := &file_stitching_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MergedProfile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MergedProfile) ProtoMessage() {}
+
+func (x *MergedProfile) ProtoReflect() protoreflect.Message {
+	mi := &file_stitching_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MergedProfile.ProtoReflect.Descriptor instead.
+func (*MergedProfile) Descriptor() ([]byte, []int) {
+	return file_stitching_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *MergedProfile) GetProfileId() int64 {
+	if x != nil {
+		return x.ProfileId
+	}
+	return 0
+}
+
+func (x *MergedProfile) GetSurvivorId() int64 {
+	if x != nil {
+		return x.SurvivorId
+	}
+	return 0
+}
+
+var File_stitching_proto protoreflect.FileDescriptor
+
+const file_stitching_proto_rawDesc = "" +
+	"\n" +
+	"\x0fstitching.proto\x12\fstitching.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"Z\n" +
+	"\vIdentifiers\x12\x16\n" +
+	"\x06cookie\x18\x01 \x01(\tR\x06cookie\x12\x1d\n" +
+	"\n" +
+	"message_id\x18\x02 \x01(\tR\tmessageId\x12\x14\n" +
+	"\x05phone\x18\x03 \x01(\tR\x05phone\"\xf8\x01\n" +
+	"\n" +
+	"TraitValue\x12#\n" +
+	"\fstring_value\x18\x01 \x01(\tH\x00R\vstringValue\x12#\n" +
+	"\fnumber_value\x18\x02 \x01(\x01H\x00R\vnumberValue\x12\x1f\n" +
+	"\n" +
+	"bool_value\x18\x03 \x01(\bH\x00R\tboolValue\x12;\n" +
+	"\n" +
+	"time_value\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampH\x00R\ttimeValue\x129\n" +
+	"\n" +
+	"updated_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tupdatedAtB\a\n" +
+	"\x05value\"\xd9\x02\n" +
+	"\x05Event\x12;\n" +
+	"\videntifiers\x18\x01 \x01(\v2\x19.stitching.v1.IdentifiersR\videntifiers\x12\x19\n" +
+	"\bevent_id\x18\x02 \x01(\x05R\aeventId\x128\n" +
+	"\ttimestamp\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x16\n" +
+	"\x06source\x18\x04 \x01(\tR\x06source\x127\n" +
+	"\x06traits\x18\x05 \x03(\v2\x1f.stitching.v1.Event.TraitsEntryR\x06traits\x12\x18\n" +
+	"\arevenue\x18\x06 \x01(\x01R\arevenue\x1aS\n" +
+	"\vTraitsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12.\n" +
+	"\x05value\x18\x02 \x01(\v2\x18.stitching.v1.TraitValueR\x05value:\x028\x01\"2\n" +
+	"\x14IngestEventsResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x03R\baccepted\"U\n" +
+	"\x16ResolveIdentityRequest\x12;\n" +
+	"\videntifiers\x18\x01 \x01(\v2\x19.stitching.v1.IdentifiersR\videntifiers\"j\n" +
+	"\x17ResolveIdentityResponse\x12\x1d\n" +
+	"\n" +
+	"profile_id\x18\x01 \x01(\x03R\tprofileId\x120\n" +
+	"\x14matching_profile_ids\x18\x02 \x03(\x03R\x12matchingProfileIds\"D\n" +
+	"\x11GetProfileRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x1f\n" +
+	"\vno_redirect\x18\x02 \x01(\bR\n" +
+	"noRedirect\"\xa7\x02\n" +
+	"\fProfileStats\x129\n" +
+	"\n" +
+	"first_seen\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\tfirstSeen\x127\n" +
+	"\tlast_seen\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\blastSeen\x12?\n" +
+	"\rlast_purchase\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\flastPurchase\x12!\n" +
+	"\ftotal_events\x18\x04 \x01(\x03R\vtotalEvents\x12%\n" +
+	"\x0epurchase_count\x18\x05 \x01(\x03R\rpurchaseCount\x12\x18\n" +
+	"\arevenue\x18\x06 \x01(\x01R\arevenue\"\xdd\x02\n" +
+	"\aProfile\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12'\n" +
+	"\x0fredirected_from\x18\x02 \x01(\x03R\x0eredirectedFrom\x12;\n" +
+	"\videntifiers\x18\x03 \x01(\v2\x19.stitching.v1.IdentifiersR\videntifiers\x129\n" +
+	"\x06traits\x18\x04 \x03(\v2!.stitching.v1.Profile.TraitsEntryR\x06traits\x120\n" +
+	"\x05stats\x18\x05 \x01(\v2\x1a.stitching.v1.ProfileStatsR\x05stats\x12\x1a\n" +
+	"\bsegments\x18\x06 \x03(\tR\bsegments\x1aS\n" +
+	"\vTraitsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12.\n" +
+	"\x05value\x18\x02 \x01(\v2\x18.stitching.v1.TraitValueR\x05value:\x028\x01\"O\n" +
+	"\rMergedProfile\x12\x1d\n" +
+	"\n" +
+	"profile_id\x18\x01 \x01(\x03R\tprofileId\x12\x1f\n" +
+	"\vsurvivor_id\x18\x02 \x01(\x03R\n" +
+	"survivorId2\xfc\x01\n" +
+	"\tStitching\x12I\n" +
+	"\fIngestEvents\x12\x13.stitching.v1.Event\x1a\".stitching.v1.IngestEventsResponse(\x01\x12^\n" +
+	"\x0fResolveIdentity\x12$.stitching.v1.ResolveIdentityRequest\x1a%.stitching.v1.ResolveIdentityResponse\x12D\n" +
+	"\n" +
+	"GetProfile\x12\x1f.stitching.v1.GetProfileRequest\x1a\x15.stitching.v1.ProfileBAZ?github.com/tomashoffer/event-stitching/internal/rpc/stitchingpbb\x06proto3"
+
+var (
+	file_stitching_proto_rawDescOnce sync.Once
+	file_stitching_proto_rawDescData []byte
+)
+
+func file_stitching_proto_rawDescGZIP() []byte {
+	file_stitching_proto_rawDescOnce.Do(func() {
+		file_stitching_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_stitching_proto_rawDesc), len(file_stitching_proto_rawDesc)))
+	})
+	return file_stitching_proto_rawDescData
+}
+
+var file_stitching_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_stitching_proto_goTypes = []any{
+	(*Identifiers)(nil),             // 0: stitching.v1.Identifiers
+	(*TraitValue)(nil),              // 1: stitching.v1.TraitValue
+	(*Event)(nil),                   // 2: stitching.v1.Event
+	(*IngestEventsResponse)(nil),    // 3: stitching.v1.IngestEventsResponse
+	(*ResolveIdentityRequest)(nil),  // 4: stitching.v1.ResolveIdentityRequest
+	(*ResolveIdentityResponse)(nil), // 5: stitching.v1.ResolveIdentityResponse
+	(*GetProfileRequest)(nil),       // 6: stitching.v1.GetProfileRequest
+	(*ProfileStats)(nil),            // 7: stitching.v1.ProfileStats
+	(*Profile)(nil),                 // 8: stitching.v1.Profile
+	(*MergedProfile)(nil),           // 9: stitching.v1.MergedProfile
+	nil,                             // 10: stitching.v1.Event.TraitsEntry
+	nil,                             // 11: stitching.v1.Profile.TraitsEntry
+	(*timestamppb.Timestamp)(nil),   // 12: google.protobuf.Timestamp
+}
+var file_stitching_proto_depIdxs = []int32{
+	12, // 0: stitching.v1.TraitValue.time_value:type_name -> google.protobuf.Timestamp
+	12, // 1: stitching.v1.TraitValue.updated_at:type_name -> google.protobuf.Timestamp
+	0,  // 2: stitching.v1.Event.identifiers:type_name -> stitching.v1.Identifiers
+	12, // 3: stitching.v1.Event.timestamp:type_name -> google.protobuf.Timestamp
+	10, // 4: stitching.v1.Event.traits:type_name -> stitching.v1.Event.TraitsEntry
+	0,  // 5: stitching.v1.ResolveIdentityRequest.identifiers:type_name -> stitching.v1.Identifiers
+	12, // 6: stitching.v1.ProfileStats.first_seen:type_name -> google.protobuf.Timestamp
+	12, // 7: stitching.v1.ProfileStats.last_seen:type_name -> google.protobuf.Timestamp
+	12, // 8: stitching.v1.ProfileStats.last_purchase:type_name -> google.protobuf.Timestamp
+	0,  // 9: stitching.v1.Profile.identifiers:type_name -> stitching.v1.Identifiers
+	11, // 10: stitching.v1.Profile.traits:type_name -> stitching.v1.Profile.TraitsEntry
+	7,  // 11: stitching.v1.Profile.stats:type_name -> stitching.v1.ProfileStats
+	1,  // 12: stitching.v1.Event.TraitsEntry.value:type_name -> stitching.v1.TraitValue
+	1,  // 13: stitching.v1.Profile.TraitsEntry.value:type_name -> stitching.v1.TraitValue
+	2,  // 14: stitching.v1.Stitching.IngestEvents:input_type -> stitching.v1.Event
+	4,  // 15: stitching.v1.Stitching.ResolveIdentity:input_type -> stitching.v1.ResolveIdentityRequest
+	6,  // 16: stitching.v1.Stitching.GetProfile:input_type -> stitching.v1.GetProfileRequest
+	3,  // 17: stitching.v1.Stitching.IngestEvents:output_type -> stitching.v1.IngestEventsResponse
+	5,  // 18: stitching.v1.Stitching.ResolveIdentity:output_type -> stitching.v1.ResolveIdentityResponse
+	8,  // 19: stitching.v1.Stitching.GetProfile:output_type -> stitching.v1.Profile
+	17, // [17:20] is the sub-list for method output_type
+	14, // [14:17] is the sub-list for method input_type
+	14, // [14:14] is the sub-list for extension type_name
+	14, // [14:14] is the sub-list for extension extendee
+	0,  // [0:14] is the sub-list for field type_name
+}
+
+func init() { file_stitching_proto_init() }
+func file_stitching_proto_init() {
+	if File_stitching_proto != nil {
+		return
+	}
+	file_stitching_proto_msgTypes[1].OneofWrappers = []any{
+		(*TraitValue_StringValue)(nil),
+		(*TraitValue_NumberValue)(nil),
+		(*TraitValue_BoolValue)(nil),
+		(*TraitValue_TimeValue)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_stitching_proto_rawDesc), len(file_stitching_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_stitching_proto_goTypes,
+		DependencyIndexes: file_stitching_proto_depIdxs,
+		MessageInfos:      file_stitching_proto_msgTypes,
+	}.Build()
+	File_stitching_proto = out.File
+	file_stitching_proto_goTypes = nil
+	file_stitching_proto_depIdxs = nil
+}
@@ -0,0 +1,201 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: stitching.proto
+
+package stitchingpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Stitching_IngestEvents_FullMethodName    = "/stitching.v1.Stitching/IngestEvents"
+	Stitching_ResolveIdentity_FullMethodName = "/stitching.v1.Stitching/ResolveIdentity"
+	Stitching_GetProfile_FullMethodName      = "/stitching.v1.Stitching/GetProfile"
+)
+
+// StitchingClient is the client API for Stitching service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Stitching ingests events and resolves them to stitched profiles
+type StitchingClient interface {
+	// IngestEvents queues every streamed event for ingestion and replies once the client closes the stream
+	IngestEvents(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Event, IngestEventsResponse], error)
+	// ResolveIdentity returns the profile currently holding the identifiers, without stitching anything
+	ResolveIdentity(ctx context.Context, in *ResolveIdentityRequest, opts ...grpc.CallOption) (*ResolveIdentityResponse, error)
+	// GetProfile returns a profile by id, following merges unless no_redirect is set
+	GetProfile(ctx context.Context, in *GetProfileRequest, opts ...grpc.CallOption) (*Profile, error)
+}
+
+type stitchingClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStitchingClient(cc grpc.ClientConnInterface) StitchingClient {
+	return &stitchingClient{cc}
+}
+
+func (c *stitchingClient) IngestEvents(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[Event, IngestEventsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Stitching_ServiceDesc.Streams[0], Stitching_IngestEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Event, IngestEventsResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stitching_IngestEventsClient = grpc.ClientStreamingClient[Event, IngestEventsResponse]
+
+func (c *stitchingClient) ResolveIdentity(ctx context.Context, in *ResolveIdentityRequest, opts ...grpc.CallOption) (*ResolveIdentityResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ResolveIdentityResponse)
+	err := c.cc.Invoke(ctx, Stitching_ResolveIdentity_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *stitchingClient) GetProfile(ctx context.Context, in *GetProfileRequest, opts ...grpc.CallOption) (*Profile, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Profile)
+	err := c.cc.Invoke(ctx, Stitching_GetProfile_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StitchingServer is the server API for Stitching service.
+// All implementations must embed UnimplementedStitchingServer
+// for forward compatibility.
+//
+// Stitching ingests events and resolves them to stitched profiles
+type StitchingServer interface {
+	// IngestEvents queues every streamed event for ingestion and replies once the client closes the stream
+	IngestEvents(grpc.ClientStreamingServer[Event, IngestEventsResponse]) error
+	// ResolveIdentity returns the profile currently holding the identifiers, without stitching anything
+	ResolveIdentity(context.Context, *ResolveIdentityRequest) (*ResolveIdentityResponse, error)
+	// GetProfile returns a profile by id, following merges unless no_redirect is set
+	GetProfile(context.Context, *GetProfileRequest) (*Profile, error)
+	mustEmbedUnimplementedStitchingServer()
+}
+
+// UnimplementedStitchingServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedStitchingServer struct{}
+
+func (UnimplementedStitchingServer) IngestEvents(grpc.ClientStreamingServer[Event, IngestEventsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method IngestEvents not implemented")
+}
+func (UnimplementedStitchingServer) ResolveIdentity(context.Context, *ResolveIdentityRequest) (*ResolveIdentityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveIdentity not implemented")
+}
+func (UnimplementedStitchingServer) GetProfile(context.Context, *GetProfileRequest) (*Profile, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetProfile not implemented")
+}
+func (UnimplementedStitchingServer) mustEmbedUnimplementedStitchingServer() {}
+func (UnimplementedStitchingServer) testEmbeddedByValue()                   {}
+
+// UnsafeStitchingServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StitchingServer will
+// result in compilation errors.
+type UnsafeStitchingServer interface {
+	mustEmbedUnimplementedStitchingServer()
+}
+
+func RegisterStitchingServer(s grpc.ServiceRegistrar, srv StitchingServer) {
+	// If the following call pancis, it indicates UnimplementedStitchingServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Stitching_ServiceDesc, srv)
+}
+
+func _Stitching_IngestEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StitchingServer).IngestEvents(&grpc.GenericServerStream[Event, IngestEventsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Stitching_IngestEventsServer = grpc.ClientStreamingServer[Event, IngestEventsResponse]
+
+func _Stitching_ResolveIdentity_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveIdentityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StitchingServer).ResolveIdentity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stitching_ResolveIdentity_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StitchingServer).ResolveIdentity(ctx, req.(*ResolveIdentityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Stitching_GetProfile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetProfileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StitchingServer).GetProfile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Stitching_GetProfile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StitchingServer).GetProfile(ctx, req.(*GetProfileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Stitching_ServiceDesc is the grpc.ServiceDesc for Stitching service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Stitching_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stitching.v1.Stitching",
+	HandlerType: (*StitchingServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ResolveIdentity",
+			Handler:    _Stitching_ResolveIdentity_Handler,
+		},
+		{
+			MethodName: "GetProfile",
+			Handler:    _Stitching_GetProfile_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "IngestEvents",
+			Handler:       _Stitching_IngestEvents_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "stitching.proto",
+}
@@ -0,0 +1,68 @@
+package sinks
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Broker is an in-process message broker fanning events out to subscribers by kind.
+// Delivery blocks until every matching subscriber received the event, so slow subscribers apply backpressure
+// on the relay instead of losing events.
+type Broker struct {
+	mu          sync.RWMutex
+	subscribers map[*subscription]struct{}
+}
+
+type subscription struct {
+	kinds []db.OutboxKind
+	ch    chan db.OutboxEvent
+	done  chan struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[*subscription]struct{})}
+}
+
+// Subscribe returns a channel receiving events of the given kinds, or all events when no kind is given,
+// and a function ending the subscription
+func (b *Broker) Subscribe(buffer int, kinds ...db.OutboxKind) (<-chan db.OutboxEvent, func()) {
+	sub := &subscription{kinds: kinds, ch: make(chan db.OutboxEvent, buffer), done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			// Release a delivery blocked on this subscriber before waiting for the lock
+			close(sub.done)
+			b.mu.Lock()
+			delete(b.subscribers, sub)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *Broker) Deliver(ctx context.Context, events []db.OutboxEvent) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, event := range events {
+		for sub := range b.subscribers {
+			if len(sub.kinds) > 0 && !slices.Contains(sub.kinds, event.Kind) {
+				continue
+			}
+			select {
+			case sub.ch <- event:
+			case <-sub.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
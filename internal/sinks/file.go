@@ -0,0 +1,42 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// FileSink appends events as newline delimited JSON to a file, syncing it after every batch.
+// A batch interrupted by a crash may be partially written and is appended again on redelivery.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sink file: %w", err)
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Deliver(ctx context.Context, events []db.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := writeNDJSON(s.file, events); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync sink file: %w", err)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
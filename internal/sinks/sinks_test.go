@@ -0,0 +1,91 @@
+package sinks_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/sinks"
+)
+
+var _ = Describe("Sinks", func() {
+	ctx := context.Background()
+	events := []db.OutboxEvent{
+		{Id: 1, Kind: db.KindProfileCreated, ProfileId: 7, Payload: json.RawMessage(`{"profile":{"id":7}}`)},
+		{Id: 2, Kind: db.KindSegmentEntered, ProfileId: 7, Payload: json.RawMessage(`{"segment":"vip"}`)},
+	}
+
+	It("should write newline delimited JSON", func() {
+		var out bytes.Buffer
+		Expect(sinks.NewWriterSink(&out).Deliver(ctx, events)).To(Succeed())
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[1]).To(ContainSubstring(`"kind":"segment.entered"`))
+		Expect(lines[1]).To(ContainSubstring(`"payload":{"segment":"vip"}`))
+	})
+
+	It("should append to the file across batches", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "changes.ndjson")
+		sink, err := sinks.NewFileSink(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Deliver(ctx, events[:1])).To(Succeed())
+		Expect(sink.Deliver(ctx, events[1:])).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.Count(string(data), "\n")).To(Equal(2))
+	})
+
+	It("should post batches to the webhook and fail on error responses", func() {
+		status := http.StatusOK
+		var received []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = io.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		sink := sinks.NewWebhookSink(server.URL)
+		Expect(sink.Deliver(ctx, events)).To(Succeed())
+
+		var body struct {
+			Events []db.OutboxEvent `json:"events"`
+		}
+		Expect(json.Unmarshal(received, &body)).To(Succeed())
+		Expect(body.Events).To(HaveLen(2))
+
+		status = http.StatusServiceUnavailable
+		Expect(sink.Deliver(ctx, events)).NotTo(Succeed())
+	})
+
+	It("should fan events out to subscribers by kind", func() {
+		broker := sinks.NewBroker()
+		all, unsubscribeAll := broker.Subscribe(10)
+		defer unsubscribeAll()
+		segments, unsubscribeSegments := broker.Subscribe(10, db.KindSegmentEntered)
+		defer unsubscribeSegments()
+
+		Expect(broker.Deliver(ctx, events)).To(Succeed())
+		Expect(all).To(HaveLen(2))
+		Expect(segments).To(HaveLen(1))
+		Expect((<-segments).Id).To(Equal(int64(2)))
+	})
+
+	It("should not block delivery on unsubscribed subscribers", func() {
+		broker := sinks.NewBroker()
+		_, unsubscribe := broker.Subscribe(0)
+		unsubscribe()
+		Expect(broker.Deliver(ctx, events)).To(Succeed())
+	})
+})
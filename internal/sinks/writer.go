@@ -0,0 +1,49 @@
+// Package sinks holds the destinations outbox events are relayed to
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// WriterSink writes events as newline delimited JSON
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// NewStdoutSink writes events as newline delimited JSON to the standard output
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout)
+}
+
+func (s *WriterSink) Deliver(ctx context.Context, events []db.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeNDJSON(s.w, events)
+}
+
+func writeNDJSON(w io.Writer, events []db.OutboxEvent) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("failed to encode outbox event %d: %w", event.Id, err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write outbox events: %w", err)
+	}
+	return nil
+}
@@ -4,17 +4,74 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/tomashoffer/event-stitching/internal/db"
 )
 
+// stitchRules decide which identifiers of events are stitched and which segments profiles are members of. The
+// stitching, rebuild and replay services embed them, so profiles come out alike whichever service computes them.
+type stitchRules struct {
+	segments     []db.Segment
+	erasures     db.DSARRepository
+	consentRules db.ConsentRules
+	workspaces   db.Workspaces
+}
+
+// SetSegments changes the segments evaluated for every profile
+func (r *stitchRules) SetSegments(segments []db.Segment) {
+	r.segments = segments
+}
+
+// SetErasures enables ignoring identifiers erased by data subject requests, so they are never stitched again
+func (r *stitchRules) SetErasures(dsarRepo db.DSARRepository) {
+	r.erasures = dsarRepo
+}
+
+// SetConsentRules changes the rules applied to profiles and identifiers without a consent decision, by default
+// everything not denied is allowed
+func (r *stitchRules) SetConsentRules(rules db.ConsentRules) {
+	r.consentRules = rules
+}
+
+// SetWorkspaces limits the identifiers stitched within the workspaces configured with identifier types
+func (r *stitchRules) SetWorkspaces(workspaces db.Workspaces) {
+	r.workspaces = workspaces
+}
+
+// stitchedIdentifiers leaves out the identifiers of the event which are erased, which its consents do not allow
+// stitching or which its workspace does not stitch. Erased identifiers are looked up within the workspace of the event.
+func (r *stitchRules) stitchedIdentifiers(ctx context.Context, event db.EventRecord) (db.EventIdentifier, error) {
+	identifiers := event.EventIdentifier
+	if r.erasures != nil {
+		var err error
+		if identifiers, err = r.erasures.RemoveErasedIdentifiers(db.WithWorkspace(ctx, event.Workspace), identifiers); err != nil {
+			return db.EventIdentifier{}, err
+		}
+	}
+	identifiers = r.consentRules.AllowedIdentifiers(db.EventConsents(event), db.PurposeStitching, identifiers)
+	return r.workspaces.AllowedIdentifiers(event.Workspace, identifiers), nil
+}
+
+// memberships returns the segments the profile matches at the time, none when its consents deny segmentation
+func (r *stitchRules) memberships(profile db.Profile, stats db.ProfileStats, consents db.Consents, now time.Time) []string {
+	if !r.consentRules.Allows(consents, db.PurposeSegments, "") {
+		return nil
+	}
+	return db.MatchingSegments(r.segments, profile, stats, now)
+}
+
 type StitchingService struct {
+	stitchRules
 	profileRepo       db.ProfileRepository
 	eventRepo         db.EventRepository
 	stitchingInterval time.Duration
 	numWorkers        int
 	batchSize         int
+	outboxRepo        db.OutboxRepository
 	log               *slog.Logger
 }
 
@@ -65,60 +122,27 @@ func (s *StitchingService) Stitch(ctx context.Context) {
 	// Create a new context with the transaction
 	txCtx := context.WithValue(ctx, db.TransactionKey{}, tx)
 
-	// Get unprocessed events within the transaction
-	events, err := s.eventRepo.GetUnProcessedEvents(txCtx, s.batchSize)
+	// Get unprocessed events of every workspace within the transaction
+	events, err := s.eventRepo.GetUnProcessedEvents(db.AllWorkspaces(txCtx), s.batchSize)
 	if err != nil {
 		s.log.Error("Failed to query unstitched events", "error", fail(err))
 		return
 	}
 
+	// Lock the identifiers of the whole batch up front in one order, as the locks of every event are held until
+	// the batch commits. Locking them event by event could deadlock with a batch sharing identifiers in another order.
+	if err := s.lockBatch(txCtx, events); err != nil {
+		s.log.Error("Failed to lock identifiers of events", "error", fail(err))
+		return
+	}
+
 	for _, event := range events {
-		profiles, found, err := s.profileRepo.TryGetProfilesByIdentifiers(txCtx, event.EventIdentifier)
-		if err != nil {
-			s.log.Warn("Failed to get profile by identifiers, moving on to next event",
+		if err := s.stitchInSavepoint(txCtx, tx, event); err != nil {
+			s.log.Error("Failed to stitch event, moving on to next event",
 				"identifiers", event.EventIdentifier,
 				"error", fail(err))
 			continue
 		}
-
-		if !found {
-			s.log.Debug("No profile found by identifiers, creating new profile",
-				"identifiers", event.EventIdentifier)
-			p := db.Profile{
-				Cookie:    event.EventIdentifier.Cookie,
-				MessageId: event.EventIdentifier.MessageId,
-				Phone:     event.EventIdentifier.Phone,
-			}
-
-			_, err = s.profileRepo.InsertProfile(txCtx, p)
-			if err != nil {
-				s.log.Error("Failed to insert profile", "error", fail(err))
-				continue
-			}
-		} else {
-			// At least one profile was found
-			if len(profiles) == 1 {
-				if err := s.profileRepo.EnrichProfileByIdentifiers(txCtx, profiles[0].Id, event.EventIdentifier); err != nil {
-					s.log.Error("Failed to enrich profile", "error", fail(err))
-					continue
-				}
-			} else {
-				// Merge profiles if more than one was found
-				profileIds := make([]int, len(profiles))
-				for i, profile := range profiles {
-					profileIds[i] = profile.Id
-				}
-				if err := s.profileRepo.MergeProfiles(txCtx, profileIds); err != nil {
-					s.log.Error("Failed to merge profiles", "error", fail(err))
-					continue
-				}
-			}
-		}
-
-		if err := s.eventRepo.MarkEventAsProcessed(txCtx, event); err != nil {
-			s.log.Error("Failed to mark event as processed", "error", fail(err))
-			continue
-		}
 		s.log.Debug("Processed event", "event", event)
 	}
 
@@ -128,3 +152,228 @@ func (s *StitchingService) Stitch(ctx context.Context) {
 		return
 	}
 }
+
+// stitchInSavepoint stitches the event and marks it processed within a savepoint of the batch transaction. A step
+// failing rolls back the stats, observations and changes already recorded for the event, which stays unprocessed and
+// is counted once when it is stitched again.
+func (s *StitchingService) stitchInSavepoint(ctx context.Context, tx pgx.Tx, event db.EventRecord) error {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin savepoint: %w", err)
+	}
+	defer savepoint.Rollback(ctx)
+
+	// Each event is only stitched with the profiles of its workspace
+	eventCtx := db.WithWorkspace(context.WithValue(ctx, db.TransactionKey{}, savepoint), event.Workspace)
+
+	result, err := s.stitchEvent(eventCtx, s.profileRepo, event)
+	if err != nil {
+		return err
+	}
+	if err := s.eventRepo.InsertSegmentTransitions(eventCtx, result.Transitions); err != nil {
+		return fmt.Errorf("failed to emit segment transitions: %w", err)
+	}
+	if err := s.emitChanges(eventCtx, result); err != nil {
+		return fmt.Errorf("failed to emit profile changes: %w", err)
+	}
+	if err := s.sealEvent(eventCtx, event, result); err != nil {
+		return fmt.Errorf("failed to seal event: %w", err)
+	}
+	if err := s.eventRepo.MarkEventAsProcessed(eventCtx, event); err != nil {
+		return fmt.Errorf("failed to mark event as processed: %w", err)
+	}
+	return savepoint.Commit(ctx)
+}
+
+// lockBatch locks the identifiers of all events, workspace by workspace in the order of their names
+func (s *StitchingService) lockBatch(ctx context.Context, events []db.EventRecord) error {
+	byWorkspace := make(map[string][]db.EventIdentifier)
+	for _, event := range events {
+		byWorkspace[event.Workspace] = append(byWorkspace[event.Workspace], event.EventIdentifier)
+	}
+	for _, workspace := range slices.Sorted(maps.Keys(byWorkspace)) {
+		if err := s.profileRepo.LockIdentifiers(db.WithWorkspace(ctx, workspace), byWorkspace[workspace]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StitchAction describes the decision taken for a single event
+type StitchAction int
+
+const (
+	ActionCreated StitchAction = iota
+	ActionEnriched
+	ActionMerged
+	// ActionSkipped leaves the event unstitched, as all of its identifiers were erased
+	ActionSkipped
+)
+
+func (a StitchAction) String() string {
+	switch a {
+	case ActionCreated:
+		return "created"
+	case ActionEnriched:
+		return "enriched"
+	case ActionMerged:
+		return "merged"
+	case ActionSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// stitchResult is the outcome of stitching a single event
+type stitchResult struct {
+	Action    StitchAction
+	ProfileId int
+	// Previous is the profile before it was enriched
+	Previous db.Profile
+	// MergedIds are the profiles absorbed into ProfileId by a merge
+	MergedIds []int
+	// Transitions are the segments the profile entered or exited due to the event
+	Transitions []db.SegmentTransition
+	// Identifiers are the identifiers the event was stitched with, without erased ones
+	Identifiers db.EventIdentifier
+}
+
+// sealEvent seals the stitched event with the key of its profile, skipped events belong to no profile
+func (s *StitchingService) sealEvent(ctx context.Context, event db.EventRecord, result stitchResult) error {
+	if result.Action == ActionSkipped {
+		return nil
+	}
+	return s.eventRepo.SealEvent(ctx, event, result.Identifiers, result.ProfileId)
+}
+
+// stitchEvent resolves the event to a profile using profileRepo, then records the event's identifiers,
+// applies its traits, accounts for it in the profile stats and recomputes the profile's segment memberships.
+// Erased identifiers, identifiers the event's consents do not allow stitching and identifiers its workspace does not
+// stitch are ignored, an event left without identifiers is skipped. The consents of the event are recorded on the
+// profile. Profiles are looked up within the workspace of the context.
+func (s *StitchingService) stitchEvent(ctx context.Context, profileRepo db.ProfileRepository, event db.EventRecord) (stitchResult, error) {
+	// Serialize stitching of events sharing an identifier across concurrent transactions, a no-op for identifiers
+	// already locked with the batch
+	if err := profileRepo.LockIdentifiers(ctx, event.EventIdentifier); err != nil {
+		return stitchResult{}, err
+	}
+
+	// Tombstones are checked under the identifier locks, which erasures take as well
+	identifiers, err := s.stitchedIdentifiers(ctx, event)
+	if err != nil {
+		return stitchResult{}, err
+	}
+	if identifiers != event.EventIdentifier {
+		s.log.Debug("Ignoring identifiers of event which are erased, without stitching consent or not stitched by its workspace",
+			"workspace", event.Workspace)
+		event.EventIdentifier = identifiers
+		if identifiers == (db.EventIdentifier{}) {
+			return stitchResult{Action: ActionSkipped}, nil
+		}
+	}
+	consents := db.EventConsents(event)
+
+	result, err := s.resolveProfile(ctx, profileRepo, event)
+	if err != nil {
+		return stitchResult{}, err
+	}
+
+	result.Identifiers = event.EventIdentifier
+
+	if err := profileRepo.RecordObservations(ctx, result.ProfileId, event); err != nil {
+		return stitchResult{}, err
+	}
+
+	if err := profileRepo.SetTraits(ctx, result.ProfileId, event.Traits); err != nil {
+		return stitchResult{}, err
+	}
+
+	if err := profileRepo.SetConsents(ctx, result.ProfileId, consents); err != nil {
+		return stitchResult{}, err
+	}
+
+	if err := profileRepo.RecordEventStats(ctx, result.ProfileId, event); err != nil {
+		return stitchResult{}, err
+	}
+
+	if result.Transitions, err = s.evaluateSegments(ctx, profileRepo, result.ProfileId); err != nil {
+		return stitchResult{}, err
+	}
+	return result, nil
+}
+
+// evaluateSegments matches the current state of the profile against all segments and stores its memberships.
+// A profile without consent to segments is a member of none.
+func (s *StitchingService) evaluateSegments(ctx context.Context, profileRepo db.ProfileRepository, profileId int) ([]db.SegmentTransition, error) {
+	if len(s.segments) == 0 {
+		return nil, nil
+	}
+
+	consents, err := profileRepo.GetConsents(ctx, []int{profileId})
+	if err != nil {
+		return nil, err
+	}
+	profile, found, err := profileRepo.GetProfileById(ctx, profileId)
+	if err != nil || !found {
+		return nil, err
+	}
+	stats, _, err := profileRepo.GetProfileStats(ctx, profileId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return profileRepo.UpdateSegments(ctx, profileId, s.memberships(profile, stats, consents[profileId], now), now)
+}
+
+// resolveProfile creates a new profile when none matches the event's identifiers,
+// enriches the single matching profile or merges all matching profiles together.
+// The identifiers must be locked by the caller.
+func (s *StitchingService) resolveProfile(ctx context.Context, profileRepo db.ProfileRepository, event db.EventRecord) (stitchResult, error) {
+	profiles, found, err := profileRepo.TryGetProfilesByIdentifiers(ctx, event.EventIdentifier)
+	if err != nil {
+		return stitchResult{}, err
+	}
+
+	if !found {
+		s.log.Debug("No profile found by identifiers, creating new profile",
+			"identifiers", event.EventIdentifier)
+		p := db.Profile{
+			Cookie:    event.EventIdentifier.Cookie,
+			MessageId: event.EventIdentifier.MessageId,
+			Phone:     event.EventIdentifier.Phone,
+			Workspace: event.Workspace,
+		}
+
+		id, err := profileRepo.InsertProfile(ctx, p)
+		if err != nil {
+			return stitchResult{}, err
+		}
+		return stitchResult{Action: ActionCreated, ProfileId: id}, nil
+	}
+
+	// At least one profile was found
+	if len(profiles) == 1 {
+		if err := profileRepo.EnrichProfileByIdentifiers(ctx, profiles[0].Id, event.EventIdentifier); err != nil {
+			return stitchResult{}, err
+		}
+		return stitchResult{Action: ActionEnriched, ProfileId: profiles[0].Id, Previous: profiles[0]}, nil
+	}
+
+	// Merge profiles if more than one was found
+	profileIds := make([]int, len(profiles))
+	for i, profile := range profiles {
+		profileIds[i] = profile.Id
+	}
+	survivorId, err := profileRepo.MergeProfiles(ctx, profileIds)
+	if err != nil {
+		return stitchResult{}, err
+	}
+	mergedIds := make([]int, 0, len(profileIds)-1)
+	for _, id := range profileIds {
+		if id != survivorId {
+			mergedIds = append(mergedIds, id)
+		}
+	}
+	return stitchResult{Action: ActionMerged, ProfileId: survivorId, MergedIds: mergedIds}, nil
+}
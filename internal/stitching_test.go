@@ -2,6 +2,8 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"maps"
 	"testing"
 	"time"
 
@@ -60,6 +62,266 @@ var _ = Describe("Stitching Service", func() {
 		Expect(eventRepo.ProcessedEvents[0]).To(Equal(event))
 	})
 
+	It("should lock the event identifiers before looking up profiles", func() {
+		event := db.GenerateRandomEvent()
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, event)
+
+		stitchingSvc.Start(ctx)
+
+		Eventually(func() []db.EventIdentifier {
+			return profileRepo.LockCalls
+		}).Should(ContainElement(event.EventIdentifier))
+	})
+
+	It("should lock the identifiers of the whole batch before stitching any event", func() {
+		first, second := db.GenerateRandomEvent(), db.GenerateRandomEvent()
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, first, second)
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(profileRepo.LockCalls).To(HaveLen(4))
+		Expect(profileRepo.LockCalls[:2]).To(Equal([]db.EventIdentifier{first.EventIdentifier, second.EventIdentifier}))
+	})
+
+	It("should record identifier observations on the resolved profile", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		event := db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie", Phone: "123456789"},
+			Source:          "crm",
+		}
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, event)
+
+		stitchingSvc.Start(ctx)
+
+		Eventually(func() []db.EventRecord {
+			return profileRepo.Observations[existingId]
+		}).Should(ConsistOf(event))
+	})
+
+	It("should apply traits of identify events to the profile", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		traits := db.Traits{"name": db.StringTrait("Jane", time.Now().UTC())}
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie"},
+			EventId:         db.EventIdIdentify,
+			Traits:          traits,
+		})
+
+		stitchingSvc.Start(ctx)
+
+		Eventually(func() (db.Traits, error) {
+			profile, _, err := profileRepo.GetProfileById(ctx, existingId)
+			return profile.Traits, err
+		}).Should(Equal(traits))
+	})
+
+	It("should count stitched events in the profile stats", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+
+		timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie"},
+			EventId:         db.EventIdPurchase,
+			EventTimestamp:  timestamp,
+			Revenue:         9.99,
+		})
+
+		stitchingSvc.Start(ctx)
+
+		Eventually(func() (db.ProfileStats, error) {
+			stats, _, err := profileRepo.GetProfileStats(ctx, existingId)
+			return stats, err
+		}).Should(Equal(db.ProfileStats{
+			ProfileId:     existingId,
+			FirstSeen:     timestamp,
+			LastSeen:      timestamp,
+			TotalEvents:   1,
+			PurchaseCount: 1,
+			Revenue:       9.99,
+			LastPurchase:  timestamp,
+		}))
+	})
+
+	It("should seal stitched events with the key of their profile", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		event := db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie"},
+			EventTimestamp:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, event)
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(eventRepo.SealedBy).To(Equal(map[mocks.EventKey]int{
+			{EventTimestamp: event.EventTimestamp}: existingId,
+		}))
+	})
+
+	It("should roll back the stats and observations of an event failing to be sealed", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		eventRepo.Snapshot = func() func() {
+			stats, observations := maps.Clone(profileRepo.Stats), maps.Clone(profileRepo.Observations)
+			return func() { profileRepo.Stats, profileRepo.Observations = stats, observations }
+		}
+		eventRepo.SealErr = errors.New("no event matched")
+		event := db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie"},
+			EventId:         db.EventIdPurchase,
+			EventTimestamp:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Revenue:         9.99,
+		}
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, event)
+
+		stitchingSvc.Stitch(ctx)
+
+		_, found, err := profileRepo.GetProfileStats(ctx, existingId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeFalse())
+		Expect(profileRepo.Observations[existingId]).To(BeEmpty())
+		Expect(eventRepo.ProcessedEvents).To(BeEmpty())
+
+		// Stitched again, the event is counted once
+		eventRepo.SealErr = nil
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, event)
+		stitchingSvc.Stitch(ctx)
+		stats, _, err := profileRepo.GetProfileStats(ctx, existingId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stats.TotalEvents).To(Equal(1))
+		Expect(stats.Revenue).To(Equal(9.99))
+	})
+
+	It("should emit transitions when the profile enters or exits segments", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		profileRepo.Segments[existingId] = []string{"no_phone"}
+
+		stitchingSvc.SetSegments([]db.Segment{
+			{Name: "no_phone", All: []db.SegmentCondition{{Field: "phone", Op: db.OpMissing}}},
+			{Name: "recent_buyers", All: []db.SegmentCondition{{Field: "last_purchase", Op: db.OpWithin, Value: "30d"}}},
+		})
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie", Phone: "111"},
+			EventId:         db.EventIdPurchase,
+			EventTimestamp:  time.Now().UTC(),
+		})
+
+		stitchingSvc.Start(ctx)
+
+		type transition struct {
+			Segment string
+			Entered bool
+		}
+		Eventually(func() ([]transition, error) {
+			logged, err := eventRepo.GetSegmentTransitions(ctx, existingId)
+			transitions := make([]transition, len(logged))
+			for i, t := range logged {
+				transitions[i] = transition{Segment: t.Segment, Entered: t.Entered}
+			}
+			return transitions, err
+		}).Should(Equal([]transition{{"recent_buyers", true}, {"no_phone", false}}))
+		Expect(profileRepo.Segments[existingId]).To(Equal([]string{"recent_buyers"}))
+	})
+
+	It("should not stitch identifiers without consent and record the consents on the profile", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents,
+			db.EventRecord{
+				EventIdentifier: db.EventIdentifier{Cookie: "test-cookie", Phone: "111"},
+				EventTimestamp:  timestamp,
+				Consents: db.Consents{
+					{Purpose: db.PurposeStitching, Status: db.ConsentGranted},
+					{Purpose: db.PurposeStitching, IdentifierType: "phone", Status: db.ConsentDenied},
+				},
+			},
+			db.EventRecord{
+				EventIdentifier: db.EventIdentifier{MessageId: "message-1"},
+				EventTimestamp:  timestamp,
+			},
+		)
+		stitchingSvc.SetConsentRules(db.ConsentRules{OptIn: []string{db.PurposeStitching}})
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(profileRepo.Profiles).To(HaveLen(1))
+		Expect(profileRepo.Profiles[existingId].Phone).To(BeEmpty())
+		Expect(profileRepo.Consents[existingId]).To(Equal(db.Consents{
+			{Purpose: db.PurposeStitching, Status: db.ConsentGranted, UpdatedAt: timestamp},
+			{Purpose: db.PurposeStitching, IdentifierType: "phone", Status: db.ConsentDenied, UpdatedAt: timestamp},
+		}))
+		// The event without any identifier consented to is skipped
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(2))
+	})
+
+	It("should keep profiles without segments consent out of all segments", func() {
+		existingId, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "test-cookie"})
+		Expect(err).NotTo(HaveOccurred())
+		profileRepo.Segments[existingId] = []string{"no_phone"}
+
+		stitchingSvc.SetSegments([]db.Segment{{Name: "no_phone", All: []db.SegmentCondition{{Field: "phone", Op: db.OpMissing}}}})
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "test-cookie"},
+			EventTimestamp:  time.Now().UTC(),
+			Consents:        db.Consents{{Purpose: db.PurposeSegments, Status: db.ConsentDenied}},
+		})
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(profileRepo.Segments[existingId]).To(BeEmpty())
+		transitions, err := eventRepo.GetSegmentTransitions(ctx, existingId)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(transitions).To(HaveLen(1))
+		Expect(transitions[0].Entered).To(BeFalse())
+	})
+
+	It("should only stitch events with profiles of their workspace", func() {
+		existingId, err := profileRepo.InsertProfile(db.WithWorkspace(ctx, "brand-a"), db.Profile{Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+		timestamp := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents,
+			db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-b", Phone: "111"}, EventTimestamp: timestamp,
+				Workspace: "brand-b"},
+			db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}, EventTimestamp: timestamp,
+				Workspace: "brand-a"},
+		)
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+		Expect(profileRepo.Profiles[existingId].Cookie).To(Equal("cookie-a"))
+		created := profileRepo.Profiles[existingId+1]
+		Expect(created.Cookie).To(Equal("cookie-b"))
+		Expect(created.Workspace).To(Equal("brand-b"))
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(2))
+	})
+
+	It("should only stitch the identifier types of the workspace", func() {
+		_, err := profileRepo.InsertProfile(ctx, db.Profile{Phone: "111"})
+		Expect(err).NotTo(HaveOccurred())
+		stitchingSvc.SetWorkspaces(db.Workspaces{"brand-a": {IdentifierTypes: []string{"cookie"}}})
+		eventRepo.UnprocessedEvents = append(eventRepo.UnprocessedEvents,
+			db.EventRecord{EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "111"}, EventTimestamp: time.Now().UTC(),
+				Workspace: "brand-a"},
+			db.EventRecord{EventIdentifier: db.EventIdentifier{Phone: "222"}, EventTimestamp: time.Now().UTC(),
+				Workspace: "brand-a"},
+		)
+
+		stitchingSvc.Stitch(ctx)
+
+		Expect(profileRepo.Profiles).To(HaveLen(2))
+		Expect(profileRepo.Profiles[1]).To(Equal(db.Profile{Id: 1, Cookie: "cookie-a", Workspace: "brand-a"}))
+		// The event left without identifiers the workspace stitches is skipped
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(2))
+	})
+
 	It("should create a new profile when no profile matches the identifier", func() {
 		// Create an existing profile with different identifiers
 		existingProfile := db.Profile{
@@ -213,4 +475,89 @@ var _ = Describe("Stitching Service", func() {
 			return eventRepo.GetEvents(ctx)
 		}, "5s").Should(HaveLen(1))
 	})
+
+	It("should stitch events synchronously and report merges", func(ctx SpecContext) {
+		created, err := stitchingSvc.StitchNow(ctx, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "cookie-a"},
+			EventTimestamp:  time.Now().UTC(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Action).To(Equal(ActionCreated))
+		Expect(created.Merged()).To(BeFalse())
+
+		other, err := stitchingSvc.StitchNow(ctx, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Phone: "+15550100"},
+			EventTimestamp:  time.Now().UTC(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		merged, err := stitchingSvc.StitchNow(ctx, db.EventRecord{
+			EventIdentifier: db.EventIdentifier{Cookie: "cookie-a", Phone: "+15550100"},
+			EventTimestamp:  time.Now().UTC(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged.Merged()).To(BeTrue())
+		Expect(merged.ProfileId).To(Equal(created.ProfileId))
+		Expect(merged.MergedIds).To(Equal([]int{other.ProfileId}))
+
+		// The events are stored as processed so the workers skip them
+		Expect(eventRepo.ProcessedEvents).To(HaveLen(3))
+		Expect(eventRepo.UnprocessedEvents).To(BeEmpty())
+		Expect(profileRepo.Stats[created.ProfileId].TotalEvents).To(Equal(2))
+	})
+})
+
+// enrichingProfileRepository stitches an identifier to a profile while its locks are being taken
+type enrichingProfileRepository struct {
+	*mocks.MockProfileRepository
+	profileId int
+	phone     string
+}
+
+func (r *enrichingProfileRepository) LockIdentifiers(ctx context.Context, identifiers ...db.EventIdentifier) error {
+	profile := r.Profiles[r.profileId]
+	profile.Phone = r.phone
+	r.Profiles[r.profileId] = profile
+	return r.MockProfileRepository.LockIdentifiers(ctx, identifiers...)
+}
+
+var _ = Describe("Merge Now", func() {
+	var (
+		ctx         context.Context
+		profileRepo *mocks.MockProfileRepository
+		eventRepo   *mocks.MockEventRepository
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		profileRepo = mocks.NewMockProfileRepository()
+		eventRepo = mocks.NewMockEventRepository()
+	})
+
+	It("should lock the identifiers of the profiles before merging them", func() {
+		first, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a"})
+		Expect(err).NotTo(HaveOccurred())
+		second, err := profileRepo.InsertProfile(ctx, db.Profile{Phone: "+15550100"})
+		Expect(err).NotTo(HaveOccurred())
+		stitchingSvc := NewStitchingService(profileRepo, eventRepo, time.Second, 1, 10)
+
+		merged, err := stitchingSvc.MergeNow(ctx, []int{second, first})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(merged.ProfileId).To(Equal(first))
+		Expect(profileRepo.LockCalls).To(Equal([]db.EventIdentifier{{Cookie: "cookie-a"}, {Phone: "+15550100"}}))
+		Expect(profileRepo.MergeCalls).To(Equal([][]int{{first, second}}))
+	})
+
+	It("should fail when an identifier is stitched to a profile while the locks are taken", func() {
+		first, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "cookie-a"})
+		Expect(err).NotTo(HaveOccurred())
+		second, err := profileRepo.InsertProfile(ctx, db.Profile{Cookie: "cookie-b"})
+		Expect(err).NotTo(HaveOccurred())
+		enriching := &enrichingProfileRepository{MockProfileRepository: profileRepo, profileId: first, phone: "+15550100"}
+		stitchingSvc := NewStitchingService(enriching, eventRepo, time.Second, 1, 10)
+
+		_, err = stitchingSvc.MergeNow(ctx, []int{first, second})
+		Expect(err).To(MatchError(ErrIdentifiersChanged))
+		Expect(profileRepo.MergeCalls).To(BeEmpty())
+	})
 })
@@ -3,16 +3,47 @@ package tools
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tomashoffer/event-stitching/internal/db"
 )
 
 // ResetDB drops and recreates all tables in the database
 func ResetDB(ctx context.Context, pool *pgxpool.Pool) error {
 	// Drop existing tables if they exist
 	_, err := pool.Exec(ctx, `
+		DROP SCHEMA IF EXISTS shadow CASCADE;
 		DROP TABLE IF EXISTS events;
+		DO $$
+		DECLARE partition_name text;
+		BEGIN
+			-- Detached monthly partitions outlive the events table
+			FOR partition_name IN SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename ~ '^events_\d{4}_\d{2}$' LOOP
+				EXECUTE format('DROP TABLE %I', partition_name);
+			END LOOP;
+		END $$;
+		DROP TABLE IF EXISTS archived_events;
 		DROP TABLE IF EXISTS profiles;
+		DROP TABLE IF EXISTS profile_identifiers;
+		DROP TABLE IF EXISTS profile_stats;
+		DROP TABLE IF EXISTS profile_segments;
+		DROP TABLE IF EXISTS profile_consents;
+		DROP TABLE IF EXISTS segment_transitions;
+		DROP TABLE IF EXISTS profile_merges;
+		DROP TABLE IF EXISTS outbox;
+		DROP TABLE IF EXISTS outbox_cursors;
+		DROP TABLE IF EXISTS webhook_endpoints;
+		DROP TABLE IF EXISTS webhook_deliveries;
+		DROP TABLE IF EXISTS import_checkpoints;
+		DROP TABLE IF EXISTS export_watermarks;
+		DROP TABLE IF EXISTS dsar_requests;
+		DROP TABLE IF EXISTS erasure_tombstones;
+		DROP TABLE IF EXISTS pii_data_keys;
+		DROP TABLE IF EXISTS profile_keys;
+		DROP TABLE IF EXISTS api_keys;
+		DROP TABLE IF EXISTS audit_log;
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to drop tables: %w", err)
@@ -23,9 +54,13 @@ func ResetDB(ctx context.Context, pool *pgxpool.Pool) error {
 		CREATE TABLE profiles (
 			id SERIAL PRIMARY KEY,
 			cookie varchar(4096),
-			message_id varchar(1024),
-			phone varchar(14)
+			message_id varchar(2048),
+			phone varchar(255),
+			traits JSONB,
+			updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+			workspace varchar(255) NOT NULL DEFAULT ''
 		);
+		CREATE INDEX idx_profiles_updated_at ON profiles(updated_at);
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to create profiles table: %w", err)
@@ -34,17 +69,309 @@ func ResetDB(ctx context.Context, pool *pgxpool.Pool) error {
 	// Create events table
 	_, err = pool.Exec(ctx, `
 		CREATE TABLE events (
-			id SERIAL PRIMARY KEY,
+			id SERIAL,
 			event_id SMALLINT,
-			event_timestamp TIMESTAMP,
+			event_timestamp TIMESTAMP NOT NULL,
 			identifiers JSONB,
-			processed BOOLEAN DEFAULT FALSE
-		);
+			processed BOOLEAN DEFAULT FALSE,
+			source varchar(255) DEFAULT '',
+			traits JSONB,
+			revenue NUMERIC(14,2) DEFAULT 0,
+			profile_key UUID,
+			consents JSONB,
+			workspace varchar(255) NOT NULL DEFAULT '',
+			PRIMARY KEY (id, event_timestamp)
+		) PARTITION BY RANGE (event_timestamp);
+		CREATE TABLE events_default PARTITION OF events DEFAULT;
+		CREATE INDEX idx_events_unprocessed ON events(event_timestamp) WHERE processed = false;
+		CREATE INDEX idx_events_timestamp_id ON events(event_timestamp, id);
+		CREATE INDEX idx_events_profile_key ON events(profile_key) WHERE profile_key IS NOT NULL;
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to create events table: %w", err)
 	}
 
+	// Create the partitions of the current and next month, the partitions command keeps creating them from then on
+	month := db.MonthStart(time.Now())
+	for range 2 {
+		next := month.AddDate(0, 1, 0)
+		bounds := fmt.Sprintf("FROM ('%s') TO ('%s')", month.Format(time.DateTime), next.Format(time.DateTime))
+		_, err = pool.Exec(ctx, "CREATE TABLE "+pgx.Identifier{db.PartitionName(month)}.Sanitize()+" PARTITION OF events FOR VALUES "+bounds)
+		if err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", db.PartitionName(month), err)
+		}
+		month = next
+	}
+
+	// Create keys of the events archived and not restored yet
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE archived_events (
+			id INT NOT NULL,
+			event_timestamp TIMESTAMP NOT NULL,
+			workspace varchar(255) NOT NULL DEFAULT '',
+			PRIMARY KEY (id, event_timestamp)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create archived_events table: %w", err)
+	}
+
+	// Create identifier observations table
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_identifiers (
+			profile_id INT NOT NULL,
+			identifier_type varchar(32) NOT NULL,
+			value varchar(4096) NOT NULL,
+			source varchar(255) NOT NULL DEFAULT '',
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			seen_count INT NOT NULL DEFAULT 1,
+			PRIMARY KEY (profile_id, identifier_type, value)
+		);
+		CREATE INDEX idx_profile_identifiers_value ON profile_identifiers(identifier_type, value);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create profile_identifiers table: %w", err)
+	}
+
+	// Create profile aggregates table
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_stats (
+			profile_id INT PRIMARY KEY,
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			total_events INT NOT NULL DEFAULT 0,
+			purchase_count INT NOT NULL DEFAULT 0,
+			revenue NUMERIC(14,2) NOT NULL DEFAULT 0,
+			last_purchase TIMESTAMP,
+			updated_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc')
+		);
+		CREATE INDEX idx_profile_stats_updated_at ON profile_stats(updated_at);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create profile_stats table: %w", err)
+	}
+
+	// Create consent records of profiles
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_consents (
+			profile_id INT NOT NULL,
+			purpose varchar(64) NOT NULL,
+			identifier_type varchar(32) NOT NULL DEFAULT '',
+			status varchar(16) NOT NULL,
+			source_event_id INT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (profile_id, purpose, identifier_type)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create profile_consents table: %w", err)
+	}
+
+	// Create segment membership and transition tables
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_segments (
+			profile_id INT NOT NULL,
+			segment varchar(255) NOT NULL,
+			entered_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (profile_id, segment)
+		);
+		CREATE INDEX idx_profile_segments_segment ON profile_segments(segment);
+		CREATE TABLE segment_transitions (
+			id BIGSERIAL PRIMARY KEY,
+			profile_id INT NOT NULL,
+			segment varchar(255) NOT NULL,
+			entered BOOLEAN NOT NULL,
+			occurred_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX idx_segment_transitions_profile_id ON segment_transitions(profile_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create segment tables: %w", err)
+	}
+
+	// Create redirects of merged profiles
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_merges (
+			merged_id INT PRIMARY KEY,
+			survivor_id INT NOT NULL,
+			merged_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX idx_profile_merges_survivor_id ON profile_merges(survivor_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create profile_merges table: %w", err)
+	}
+
+	// Create outbox of profile changes and the positions of its consumers
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE outbox (
+			id BIGSERIAL PRIMARY KEY,
+			tx_id xid8 NOT NULL DEFAULT pg_current_xact_id(),
+			kind varchar(64) NOT NULL,
+			profile_id INT NOT NULL,
+			payload JSONB NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT (now() AT TIME ZONE 'utc'),
+			workspace varchar(255) NOT NULL DEFAULT ''
+		);
+		CREATE INDEX idx_outbox_tx_id_id ON outbox(tx_id, id);
+		CREATE TABLE outbox_cursors (
+			consumer varchar(255) PRIMARY KEY,
+			last_tx_id BIGINT NOT NULL,
+			last_id BIGINT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox tables: %w", err)
+	}
+
+	// Create webhook endpoints and their delivery log
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE webhook_endpoints (
+			id SERIAL PRIMARY KEY,
+			url varchar(2048) NOT NULL,
+			secret varchar(255) NOT NULL,
+			kinds text[] NOT NULL DEFAULT '{}',
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP NOT NULL,
+			workspace varchar(255) NOT NULL DEFAULT ''
+		);
+		CREATE TABLE webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			endpoint_id INT NOT NULL,
+			outbox_id BIGINT NOT NULL,
+			kind varchar(64) NOT NULL,
+			attempt INT NOT NULL,
+			status_code INT NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms INT NOT NULL,
+			success BOOLEAN NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX idx_webhook_deliveries_endpoint_id ON webhook_deliveries(endpoint_id, id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create webhook tables: %w", err)
+	}
+
+	// Create watermarks of incremental exports
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE export_watermarks (
+			name varchar(255) PRIMARY KEY,
+			watermark TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create export_watermarks table: %w", err)
+	}
+
+	// Create progress of bulk imports
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE import_checkpoints (
+			name varchar(1024) PRIMARY KEY,
+			line BIGINT NOT NULL,
+			loaded BIGINT NOT NULL,
+			rejected BIGINT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create import_checkpoints table: %w", err)
+	}
+
+	// Create audit log of data subject requests and tombstones of erased identifiers
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE dsar_requests (
+			id BIGSERIAL PRIMARY KEY,
+			kind varchar(32) NOT NULL,
+			identifier_type varchar(32) NOT NULL,
+			identifier_hash char(64) NOT NULL,
+			mode varchar(32) NOT NULL DEFAULT '',
+			status varchar(32) NOT NULL,
+			profile_ids INT[] NOT NULL DEFAULT '{}',
+			events INT NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			requested_by varchar(255) NOT NULL DEFAULT '',
+			requested_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			workspace varchar(255) NOT NULL DEFAULT ''
+		);
+		CREATE TABLE erasure_tombstones (
+			workspace varchar(255) NOT NULL DEFAULT '',
+			identifier_type varchar(32) NOT NULL,
+			value_hash char(64) NOT NULL,
+			request_id BIGINT NOT NULL,
+			erased_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (workspace, identifier_type, value_hash)
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create DSAR tables: %w", err)
+	}
+
+	// Create wrapped data keys protecting identifiers
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE pii_data_keys (
+			id SERIAL PRIMARY KEY,
+			purpose varchar(32) NOT NULL,
+			master_key_id varchar(255) NOT NULL,
+			wrapped_key BYTEA NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create pii_data_keys table: %w", err)
+	}
+
+	// Create per-profile keys sealing stitched events, destroyed to erase the profile. Keys are never reused, the
+	// profile owning a key changes on merges and rebuilds.
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE profile_keys (
+			key_id UUID PRIMARY KEY,
+			profile_id INT,
+			master_key_id varchar(255) NOT NULL,
+			wrapped_key BYTEA,
+			created_at TIMESTAMP NOT NULL,
+			shredded_at TIMESTAMP
+		);
+		CREATE INDEX idx_profile_keys_profile_id ON profile_keys(profile_id) WHERE profile_id IS NOT NULL;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create profile_keys table: %w", err)
+	}
+
+	// Create hashed API keys and the audit log of actions taken with them
+	_, err = pool.Exec(ctx, `
+		CREATE TABLE api_keys (
+			id SERIAL PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			workspace varchar(255) NOT NULL DEFAULT '',
+			key_hash char(64) NOT NULL UNIQUE,
+			prefix varchar(32) NOT NULL,
+			scopes text[] NOT NULL,
+			rate_limit DOUBLE PRECISION NOT NULL DEFAULT 0,
+			burst INT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP
+		);
+		CREATE TABLE audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			api_key_id INT NOT NULL DEFAULT 0,
+			actor varchar(255) NOT NULL,
+			workspace varchar(255) NOT NULL DEFAULT '',
+			action varchar(64) NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			outcome TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create API key tables: %w", err)
+	}
+
 	fmt.Println("Database tables reset successfully")
 	return nil
 }
@@ -0,0 +1,58 @@
+package internal
+
+// unionFind is a disjoint-set forest over string keys with path compression and union by size
+type unionFind struct {
+	parent map[string]string
+	size   map[string]int
+}
+
+func newUnionFind() *unionFind {
+	return &unionFind{
+		parent: make(map[string]string),
+		size:   make(map[string]int),
+	}
+}
+
+// Add registers key as a singleton set if it is not known yet
+func (u *unionFind) Add(key string) {
+	if _, ok := u.parent[key]; ok {
+		return
+	}
+	u.parent[key] = key
+	u.size[key] = 1
+}
+
+// Find returns the representative of the set containing key, adding key if needed
+func (u *unionFind) Find(key string) string {
+	u.Add(key)
+	root := key
+	for u.parent[root] != root {
+		root = u.parent[root]
+	}
+	// Compress the path so subsequent lookups are constant time
+	for key != root {
+		next := u.parent[key]
+		u.parent[key] = root
+		key = next
+	}
+	return root
+}
+
+// Union joins the sets containing a and b
+func (u *unionFind) Union(a, b string) {
+	rootA, rootB := u.Find(a), u.Find(b)
+	if rootA == rootB {
+		return
+	}
+	if u.size[rootA] < u.size[rootB] {
+		rootA, rootB = rootB, rootA
+	}
+	u.parent[rootB] = rootA
+	u.size[rootA] += u.size[rootB]
+	delete(u.size, rootB)
+}
+
+// Len returns the number of distinct sets
+func (u *unionFind) Len() int {
+	return len(u.size)
+}
@@ -0,0 +1,183 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// RetryPolicy configures how often and how patiently a single event is retried
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy makes 5 attempts over roughly 8 seconds
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 5, BaseDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second}
+}
+
+// Backoff returns the delay before the given retry, doubling from BaseDelay up to MaxDelay
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// EndpointSink delivers outbox events one by one to a webhook endpoint, skipping kinds the endpoint
+// did not subscribe to and, once consents are set, events of profiles without consent to webhooks.
+// Every attempt is recorded in the delivery log.
+type EndpointSink struct {
+	endpoint     db.WebhookEndpoint
+	webhookRepo  db.WebhookRepository
+	profileRepo  db.ProfileRepository
+	consentRules db.ConsentRules
+	client       *http.Client
+	retry        RetryPolicy
+	breaker      *CircuitBreaker
+	log          *slog.Logger
+}
+
+func NewEndpointSink(endpoint db.WebhookEndpoint, webhookRepo db.WebhookRepository, retry RetryPolicy, breaker *CircuitBreaker) *EndpointSink {
+	return &EndpointSink{
+		endpoint:    endpoint,
+		webhookRepo: webhookRepo,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		retry:       retry,
+		breaker:     breaker,
+		log:         slog.Default(),
+	}
+}
+
+// SetConsents enables skipping events of profiles the consents read from profileRepo do not allow sending to
+// webhooks. Erasure notices are always sent, so endpoints can delete what they hold.
+func (s *EndpointSink) SetConsents(profileRepo db.ProfileRepository, rules db.ConsentRules) {
+	s.profileRepo, s.consentRules = profileRepo, rules
+}
+
+// Deliver sends the events in order and stops at the first one which could not be delivered, so the relay
+// keeps its cursor and redelivers the batch later. Events rejected by the endpoint with a 4xx response other
+// than 429 are not retried, they stay in the delivery log for a manual replay.
+func (s *EndpointSink) Deliver(ctx context.Context, events []db.OutboxEvent) error {
+	deliverable, err := s.deliverable(ctx, events)
+	if err != nil {
+		return err
+	}
+	for _, event := range deliverable {
+		if err := s.deliverEvent(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverable returns the events of the endpoint's workspace it subscribed to and their profiles consent to sending
+func (s *EndpointSink) deliverable(ctx context.Context, events []db.OutboxEvent) ([]db.OutboxEvent, error) {
+	accepted := make([]db.OutboxEvent, 0, len(events))
+	for _, event := range events {
+		if s.endpoint.Receives(event) {
+			accepted = append(accepted, event)
+		}
+	}
+	if s.profileRepo == nil {
+		return accepted, nil
+	}
+	return internal.ConsentedOutboxEvents(ctx, s.profileRepo, s.consentRules, accepted)
+}
+
+func (s *EndpointSink) deliverEvent(ctx context.Context, event db.OutboxEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox event %d: %w", event.Id, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		if !s.breaker.Allow() {
+			return fmt.Errorf("failed to deliver outbox event %d to webhook %d: %w", event.Id, s.endpoint.Id, ErrCircuitOpen)
+		}
+
+		status, err := s.attempt(ctx, event, attempt, body)
+		switch {
+		case err == nil:
+			s.breaker.Success()
+			return nil
+		case status >= 400 && status < 500 && status != http.StatusTooManyRequests:
+			// The endpoint is up but refuses the event, retrying won't help
+			s.breaker.Success()
+			s.log.Warn("Webhook rejected event", "endpoint", s.endpoint.Id, "event", event.Id, "status", status)
+			return nil
+		}
+
+		s.breaker.Failure()
+		if attempt >= s.retry.MaxAttempts {
+			return fmt.Errorf("failed to deliver outbox event %d to webhook %d after %d attempts: %w",
+				event.Id, s.endpoint.Id, attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.retry.Backoff(attempt)):
+		}
+	}
+}
+
+// attempt makes a single signed request and records it, returning the response status if there was one
+func (s *EndpointSink) attempt(ctx context.Context, event db.OutboxEvent, attempt int, body []byte) (int, error) {
+	started := time.Now()
+	status, err := s.send(ctx, event, body)
+
+	delivery := db.WebhookDelivery{
+		EndpointId: s.endpoint.Id,
+		OutboxId:   event.Id,
+		Kind:       event.Kind,
+		Attempt:    attempt,
+		StatusCode: status,
+		DurationMs: int(time.Since(started).Milliseconds()),
+		Success:    err == nil,
+		CreatedAt:  started.UTC(),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if logErr := s.webhookRepo.RecordWebhookDelivery(ctx, delivery); logErr != nil {
+		s.log.Error("Failed to record webhook delivery", "endpoint", s.endpoint.Id, "error", logErr)
+	}
+	return status, err
+}
+
+func (s *EndpointSink) send(ctx context.Context, event db.OutboxEvent, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdHeader, strconv.FormatInt(event.Id, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(s.endpoint.Secret, now, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,103 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/tomashoffer/event-stitching/internal"
+	"github.com/tomashoffer/event-stitching/internal/db"
+)
+
+// Service relays the outbox to every active webhook endpoint, each with its own cursor and circuit breaker
+type Service struct {
+	webhookRepo db.WebhookRepository
+	outboxRepo  db.OutboxRepository
+	retry       RetryPolicy
+	interval    time.Duration
+	batchSize   int
+	// breakerThreshold failed deliveries open an endpoint's circuit for breakerCooldown
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	profileRepo      db.ProfileRepository
+	consentRules     db.ConsentRules
+	log              *slog.Logger
+}
+
+func NewService(webhookRepo db.WebhookRepository, outboxRepo db.OutboxRepository, retry RetryPolicy, interval time.Duration, batchSize int) *Service {
+	return &Service{
+		webhookRepo:      webhookRepo,
+		outboxRepo:       outboxRepo,
+		retry:            retry,
+		interval:         interval,
+		batchSize:        batchSize,
+		breakerThreshold: 3 * retry.MaxAttempts,
+		breakerCooldown:  time.Minute,
+		log:              slog.Default(),
+	}
+}
+
+// SetCircuitBreaker changes after how many consecutive failed attempts an endpoint's circuit opens and for how long
+func (s *Service) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	s.breakerThreshold, s.breakerCooldown = threshold, cooldown
+}
+
+// SetConsents enables skipping events of profiles without consent to webhooks, see EndpointSink.SetConsents
+func (s *Service) SetConsents(profileRepo db.ProfileRepository, rules db.ConsentRules) {
+	s.profileRepo, s.consentRules = profileRepo, rules
+}
+
+// Start launches a relay for every endpoint active at the time of the call
+func (s *Service) Start(ctx context.Context) (int, error) {
+	endpoints, err := s.webhookRepo.GetWebhookEndpoints(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("webhooks: %w", err)
+	}
+
+	started := 0
+	for _, endpoint := range endpoints {
+		if !endpoint.Active {
+			continue
+		}
+		sink := s.newSink(endpoint)
+		internal.NewOutboxRelay(s.outboxRepo, sink, endpoint.Consumer(), s.interval, s.batchSize).Start(ctx)
+		started++
+	}
+	return started, nil
+}
+
+// Replay delivers the outbox events with ids between fromId and toId again, regardless of the endpoint's cursor,
+// and returns how many of them were delivered
+func (s *Service) Replay(ctx context.Context, endpointId int, fromId, toId int64) (int, error) {
+	endpoint, found, err := s.webhookRepo.GetWebhookEndpoint(ctx, endpointId)
+	if err != nil {
+		return 0, fmt.Errorf("replay delivery: %w", err)
+	}
+	if !found {
+		return 0, fmt.Errorf("replay delivery: webhook endpoint %d not found", endpointId)
+	}
+
+	events, err := s.outboxRepo.GetOutboxRange(ctx, fromId, toId)
+	if err != nil {
+		return 0, fmt.Errorf("replay delivery: %w", err)
+	}
+
+	sink := s.newSink(endpoint)
+	deliverable, err := sink.deliverable(ctx, events)
+	if err != nil {
+		return 0, fmt.Errorf("replay delivery: %w", err)
+	}
+	if err := sink.Deliver(ctx, deliverable); err != nil {
+		return 0, fmt.Errorf("replay delivery: %w", err)
+	}
+	return len(deliverable), nil
+}
+
+func (s *Service) newSink(endpoint db.WebhookEndpoint) *EndpointSink {
+	sink := NewEndpointSink(endpoint, s.webhookRepo, s.retry, NewCircuitBreaker(s.breakerThreshold, s.breakerCooldown))
+	if s.profileRepo != nil {
+		sink.SetConsents(s.profileRepo, s.consentRules)
+	}
+	return sink
+}
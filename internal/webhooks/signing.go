@@ -0,0 +1,42 @@
+// Package webhooks delivers outbox events to registered HTTP endpoints
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+const (
+	// IdHeader carries the outbox event id, receivers deduplicate redelivered events by it
+	IdHeader = "X-Webhook-Id"
+	// TimestampHeader carries the unix time the request was signed at
+	TimestampHeader = "X-Webhook-Timestamp"
+	// SignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>" keyed by the endpoint secret
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// Sign computes the signature header value of a request body sent at the timestamp
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a received request, rejecting requests signed
+// more than tolerance ago to limit replays
+func Verify(secret, timestamp, signature string, body []byte, tolerance time.Duration, now time.Time) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signedAt := time.Unix(seconds, 0)
+	if now.Sub(signedAt) > tolerance || signedAt.Sub(now) > tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, signedAt, body)))
+}
@@ -0,0 +1,216 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/tomashoffer/event-stitching/internal/db"
+	"github.com/tomashoffer/event-stitching/internal/mocks"
+)
+
+// testEndpoint answers with the queued statuses, then with 200, and records received requests
+type testEndpoint struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (e *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	e.requests = append(e.requests, r)
+	e.bodies = append(e.bodies, body)
+
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (e *testEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.requests)
+}
+
+var _ = Describe("Webhooks", func() {
+	var (
+		ctx         context.Context
+		endpoint    *testEndpoint
+		server      *httptest.Server
+		webhookRepo *mocks.MockWebhookRepository
+		outboxRepo  *mocks.MockOutboxRepository
+		retry       RetryPolicy
+	)
+
+	outboxEvent := func(kind db.OutboxKind) db.OutboxEvent {
+		return db.OutboxEvent{Kind: kind, ProfileId: 1, Payload: json.RawMessage(`{"profile":{"id":1}}`)}
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		endpoint = &testEndpoint{}
+		server = httptest.NewServer(endpoint)
+		webhookRepo = mocks.NewMockWebhookRepository()
+		outboxRepo = mocks.NewMockOutboxRepository()
+		retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should sign requests verifiably", func() {
+		now := time.Unix(1700000000, 0)
+		body := []byte(`{"id":1}`)
+		signature := Sign("secret", now, body)
+
+		Expect(Verify("secret", "1700000000", signature, body, time.Minute, now)).To(BeTrue())
+		Expect(Verify("other", "1700000000", signature, body, time.Minute, now)).To(BeFalse())
+		Expect(Verify("secret", "1700000000", signature, []byte(`{"id":2}`), time.Minute, now)).To(BeFalse())
+		Expect(Verify("secret", "1700000000", signature, body, time.Minute, now.Add(time.Hour))).To(BeFalse())
+	})
+
+	It("should back off exponentially up to the maximum delay", func() {
+		policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+		Expect(policy.Backoff(1)).To(Equal(time.Second))
+		Expect(policy.Backoff(2)).To(Equal(2 * time.Second))
+		Expect(policy.Backoff(3)).To(Equal(4 * time.Second))
+		Expect(policy.Backoff(4)).To(Equal(5 * time.Second))
+	})
+
+	It("should open the circuit after consecutive failures and let a trial through after the cooldown", func() {
+		now := time.Unix(0, 0)
+		breaker := NewCircuitBreaker(2, time.Minute)
+		breaker.now = func() time.Time { return now }
+
+		breaker.Failure()
+		Expect(breaker.Allow()).To(BeTrue())
+		breaker.Failure()
+		Expect(breaker.Allow()).To(BeFalse())
+
+		now = now.Add(time.Minute)
+		Expect(breaker.Allow()).To(BeTrue())
+		Expect(breaker.Allow()).To(BeFalse(), "only a single trial call is allowed")
+		breaker.Success()
+		Expect(breaker.Allow()).To(BeTrue())
+	})
+
+	It("should retry failed deliveries and log every attempt", func() {
+		endpoint.statuses = []int{http.StatusInternalServerError, http.StatusBadGateway}
+		id, _ := webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{Url: server.URL, Secret: "secret"})
+		sink := NewEndpointSink(webhookRepo.Endpoints[id], webhookRepo, retry, NewCircuitBreaker(10, time.Minute))
+
+		event := outboxEvent(db.KindProfileCreated)
+		event.Id = 42
+		Expect(sink.Deliver(ctx, []db.OutboxEvent{event})).To(Succeed())
+
+		Expect(endpoint.count()).To(Equal(3))
+		Expect(webhookRepo.Deliveries).To(HaveLen(3))
+		Expect(webhookRepo.Deliveries[0].StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(webhookRepo.Deliveries[2].Success).To(BeTrue())
+		Expect(webhookRepo.Deliveries[2].Attempt).To(Equal(3))
+
+		last := endpoint.requests[2]
+		Expect(last.Header.Get(IdHeader)).To(Equal("42"))
+		Expect(Verify("secret", last.Header.Get(TimestampHeader), last.Header.Get(SignatureHeader),
+			endpoint.bodies[2], time.Minute, time.Now())).To(BeTrue())
+	})
+
+	It("should fail the batch once retries are exhausted and stop calling an open circuit", func() {
+		endpoint.statuses = []int{500, 500, 500, 500}
+		id, _ := webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{Url: server.URL, Secret: "secret"})
+		sink := NewEndpointSink(webhookRepo.Endpoints[id], webhookRepo, retry, NewCircuitBreaker(4, time.Minute))
+
+		events := []db.OutboxEvent{outboxEvent(db.KindProfileCreated)}
+		Expect(sink.Deliver(ctx, events)).NotTo(Succeed())
+		Expect(endpoint.count()).To(Equal(3))
+
+		Expect(sink.Deliver(ctx, events)).To(MatchError(ErrCircuitOpen))
+		Expect(endpoint.count()).To(Equal(4))
+	})
+
+	It("should not retry events rejected by the endpoint", func() {
+		endpoint.statuses = []int{http.StatusUnprocessableEntity}
+		id, _ := webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{Url: server.URL, Secret: "secret"})
+		sink := NewEndpointSink(webhookRepo.Endpoints[id], webhookRepo, retry, NewCircuitBreaker(10, time.Minute))
+
+		Expect(sink.Deliver(ctx, []db.OutboxEvent{outboxEvent(db.KindProfileCreated)})).To(Succeed())
+		Expect(endpoint.count()).To(Equal(1))
+		Expect(webhookRepo.Deliveries[0].Success).To(BeFalse())
+	})
+
+	It("should skip events of profiles without webhooks consent except erasures", func() {
+		id, _ := webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{Url: server.URL, Secret: "secret"})
+		sink := NewEndpointSink(webhookRepo.Endpoints[id], webhookRepo, retry, NewCircuitBreaker(10, time.Minute))
+		profileRepo := mocks.NewMockProfileRepository()
+		profileRepo.Consents[2] = db.Consents{{Purpose: db.PurposeWebhooks, Status: db.ConsentGranted}}
+		sink.SetConsents(profileRepo, db.ConsentRules{OptIn: []string{db.PurposeWebhooks}})
+
+		granted := outboxEvent(db.KindProfileUpdated)
+		granted.ProfileId = 2
+		Expect(sink.Deliver(ctx, []db.OutboxEvent{
+			outboxEvent(db.KindProfileUpdated),
+			granted,
+			outboxEvent(db.KindProfileErased),
+		})).To(Succeed())
+
+		Expect(webhookRepo.Deliveries).To(HaveLen(2))
+		Expect(webhookRepo.Deliveries[0].Kind).To(Equal(db.KindProfileUpdated))
+		Expect(webhookRepo.Deliveries[1].Kind).To(Equal(db.KindProfileErased))
+	})
+
+	Describe("Service", func() {
+		var endpointId int
+
+		BeforeEach(func() {
+			endpointId, _ = webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{
+				Url:    server.URL,
+				Secret: "secret",
+				Kinds:  []string{string(db.KindProfileMerged), string(db.KindSegmentEntered)},
+			})
+			Expect(outboxRepo.AppendOutbox(ctx, []db.OutboxEvent{
+				outboxEvent(db.KindProfileCreated),
+				outboxEvent(db.KindProfileMerged),
+				outboxEvent(db.KindSegmentEntered),
+			})).To(Succeed())
+		})
+
+		It("should relay subscribed kinds to every active endpoint", func() {
+			webhookRepo.CreateWebhookEndpoint(ctx, db.WebhookEndpoint{Url: server.URL, Secret: "secret"})
+			webhookRepo.SetWebhookEndpointActive(ctx, 2, false)
+
+			service := NewService(webhookRepo, outboxRepo, retry, time.Hour, 10)
+			runCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			started, err := service.Start(runCtx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(started).To(Equal(1))
+
+			Eventually(endpoint.count).Should(Equal(2))
+			Consistently(endpoint.count, "50ms").Should(Equal(2))
+		})
+
+		It("should replay a range of events regardless of the cursor", func() {
+			service := NewService(webhookRepo, outboxRepo, retry, time.Hour, 10)
+
+			replayed, err := service.Replay(ctx, endpointId, 2, 3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(replayed).To(Equal(2))
+			Expect(endpoint.count()).To(Equal(2))
+
+			_, err = service.Replay(ctx, endpointId+100, 2, 3)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})